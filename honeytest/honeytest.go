@@ -0,0 +1,207 @@
+// Package honeytest lets apps unit-test their enrichers, processors, and
+// routing against a real UserEventsHandler without sending anything to
+// Honeycomb. Attach swaps every libhoney client the handler has (its own,
+// each ClientRouter environment, and each tenant's) for one backed by
+// libhoney's MockSender, so events stop at the transmission and can be
+// inspected:
+//
+//     func TestCheckoutEnricher(t *testing.T) {
+//         handler := &userevents.UserEventsHandler{Enrichers: []userevents.Enricher{CheckoutEnricher{}}}
+//         rec := honeytest.Attach(handler)
+//
+//         handler.HandleBatch(httptest.NewRecorder(), httptest.NewRequest("POST", "/events/batch",
+//             strings.NewReader(`{"type": "page-load", "page_url": "/checkout"}`)))
+//
+//         ev := rec.Only(t, "page-load")
+//         honeytest.AssertFieldEquals(t, ev, "checkout_step", "cart")
+//         honeytest.AssertDataset(t, ev, "browser-events")
+//         honeytest.AssertSampled(t, ev, 1)
+//     }
+//
+// Events go through the handler's Queue asynchronously if it has one, so
+// tests should leave Queue nil (or Close the handler before looking).
+package honeytest
+
+import (
+    "fmt"
+    "reflect"
+    "sort"
+    "strconv"
+    "sync"
+    "testing"
+    "time"
+
+    libhoney "github.com/honeycombio/libhoney-go"
+    "github.com/honeycombio/libhoney-go/transmission"
+
+    userevents "github.com/eanakashima/honeycombio-browser-js-example"
+)
+
+// Recorder holds on to everything sent through the clients Attach set up.
+type Recorder struct {
+    mu      sync.Mutex
+    senders map[string]*transmission.MockSender
+    skip    map[string]int // Events each sender had at the last Reset
+}
+
+// Event is one event as it reached libhoney.
+type Event struct {
+    Client     string // The name of the client it was sent with, "default" for the handler's Libhoney
+    Dataset    string
+    SampleRate uint
+    Timestamp  time.Time
+    Fields     map[string]interface{}
+}
+
+// Attach replaces h's libhoney clients with recording ones, and returns the
+// Recorder that sees what they send. A handler without a Libhoney client gets
+// one, so events with no other client configured are recorded too.
+func Attach(h *userevents.UserEventsHandler) *Recorder {
+    rec := &Recorder{senders: map[string]*transmission.MockSender{}, skip: map[string]int{}}
+    h.SwapClients(func(name string, old *libhoney.Client) *libhoney.Client {
+        return rec.client(name)
+    })
+    return rec
+}
+
+func (rec *Recorder) client(name string) *libhoney.Client {
+    sender := &transmission.MockSender{}
+    client, err := libhoney.NewClient(libhoney.ClientConfig{
+        APIKey:       "honeytest",
+        Dataset:      "honeytest",
+        Transmission: sender,
+    })
+    if err != nil {
+        panic(fmt.Sprintf("recorder: can't create mock client: %v", err)) // Only if libhoney rejects its own MockSender
+    }
+    rec.mu.Lock()
+    rec.senders[name] = sender
+    rec.mu.Unlock()
+    return client
+}
+
+// Events returns everything sent so far, oldest first within each client.
+func (rec *Recorder) Events() []Event {
+    rec.mu.Lock()
+    defer rec.mu.Unlock()
+    names := make([]string, 0, len(rec.senders))
+    for name := range rec.senders {
+        names = append(names, name)
+    }
+    sort.Strings(names)
+
+    var events []Event
+    for _, name := range names {
+        for _, ev := range rec.senders[name].Events()[rec.skip[name]:] {
+            events = append(events, Event{
+                Client:     name,
+                Dataset:    ev.Dataset,
+                SampleRate: ev.SampleRate,
+                Timestamp:  ev.Timestamp,
+                Fields:     ev.Data,
+            })
+        }
+    }
+    return events
+}
+
+// OfType returns the events with the given "type" field.
+func (rec *Recorder) OfType(eventType string) []Event {
+    var matches []Event
+    for _, ev := range rec.Events() {
+        if ev.Fields["type"] == eventType {
+            matches = append(matches, ev)
+        }
+    }
+    return matches
+}
+
+// Only returns the one event of the given type, failing the test if there
+// isn't exactly one.
+func (rec *Recorder) Only(t testing.TB, eventType string) Event {
+    t.Helper()
+    matches := rec.OfType(eventType)
+    if len(matches) != 1 {
+        t.Fatalf("want exactly one %q event, got %d (of %d events sent)", eventType, len(matches), len(rec.Events()))
+    }
+    return matches[0]
+}
+
+// Reset forgets everything sent so far. MockSender can't clear its events,
+// so we remember how many each one had, and skip those from now on.
+func (rec *Recorder) Reset() {
+    rec.mu.Lock()
+    defer rec.mu.Unlock()
+    for name, sender := range rec.senders {
+        rec.skip[name] = len(sender.Events())
+    }
+}
+
+// AssertFieldEquals fails the test unless ev has field set to want. Numbers
+// compare by value, so an int want matches the float64 JSON decoding gives.
+func AssertFieldEquals(t testing.TB, ev Event, field string, want interface{}) {
+    t.Helper()
+    got, ok := ev.Fields[field]
+    if !ok {
+        t.Errorf("%s event has no %q field", typeOf(ev), field)
+        return
+    }
+    if !valuesEqual(got, want) {
+        t.Errorf("%s event field %q = %#v, want %#v", typeOf(ev), field, got, want)
+    }
+}
+
+// AssertFieldAbsent fails the test if ev has field at all, e.g. one a
+// Scrubber should have removed.
+func AssertFieldAbsent(t testing.TB, ev Event, field string) {
+    t.Helper()
+    if got, ok := ev.Fields[field]; ok {
+        t.Errorf("%s event has field %q = %#v, want it absent", typeOf(ev), field, got)
+    }
+}
+
+// AssertDataset fails the test unless ev was sent to dataset.
+func AssertDataset(t testing.TB, ev Event, dataset string) {
+    t.Helper()
+    if ev.Dataset != dataset {
+        t.Errorf("%s event sent to dataset %q, want %q", typeOf(ev), ev.Dataset, dataset)
+    }
+}
+
+// AssertSampled fails the test unless ev was sent with the given sample
+// rate (1 for unsampled).
+func AssertSampled(t testing.TB, ev Event, rate uint) {
+    t.Helper()
+    if ev.SampleRate != rate {
+        t.Errorf("%s event sent with sample rate %d, want %d", typeOf(ev), ev.SampleRate, rate)
+    }
+}
+
+func typeOf(ev Event) string {
+    if eventType, ok := ev.Fields["type"].(string); ok {
+        return strconv.Quote(eventType)
+    }
+    return "untyped"
+}
+
+func valuesEqual(got, want interface{}) bool {
+    if reflect.DeepEqual(got, want) {
+        return true
+    }
+    g, gotNumber := asFloat(got)
+    w, wantNumber := asFloat(want)
+    return gotNumber && wantNumber && g == w
+}
+
+func asFloat(value interface{}) (float64, bool) {
+    v := reflect.ValueOf(value)
+    switch v.Kind() {
+    case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+        return float64(v.Int()), true
+    case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+        return float64(v.Uint()), true
+    case reflect.Float32, reflect.Float64:
+        return v.Float(), true
+    }
+    return 0, false
+}
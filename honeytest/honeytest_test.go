@@ -0,0 +1,63 @@
+package honeytest
+
+import (
+    "net/http/httptest"
+    "strings"
+    "testing"
+
+    libhoney "github.com/honeycombio/libhoney-go"
+    "github.com/honeycombio/libhoney-go/transmission"
+
+    userevents "github.com/eanakashima/honeycombio-browser-js-example"
+)
+
+func postBatch(h *userevents.UserEventsHandler, body string) {
+    h.HandleBatch(httptest.NewRecorder(), httptest.NewRequest("POST", "/events/batch", strings.NewReader(body)))
+}
+
+func TestAttachRecordsTheHandlersEvents(t *testing.T) {
+    handler := &userevents.UserEventsHandler{}
+    rec := Attach(handler)
+
+    postBatch(handler, `[{"type": "checkout", "checkout_step": "cart", "items": 3}]`)
+
+    ev := rec.Only(t, "checkout")
+    AssertFieldEquals(t, ev, "checkout_step", "cart")
+    AssertFieldEquals(t, ev, "items", 3)
+    AssertSampled(t, ev, 1)
+    if ev.Client != "default" {
+        t.Errorf("event sent with client %q, want the handler's own", ev.Client)
+    }
+}
+
+func TestAttachSwapsRoutedClients(t *testing.T) {
+    original := &transmission.MockSender{}
+    eu, err := libhoney.NewClient(libhoney.ClientConfig{APIKey: "unused", Dataset: "unused", Transmission: original})
+    if err != nil {
+        t.Fatal(err)
+    }
+    handler := &userevents.UserEventsHandler{
+        Clients: &userevents.ClientRouter{Clients: map[string]*libhoney.Client{"eu": eu}, Default: "eu"},
+    }
+    rec := Attach(handler)
+
+    postBatch(handler, `{"type": "checkout"}`)
+
+    if ev := rec.Only(t, "checkout"); ev.Client != "eu" {
+        t.Errorf("event sent with client %q, want eu", ev.Client)
+    }
+    if sent := original.Events(); len(sent) != 0 {
+        t.Errorf("replaced client still sent %d events", len(sent))
+    }
+}
+
+func TestResetForgetsEarlierEvents(t *testing.T) {
+    handler := &userevents.UserEventsHandler{}
+    rec := Attach(handler)
+
+    postBatch(handler, `{"type": "checkout", "checkout_step": "cart"}`)
+    rec.Reset()
+    postBatch(handler, `{"type": "checkout", "checkout_step": "payment"}`)
+
+    AssertFieldEquals(t, rec.Only(t, "checkout"), "checkout_step", "payment")
+}
@@ -0,0 +1,58 @@
+// Send a user event to Honeycomb whenever an uncaught error or unhandled
+// promise rejection happens in the browser, so we can track JS errors
+// alongside our page-load stats.
+//
+// The server parses the stack, normalizes it, and computes an
+// `error_fingerprint` so the same bug groups together in Honeycomb.
+import honeycomb from "../honeycomb";
+import { newEventId, pageLoadId, tabId } from "./page-load";
+
+// Don't let an error loop (e.g. in a requestAnimationFrame callback) flood us
+const maxErrorsPerPage = 10;
+let errorCount = 0;
+
+const sendErrorEvent = function(error, details) {
+  if (errorCount >= maxErrorsPerPage) {
+    return;
+  }
+  errorCount++;
+
+  honeycomb.sendEvent({
+    type: "error",
+    page_load_id: pageLoadId,
+    tab_id: tabId,
+    visibility_state: document.visibilityState,
+    event_id: newEventId(),
+    sent_at: Date.now(),
+    url: window.location.href,
+
+    // Which build this page is running, so the server can find the right
+    // source maps to de-minify the stack with
+    release: document.querySelector("meta[name=release]") && document.querySelector("meta[name=release]").content,
+
+    error_name: (error && error.name) || "Error",
+    error_message: (error && error.message) || details.message || String(error),
+    error_stack: error && error.stack,
+
+    // Where the browser says the error happened. For errors thrown from
+    // cross-origin scripts without CORS headers, these are all we get.
+    error_source: details.source,
+    error_lineno: details.lineno,
+    error_colno: details.colno,
+    error_handled_by: details.handledBy,
+  });
+};
+
+window.addEventListener("error", function(e) {
+  sendErrorEvent(e.error, {
+    message: e.message,
+    source: e.filename,
+    lineno: e.lineno,
+    colno: e.colno,
+    handledBy: "onerror",
+  });
+});
+
+window.addEventListener("unhandledrejection", function(e) {
+  sendErrorEvent(e.reason, { handledBy: "unhandledrejection" });
+});
@@ -0,0 +1,93 @@
+// Send a user event to Honeycomb for every long task (main thread blocked for
+// 50ms+) and every slow interaction (the raw material for INP), so we can see
+// which routes and releases feel janky after they've loaded.
+//
+// Both need PerformanceObserver support for the entry type; browsers without
+// it just don't send these events.
+import honeycomb from "../honeycomb";
+import { newEventId, pageLoadId, pageSpanId, pageTraceId, tabId } from "./page-load";
+
+// Interactions faster than this are fine, and there are a lot of them
+const minInteractionMs = 40;
+
+// Don't let a page that's janky all the time flood us
+const maxEventsPerPage = 50;
+let eventCount = 0;
+
+const sendInteractivityEvent = function(event) {
+  if (eventCount >= maxEventsPerPage) {
+    return;
+  }
+  eventCount++;
+
+  event.page_view_id = pageLoadId;
+  event.tab_id = tabId;
+  event.visibility_state = document.visibilityState;
+  event.event_id = newEventId();
+  event.trace_id = pageTraceId;
+  event.span_id = pageSpanId;
+  event.sent_at = Date.now();
+  event.url = window.location.href;
+  event.release = document.querySelector("meta[name=release]") && document.querySelector("meta[name=release]").content;
+  honeycomb.sendEvent(event);
+};
+
+// A CSS-selector-ish description of the element, good enough to find it
+const describeTarget = function(el) {
+  if (!el || !el.tagName) {
+    return undefined;
+  }
+  let description = el.tagName.toLowerCase();
+  if (el.id) {
+    description += `#${el.id}`;
+  } else if (el.classList && el.classList.length) {
+    description += `.${Array.prototype.slice.call(el.classList, 0, 3).join(".")}`;
+  }
+  return description;
+};
+
+const observe = function(type, options, callback) {
+  if (!window.PerformanceObserver || !PerformanceObserver.supportedEntryTypes ||
+      PerformanceObserver.supportedEntryTypes.indexOf(type) < 0) {
+    return;
+  }
+  new PerformanceObserver(list => list.getEntries().forEach(callback)).observe(Object.assign({ type: type, buffered: true }, options));
+};
+
+observe("longtask", {}, function(entry) {
+  const container = (entry.attribution && entry.attribution[0]) || {};
+  sendInteractivityEvent({
+    type: "long-task",
+    duration_ms: entry.duration,
+    start_time_ms: entry.startTime,
+    attribution_name: entry.name,
+    container_type: container.containerType,
+    container_src: container.containerSrc,
+    container_id: container.containerId,
+    container_name: container.containerName,
+  });
+});
+
+// An interaction can be several entries (pointerdown, pointerup, click) with
+// the same interactionId, which share its duration; we only report the first
+const seenInteractions = {};
+observe("event", { durationThreshold: minInteractionMs }, function(entry) {
+  if (!entry.interactionId || entry.duration < minInteractionMs) {
+    return;
+  }
+  if (seenInteractions[entry.interactionId]) {
+    return;
+  }
+  seenInteractions[entry.interactionId] = true;
+
+  sendInteractivityEvent({
+    type: "interaction",
+    duration_ms: entry.duration,
+    interaction_type: entry.name,
+    interaction_target: describeTarget(entry.target),
+    input_delay_ms: entry.processingStart - entry.startTime,
+    processing_ms: entry.processingEnd - entry.processingStart,
+    presentation_delay_ms: entry.startTime + entry.duration - entry.processingEnd,
+    load_state: document.readyState,
+  });
+});
@@ -9,11 +9,64 @@ import honeycomb from "../honeycomb";
 // Randomly generate a page load ID so we can correlate load/unload events
 export let pageLoadId = Math.floor(Math.random() * 100000000);
 
+// A random ID for each event, so the server can drop duplicates when the
+// browser retries a request it isn't sure got through
+export const newEventId = function() {
+  if (window.crypto && window.crypto.randomUUID) {
+    return window.crypto.randomUUID();
+  }
+  return "xxxxxxxx-xxxx-4xxx-yxxx-xxxxxxxxxxxx".replace(/[xy]/g, function(c) {
+    const r = (Math.random() * 16) | 0;
+    return (c === "x" ? r : (r & 0x3) | 0x8).toString(16);
+  });
+};
+
+// Every event from this page view goes into one trace, as children of a span
+// standing for the page view itself, so the server can hang per-resource
+// timings under it
+const randomHex = function(bytes) {
+  const buf = new Uint8Array(bytes);
+  if (window.crypto && window.crypto.getRandomValues) {
+    window.crypto.getRandomValues(buf);
+  } else {
+    for (let i = 0; i < bytes; i++) buf[i] = Math.floor(Math.random() * 256);
+  }
+  return _.map(buf, b => ("0" + b.toString(16)).slice(-2)).join("");
+};
+export const pageTraceId = randomHex(16);
+export const pageSpanId = randomHex(8);
+
+// An ID for this tab, kept in sessionStorage (which each tab has its own of,
+// and which survives reloads), so the server can tell a session's tabs apart
+export const tabId = (function() {
+  try {
+    let id = window.sessionStorage.getItem("honeycomb_tab_id");
+    if (!id) {
+      id = newEventId();
+      window.sessionStorage.setItem("honeycomb_tab_id", id);
+    }
+    return id;
+  } catch (e) {
+    return undefined; // Storage is blocked (e.g. some private browsing modes)
+  }
+})();
+
 // Memory usage stats collected as soon as JS executes, so we can compare the
 // delta later on page unload
 export let jsHeapUsed = window.performance.memory && window.performance.memory.usedJSHeapSize;
 const jsHeapTotal = window.performance.memory && window.performance.memory.totalJSHeapSize;
 
+// Which build this page is running. We render these into meta tags at deploy
+// time; if they're missing, the server can still usually work out the release
+// from the (content-hashed) URL of the script that's running.
+const metaContent = name => document.querySelector(`meta[name=${name}]`) && document.querySelector(`meta[name=${name}]`).content;
+const release = metaContent("release");
+const buildSha = metaContent("build-sha");
+// Our unload beacons are single-use: the server renders a nonce for this page
+// view, and only accepts it once per event type (see PageNonces).
+const pageNonce = metaContent("page-nonce");
+const scriptSrc = document.currentScript && document.currentScript.src;
+
 // Names of static asset files we care to collect metrics about
 const trackedAssets = ["/main.css", "/main.js"];
 
@@ -24,11 +77,31 @@ const pageLoadEvent = function() {
   const event = {
     type: "page-load",
     page_load_id: pageLoadId,
+    tab_id: tabId,
+    visibility_state: document.visibilityState,
+    event_id: newEventId(),
+    trace_id: pageTraceId,
+    span_id: pageSpanId,
+    page_nonce: pageNonce,
+
+    // When the browser thinks it sent this event, in ms since the epoch. Client
+    // clocks are often minutes off, so the server compares this to when it
+    // received the event to work out (and correct for) the skew.
+    sent_at: Date.now(),
+
+    release: release,
+    build_sha: buildSha,
+    script_src: scriptSrc,
 
     // User agent. We can parse the user agent into device, os name, os version,
     // browser name, and browser version fields server-side if we want to later.
     user_agent: window.navigator.userAgent,
 
+    // The page's URL. The server strips the query string and maps the path to
+    // a route template (url_route) so it's groupable.
+    url: window.location.href,
+    referrer: document.referrer,
+
     // Current window size & screen size stats
     // We use a derived column in Honeycomb to also be able to query window
     // total pixels and the ratio of window size to screen size. That way we
@@ -130,6 +203,26 @@ const pageLoadEvent = function() {
   return event;
 };
 
+// The full ResourceTiming buffer, so the server can break load times down by
+// CDN and asset type. Entry times are relative to time_origin.
+const resourceTimingEvent = function() {
+  const fields = ["name", "initiatorType", "nextHopProtocol", "renderBlockingStatus", "startTime", "duration",
+    "requestStart", "responseStart", "transferSize", "encodedBodySize", "decodedBodySize"];
+  return {
+    type: "resource-timing",
+    page_load_id: pageLoadId,
+    tab_id: tabId,
+    visibility_state: document.visibilityState,
+    event_id: newEventId(),
+    trace_id: pageTraceId,
+    span_id: pageSpanId,
+    page_nonce: pageNonce,
+    sent_at: Date.now(),
+    url: window.location.href,
+    time_origin: window.performance.timeOrigin || window.performance.timing.navigationStart,
+    resources: _.map(window.performance.getEntriesByType("resource"), resource => _.pick(resource, fields)),
+  };
+};
 
 // Send this wide event we've constructed after the page has fully loaded
 window.addEventListener("load", function() {
@@ -137,5 +230,8 @@ window.addEventListener("load", function() {
   setTimeout(function() {
     // Sends the event to our servers for forwarding on to api.honeycomb.io
     honeycomb.sendEvent(pageLoadEvent());
+    if (window.performance.getEntriesByType) {
+      honeycomb.sendEvent(resourceTimingEvent());
+    }
   }, 0);
 });
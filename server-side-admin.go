@@ -0,0 +1,340 @@
+// Turning a noisy event type's sampling up, or everything off while a bad SDK
+// release floods us, shouldn't wait on a config change and a deploy. AdminAPI
+// serves the handler's runtime settings, and lets operators change them on
+// the fly:
+//
+//     handler.Admin = &AdminAPI{Token: os.Getenv("ADMIN_TOKEN")}
+//     go handler.Admin.Run(ctx, handler)
+//     mux.HandleFunc("/admin/settings", handler.HandleAdmin)
+//     mux.HandleFunc("/admin/settings/dry-run", handler.HandleAdmin)
+//
+// GET returns the current RuntimeSettings, and PUT replaces them, with the
+// Version it read them at, so two operators can't quietly undo each other's
+// changes (AdminClient does the read and the write for you). What they can
+// change:
+//
+//     killed          drop every event from browsers, as if the endpoint weren't there
+//     disabled_types  drop just these event types
+//     sample_rates    sample these types at these rates, in place of the Sampler's
+//     drop_fields     scrub these fields (exact, or path.Match globs) from every event
+//     dry_run_types   run these types through the pipeline without sending them
+//
+// The dry-run path gives the report for dry_run_types so far. These only add
+// to the handler's own settings: drop_fields can't bring back a field the
+// Scrubber removes, and types the handler's DryRun covers stay dry runs.
+// Settings are kept in the handler's StateStore, each version claimed
+// atomically, and Run picks up changes made on other instances every
+// PollInterval. Every change is sent as an
+// admin-change event to AuditDataset, with who made it (the X-Admin-Actor
+// header, since everyone shares the Token) and the settings before and after.
+type AdminAPI struct {
+    Token        string        // Required as "Authorization: Bearer <token>"; with no Token, every request is refused
+    AuditDataset string        // Defaults to "user-events-ops"
+    PollInterval time.Duration // Defaults to 10 seconds
+
+    current atomic.Value // *RuntimeSettings
+    dryRun  DryRun       // For dry_run_types, when the handler has no DryRun of its own
+}
+
+// RuntimeSettings are what AdminAPI lets operators change at runtime. The
+// zero value changes nothing.
+type RuntimeSettings struct {
+    Version       int64           `json:"version"`
+    Killed        bool            `json:"killed"`
+    DisabledTypes []string        `json:"disabled_types,omitempty"`
+    SampleRates   map[string]uint `json:"sample_rates,omitempty"`
+    DropFields    []string        `json:"drop_fields,omitempty"`
+    DryRunTypes   []string        `json:"dry_run_types,omitempty"`
+    UpdatedAt     time.Time       `json:"updated_at,omitempty"`
+    UpdatedBy     string          `json:"updated_by,omitempty"`
+}
+
+// ErrSettingsConflict is returned by AdminClient.Put when the settings have
+// changed since the Version it was given.
+var ErrSettingsConflict = errors.New("admin: settings changed since they were read")
+
+const (
+    adminSettingsKey = "admin:settings"
+    adminChangeType  = "admin-change"
+)
+
+var adminChanges = promauto.NewCounter(prometheus.CounterOpts{
+    Name: "user_events_admin_changes_total",
+    Help: "Runtime settings changes made through the admin API.",
+})
+
+func (a *AdminAPI) auditDataset() string {
+    if a.AuditDataset != "" {
+        return a.AuditDataset
+    }
+    return "user-events-ops"
+}
+
+func (a *AdminAPI) pollInterval() time.Duration {
+    if a.PollInterval > 0 {
+        return a.PollInterval
+    }
+    return 10 * time.Second
+}
+
+func (s *RuntimeSettings) validate() error {
+    for eventType, rate := range s.SampleRates {
+        if rate < 1 {
+            return fmt.Errorf("sample rate for %s must be at least 1", eventType)
+        }
+    }
+    for _, pattern := range s.DropFields {
+        if _, err := path.Match(pattern, ""); err != nil {
+            return fmt.Errorf("drop field %s: %v", pattern, err)
+        }
+    }
+    return nil
+}
+
+// The settings in effect, or nil if nobody's changed any (or there's no
+// AdminAPI)
+func (a *AdminAPI) settings() *RuntimeSettings {
+    if a == nil {
+        return nil
+    }
+    s, _ := a.current.Load().(*RuntimeSettings)
+    return s
+}
+
+// Why an event of this type is turned away, or "" if it isn't
+func (a *AdminAPI) dropReason(eventType string) string {
+    s := a.settings()
+    switch {
+    case s == nil:
+        return ""
+    case s.Killed:
+        return "killed"
+    case containsString(s.DisabledTypes, eventType):
+        return "disabled"
+    }
+    return ""
+}
+
+func (a *AdminAPI) sampleRate(eventType string) (uint, bool) {
+    s := a.settings()
+    if s == nil {
+        return 0, false
+    }
+    rate, ok := s.SampleRates[eventType]
+    return rate, ok
+}
+
+func (a *AdminAPI) dropFields(fields map[string]interface{}) {
+    s := a.settings()
+    if s == nil || len(s.DropFields) == 0 {
+        return
+    }
+    for name := range fields {
+        if _, matched := matchesAny(s.DropFields, name); matched {
+            delete(fields, name)
+        }
+    }
+}
+
+// The DryRun an event of this type should be captured by, if any
+func (h *UserEventsHandler) dryRunFor(eventType string) *DryRun {
+    if h.DryRun.applies(eventType) {
+        return h.DryRun
+    }
+    if s := h.Admin.settings(); s != nil && containsString(s.DryRunTypes, eventType) {
+        if h.DryRun != nil {
+            return h.DryRun // So there's one report, and its Output
+        }
+        return &h.Admin.dryRun
+    }
+    return nil
+}
+
+func containsString(values []string, want string) bool {
+    for _, value := range values {
+        if value == want {
+            return true
+        }
+    }
+    return false
+}
+
+// Each version of the settings is claimed with SetIfAbsent under a key of its
+// own, so of two PUTs made at the same version only one can win.
+// adminSettingsKey just says where to start looking for the latest, for
+// instances that haven't seen any yet; it may be a version or two behind.
+func adminVersionKey(version int64) string {
+    return fmt.Sprintf("%s:v%d", adminSettingsKey, version)
+}
+
+// How long each version's key is kept, for instances catching up
+const adminVersionTTL = 7 * 24 * time.Hour
+
+// Reads the latest shared settings, falling back on our own if the store
+// can't say. The stored settings are decoded into a RuntimeSettings of their
+// own: the current ones' maps are being read by every request.
+func (a *AdminAPI) load(ctx context.Context, store StateStore) (RuntimeSettings, error) {
+    var fallback RuntimeSettings
+    if current := a.settings(); current != nil {
+        fallback = *current
+    }
+    latest := fallback
+    if raw, ok, err := store.Get(ctx, adminSettingsKey); err != nil {
+        return fallback, err
+    } else if ok {
+        var hint RuntimeSettings
+        if err := json.Unmarshal(raw, &hint); err != nil {
+            return fallback, fmt.Errorf("admin: stored settings: %v", err)
+        }
+        if hint.Version >= latest.Version {
+            latest = hint
+        }
+    }
+    for {
+        raw, ok, err := store.Get(ctx, adminVersionKey(latest.Version+1))
+        if err != nil {
+            return fallback, err
+        }
+        if !ok {
+            return latest, nil
+        }
+        var next RuntimeSettings
+        if err := json.Unmarshal(raw, &next); err != nil {
+            return fallback, fmt.Errorf("admin: stored settings v%d: %v", latest.Version+1, err)
+        }
+        latest = next
+    }
+}
+
+// Run keeps this instance's settings in step with changes made through
+// other instances, until ctx is done.
+func (a *AdminAPI) Run(ctx context.Context, h *UserEventsHandler) {
+    ticker := time.NewTicker(a.pollInterval())
+    defer ticker.Stop()
+    for {
+        a.refresh(ctx, h)
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+        }
+    }
+}
+
+func (a *AdminAPI) refresh(ctx context.Context, h *UserEventsHandler) {
+    ctx, cancel := context.WithTimeout(ctx, stateStoreTimeout)
+    defer cancel()
+    s, err := a.load(ctx, h.state())
+    if err != nil {
+        h.logger().Warn("couldn't read runtime settings", "error", err)
+        return
+    }
+    if current := a.settings(); current == nil || s.Version != current.Version {
+        if current != nil {
+            h.logger().Info("picked up runtime settings", "version", s.Version, "updated_by", s.UpdatedBy)
+        }
+        a.current.Store(&s)
+    }
+}
+
+func (h *UserEventsHandler) HandleAdmin(w http.ResponseWriter, r *http.Request) {
+    a := h.Admin
+    if a == nil {
+        http.NotFound(w, r)
+        return
+    }
+    if !bearerTokenOK(r, a.Token) {
+        http.Error(w, "unauthorized", http.StatusUnauthorized)
+        return
+    }
+    ctx, cancel := context.WithTimeout(r.Context(), stateStoreTimeout)
+    defer cancel()
+
+    if strings.HasSuffix(r.URL.Path, "/dry-run") {
+        dry := h.DryRun
+        if dry == nil {
+            dry = &a.dryRun
+        }
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(dry.Report())
+        return
+    }
+
+    switch r.Method {
+    case http.MethodGet:
+        s, err := a.load(ctx, h.state())
+        if err != nil {
+            h.logger().Error("couldn't read runtime settings", "error", err)
+            http.Error(w, "couldn't read settings", http.StatusInternalServerError)
+            return
+        }
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(s)
+    case http.MethodPut:
+        var next RuntimeSettings
+        if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&next); err != nil {
+            http.Error(w, "settings must be JSON: "+err.Error(), http.StatusBadRequest)
+            return
+        }
+        if err := next.validate(); err != nil {
+            http.Error(w, err.Error(), http.StatusBadRequest)
+            return
+        }
+        previous, err := a.load(ctx, h.state())
+        if err != nil {
+            h.logger().Error("couldn't read runtime settings", "error", err)
+            http.Error(w, "couldn't read settings", http.StatusInternalServerError)
+            return
+        }
+        if next.Version != previous.Version {
+            w.Header().Set("Content-Type", "application/json")
+            w.WriteHeader(http.StatusConflict)
+            json.NewEncoder(w).Encode(previous)
+            return
+        }
+        next.Version = previous.Version + 1
+        next.UpdatedAt = time.Now().UTC()
+        next.UpdatedBy = r.Header.Get("X-Admin-Actor")
+        encoded, _ := json.Marshal(next)
+        claimed, err := h.state().SetIfAbsent(ctx, adminVersionKey(next.Version), encoded, adminVersionTTL)
+        if err != nil {
+            h.logger().Error("couldn't save runtime settings", "error", err)
+            http.Error(w, "couldn't save settings", http.StatusInternalServerError)
+            return
+        }
+        if !claimed {
+            // Someone else saved this version first
+            latest, _ := a.load(ctx, h.state())
+            w.Header().Set("Content-Type", "application/json")
+            w.WriteHeader(http.StatusConflict)
+            json.NewEncoder(w).Encode(latest)
+            return
+        }
+        if err := h.state().Set(ctx, adminSettingsKey, encoded, 0); err != nil {
+            h.logger().Warn("couldn't update latest runtime settings hint", "error", err)
+        }
+        a.current.Store(&next)
+        adminChanges.Inc()
+        h.logger().Warn("runtime settings changed", "version", next.Version, "updated_by", next.UpdatedBy)
+        a.audit(ctx, h, r, previous, next)
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(next)
+    default:
+        w.Header().Set("Allow", "GET, PUT")
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+    }
+}
+
+func (a *AdminAPI) audit(ctx context.Context, h *UserEventsHandler, r *http.Request, previous, next RuntimeSettings) {
+    before, _ := json.Marshal(previous)
+    after, _ := json.Marshal(next)
+    ev := h.newEvent(adminChangeType, nil, nil)
+    ev.Dataset = a.auditDataset()
+    ev.AddField("actor", next.UpdatedBy)
+    ev.AddField("remote_addr", r.RemoteAddr)
+    ev.AddField("version", next.Version)
+    ev.AddField("killed", next.Killed)
+    ev.AddField("before", string(before))
+    ev.AddField("after", string(after))
+    h.send(ctx, ev)
+}
@@ -0,0 +1,82 @@
+// AdminClient talks to an AdminAPI, for scripts and runbooks that would
+// rather not hand-roll the version check:
+//
+//     admin := &AdminClient{URL: "https://events.example.com/admin/settings", Token: os.Getenv("ADMIN_TOKEN"), Actor: "oncall"}
+//     _, err := admin.Update(ctx, func(s *RuntimeSettings) {
+//         s.SampleRates = map[string]uint{"heartbeat": 50}
+//     })
+type AdminClient struct {
+    URL        string // Where HandleAdmin is mounted
+    Token      string
+    Actor      string // Who's making the changes, for the audit events
+    HTTPClient *http.Client
+}
+
+// Get returns the settings in effect.
+func (c *AdminClient) Get(ctx context.Context) (RuntimeSettings, error) {
+    var s RuntimeSettings
+    err := c.call(ctx, http.MethodGet, nil, &s)
+    return s, err
+}
+
+// Put replaces the settings with s, which must have the Version they were
+// read at; if they've changed since, it returns ErrSettingsConflict.
+func (c *AdminClient) Put(ctx context.Context, s RuntimeSettings) (RuntimeSettings, error) {
+    var saved RuntimeSettings
+    err := c.call(ctx, http.MethodPut, s, &saved)
+    return saved, err
+}
+
+// Update reads the settings, changes them with change, and writes them back,
+// starting over (a few times) if someone else changed them in between.
+func (c *AdminClient) Update(ctx context.Context, change func(*RuntimeSettings)) (RuntimeSettings, error) {
+    for attempt := 0; ; attempt++ {
+        s, err := c.Get(ctx)
+        if err != nil {
+            return s, err
+        }
+        change(&s)
+        saved, err := c.Put(ctx, s)
+        if errors.Is(err, ErrSettingsConflict) && attempt < 3 {
+            continue
+        }
+        return saved, err
+    }
+}
+
+func (c *AdminClient) call(ctx context.Context, method string, body, out interface{}) error {
+    var reader io.Reader
+    if body != nil {
+        encoded, err := json.Marshal(body)
+        if err != nil {
+            return err
+        }
+        reader = bytes.NewReader(encoded)
+    }
+    req, err := http.NewRequestWithContext(ctx, method, c.URL, reader)
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Authorization", "Bearer "+c.Token)
+    req.Header.Set("Content-Type", "application/json")
+    if c.Actor != "" {
+        req.Header.Set("X-Admin-Actor", c.Actor)
+    }
+    client := c.HTTPClient
+    if client == nil {
+        client = http.DefaultClient
+    }
+    resp, err := client.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    switch {
+    case resp.StatusCode == http.StatusConflict:
+        return ErrSettingsConflict
+    case resp.StatusCode != http.StatusOK:
+        message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+        return fmt.Errorf("admin: %s %s returned %s: %s", method, c.URL, resp.Status, strings.TrimSpace(string(message)))
+    }
+    return json.NewDecoder(resp.Body).Decode(out)
+}
@@ -0,0 +1,92 @@
+// When we go over our Honeycomb quota, Honeycomb starts answering 429 and
+// drops whatever we send, which means losing a random slice of every event
+// type. AdmissionController turns that feedback into sampling instead: each
+// Interval in which some sends were rate limited doubles a multiplier that
+// every sample rate is scaled up by (up to MaxMultiplier), and each Interval
+// without any halves it again, so we back off while we're over and recover
+// gradually once we're not. Because it's sampling, Honeycomb still weights the
+// events we keep correctly. Low-priority types (see Priorities) get the
+// multiplier squared, and high-priority and Protected types are never sampled
+// any harder.
+//
+//     handler.Admission = &AdmissionController{Protected: []string{"error"}}
+//
+// Events sent while it's on get an `effective_sample_rate` field, so it's
+// clear in Honeycomb when the multiplier was kicking in.
+type AdmissionController struct {
+    MaxMultiplier uint          // Defaults to 64
+    Interval      time.Duration // Defaults to 10 seconds
+    Protected     []string      // Event types we never scale the sample rate of
+
+    mu          sync.Mutex
+    multiplier  uint
+    windowStart time.Time
+    responses   int
+    limited     int
+}
+
+var admissionMultiplier = promauto.NewGauge(prometheus.GaugeOpts{
+    Name: "user_events_admission_sample_multiplier",
+    Help: "What sample rates are currently being multiplied by because of Honeycomb rate limiting.",
+})
+
+func (a *AdmissionController) record(resp transmission.Response) {
+    a.mu.Lock()
+    defer a.mu.Unlock()
+    a.roll(time.Now())
+    a.responses++
+    if classifyResponse(resp) == SendRateLimited {
+        a.limited++
+    }
+}
+
+// multiplierFor is how much to scale eventType's sample rate by right now. a
+// may be nil.
+func (a *AdmissionController) multiplierFor(eventType string, priority Priority) uint {
+    if a == nil || priority > PriorityNormal {
+        return 1
+    }
+    for _, t := range a.Protected {
+        if t == eventType {
+            return 1
+        }
+    }
+    a.mu.Lock()
+    defer a.mu.Unlock()
+    a.roll(time.Now())
+    if priority < PriorityNormal {
+        return a.multiplier * a.multiplier
+    }
+    return a.multiplier
+}
+
+// Called with a.mu held. Closes out the current window if it's over, and
+// adjusts the multiplier going by how it went.
+func (a *AdmissionController) roll(now time.Time) {
+    if a.multiplier == 0 {
+        a.multiplier = 1
+    }
+    interval := a.Interval
+    if interval <= 0 {
+        interval = 10 * time.Second
+    }
+    if now.Sub(a.windowStart) < interval {
+        return
+    }
+
+    max := a.MaxMultiplier
+    if max == 0 {
+        max = 64
+    }
+    switch {
+    case a.limited > 0 && a.multiplier < max:
+        a.multiplier *= 2
+        if a.multiplier > max {
+            a.multiplier = max
+        }
+    case a.limited == 0 && a.multiplier > 1:
+        a.multiplier /= 2
+    }
+    admissionMultiplier.Set(float64(a.multiplier))
+    a.windowStart, a.responses, a.limited = now, 0, 0
+}
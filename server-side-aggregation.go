@@ -0,0 +1,153 @@
+// Some event types (scrolls, heartbeats) are very frequent and individually
+// boring. Rather than send each one, an Aggregator rolls them up per user
+// session per minute into a single summary event with a count and p50/p95 of
+// every numeric field. Other event types (page-loads, errors) pass straight
+// through untouched.
+//
+// Start the flush loop alongside the handler:
+//
+//     handler.Aggregator = NewAggregator("scroll", "heartbeat")
+//     go handler.Aggregator.Run(ctx, handler)
+type Aggregator struct {
+    Types  map[string]bool // Event types to roll up
+    Window time.Duration   // Defaults to 1 minute
+
+    mu      sync.Mutex
+    rollups map[rollupKey]*rollup
+}
+
+type rollupKey struct {
+    EventType string
+    UserID    string
+    SessionID string
+    Window    int64 // Start of the window, in unix seconds
+}
+
+type rollup struct {
+    count   int
+    numbers map[string][]float64
+}
+
+// Keep at most this many values per field per rollup for percentiles, so a
+// flood of events can't grow a rollup without bound. Past this we still count
+// events, and the percentiles are from the first values we saw.
+const maxRollupValues = 1000
+
+func NewAggregator(eventTypes ...string) *Aggregator {
+    types := make(map[string]bool, len(eventTypes))
+    for _, eventType := range eventTypes {
+        types[eventType] = true
+    }
+    return &Aggregator{Types: types, rollups: make(map[rollupKey]*rollup)}
+}
+
+func (a *Aggregator) window() time.Duration {
+    if a.Window > 0 {
+        return a.Window
+    }
+    return time.Minute
+}
+
+// Absorb adds the event to its rollup and returns true, or returns false if
+// this isn't an event type we aggregate and it should be sent as normal.
+func (a *Aggregator) Absorb(eventType string, metadata map[string]interface{}, user *UserInfo) bool {
+    if !a.Types[eventType] {
+        return false
+    }
+
+    key := rollupKey{
+        EventType: eventType,
+        SessionID: fmt.Sprint(firstPresent(metadata, "session_id", "page_load_id")),
+        Window:    time.Now().Truncate(a.window()).Unix(),
+    }
+    if user != nil {
+        key.UserID = user.ID
+    }
+
+    a.mu.Lock()
+    defer a.mu.Unlock()
+    r, ok := a.rollups[key]
+    if !ok {
+        r = &rollup{numbers: make(map[string][]float64)}
+        a.rollups[key] = r
+    }
+    r.count++
+    for name, value := range metadata {
+        if number, ok := value.(float64); ok && len(r.numbers[name]) < maxRollupValues {
+            r.numbers[name] = append(r.numbers[name], number)
+        }
+    }
+    return true
+}
+
+func firstPresent(metadata map[string]interface{}, names ...string) interface{} {
+    for _, name := range names {
+        if value, ok := metadata[name]; ok && value != nil {
+            return value
+        }
+    }
+    return ""
+}
+
+func (a *Aggregator) Run(ctx context.Context, h *UserEventsHandler) {
+    ticker := time.NewTicker(a.window() / 4)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-ctx.Done():
+            a.flush(h, time.Time{}) // Send everything we've got, finished window or not
+            return
+        case now := <-ticker.C:
+            a.flush(h, now.Truncate(a.window()))
+        }
+    }
+}
+
+// Sends a summary event for every rollup whose window started before
+// `before` (the current window is still filling up). A zero `before` flushes
+// everything.
+func (a *Aggregator) flush(h *UserEventsHandler, before time.Time) {
+    a.mu.Lock()
+    done := make(map[rollupKey]*rollup)
+    for key, r := range a.rollups {
+        if before.IsZero() || key.Window < before.Unix() {
+            done[key] = r
+            delete(a.rollups, key)
+        }
+    }
+    a.mu.Unlock()
+
+    for key, r := range done {
+        ev := h.newEvent(key.EventType+"-rollup", nil, nil)
+        ev.Dataset = h.Datasets.datasetFor(key.EventType) // Alongside the events it rolls up
+        ev.Timestamp = time.Unix(key.Window, 0)
+        ev.AddField("rollup_event_type", key.EventType)
+        ev.AddField("rollup_window_sec", a.window().Seconds())
+        ev.AddField("count", r.count)
+        if key.UserID != "" {
+            ev.AddField("user_id", key.UserID)
+        }
+        ev.AddField("session_id", key.SessionID)
+        for name, values := range r.numbers {
+            sort.Float64s(values)
+            ev.AddField(name+"_p50", percentile(values, 0.50))
+            ev.AddField(name+"_p95", percentile(values, 0.95))
+        }
+        ctx, cancel := context.WithTimeout(context.Background(), queueSendTimeout)
+        h.scrub(ctx, ev)
+        h.send(ctx, ev)
+        cancel()
+    }
+}
+
+// Nearest-rank percentile of already-sorted values
+func percentile(sorted []float64, p float64) float64 {
+    if len(sorted) == 0 {
+        return 0
+    }
+    i := int(math.Ceil(p*float64(len(sorted)))) - 1
+    if i < 0 {
+        i = 0
+    }
+    return sorted[i]
+}
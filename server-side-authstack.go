@@ -0,0 +1,283 @@
+// Which user an event belongs to used to be worked out lazily, deep inside
+// whichever handler asked for it, so there was no one place to see (or test)
+// how a request was authenticated. AuthStack makes it explicit: Identify runs
+// the stack's methods in order, once per request, and the first one that
+// recognizes the request decides the user every later step sees.
+//
+//     handler.Auth = &AuthStack{Methods: []AuthMethod{
+//         {Name: "oauth", Resolver: &JWTResolver{Keyfunc: jwks.Keyfunc, Audience: "events"}},
+//         {Name: "session", Resolver: SessionResolver(app.CurrentUser)},
+//         {Name: "anonymous_token", Resolver: &AnonymousTokenResolver{Secret: visitorSecret}},
+//     }}
+//     mux.Handle("/events/batch", handler.Identify(http.HandlerFunc(handler.HandleBatch)))
+//
+// Each method is just a UserResolver, so the ones that already exist (a
+// session lookup, JWTs, OAuth token introspection, signed anonymous tokens)
+// can be mixed in any order. Without an Auth stack, or for requests that
+// didn't come through Identify, the handler falls back to Users as before.
+type AuthStack struct {
+    Methods []AuthMethod
+
+    // Required turns away requests no method identifies (or whose
+    // credentials are bad) with a 401, rather than sending their events
+    // without a user.
+    Required bool
+}
+
+type AuthMethod struct {
+    Name     string // For metrics and logs, e.g. "session"
+    Resolver UserResolver
+}
+
+var (
+    authAttempts = promauto.NewCounterVec(prometheus.CounterOpts{
+        Name: "user_events_auth_attempts_total",
+        Help: "Requests each auth method looked at, by outcome (authenticated, no_credentials, or invalid).",
+    }, []string{"method", "outcome"})
+    authDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+        Name:    "user_events_auth_duration_seconds",
+        Help:    "How long each auth method took to make up its mind.",
+        Buckets: []float64{.0005, .001, .005, .01, .05, .1, .5},
+    }, []string{"method"})
+)
+
+type authResultKey struct{}
+
+// What Identify decided, so currentUser doesn't resolve the request again
+type authResult struct {
+    user   *UserInfo // nil for nobody in particular
+    method string
+}
+
+// Authenticate runs each method in turn, returning the first user found and
+// the name of the method that found it. Like ChainResolver, it returns
+// ErrNoUser if nobody recognized the request, or the first method's error if
+// one of them tried to and failed.
+func (a *AuthStack) Authenticate(r *http.Request) (*UserInfo, string, error) {
+    err := ErrNoUser
+    for _, method := range a.Methods {
+        start := time.Now()
+        user, resolveErr := method.Resolver.Resolve(r)
+        authDuration.WithLabelValues(method.Name).Observe(time.Since(start).Seconds())
+
+        switch {
+        case resolveErr == nil && user.ID != "":
+            authAttempts.WithLabelValues(method.Name, "authenticated").Inc()
+            return &user, method.Name, nil
+        case resolveErr == nil, errors.Is(resolveErr, ErrNoUser):
+            authAttempts.WithLabelValues(method.Name, "no_credentials").Inc()
+        default:
+            authAttempts.WithLabelValues(method.Name, "invalid").Inc()
+            if errors.Is(err, ErrNoUser) {
+                err = fmt.Errorf("%s: %w", method.Name, resolveErr)
+            }
+        }
+    }
+    return nil, "", err
+}
+
+// Identify authenticates the request with the handler's Auth stack before
+// passing it on. A handler with no Auth stack passes everything through.
+func (h *UserEventsHandler) Identify(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        if h.Auth == nil || r.Method == http.MethodOptions {
+            next.ServeHTTP(w, r)
+            return
+        }
+        user, method, err := h.Auth.Authenticate(r)
+        if errors.Is(err, ErrUserLookupUnavailable) {
+            // Not the browser's fault, so not a reason to turn it away, even
+            // if we'd otherwise insist on knowing who it is
+            if unresolved := h.UserFallback.unresolved(r); unresolved != nil {
+                h.logger().Info("couldn't authenticate request, so sending its events unresolved", "path", r.URL.Path, "error", err)
+                user, err = unresolved, nil
+            }
+        }
+        if err != nil {
+            if h.Auth.Required {
+                writeRejection(w, http.StatusUnauthorized, CodeUnauthenticated, "request isn't authenticated")
+                return
+            }
+            if !errors.Is(err, ErrNoUser) {
+                h.logger().Info("couldn't authenticate request", "path", r.URL.Path, "error", err)
+            }
+        }
+        ctx := context.WithValue(r.Context(), authResultKey{}, authResult{user: user, method: method})
+        next.ServeHTTP(w, r.WithContext(ctx))
+    })
+}
+
+// The user Identify found for the request, if it came through Identify
+func identifiedUser(r *http.Request) (*UserInfo, bool) {
+    result, ok := r.Context().Value(authResultKey{}).(authResult)
+    return result.user, ok
+}
+
+// AnonymousTokenResolver recognizes visitors by a token we signed for them
+// (see IssueAnonymousToken), sent in a header. Unlike a plain visitor cookie,
+// a token can't be made up to pass as some other visitor, and it works from
+// pages where we can't set cookies.
+type AnonymousTokenResolver struct {
+    Secret []byte
+    Header string // Defaults to "X-Visitor-Token"
+}
+
+const defaultAnonymousTokenHeader = "X-Visitor-Token"
+
+// IssueAnonymousToken signs visitorID for ttl, for the page to send back in
+// AnonymousTokenResolver's header. Tokens look like
+// "v1.<visitor ID>.<expiry, unix seconds>.<signature>".
+func IssueAnonymousToken(secret []byte, visitorID string, ttl time.Duration) string {
+    payload := "v1." + base64.RawURLEncoding.EncodeToString([]byte(visitorID)) + "." + strconv.FormatInt(time.Now().Add(ttl).Unix(), 10)
+    return payload + "." + anonymousTokenSignature(secret, payload)
+}
+
+func anonymousTokenSignature(secret []byte, payload string) string {
+    mac := hmac.New(sha256.New, secret)
+    mac.Write([]byte("anonymous-token:" + payload))
+    return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (a *AnonymousTokenResolver) Resolve(r *http.Request) (UserInfo, error) {
+    header := a.Header
+    if header == "" {
+        header = defaultAnonymousTokenHeader
+    }
+    token := r.Header.Get(header)
+    if token == "" {
+        return UserInfo{}, ErrNoUser
+    }
+
+    parts := strings.Split(token, ".")
+    if len(parts) != 4 || parts[0] != "v1" {
+        return UserInfo{}, errors.New("malformed anonymous token")
+    }
+    payload := strings.Join(parts[:3], ".")
+    if !hmac.Equal([]byte(parts[3]), []byte(anonymousTokenSignature(a.Secret, payload))) {
+        return UserInfo{}, errors.New("anonymous token signature doesn't match")
+    }
+    expires, err := strconv.ParseInt(parts[2], 10, 64)
+    if err != nil || time.Now().Unix() > expires {
+        return UserInfo{}, errors.New("anonymous token has expired")
+    }
+    id, err := base64.RawURLEncoding.DecodeString(parts[1])
+    if err != nil || len(id) == 0 {
+        return UserInfo{}, errors.New("malformed anonymous token")
+    }
+    return UserInfo{ID: string(id), Anonymous: true}, nil
+}
+
+// IntrospectionResolver checks opaque OAuth access tokens (the ones that
+// aren't JWTs, so JWTResolver can't read them) with the authorization
+// server's RFC 7662 introspection endpoint. Answers are cached for CacheTTL,
+// since the browser sends the same token with every batch.
+type IntrospectionResolver struct {
+    URL          string
+    ClientID     string
+    ClientSecret string
+    HTTPClient   *http.Client  // Defaults to one with a 2 second timeout
+    CacheTTL     time.Duration // Defaults to a minute; never longer than the token's own expiry
+
+    EmailClaim string   // Defaults to "email"
+    Claims     []string // Other claims to copy into Attributes, like JWTResolver
+
+    once  sync.Once
+    cache *lru.Cache
+}
+
+type cachedIntrospection struct {
+    user    UserInfo
+    active  bool
+    expires time.Time
+}
+
+var introspectionHTTPClient = &http.Client{Timeout: 2 * time.Second}
+
+func (i *IntrospectionResolver) Resolve(r *http.Request) (UserInfo, error) {
+    auth := r.Header.Get("Authorization")
+    if !strings.HasPrefix(auth, "Bearer ") {
+        return UserInfo{}, ErrNoUser
+    }
+    token := strings.TrimPrefix(auth, "Bearer ")
+    if strings.Count(token, ".") == 2 {
+        return UserInfo{}, ErrNoUser // A JWT; leave it to JWTResolver
+    }
+
+    i.once.Do(func() { i.cache, _ = lru.New(10000) })
+    cacheKey := sha256.Sum256([]byte(token)) // Not the token itself, in case of a heap dump
+    if cached, ok := i.cache.Get(cacheKey); ok && time.Now().Before(cached.(cachedIntrospection).expires) {
+        if !cached.(cachedIntrospection).active {
+            return UserInfo{}, errors.New("bearer token isn't active")
+        }
+        return cached.(cachedIntrospection).user, nil
+    }
+
+    result, err := i.introspect(r.Context(), token)
+    if err != nil {
+        return UserInfo{}, err
+    }
+    i.cache.Add(cacheKey, result)
+    if !result.active {
+        return UserInfo{}, errors.New("bearer token isn't active")
+    }
+    return result.user, nil
+}
+
+func (i *IntrospectionResolver) introspect(ctx context.Context, token string) (cachedIntrospection, error) {
+    form := url.Values{"token": {token}, "token_type_hint": {"access_token"}}
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, i.URL, strings.NewReader(form.Encode()))
+    if err != nil {
+        return cachedIntrospection{}, err
+    }
+    req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+    req.SetBasicAuth(i.ClientID, i.ClientSecret)
+    client := i.HTTPClient
+    if client == nil {
+        client = introspectionHTTPClient
+    }
+    resp, err := client.Do(req)
+    if err != nil {
+        return cachedIntrospection{}, fmt.Errorf("introspecting bearer token: %w", err)
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        return cachedIntrospection{}, fmt.Errorf("introspecting bearer token: %s", resp.Status)
+    }
+    claims := map[string]interface{}{}
+    if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&claims); err != nil {
+        return cachedIntrospection{}, fmt.Errorf("invalid introspection response: %v", err)
+    }
+
+    ttl := i.CacheTTL
+    if ttl <= 0 {
+        ttl = time.Minute
+    }
+    result := cachedIntrospection{expires: time.Now().Add(ttl)}
+    result.active, _ = claims["active"].(bool)
+    if exp, ok := claims["exp"].(float64); ok && time.Unix(int64(exp), 0).Before(result.expires) {
+        result.expires = time.Unix(int64(exp), 0)
+    }
+    subject, _ := claims["sub"].(string)
+    if subject == "" {
+        result.active = false
+    }
+    if !result.active {
+        return result, nil
+    }
+
+    result.user = UserInfo{ID: subject}
+    emailClaim := i.EmailClaim
+    if emailClaim == "" {
+        emailClaim = "email"
+    }
+    result.user.Email, _ = claims[emailClaim].(string)
+    for _, claim := range i.Claims {
+        if value, ok := claims[claim]; ok {
+            if result.user.Attributes == nil {
+                result.user.Attributes = map[string]interface{}{}
+            }
+            result.user.Attributes[claim] = value
+        }
+    }
+    return result, nil
+}
@@ -0,0 +1,158 @@
+// Single-page apps can emit a lot of events per session, so rather than making
+// one HTTP request per page-load/page-unload, the browser can buffer events up
+// and POST them to /events/batch in one go. The body is either a JSON array of
+// event objects, or newline-delimited JSON (one event object per line), or one
+// of the more compact encodings in decodeBatchRequest.
+
+// Cap how many events we'll accept in one request, so a runaway client can't
+// tie up a handler goroutine forwarding thousands of events
+const maxBatchEvents = 100
+
+// For decoders that can tell there are too many events before decoding them
+var errTooManyEvents = fmt.Errorf("too many events in batch (max %d)", maxBatchEvents)
+
+// HandleBatch is wired up at /events/batch.
+func (h *UserEventsHandler) HandleBatch(w http.ResponseWriter, r *http.Request) {
+    decode := spanFrom(r.Context()).child("decode")
+    events, err := h.decodeBatchRequest(w, r)
+    decode.add("events", len(events))
+    decode.end()
+    if err == errTooManyEvents || len(events) > maxBatchEvents {
+        writeRejection(w, http.StatusBadRequest, CodeTooManyEvents, errTooManyEvents.Error())
+        return
+    }
+    if err != nil {
+        writeRejection(w, bodyErrorStatus(err), bodyErrorCode(err), err.Error())
+        return
+    }
+
+    results, errs := h.sendBatchToHoneycombAPI(r.Context(), events, r, h.currentUser(r))
+    respondToBatch(w, results, errs)
+}
+
+// Each event in the batch becomes its own libhoney event, exactly as if the
+// browser had sent them one at a time. Events without a "type" field can't be
+// told apart in Honeycomb, so we drop them (as missing_type). One bad event
+// doesn't stop the rest of the batch from being sent; we return the errors for
+// any that were rejected, along with what became of every event.
+func (h *UserEventsHandler) sendBatchToHoneycombAPI(ctx context.Context, events []map[string]interface{}, r *http.Request, user *UserInfo) ([]EventResult, []error) {
+    var errs []error
+    results := newEventResults(len(events))
+    for i, metadata := range events {
+        if err := ctx.Err(); err != nil {
+            // The browser gave up on us, so there's no one left to hear about
+            // the rest; they're counted as dropped rather than silently lost
+            for j, rest := range events[i:] {
+                eventType, _ := rest["type"].(string)
+                eventsDropped.WithLabelValues(metricsTypeLabel(eventType), "canceled").Inc()
+                results[i+j].reject(err)
+            }
+            return results, append(errs, err)
+        }
+        eventType, ok := metadata["type"].(string)
+        if !ok || eventType == "" {
+            results[i].drop(CodeMissingType, "event has no type")
+            continue
+        }
+        dropped, err := h.ingest(ctx, eventType, metadata, r, user)
+        switch {
+        case err != nil:
+            errs = append(errs, fmt.Errorf("event #%d: %w", i+1, err))
+            results[i].reject(err)
+        case dropped == shedDropReason:
+            results[i].shed = true // Accepted, as far as the browser's concerned
+        case dropped != "":
+            results[i].drop(dropCode(dropped), "event was dropped")
+        }
+    }
+    return results, errs
+}
+
+// 204 if every event was accepted (202 if some were shed for load), 200 with
+// the results if some were only dropped, otherwise rejectEvents' status with
+// the results
+func respondToBatch(w http.ResponseWriter, results []EventResult, errs []error) {
+    switch {
+    case len(errs) > 0:
+        rejectEvents(w, errs, results)
+    case allAccepted(results) && anyShed(results):
+        w.WriteHeader(http.StatusAccepted)
+    case allAccepted(results):
+        w.WriteHeader(http.StatusNoContent)
+    default:
+        writeRejectionBody(w, http.StatusOK, rejectionBody{Results: results})
+    }
+}
+
+// Tells the browser why some of its events were turned away: 503 if we're
+// backed up or 429 if its tenant is over quota (so it should retry later), 401
+// for an unknown tenant, otherwise 400. The first of those we find is the
+// error for the whole request; results says what happened to each event.
+func rejectEvents(w http.ResponseWriter, errs []error, results []EventResult) {
+    status, code := http.StatusBadRequest, errorCodeFor(errs[0])
+    for _, err := range errs {
+        if errors.Is(err, ErrQueueFull) || errors.Is(err, ErrQuotaExceeded) || errors.Is(err, ErrUnknownTenant) {
+            code = errorCodeFor(err)
+            break
+        }
+    }
+    switch code {
+    case CodeQueueFull:
+        w.Header().Set("Retry-After", "5")
+        status = http.StatusServiceUnavailable
+    case CodeQuotaExceeded:
+        w.Header().Set("Retry-After", "60")
+        status = http.StatusTooManyRequests
+    case CodeUnknownTenant:
+        status = http.StatusUnauthorized
+    }
+    writeRejectionBody(w, status, rejectionBody{
+        Error:   &rejectionError{Code: code, Message: joinErrors(errs), Action: actionFor(code)},
+        Results: results,
+    })
+}
+
+func joinErrors(errs []error) string {
+    messages := make([]string, len(errs))
+    for i, err := range errs {
+        messages[i] = err.Error()
+    }
+    return strings.Join(messages, "\n")
+}
+
+// Accepts either `[{...}, {...}]` or `{...}\n{...}\n`. json.Decoder happily
+// reads a stream of concatenated values, which covers the NDJSON case. The
+// body's nesting is checked against the limits before any of it's decoded.
+func decodeEventBatch(body io.Reader, limits *PayloadLimits) ([]map[string]interface{}, error) {
+    buf, err := ioutil.ReadAll(body)
+    if err != nil {
+        return nil, fmt.Errorf("reading events: %w", err)
+    }
+    buf = bytes.TrimSpace(buf)
+
+    var events []map[string]interface{}
+    if len(buf) > 0 && buf[0] == '[' {
+        if jsonDepthExceeds(buf, limits.maxDepth()+1) { // The array is a level of its own
+            return nil, fmt.Errorf("invalid JSON array of events: nests deeper than %d levels", limits.maxDepth())
+        }
+        if err := json.Unmarshal(buf, &events); err != nil {
+            return nil, fmt.Errorf("invalid JSON array of events: %v", err)
+        }
+        return events, nil
+    }
+
+    if jsonDepthExceeds(buf, limits.maxDepth()) {
+        return nil, fmt.Errorf("invalid NDJSON events: nest deeper than %d levels", limits.maxDepth())
+    }
+    dec := json.NewDecoder(bytes.NewReader(buf))
+    for {
+        var metadata map[string]interface{}
+        if err := dec.Decode(&metadata); err == io.EOF {
+            break
+        } else if err != nil {
+            return nil, fmt.Errorf("invalid NDJSON event #%d: %v", len(events)+1, err)
+        }
+        events = append(events, metadata)
+    }
+    return events, nil
+}
@@ -0,0 +1,268 @@
+// Under load, a lot of our CPU went on handing events to libhoney one at a
+// time: a NewEvent, a field map copy, a lock, and a JSON marshal per event.
+// BatchSink skips libhoney's per-event path. Events are buffered by dataset
+// and POSTed to Honeycomb's batch API whenever a dataset has BatchSize of
+// them, or every FlushInterval, whichever comes first, with each batch
+// marshaled in one go.
+//
+//     handler.Sink = NewBatchSink(handler, os.Getenv("HONEYCOMB_WRITEKEY"), 500, time.Second)
+//
+// Honeycomb's per-event statuses are fed through the same response handling
+// as libhoney's (metrics, the circuit breaker, the dead letter queue, and
+// OnResponse), so retries work as before; retried events go back out through
+// the handler's libhoney clients. BatchSink sends everything with one API
+// key, so it doesn't honor ClientRouter or per-tenant clients. At most
+// MaxInFlight batches are posted at once; while they're all busy, events
+// wait in the buffer, so a slow Honeycomb turns into ErrQueueFull rather
+// than a pile of goroutines.
+type BatchSink struct {
+    APIKey      string
+    APIHost     string       // Defaults to https://api.honeycomb.io
+    MaxPending  int          // Send returns ErrQueueFull past this many buffered events; defaults to 20 batches' worth
+    MaxInFlight int          // Batches posted at once; defaults to 4. Set before the first Send.
+    HTTPClient  *http.Client // Defaults to a shared pooled client
+
+    h             *UserEventsHandler
+    batchSize     int
+    flushInterval time.Duration
+
+    mu      sync.Mutex
+    pending map[string][]Event // Dataset -> events waiting to go
+    count   int
+    closed  bool
+
+    full     chan struct{} // Nudges the flusher when a dataset has a full batch
+    done     chan struct{}
+    stopped  chan struct{} // Closed once run returns, so no more flushes start
+    flushing sync.WaitGroup
+    slotOnce sync.Once
+    slots    chan struct{} // One per batch being posted
+}
+
+// Honeycomb takes up to 5MB per batch; 500 browser events is well under that
+const defaultBatchSize = 500
+
+// NewBatchSink starts the flusher straight away. Zero batchSize or
+// flushInterval mean 500 events and 1 second.
+func NewBatchSink(h *UserEventsHandler, apiKey string, batchSize int, flushInterval time.Duration) *BatchSink {
+    if batchSize <= 0 {
+        batchSize = defaultBatchSize
+    }
+    if flushInterval <= 0 {
+        flushInterval = time.Second
+    }
+    s := &BatchSink{
+        APIKey:        apiKey,
+        h:             h,
+        batchSize:     batchSize,
+        flushInterval: flushInterval,
+        pending:       make(map[string][]Event),
+        full:          make(chan struct{}, 1),
+        done:          make(chan struct{}),
+        stopped:       make(chan struct{}),
+    }
+    go s.run()
+    return s
+}
+
+func (s *BatchSink) Send(ctx context.Context, ev Event) error {
+    if s.h.Breaker != nil && !s.h.Breaker.Allow(ev.Client) {
+        return s.h.shortCircuit(ev)
+    }
+    maxPending := s.MaxPending
+    if maxPending <= 0 {
+        maxPending = 20 * s.batchSize
+    }
+
+    s.mu.Lock()
+    if s.closed {
+        s.mu.Unlock()
+        return errors.New("batch sink is closed")
+    }
+    if s.count >= maxPending {
+        s.mu.Unlock()
+        return ErrQueueFull
+    }
+    s.pending[ev.Dataset] = append(s.pending[ev.Dataset], ev)
+    s.count++
+    batchFull := len(s.pending[ev.Dataset]) >= s.batchSize
+    s.mu.Unlock()
+
+    if batchFull {
+        select {
+        case s.full <- struct{}{}:
+        default: // Already nudged
+        }
+    }
+    return nil
+}
+
+func (s *BatchSink) run() {
+    defer close(s.stopped)
+    ticker := time.NewTicker(s.flushInterval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-s.done:
+            return
+        case <-ticker.C:
+            s.flush(false)
+        case <-s.full:
+            s.flush(true)
+        }
+    }
+}
+
+// Sends what's buffered. With onlyFull, datasets that haven't filled a batch
+// yet keep waiting for the next tick.
+func (s *BatchSink) flush(onlyFull bool) {
+    s.mu.Lock()
+    var batches [][]Event
+    for dataset, events := range s.pending {
+        for len(events) >= s.batchSize {
+            batches = append(batches, events[:s.batchSize:s.batchSize])
+            events = events[s.batchSize:]
+        }
+        if len(events) > 0 && !onlyFull {
+            batches = append(batches, events)
+            events = nil
+        }
+        if len(events) == 0 {
+            delete(s.pending, dataset)
+        } else {
+            s.pending[dataset] = events
+        }
+    }
+    for _, batch := range batches {
+        s.count -= len(batch)
+    }
+    s.mu.Unlock()
+
+    s.slotOnce.Do(func() {
+        n := s.MaxInFlight
+        if n <= 0 {
+            n = 4
+        }
+        s.slots = make(chan struct{}, n)
+    })
+    for _, batch := range batches {
+        s.slots <- struct{}{} // Waits for a post to finish, if they're all busy
+        s.flushing.Add(1)
+        go func(batch []Event) {
+            defer func() {
+                <-s.slots
+                s.flushing.Done()
+            }()
+            s.post(batch)
+        }(batch)
+    }
+}
+
+// The shape of each event in a batch API request
+type batchAPIEvent struct {
+    Data       map[string]interface{} `json:"data"`
+    Time       time.Time              `json:"time"`
+    SampleRate uint                   `json:"samplerate"`
+}
+
+// Sends one dataset's batch, and reports how each event did
+func (s *BatchSink) post(batch []Event) {
+    dataset := batch[0].Dataset
+    items := make([]batchAPIEvent, len(batch))
+    for i, ev := range batch {
+        items[i] = batchAPIEvent{Data: ev.Fields(), Time: ev.Timestamp, SampleRate: ev.SampleRate}
+    }
+
+    start := time.Now()
+    statusCode, statuses, err := s.postBatch(dataset, items)
+    elapsed := time.Since(start)
+
+    for i, ev := range batch {
+        resp := transmission.Response{
+            Duration: elapsed,
+            Metadata: &SpooledEvent{
+                Client:     ev.Client,
+                Dataset:    ev.Dataset,
+                Timestamp:  ev.Timestamp,
+                SampleRate: ev.SampleRate,
+                Fields:     ev.Fields(),
+                Attempts:   1,
+            },
+        }
+        switch {
+        case err != nil:
+            resp.Err = err
+        case statusCode != http.StatusOK:
+            resp.StatusCode = statusCode // The whole batch was turned away, e.g. 429 or 401
+        case i < len(statuses):
+            resp.StatusCode = statuses[i].Status
+            resp.Body = []byte(statuses[i].Error)
+        default:
+            resp.Err = errors.New("batch API response was missing this event's status")
+        }
+        s.h.handleResponse(ev.Client, resp)
+    }
+}
+
+type batchEventStatus struct {
+    Status int    `json:"status"`
+    Error  string `json:"error"`
+}
+
+// Returns the response's status, and the per-event statuses if it was a 200
+func (s *BatchSink) postBatch(dataset string, items []batchAPIEvent) (int, []batchEventStatus, error) {
+    body, err := json.Marshal(items)
+    if err != nil {
+        return 0, nil, err
+    }
+    host := s.APIHost
+    if host == "" {
+        host = defaultAPIHost
+    }
+    ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+    defer cancel()
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(host, "/")+"/1/batch/"+url.PathEscape(dataset), bytes.NewReader(body))
+    if err != nil {
+        return 0, nil, err
+    }
+    req.Header.Set("X-Honeycomb-Team", s.APIKey)
+    req.Header.Set("Content-Type", "application/json")
+
+    client := s.HTTPClient
+    if client == nil {
+        client = proxyHTTPClient
+    }
+    resp, err := client.Do(req)
+    if err != nil {
+        return 0, nil, err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        io.Copy(ioutil.Discard, resp.Body)
+        return resp.StatusCode, nil, nil
+    }
+    var statuses []batchEventStatus
+    if err := json.NewDecoder(resp.Body).Decode(&statuses); err != nil {
+        return 0, nil, fmt.Errorf("reading batch response: %v", err)
+    }
+    return resp.StatusCode, statuses, nil
+}
+
+// Close sends everything still buffered, and waits for it.
+func (s *BatchSink) Close() error {
+    s.mu.Lock()
+    if s.closed {
+        s.mu.Unlock()
+        return nil
+    }
+    s.closed = true
+    s.mu.Unlock()
+
+    // A flush run is part way through may still be adding posts, so let it
+    // finish before we start waiting on them
+    close(s.done)
+    <-s.stopped
+    s.flush(false)
+    s.flushing.Wait()
+    return nil
+}
@@ -0,0 +1,69 @@
+// Page-unload events are sent with navigator.sendBeacon, since it's the only
+// way to reliably get a request out while the page is going away. Beacons
+// can't set custom headers (no Content-Type: application/json, no CSRF token),
+// so they arrive as text/plain or application/x-www-form-urlencoded and our
+// regular session middleware turns them away. HandleBeacon is mounted on its
+// own path (e.g. /events/beacon) outside that middleware: it decodes the
+// payload itself, and then sends the events on exactly like any others.
+func (h *UserEventsHandler) HandleBeacon(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        w.Header().Set("Allow", http.MethodPost)
+        http.Error(w, "beacons must be POSTed", http.StatusMethodNotAllowed)
+        return
+    }
+
+    decode := spanFrom(r.Context()).child("decode")
+    events, err := h.decodeBeacon(w, r)
+    decode.add("events", len(events))
+    decode.end()
+    if err != nil {
+        writeRejection(w, bodyErrorStatus(err), bodyErrorCode(err), err.Error())
+        return
+    }
+    if len(events) > maxBatchEvents {
+        writeRejection(w, http.StatusBadRequest, CodeTooManyEvents, fmt.Sprintf("too many events in beacon (max %d)", maxBatchEvents))
+        return
+    }
+
+    // Beacons still carry cookies, so we can usually tell who sent them. If
+    // the session has expired we'd rather keep the event without user fields
+    // than drop it.
+    if _, errs := h.sendBatchToHoneycombAPI(r.Context(), events, r, h.currentUser(r)); len(errs) > 0 {
+        rejectEvents(w, errs, nil)
+        return
+    }
+
+    // Nobody's around to read the response, so keep it as small as possible
+    // (which also means no per-event results)
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// sendBeacon(url, string) sends text/plain containing whatever JSON we
+// stringified (one event, an array, or NDJSON). sendBeacon(url, FormData or
+// URLSearchParams) sends a form, where we either expect the JSON in an
+// "events" field or treat each form field as an event field.
+func (h *UserEventsHandler) decodeBeacon(w http.ResponseWriter, r *http.Request) ([]map[string]interface{}, error) {
+    r.Body = http.MaxBytesReader(w, r.Body, h.maxBodyBytes())
+    mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+    if err != nil {
+        mediaType = "text/plain"
+    }
+
+    switch mediaType {
+    case "text/plain", "application/json":
+        return decodeEventBatch(r.Body, h.limits())
+    case "application/x-www-form-urlencoded", "multipart/form-data":
+        if err := r.ParseMultipartForm(1 << 20); err != nil && err != http.ErrNotMultipart {
+            return nil, fmt.Errorf("invalid beacon form: %w", err)
+        }
+        if encoded := r.PostForm.Get("events"); encoded != "" {
+            return decodeEventBatch(strings.NewReader(encoded), h.limits())
+        }
+        metadata := make(map[string]interface{}, len(r.PostForm))
+        for key, values := range r.PostForm {
+            metadata[key] = values[0]
+        }
+        return []map[string]interface{}{metadata}, nil
+    }
+    return nil, fmt.Errorf("unsupported beacon content type %q", mediaType)
+}
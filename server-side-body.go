@@ -0,0 +1,74 @@
+// Large (rrweb-style) payloads used to either OOM the handler or get rejected
+// by something in between with an unhelpful error. LimitBody caps how much we
+// read from the browser, answering 413 when a payload's too big, and
+// transparently decompresses gzip, deflate, and brotli request bodies, which
+// the browser SDK uses for anything sizeable. The limit applies to the
+// decompressed size, so a small payload can't decompress into a huge one.
+//
+//     mux.Handle("/events/batch", handler.LimitBody(...))
+func (h *UserEventsHandler) LimitBody(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        max := h.maxBodyBytes()
+        if r.ContentLength > max {
+            writeRejection(w, http.StatusRequestEntityTooLarge, CodePayloadTooLarge, fmt.Sprintf("payload too large (max %d bytes)", max))
+            return
+        }
+
+        body, err := decompressBody(r)
+        if err != nil {
+            writeRejection(w, http.StatusBadRequest, CodeInvalidBody, err.Error())
+            return
+        }
+        r.Body = http.MaxBytesReader(w, body, max)
+        r.Header.Del("Content-Encoding")
+        r.ContentLength = -1 // No longer accurate once decompressed
+        next.ServeHTTP(w, r)
+    })
+}
+
+// Defaults to 1MB, which is plenty for any event we expect from page-load.js
+const defaultMaxBodyBytes = 1 << 20
+
+func (h *UserEventsHandler) maxBodyBytes() int64 {
+    if h.MaxBodyBytes > 0 {
+        return h.MaxBodyBytes
+    }
+    return defaultMaxBodyBytes
+}
+
+func decompressBody(r *http.Request) (io.ReadCloser, error) {
+    switch encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))); encoding {
+    case "", "identity":
+        return r.Body, nil
+    case "gzip", "x-gzip":
+        zr, err := gzip.NewReader(r.Body)
+        if err != nil {
+            return nil, fmt.Errorf("invalid gzip body: %v", err)
+        }
+        return zr, nil
+    case "deflate":
+        return flate.NewReader(r.Body), nil
+    case "br":
+        return ioutil.NopCloser(brotli.NewReader(r.Body)), nil
+    default:
+        return nil, fmt.Errorf("unsupported Content-Encoding %q", encoding)
+    }
+}
+
+// The status for an error reading a request body: 413 if it's because we hit
+// the LimitBody cap, otherwise 400.
+func bodyErrorStatus(err error) int {
+    var tooLarge *http.MaxBytesError
+    if errors.As(err, &tooLarge) {
+        return http.StatusRequestEntityTooLarge
+    }
+    return http.StatusBadRequest
+}
+
+// The ErrorCode to go with bodyErrorStatus
+func bodyErrorCode(err error) ErrorCode {
+    if bodyErrorStatus(err) == http.StatusRequestEntityTooLarge {
+        return CodePayloadTooLarge
+    }
+    return CodeInvalidBody
+}
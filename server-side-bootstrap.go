@@ -0,0 +1,132 @@
+// A new team pointing this handler at a fresh Honeycomb environment used to
+// start from a blank screen. Bootstrap sets up the basics through the
+// Honeycomb API: some derived columns on every dataset the handler sends to,
+// and a starter board with page-load latency, errors by release, and the
+// slowest routes. It only ever adds things: columns and boards that already
+// exist (by name) are left as they are, so it's safe to run on every startup.
+//
+//     bootstrap := &Bootstrap{APIKey: os.Getenv("HONEYCOMB_CONFIG_KEY")}
+//     if err := bootstrap.Run(ctx, handler); err != nil { ... }
+type Bootstrap struct {
+    APIKey     string // Needs permission to create boards, queries, and derived columns
+    APIHost    string // Defaults to https://api.honeycomb.io
+    BoardName  string // Defaults to "Browser performance"
+    HTTPClient *http.Client
+}
+
+type derivedColumn struct {
+    Alias       string `json:"alias"`
+    Expression  string `json:"expression"`
+    Description string `json:"description"`
+}
+
+// The derived columns page-load.js's comments keep promising
+var bootstrapColumns = []derivedColumn{
+    {"window_pixels", "MUL($window_height, $window_width)", "How many pixels the browser window has"},
+    {"window_screen_ratio", "DIV(MUL($window_height, $window_width), MUL($screen_height, $screen_width))", "How much of the screen the window takes up"},
+    {"is_slow_page_load", "GT($timing_total_duration_ms, 3000)", "Page load took over 3 seconds"},
+    {"is_error", `EQUALS($type, "error")`, "The event is a browser error"},
+}
+
+type bootstrapQuery struct {
+    caption string
+    dataset string
+    spec    map[string]interface{}
+}
+
+func (b *Bootstrap) Run(ctx context.Context, h *UserEventsHandler) error {
+    for _, dataset := range h.Datasets.all() {
+        if err := b.ensureColumns(ctx, dataset); err != nil {
+            return fmt.Errorf("derived columns on %s: %v", dataset, err)
+        }
+    }
+
+    pageLoads := h.Datasets.datasetFor("page-load")
+    errorsDataset := h.Datasets.datasetFor(errorEventType)
+    return b.ensureBoard(ctx, []bootstrapQuery{
+        {"Page load latency", pageLoads, map[string]interface{}{
+            "calculations": []map[string]string{{"op": "HEATMAP", "column": "timing_total_duration_ms"}, {"op": "P95", "column": "timing_total_duration_ms"}},
+            "filters":      []map[string]string{{"column": "type", "op": "=", "value": "page-load"}},
+            "time_range":   86400,
+        }},
+        {"Errors by release", errorsDataset, map[string]interface{}{
+            "calculations": []map[string]string{{"op": "COUNT"}},
+            "breakdowns":   []string{"app_version"},
+            "time_range":   86400,
+        }},
+        {"Slowest routes", pageLoads, map[string]interface{}{
+            "calculations": []map[string]string{{"op": "P95", "column": "timing_total_duration_ms"}},
+            "filters":      []map[string]string{{"column": "type", "op": "=", "value": "page-load"}},
+            "breakdowns":   []string{"url_route"},
+            "orders":       []map[string]string{{"op": "P95", "column": "timing_total_duration_ms", "order": "descending"}},
+            "limit":        10,
+            "time_range":   86400,
+        }},
+    })
+}
+
+func (b *Bootstrap) ensureColumns(ctx context.Context, dataset string) error {
+    base := "/1/derived_columns/" + url.PathEscape(dataset)
+    var existing []derivedColumn
+    if err := b.call(ctx, http.MethodGet, base, nil, &existing); err != nil {
+        return err
+    }
+    have := make(map[string]bool, len(existing))
+    for _, column := range existing {
+        have[column.Alias] = true
+    }
+    for _, column := range bootstrapColumns {
+        if have[column.Alias] {
+            continue
+        }
+        if err := b.call(ctx, http.MethodPost, base, column, nil); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func (b *Bootstrap) ensureBoard(ctx context.Context, queries []bootstrapQuery) error {
+    name := b.BoardName
+    if name == "" {
+        name = "Browser performance"
+    }
+    var boards []struct {
+        Name string `json:"name"`
+    }
+    if err := b.call(ctx, http.MethodGet, "/1/boards", nil, &boards); err != nil {
+        return err
+    }
+    for _, board := range boards {
+        if board.Name == name {
+            return nil
+        }
+    }
+
+    // Boards refer to saved queries by ID, so create those first
+    var boardQueries []map[string]string
+    for _, q := range queries {
+        var created struct {
+            ID string `json:"id"`
+        }
+        if err := b.call(ctx, http.MethodPost, "/1/queries/"+url.PathEscape(q.dataset), q.spec, &created); err != nil {
+            return fmt.Errorf("query %q: %v", q.caption, err)
+        }
+        boardQueries = append(boardQueries, map[string]string{
+            "caption":     q.caption,
+            "dataset":     q.dataset,
+            "query_id":    created.ID,
+            "query_style": "graph",
+        })
+    }
+    return b.call(ctx, http.MethodPost, "/1/boards", map[string]interface{}{
+        "name":          name,
+        "description":   "Created by the user events handler's Bootstrap",
+        "column_layout": "multi",
+        "queries":       boardQueries,
+    }, nil)
+}
+
+func (b *Bootstrap) call(ctx context.Context, method, path string, body, out interface{}) error {
+    return honeycombAPI(ctx, b.HTTPClient, b.APIHost, b.APIKey, method, path, body, out)
+}
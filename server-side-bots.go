@@ -0,0 +1,94 @@
+// Our page-load dashboards were polluted by Pingdom checks, Googlebot, and
+// headless browsers. BotFilter classifies each event, adding `is_bot` and
+// `bot_reason` fields, and can also drop or down-sample bot traffic before it
+// uses up our quota.
+type BotFilter struct {
+    // Matched against the User-Agent header. Defaults to defaultBotUserAgents.
+    UserAgents *regexp.Regexp
+
+    // Known crawler and uptime-checker IP ranges
+    IPRanges []*net.IPNet
+
+    Action     BotAction
+    SampleRate uint // For BotSample: keep 1 in SampleRate bot events
+}
+
+type BotAction int
+
+const (
+    BotTag    BotAction = iota // Send bot events, just tagged with is_bot
+    BotSample                  // Send 1 in SampleRate bot events
+    BotDrop                    // Don't send bot events at all
+)
+
+var defaultBotUserAgents = regexp.MustCompile(`(?i)bot|crawl|spider|slurp|pingdom|uptime|monitor|headless|phantomjs|selenium|lighthouse|pagespeed|curl|wget|python-requests|go-http-client`)
+
+// Nobody's page load takes longer than this, so anything claiming it did is
+// made up (or a tab suspended mid-load, which is just as useless to us)
+const maxPlausiblePageLoadMs = 10 * 60 * 1000
+
+// Classify returns why we think this event came from a bot, or "" if it looks
+// like a real person.
+func (b *BotFilter) Classify(r *http.Request, metadata map[string]interface{}, user *UserInfo) string {
+    userAgents := b.UserAgents
+    if userAgents == nil {
+        userAgents = defaultBotUserAgents
+    }
+    if ua := r.UserAgent(); ua == "" {
+        return "missing_user_agent"
+    } else if userAgents.MatchString(ua) {
+        return "user_agent"
+    }
+
+    if ip := clientIP(r); ip != nil {
+        for _, ipRange := range b.IPRanges {
+            if ipRange.Contains(ip) {
+                return "ip_range"
+            }
+        }
+    }
+
+    // Real browsers on our site always have at least the session cookie by
+    // the time they're sending events
+    if user == nil && len(r.Cookies()) == 0 {
+        return "no_cookies"
+    }
+
+    if total, ok := metadata["timing_total_duration_ms"].(float64); ok && (total < 0 || total > maxPlausiblePageLoadMs) {
+        return "impossible_timing"
+    }
+    width, _ := metadata["window_width"].(float64)
+    height, _ := metadata["window_height"].(float64)
+    if _, ok := metadata["window_width"]; ok && width == 0 && height == 0 {
+        return "zero_window"
+    }
+    return ""
+}
+
+// Decides whether to keep a bot event, and if so what to multiply its sample
+// rate by
+func (b *BotFilter) sample() (keep bool, rate uint) {
+    switch b.Action {
+    case BotDrop:
+        return false, 0
+    case BotSample:
+        if b.SampleRate > 1 {
+            return rand.Intn(int(b.SampleRate)) == 0, b.SampleRate
+        }
+    }
+    return true, 1
+}
+
+// ParseCIDRs is a convenience for building IPRanges from config, e.g. the
+// published ranges for uptime checkers.
+func ParseCIDRs(cidrs ...string) ([]*net.IPNet, error) {
+    ranges := make([]*net.IPNet, 0, len(cidrs))
+    for _, cidr := range cidrs {
+        _, ipRange, err := net.ParseCIDR(cidr)
+        if err != nil {
+            return nil, err
+        }
+        ranges = append(ranges, ipRange)
+    }
+    return ranges, nil
+}
@@ -0,0 +1,217 @@
+// When Honeycomb is having a bad time, every send we make fails slowly, and
+// libhoney's queues (and our worker pool behind them) fill up until we run out
+// of memory. CircuitBreaker watches the responses for each client, and once
+// too many of them in a row are errors or 429s, "opens": for the next Cooldown
+// we don't even try to send with that client. Events go straight to the dead
+// letter spool instead (or are dropped, if there isn't one), to be retried
+// once it's back.
+//
+// After the cooldown we let a single probe event through. If it lands the
+// circuit closes again; if not, it stays open for another cooldown.
+//
+//     handler.Breaker = &CircuitBreaker{}
+//     go handler.WatchResponses(ctx) // The breaker only learns from responses
+type CircuitBreaker struct {
+    // Open once at least MinResponses responses in a Window have come back,
+    // and at least FailureRatio of them failed. Default to 20, 30s, and 0.5.
+    MinResponses int
+    Window       time.Duration
+    FailureRatio float64
+
+    Cooldown time.Duration // How long to stay open before probing; defaults to 30s
+
+    // OnStateChange, if set, is called (from the response watcher) whenever a
+    // client's circuit opens or closes, e.g. to page someone
+    OnStateChange func(client string, from, to BreakerState)
+
+    mu       sync.Mutex
+    circuits map[string]*circuit
+    log      *slog.Logger // The handler's, once it's given us a response
+}
+
+type BreakerState int
+
+const (
+    BreakerClosed BreakerState = iota
+    BreakerHalfOpen
+    BreakerOpen
+)
+
+func (s BreakerState) String() string {
+    switch s {
+    case BreakerHalfOpen:
+        return "half-open"
+    case BreakerOpen:
+        return "open"
+    }
+    return "closed"
+}
+
+// ErrCircuitOpen is what a Sink returns for events it won't send because the
+// circuit is open and there's nowhere to spool them
+var ErrCircuitOpen = errors.New("circuit open: Honeycomb is failing, not sending")
+
+var breakerState = promauto.NewGaugeVec(prometheus.GaugeOpts{
+    Name: "user_events_circuit_state",
+    Help: "State of each Honeycomb client's circuit breaker: 0 closed, 1 half-open, 2 open.",
+}, []string{"client"})
+
+type circuit struct {
+    state       BreakerState
+    windowStart time.Time
+    responses   int
+    failures    int
+    openedAt    time.Time
+    probeSent   time.Time // Zero unless a probe is out
+}
+
+func (b *CircuitBreaker) circuitFor(client string) *circuit {
+    if b.circuits == nil {
+        b.circuits = make(map[string]*circuit)
+    }
+    c, ok := b.circuits[client]
+    if !ok {
+        c = &circuit{windowStart: time.Now()}
+        b.circuits[client] = c
+    }
+    return c
+}
+
+// Allow says whether we should try sending with client right now
+func (b *CircuitBreaker) Allow(client string) bool {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    c := b.circuitFor(client)
+    switch c.state {
+    case BreakerOpen:
+        if time.Since(c.openedAt) < b.cooldown() {
+            return false
+        }
+        b.transition(client, c, BreakerHalfOpen)
+        fallthrough
+    case BreakerHalfOpen:
+        // One probe at a time, unless the last one never came back
+        if !c.probeSent.IsZero() && time.Since(c.probeSent) < b.cooldown() {
+            return false
+        }
+        c.probeSent = time.Now()
+        return true
+    }
+    return true
+}
+
+// record counts a response from client, logging any change of state to log.
+// Anything that isn't worth retrying
+// (including a 400 for a bad event) means Honeycomb is up, so counts as a
+// success here.
+func (b *CircuitBreaker) record(log *slog.Logger, client string, resp transmission.Response) {
+    failed := retryable(resp)
+
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    b.log = log
+    c := b.circuitFor(client)
+    now := time.Now()
+
+    switch c.state {
+    case BreakerHalfOpen:
+        c.probeSent = time.Time{}
+        if failed {
+            c.openedAt = now
+            b.transition(client, c, BreakerOpen)
+        } else {
+            b.transition(client, c, BreakerClosed)
+        }
+        return
+    case BreakerOpen:
+        return // Stragglers sent before we opened
+    }
+
+    if now.Sub(c.windowStart) > b.window() {
+        c.windowStart, c.responses, c.failures = now, 0, 0
+    }
+    c.responses++
+    if failed {
+        c.failures++
+    }
+    if c.responses >= b.minResponses() && float64(c.failures)/float64(c.responses) >= b.failureRatio() {
+        c.openedAt = now
+        b.transition(client, c, BreakerOpen)
+    }
+}
+
+// Called with b.mu held
+func (b *CircuitBreaker) transition(client string, c *circuit, to BreakerState) {
+    from := c.state
+    c.state = to
+    if to == BreakerClosed {
+        c.windowStart, c.responses, c.failures = time.Now(), 0, 0
+    }
+    breakerState.WithLabelValues(client).Set(float64(to))
+    if from == to {
+        return
+    }
+    b.logger().Warn("circuit breaker changed state", "client", client, "from", from.String(), "to", to.String())
+    if b.OnStateChange != nil && to != BreakerHalfOpen {
+        go b.OnStateChange(client, from, to)
+    }
+}
+
+func (b *CircuitBreaker) logger() *slog.Logger {
+    if b.log != nil {
+        return b.log
+    }
+    return slog.Default()
+}
+
+// State is the current state of client's circuit, e.g. for health checks
+func (b *CircuitBreaker) State(client string) BreakerState {
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    return b.circuitFor(client).state
+}
+
+func (b *CircuitBreaker) minResponses() int {
+    if b.MinResponses > 0 {
+        return b.MinResponses
+    }
+    return 20
+}
+
+func (b *CircuitBreaker) window() time.Duration {
+    if b.Window > 0 {
+        return b.Window
+    }
+    return 30 * time.Second
+}
+
+func (b *CircuitBreaker) failureRatio() float64 {
+    if b.FailureRatio > 0 {
+        return b.FailureRatio
+    }
+    return 0.5
+}
+
+func (b *CircuitBreaker) cooldown() time.Duration {
+    if b.Cooldown > 0 {
+        return b.Cooldown
+    }
+    return 30 * time.Second
+}
+
+// What honeycombSink does with an event instead of sending it while the
+// circuit's open
+func (h *UserEventsHandler) shortCircuit(ev Event) error {
+    if h.DeadLetters == nil {
+        return ErrCircuitOpen
+    }
+    return h.DeadLetters.spool(h).Put(&SpooledEvent{
+        Client:      ev.Client,
+        Dataset:     ev.Dataset,
+        Timestamp:   ev.Timestamp,
+        SampleRate:  ev.SampleRate,
+        Fields:      ev.Fields(),
+        LastError:   ErrCircuitOpen.Error(),
+        NextAttempt: time.Now().Add(h.Breaker.cooldown()),
+    })
+}
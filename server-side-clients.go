@@ -0,0 +1,220 @@
+// We used to have one libhoney client, and which Honeycomb it sent to (our
+// production cluster, or the internal Dogfood cluster when running in
+// Production) was decided by build config. ClientRouter makes that explicit:
+// it holds a libhoney client per named Honeycomb environment (e.g. "prod",
+// "dogfood", "eu"), each with its own API key and host, and picks one per
+// event. The first match wins:
+//
+//  1. the event's dataset's entry in ByDataset, which nothing overrides, so
+//     a dataset's events stay in one region
+//  2. the event's Field (e.g. "honeycomb_env"), if set and a known name
+//  3. the request's Header (e.g. "X-Honeycomb-Env"), if set and a known name
+//  4. the event type's entry in ByType
+//  5. Default
+//
+// Only names in Clients are ever honored, so a browser can't send events
+// anywhere we haven't configured.
+type ClientRouter struct {
+    Clients   map[string]*libhoney.Client
+    Default   string
+    ByType    map[string]string // Event type -> client name
+    ByDataset map[string]string // Dataset -> client name
+    Header    string
+    Field     string
+
+    // Regions has the Honeycomb region each client sends to, for
+    // DatasetsByRegion; NewClientRouter fills it in. Clients without one
+    // count as "us".
+    Regions map[string]string // Client name -> region
+}
+
+// The name the handler's own Libhoney client goes by, e.g. in spooled events
+const defaultClientName = "default"
+
+func (c *ClientRouter) route(eventType, dataset string, metadata map[string]interface{}, r *http.Request) string {
+    if name, ok := c.ByDataset[dataset]; ok && c.Clients[name] != nil {
+        return name
+    }
+    if c.Field != "" {
+        if name, ok := metadata[c.Field].(string); ok && c.Clients[name] != nil {
+            return name
+        }
+    }
+    if c.Header != "" && r != nil {
+        if name := r.Header.Get(c.Header); c.Clients[name] != nil {
+            return name
+        }
+    }
+    if name, ok := c.ByType[eventType]; ok && c.Clients[name] != nil {
+        return name
+    }
+    return c.Default
+}
+
+// Picks the client for an event, returning its name too so we can find the
+// same client again if the event needs retrying. r may be nil for events we
+// synthesize ourselves.
+func (h *UserEventsHandler) clientFor(eventType, dataset string, metadata map[string]interface{}, r *http.Request) (string, *libhoney.Client) {
+    h.clientsMu.RLock()
+    defer h.clientsMu.RUnlock()
+    if h.Clients != nil {
+        name := h.Clients.route(eventType, dataset, metadata, r)
+        if client := h.Clients.Clients[name]; client != nil {
+            return name, client
+        }
+    }
+    return defaultClientName, h.Libhoney
+}
+
+// Finds the client an event was routed to, and marks it in use by the send
+// until the returned func is called, so a client being replaced isn't
+// closed under it. It's marked while clientsMu is still held, so
+// replaceClient can't swap it out in between.
+func (h *UserEventsHandler) useClient(name string) (*libhoney.Client, func()) {
+    h.clientsMu.RLock()
+    defer h.clientsMu.RUnlock()
+    client := h.Tenants.clientNamed(name)
+    if client == nil && h.Clients != nil {
+        client = h.Clients.Clients[name]
+    }
+    if client == nil {
+        client = h.Libhoney
+    }
+    h.clientUses.add(client)
+    return client, func() { h.clientUses.done(client) }
+}
+
+// Every client we might send to, by name
+func (h *UserEventsHandler) allClients() map[string]*libhoney.Client {
+    h.clientsMu.RLock()
+    defer h.clientsMu.RUnlock()
+    all := map[string]*libhoney.Client{}
+    if h.Libhoney != nil {
+        all[defaultClientName] = h.Libhoney
+    }
+    if h.Clients != nil {
+        for name, client := range h.Clients.Clients {
+            all[name] = client
+        }
+    }
+    if h.Tenants != nil {
+        for _, tenant := range h.Tenants.Tenants {
+            if tenant.Client != nil {
+                all[tenant.clientName()] = tenant.Client
+            }
+        }
+    }
+    return all
+}
+
+// How many sends are using each client. Each client is counted on its own,
+// so waiting out a replaced client's sends doesn't hold up anyone else's.
+type clientUses struct {
+    mu      sync.Mutex
+    counts  map[*libhoney.Client]int
+    drained map[*libhoney.Client]chan struct{} // For retired clients; closed once their count gets to 0
+}
+
+func (u *clientUses) add(client *libhoney.Client) {
+    if client == nil {
+        return
+    }
+    u.mu.Lock()
+    defer u.mu.Unlock()
+    if u.counts == nil {
+        u.counts = make(map[*libhoney.Client]int)
+    }
+    u.counts[client]++
+}
+
+func (u *clientUses) done(client *libhoney.Client) {
+    if client == nil {
+        return
+    }
+    u.mu.Lock()
+    defer u.mu.Unlock()
+    u.counts[client]--
+    if u.counts[client] > 0 {
+        return
+    }
+    delete(u.counts, client)
+    if drained, ok := u.drained[client]; ok {
+        close(drained)
+        delete(u.drained, client)
+    }
+}
+
+// Closed once nothing's using client, which mustn't be handed out any more
+func (u *clientUses) drain(client *libhoney.Client) <-chan struct{} {
+    u.mu.Lock()
+    defer u.mu.Unlock()
+    drained := make(chan struct{})
+    if u.counts[client] == 0 {
+        close(drained)
+        return drained
+    }
+    if u.drained == nil {
+        u.drained = make(map[*libhoney.Client]chan struct{})
+    }
+    u.drained[client] = drained
+    return drained
+}
+
+// How long a replaced client waits for the sends still using it before we
+// warn about them
+const clientDrainTimeout = 10 * time.Second
+
+// Closes a client that's been replaced, once the sends that picked it up
+// before the swap are done with it. New sends get the new client, and don't
+// wait on this. Closing flushes what it already had queued.
+func (h *UserEventsHandler) retireClient(name string, old *libhoney.Client) {
+    drained := h.clientUses.drain(old)
+    select {
+    case <-drained:
+    case <-time.After(clientDrainTimeout):
+        h.logger().Warn("replaced Honeycomb client still has sends using it after drain timeout; waiting for them", "client", name)
+        <-drained
+    }
+    old.Close()
+}
+
+// SwapClients replaces every libhoney client the handler has (its own, each
+// ClientRouter environment's, and each tenant's) with what swap returns for
+// it, by the name events record it under, e.g. for honeytest's Recorder.
+// swap is called for the handler's own client even if it has none, with a
+// nil old client. The clients replaced aren't closed.
+func (h *UserEventsHandler) SwapClients(swap func(name string, old *libhoney.Client) *libhoney.Client) {
+    h.clientsMu.Lock()
+    defer h.clientsMu.Unlock()
+    h.Libhoney = swap(defaultClientName, h.Libhoney)
+    if h.Clients != nil {
+        for name, client := range h.Clients.Clients {
+            h.Clients.Clients[name] = swap(name, client)
+        }
+    }
+    if h.Tenants != nil {
+        for _, tenant := range h.Tenants.Tenants {
+            if tenant.Client != nil {
+                tenant.Client = swap(tenant.clientName(), tenant.Client)
+            }
+        }
+    }
+}
+
+// Swaps in a new client under an existing name (e.g. after a key rotation),
+// returning the one it replaced
+func (h *UserEventsHandler) replaceClient(name string, client *libhoney.Client) (*libhoney.Client, error) {
+    h.clientsMu.Lock()
+    defer h.clientsMu.Unlock()
+    if name == defaultClientName {
+        old := h.Libhoney
+        h.Libhoney = client
+        return old, nil
+    }
+    if h.Clients == nil || h.Clients.Clients[name] == nil {
+        return nil, fmt.Errorf("no Honeycomb client named %q", name)
+    }
+    old := h.Clients.Clients[name]
+    h.Clients.Clients[name] = client
+    return old, nil
+}
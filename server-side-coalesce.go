@@ -0,0 +1,146 @@
+// A rage-click is twenty identical click events in three seconds, and a
+// scroll handler without a debounce sends hundreds; each one costs the same
+// to send and store as an event that tells us something. Coalescer folds a
+// run of identical consecutive events from one session into the run's first
+// event, sent once the run is over with a repeat_count (and
+// repeat_duration_ms, from the first to the last):
+//
+//     handler.Coalesce = &Coalescer{Types: map[string][]string{
+//         "click":  {"target_selector", "page_path"},
+//         "scroll": {"page_path"},
+//     }}
+//     go handler.Coalesce.Run(ctx, handler)
+//
+// Events are identical if they're the same type with the same values for its
+// fields in Types (with none listed, any two events of the type are). A run
+// ends when the session sends anything else, or nothing at all for Window,
+// or after MaxRepeats. Unlike Aggregator, this keeps the first event as it
+// was, so a coalesced click still has everything a click has; SUM(repeat_count)
+// is the number the browser sent. Runs are per instance, and the held events
+// are sent by Run (or by Close, at shutdown).
+type Coalescer struct {
+    Types      map[string][]string
+    Window     time.Duration // Defaults to 2 seconds
+    MaxRepeats int           // Defaults to 1000
+
+    mu   sync.Mutex
+    runs map[string]*coalescedRun // By session
+}
+
+type coalescedRun struct {
+    job         *eventJob // The first event's
+    key         string
+    count       int
+    first, last time.Time
+}
+
+type coalesceResult int
+
+const (
+    coalesceNone   coalesceResult = iota // Not one we coalesce, so send it now
+    coalesceHeld                         // The start of a run, held until the run's over
+    coalesceRepeat                       // Counted in its run's first event
+)
+
+func (c *Coalescer) window() time.Duration {
+    if c.Window > 0 {
+        return c.Window
+    }
+    return 2 * time.Second
+}
+
+func (c *Coalescer) maxRepeats() int {
+    if c.MaxRepeats > 0 {
+        return c.MaxRepeats
+    }
+    return 1000
+}
+
+// Decides what becomes of job, sending the run it ends, if it ends one
+func (c *Coalescer) absorb(h *UserEventsHandler, job *eventJob) coalesceResult {
+    session := idString(firstPresent(job.metadata, "session_id", "page_load_id"))
+    if session == "" {
+        return coalesceNone
+    }
+    fields, coalesced := c.Types[job.eventType]
+    var key string
+    if coalesced {
+        key = sampleKey(job.eventType, fields, job.metadata)
+    }
+
+    c.mu.Lock()
+    run := c.runs[session]
+    if run != nil && coalesced && run.key == key && job.receivedAt.Sub(run.last) < c.window() && run.count < c.maxRepeats() {
+        run.count++
+        run.last = job.receivedAt
+        c.mu.Unlock()
+        return coalesceRepeat
+    }
+    ended := run
+    delete(c.runs, session)
+    if coalesced {
+        if c.runs == nil {
+            c.runs = make(map[string]*coalescedRun)
+        }
+        c.runs[session] = &coalescedRun{job: job, key: key, count: 1, first: job.receivedAt, last: job.receivedAt}
+    }
+    c.mu.Unlock()
+
+    if ended != nil {
+        c.send(h, ended)
+    }
+    if coalesced {
+        return coalesceHeld
+    }
+    return coalesceNone
+}
+
+// Run sends runs that have gone quiet for Window, until ctx is done or the
+// handler's closing.
+func (c *Coalescer) Run(ctx context.Context, h *UserEventsHandler) {
+    ticker := time.NewTicker(c.window() / 2)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case now := <-ticker.C:
+            if !h.beginSend() {
+                return // Close sends the rest
+            }
+            c.flush(h, now)
+            h.inflight.Done()
+        }
+    }
+}
+
+// Sends every run that's been quiet for Window as of now, or every run at all
+// for a zero now
+func (c *Coalescer) flush(h *UserEventsHandler, now time.Time) {
+    c.mu.Lock()
+    var done []*coalescedRun
+    for session, run := range c.runs {
+        if now.IsZero() || now.Sub(run.last) >= c.window() {
+            done = append(done, run)
+            delete(c.runs, session)
+        }
+    }
+    c.mu.Unlock()
+
+    for _, run := range done {
+        c.send(h, run)
+    }
+}
+
+func (c *Coalescer) send(h *UserEventsHandler, run *coalescedRun) {
+    run.job.metadata["repeat_count"] = run.count
+    if run.count > 1 {
+        run.job.metadata["repeat_duration_ms"] = run.last.Sub(run.first).Milliseconds()
+    }
+    // Not the context of whichever request ended the run: this isn't its event
+    ctx, cancel := context.WithTimeout(context.Background(), queueSendTimeout)
+    defer cancel()
+    if _, err := h.dispatch(ctx, run.job); err != nil {
+        h.logger().Warn("couldn't send coalesced event", "type", run.job.eventType, "repeat_count", run.count, "error", err)
+    }
+}
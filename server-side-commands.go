@@ -0,0 +1,34 @@
+// The handler's binary doubles as its operational tools, so they're always
+// built against the same config, spool, and encryption formats as the
+// handler itself:
+//
+//     user-events replay -writekey $HONEYCOMB_WRITEKEY /var/spool/user-events
+//     user-events decrypt -keys "2024-01=$KEY_B64" export.jsonl
+//     user-events datasets -configkey $HONEYCOMB_CONFIG_KEY -config user-events.yaml
+//     user-events pseudonym -config user-events.yaml -field user_id 42
+//
+// main hands them its arguments before it starts serving:
+//
+//     if len(os.Args) > 1 && RunCommand(os.Args[1:]) {
+//         return
+//     }
+var commands = map[string]func(args []string){
+    "replay":    replayCommand,
+    "decrypt":   decryptCommand,
+    "datasets":  datasetsCommand,
+    "pseudonym": pseudonymCommand,
+}
+
+// RunCommand runs the tool args[0] names with the rest of args, and says
+// whether there was one. A tool that fails exits the process.
+func RunCommand(args []string) bool {
+    if len(args) == 0 {
+        return false
+    }
+    command, ok := commands[args[0]]
+    if !ok {
+        return false
+    }
+    command(args[1:])
+    return true
+}
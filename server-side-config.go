@@ -0,0 +1,722 @@
+// Config is everything about the handler you'd want to change without a code
+// change, loaded from a YAML file. Values can refer to environment variables
+// (`${HONEYCOMB_API_KEY}`), and a few can be overridden by env vars directly,
+// which is handy in Kubernetes:
+//
+//     USER_EVENTS_DEFAULT_DATASET  overrides datasets.default
+//     USER_EVENTS_SAMPLE_RATE      overrides sampling.default
+//
+// An example file:
+//
+//     datasets:
+//       default: user-events
+//       by_type: {page-error: browser-errors}
+//       settings: {"*": {expand_json_depth: 2}}
+//     sampling:
+//       default: 1
+//       by_type: {page-load: 10}
+//       dynamic: {goal_rate: 20, fields: [url_path], types: [click]}
+//     scrubbing:
+//       hash_salt: ${SCRUB_SALT}
+//       rules:
+//         - {field: user_email, action: hash}
+//         - {field: "*_token", action: drop}
+//     rate_limit: {per_second: 10, burst: 50}
+//     sinks:
+//       - {type: honeycomb}
+//       - {type: kafka, brokers: [kafka-1:9092], topic: user-events, sample_rate: 10}
+//       - {type: parquet, url: "s3://browser-events?region=us-east-1", prefix: user-events/}
+//     derived_fields:
+//       - {name: is_slow, expression: "event.page_load_time_ms > 3000"}
+//     encryption: {fields: [user_email], key_id: "2024-01", key: ${FIELD_ENCRYPTION_KEY}}
+//     pseudonyms: {kind: hmac, key: ${PSEUDONYM_KEY}}
+//     default_triggers: true
+//     triggers:
+//       - {name: Slow LCP, calculation: P75(lcp), filters: ["type = page-load"], threshold: "> 4000", window: 10m}
+//     burn_alerts:
+//       - {slo: Page loads under 3s, exhaustion: 4h, recipients: [{type: pagerduty, target: frontend}]}
+//     dry_run: {types: [page-error], path: /tmp/dry-run.jsonl}
+//     transforms:
+//       page-load:
+//         - {rename: pageLoadTime, to: page_load_ms}
+//     flattening: {max_depth: 3, arrays: aggregate}
+//     honeycomb:
+//       default: us
+//       clients:
+//         us: {region: us, api_key: ${HONEYCOMB_API_KEY}}
+//         eu: {region: eu, api_key: ${HONEYCOMB_EU_API_KEY}}
+//       by_dataset: {eu-user-events: eu}
+//     tenants:
+//       - {name: checkout, tokens: [${CHECKOUT_INGEST_TOKEN}], dataset_prefix: checkout-, events_per_minute: 20000}
+//       - {name: checkout-eu, tokens: [${CHECKOUT_EU_INGEST_TOKEN}], dataset_prefix: checkout-, region: eu,
+//          endpoint: {region: eu, api_key: ${CHECKOUT_EU_API_KEY}}}
+//     late_events: {max_age: 1h, action: retimestamp}
+//     self_tracing: {dataset: user-events-ops, sample_rate: 100}
+//     retention: {fields: {page_url: ephemeral, lcp: long-term}, long_term_dataset: user-events-archive}
+//     delivery_timing: {dataset: user-events-ops, sample_rate: 100}
+//     load_shedding: {max_heap_bytes: 2147483648, max_goroutines: 20000}
+type Config struct {
+    Datasets  DatasetsConfig   `yaml:"datasets"`
+    Sampling  SamplingConfig   `yaml:"sampling"`
+    Scrubbing ScrubbingConfig  `yaml:"scrubbing"`
+    RateLimit *RateLimitConfig `yaml:"rate_limit"`
+    Sinks     []SinkConfig     `yaml:"sinks"` // Defaults to just Honeycomb
+
+    // Traffic adds traffic source fields (see TrafficSourceEnricher) if set
+    Traffic *TrafficSourceEnricher `yaml:"traffic"`
+
+    // URLRoutes are route templates for URLNormalizer, which is only added if
+    // there are some
+    URLRoutes []string `yaml:"url_routes"`
+
+    // DerivedFields are computed from each event's other fields; see
+    // DerivedFields
+    DerivedFields []DerivedField `yaml:"derived_fields"`
+
+    // Encryption, if set, encrypts the listed fields; see FieldEncryptor
+    Encryption *EncryptionConfig `yaml:"encryption"`
+
+    // Pseudonyms, if set, replaces user IDs and emails with pseudonyms; see
+    // Pseudonymizer
+    Pseudonyms *PseudonymsConfig `yaml:"pseudonyms"`
+
+    // Triggers, and BurnAlerts on existing SLOs, are synced to Honeycomb by
+    // SyncTriggers; DefaultTriggers adds DefaultTriggers to them
+    Triggers        []TriggerSpec   `yaml:"triggers"`
+    DefaultTriggers bool            `yaml:"default_triggers"`
+    BurnAlerts      []BurnAlertSpec `yaml:"burn_alerts"`
+
+    // DryRun, if set, stops the listed event types (or all of them) being
+    // sent; see DryRun
+    DryRun *DryRunConfig `yaml:"dry_run"`
+
+    // Transforms, by event type ("*" for all); see Transforms
+    Transforms map[string][]Transform `yaml:"transforms"`
+
+    // Flattening, if set, flattens nested fields as they arrive; see
+    // Flattener
+    Flattening *FlatteningConfig `yaml:"flattening"`
+
+    // Honeycomb, if set, starts a client per endpoint and routes between
+    // them; see ClientRouter and HoneycombEndpoint
+    Honeycomb *HoneycombConfig `yaml:"honeycomb"`
+
+    // LateEvents, if set, handles events that arrive after their max age;
+    // see LateEvents
+    LateEvents *LateEvents `yaml:"late_events"`
+
+    // SelfTracing, if set, traces requests through TracePipeline; see
+    // SelfTracing
+    SelfTracing *SelfTracing `yaml:"self_tracing"`
+
+    // Retention, if set, splits events up by their fields' retention
+    // classes; see RetentionPolicy
+    Retention *RetentionPolicy `yaml:"retention"`
+
+    // DeliveryTiming, if set, adds delivery.* latency fields; see
+    // DeliveryTiming
+    DeliveryTiming *DeliveryTiming `yaml:"delivery_timing"`
+
+    // LoadShedding, if set, sheds low-priority events under memory, queue,
+    // or goroutine pressure; see LoadShedder. Its Run still has to be
+    // started.
+    LoadShedding *LoadShedder `yaml:"load_shedding"`
+
+    // Tenants, if there are any, are who requests can belong to; see
+    // TenantRegistry
+    Tenants []TenantConfig `yaml:"tenants"`
+}
+
+type TenantConfig struct {
+    Name            string             `yaml:"name"`
+    Tokens          []string           `yaml:"tokens"`
+    Hosts           []string           `yaml:"hosts"`
+    DatasetPrefix   string             `yaml:"dataset_prefix"`
+    EventsPerMinute int64              `yaml:"events_per_minute"`
+    Region          string             `yaml:"region"`
+    Endpoint        *HoneycombEndpoint `yaml:"endpoint"`
+}
+
+type DatasetsConfig struct {
+    Default  string                     `yaml:"default"`
+    ByType   map[string]string          `yaml:"by_type"`
+    Settings map[string]DatasetSettings `yaml:"settings"` // Applied by SyncDatasets; see DatasetSync
+}
+
+type SamplingConfig struct {
+    Default uint            `yaml:"default"`
+    ByType  map[string]uint `yaml:"by_type"`
+
+    // Dynamic samples the listed Types with a DynamicSampler instead
+    Dynamic *struct {
+        GoalRate int      `yaml:"goal_rate"`
+        Fields   []string `yaml:"fields"`
+        Types    []string `yaml:"types"`
+    } `yaml:"dynamic"`
+}
+
+type ScrubbingConfig struct {
+    HashSalt string `yaml:"hash_salt"`
+    Rules    []struct {
+        Field  string `yaml:"field"`
+        Action string `yaml:"action"` // allow, drop, hash, or strip_query
+    } `yaml:"rules"`
+}
+
+type RateLimitConfig struct {
+    PerSecond float64 `yaml:"per_second"`
+    Burst     int     `yaml:"burst"`
+}
+
+type EncryptionConfig struct {
+    Fields        []string `yaml:"fields"`
+    KeyID         string   `yaml:"key_id"`
+    Key           string   `yaml:"key"` // Base64
+    Deterministic bool     `yaml:"deterministic"`
+}
+
+type PseudonymsConfig struct {
+    Kind       string   `yaml:"kind"`   // "pass-through", "hmac", or "vault"
+    Fields     []string `yaml:"fields"` // Defaults to user_id and user_email
+    Key        string   `yaml:"key"`    // Base64, for hmac
+    Prefix     string   `yaml:"prefix"` // For hmac
+    VaultURL   string   `yaml:"vault_url"`
+    VaultToken string   `yaml:"vault_token"`
+}
+
+// Pseudonymizer builds the Pseudonymizer the config describes.
+func (c *PseudonymsConfig) Pseudonymizer() (Pseudonymizer, error) {
+    switch c.Kind {
+    case "pass-through":
+        return PassThroughPseudonymizer{}, nil
+    case "hmac":
+        key, err := base64.StdEncoding.DecodeString(c.Key)
+        if err != nil {
+            return nil, fmt.Errorf("pseudonyms.key: %v", err)
+        }
+        if len(key) < 16 {
+            return nil, errors.New("pseudonyms.key must be at least 16 bytes")
+        }
+        return &HMACPseudonymizer{Key: key, Prefix: c.Prefix}, nil
+    case "vault":
+        if c.VaultURL == "" {
+            return nil, errors.New("pseudonyms.vault_url is required for a vault")
+        }
+        return &TokenVault{URL: c.VaultURL, Token: c.VaultToken}, nil
+    }
+    return nil, fmt.Errorf("pseudonyms.kind %q isn't pass-through, hmac, or vault", c.Kind)
+}
+
+type DryRunConfig struct {
+    All   bool     `yaml:"all"`
+    Types []string `yaml:"types"`
+    Path  string   `yaml:"path"` // Writes dry-run events here as JSON lines if set
+}
+
+type HoneycombConfig struct {
+    Clients   map[string]HoneycombEndpoint `yaml:"clients"`
+    Default   string                       `yaml:"default"`
+    ByType    map[string]string            `yaml:"by_type"`
+    ByDataset map[string]string            `yaml:"by_dataset"`
+    Header    string                       `yaml:"header"`
+    Field     string                       `yaml:"field"`
+}
+
+type FlatteningConfig struct {
+    MaxDepth      int      `yaml:"max_depth"`
+    Separator     string   `yaml:"separator"`
+    Arrays        string   `yaml:"arrays"` // json (the default), index, or aggregate
+    MaxArrayItems int      `yaml:"max_array_items"`
+    Skip          []string `yaml:"skip"`
+}
+
+type SinkConfig struct {
+    Type       string   `yaml:"type"` // honeycomb, stdout, file, kafka, or parquet
+    Path       string   `yaml:"path"` // For file
+    URL        string   `yaml:"url"`  // Bucket, for parquet
+    Prefix     string   `yaml:"prefix"`
+    Brokers    []string `yaml:"brokers"`
+    Topic      string   `yaml:"topic"`
+    SampleRate uint     `yaml:"sample_rate"`
+}
+
+var scrubActions = map[string]ScrubAction{
+    "allow":       ScrubAllow,
+    "drop":        ScrubDrop,
+    "hash":        ScrubHash,
+    "strip_query": ScrubStripQuery,
+}
+
+func LoadConfig(path string) (*Config, error) {
+    raw, err := ioutil.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+    var c Config
+    if err := yaml.Unmarshal([]byte(os.ExpandEnv(string(raw))), &c); err != nil {
+        return nil, fmt.Errorf("parsing %s: %v", path, err)
+    }
+
+    if dataset := os.Getenv("USER_EVENTS_DEFAULT_DATASET"); dataset != "" {
+        c.Datasets.Default = dataset
+    }
+    if rate := os.Getenv("USER_EVENTS_SAMPLE_RATE"); rate != "" {
+        n, err := strconv.ParseUint(rate, 10, 32)
+        if err != nil {
+            return nil, fmt.Errorf("USER_EVENTS_SAMPLE_RATE: %v", err)
+        }
+        c.Sampling.Default = uint(n)
+    }
+    return &c, nil
+}
+
+// TenantRegistry has the configured tenants, or is nil if there are none.
+// Their clients are started by ValidateEndpoints.
+func (c *Config) TenantRegistry() *TenantRegistry {
+    if len(c.Tenants) == 0 {
+        return nil
+    }
+    registry := &TenantRegistry{}
+    for _, t := range c.Tenants {
+        registry.Tenants = append(registry.Tenants, &Tenant{
+            Name:            t.Name,
+            Tokens:          t.Tokens,
+            Hosts:           t.Hosts,
+            DatasetPrefix:   t.DatasetPrefix,
+            EventsPerMinute: t.EventsPerMinute,
+            Region:          t.Region,
+            Endpoint:        t.Endpoint,
+        })
+    }
+    return registry
+}
+
+// Apply configures the handler. Call it before the handler starts serving;
+// once it has, only Reload is safe.
+func (c *Config) Apply(h *UserEventsHandler) error {
+    h.Datasets = DatasetRoutes{Default: c.Datasets.Default, ByType: c.Datasets.ByType}
+
+    if tenants := c.TenantRegistry(); tenants != nil {
+        h.Tenants = tenants
+    }
+    if c.Honeycomb != nil {
+        router, err := NewClientRouter(c.Honeycomb.Clients, c.Honeycomb.Default)
+        if err != nil {
+            return err
+        }
+        router.ByType = c.Honeycomb.ByType
+        router.ByDataset = c.Honeycomb.ByDataset
+        router.Header = c.Honeycomb.Header
+        router.Field = c.Honeycomb.Field
+        h.Clients = router
+    }
+    if err := h.ValidateEndpoints(); err != nil {
+        return err
+    }
+
+    sampler, err := c.Sampling.sampler()
+    if err != nil {
+        return err
+    }
+    reloadable := &ReloadableSampler{}
+    reloadable.Set(sampler)
+    h.Sampler = reloadable
+
+    scrubber, err := c.Scrubbing.scrubber()
+    if err != nil {
+        return err
+    }
+    h.Scrubber = scrubber
+
+    if c.RateLimit != nil {
+        h.RateLimiter = NewRateLimiter(c.RateLimit.PerSecond, c.RateLimit.Burst)
+    }
+
+    sink, err := c.sink(h)
+    if err != nil {
+        return err
+    }
+    h.Sink = sink
+
+    // Even with none configured, so Reload can add some later
+    transforms, err := NewTransforms(c.Transforms)
+    if err != nil {
+        return err
+    }
+    h.Transforms = transforms
+
+    if c.LateEvents != nil {
+        if err := c.LateEvents.validate(); err != nil {
+            return err
+        }
+        h.Late = c.LateEvents
+    }
+
+    if c.SelfTracing != nil {
+        h.SelfTrace = c.SelfTracing
+    }
+
+    if c.Retention != nil {
+        if err := c.Retention.validate(); err != nil {
+            return err
+        }
+        h.Retention = c.Retention
+    }
+
+    if c.DeliveryTiming != nil {
+        h.Delivery = c.DeliveryTiming
+    }
+
+    if c.LoadShedding != nil {
+        if err := c.LoadShedding.validate(); err != nil {
+            return err
+        }
+        h.LoadShed = c.LoadShedding
+    }
+
+    if c.Flattening != nil {
+        flatten, err := c.Flattening.flattener()
+        if err != nil {
+            return err
+        }
+        h.Flatten = flatten
+    }
+
+    if c.Traffic != nil {
+        h.Enrichers = append(h.Enrichers, c.Traffic) // Before URLNormalizer strips the UTM parameters
+    }
+    if len(c.URLRoutes) > 0 {
+        h.Enrichers = append(h.Enrichers, &URLNormalizer{Routes: c.URLRoutes})
+    }
+    if len(c.DerivedFields) > 0 {
+        derived, err := NewDerivedFields(c.DerivedFields)
+        if err != nil {
+            return err
+        }
+        h.Enrichers = append(h.Enrichers, derived)
+    }
+    if c.Encryption != nil {
+        key, err := base64.StdEncoding.DecodeString(c.Encryption.Key)
+        if err != nil {
+            return fmt.Errorf("encryption.key: %v", err)
+        }
+        if _, err := newFieldCipher(key); err != nil {
+            return fmt.Errorf("encryption.key: %v", err)
+        }
+        h.Encryptor = &FieldEncryptor{
+            Fields:        c.Encryption.Fields,
+            KeyID:         c.Encryption.KeyID,
+            Key:           key,
+            Deterministic: c.Encryption.Deterministic,
+        }
+    }
+    if c.Pseudonyms != nil {
+        pseudonyms, err := c.Pseudonyms.Pseudonymizer()
+        if err != nil {
+            return err
+        }
+        h.Pseudonyms = pseudonyms
+        h.PseudonymFields = c.Pseudonyms.Fields
+    }
+    if c.DryRun != nil {
+        h.DryRun = &DryRun{All: c.DryRun.All, Types: c.DryRun.Types}
+        if c.DryRun.Path != "" {
+            f, err := os.OpenFile(c.DryRun.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+            if err != nil {
+                return fmt.Errorf("dry_run: %v", err)
+            }
+            h.DryRun.Output = &JSONLinesSink{W: f}
+        }
+    }
+    return nil
+}
+
+// SyncDatasets creates the datasets h sends to that don't exist yet, in each
+// region it sends to, and applies their settings. Call it once at startup,
+// after Apply and before SyncTriggers, which needs the datasets to be there.
+func (c *Config) SyncDatasets(ctx context.Context, h *UserEventsHandler, sync *DatasetSync) error {
+    return sync.SyncRegions(ctx, c.Datasets.Settings, h.DatasetsByRegion())
+}
+
+// SyncTriggers creates and updates the configured triggers and burn alerts
+// in Honeycomb, on the datasets h sends to. Call it once at startup, after
+// Apply.
+func (c *Config) SyncTriggers(ctx context.Context, h *UserEventsHandler, sync *TriggerSync) error {
+    if sync.Logger == nil {
+        sync.Logger = h.logger()
+    }
+    specs := c.Triggers
+    if c.DefaultTriggers {
+        specs = append(append([]TriggerSpec(nil), DefaultTriggers...), specs...)
+    }
+    if err := sync.Sync(ctx, specs, h.Datasets.all()); err != nil {
+        return err
+    }
+    return sync.SyncBurnAlerts(ctx, c.BurnAlerts, h.Datasets.all())
+}
+
+// Reload applies the parts of c that can change while the handler is
+// serving: sampling (the thing you actually want to turn up at 3am during an
+// incident) and transforms (so a new SDK release's renamed fields don't need
+// a deploy). Sinks are rebuilt if they've changed, as long as both configs
+// have some, and the old ones closed. Everything else is logged if it's
+// changed, and takes a restart.
+func (c *Config) Reload(h *UserEventsHandler, previous *Config) error {
+    reloadable, ok := h.Sampler.(*ReloadableSampler)
+    if !ok {
+        return errors.New("handler wasn't configured with Config.Apply")
+    }
+    sampler, err := c.Sampling.sampler()
+    if err != nil {
+        return err
+    }
+    if h.Transforms == nil {
+        return errors.New("handler wasn't configured with Config.Apply")
+    }
+    sinksChanged := previous != nil && !reflect.DeepEqual(c.Sinks, previous.Sinks)
+    // Going to or from no sinks changes how the handler recycles fields
+    swapSinks := sinksChanged && len(c.Sinks) > 0 && len(previous.Sinks) > 0
+    var sink Sink
+    if swapSinks {
+        if sink, err = c.sink(h); err != nil {
+            return err
+        }
+    }
+    if err := h.Transforms.Set(c.Transforms); err != nil {
+        closeSink(h, sink)
+        return err
+    }
+    reloadable.Set(sampler)
+    if swapSinks {
+        h.swapSink(sink)
+    }
+
+    if previous != nil {
+        for section, changed := range map[string]bool{
+            "datasets":       !reflect.DeepEqual(c.Datasets, previous.Datasets),
+            "scrubbing":      !reflect.DeepEqual(c.Scrubbing, previous.Scrubbing),
+            "rate_limit":     !reflect.DeepEqual(c.RateLimit, previous.RateLimit),
+            "sinks":          sinksChanged && !swapSinks,
+            "traffic":        !reflect.DeepEqual(c.Traffic, previous.Traffic),
+            "url_routes":     !reflect.DeepEqual(c.URLRoutes, previous.URLRoutes),
+            "derived_fields": !reflect.DeepEqual(c.DerivedFields, previous.DerivedFields),
+            "encryption":     !reflect.DeepEqual(c.Encryption, previous.Encryption),
+            "pseudonyms":     !reflect.DeepEqual(c.Pseudonyms, previous.Pseudonyms),
+            "dry_run":        !reflect.DeepEqual(c.DryRun, previous.DryRun),
+            "triggers":       !reflect.DeepEqual(c.Triggers, previous.Triggers) || c.DefaultTriggers != previous.DefaultTriggers,
+            "burn_alerts":    !reflect.DeepEqual(c.BurnAlerts, previous.BurnAlerts),
+            "flattening":     !reflect.DeepEqual(c.Flattening, previous.Flattening),
+            "honeycomb":      !reflect.DeepEqual(c.Honeycomb, previous.Honeycomb),
+            "tenants":        !reflect.DeepEqual(c.Tenants, previous.Tenants),
+            // Apply hands these to the handler, which keeps its own state in
+            // them, so compare what the config says rather than the structs
+            "late_events":     yamlChanged(c.LateEvents, previous.LateEvents),
+            "self_tracing":    yamlChanged(c.SelfTracing, previous.SelfTracing),
+            "retention":       yamlChanged(c.Retention, previous.Retention),
+            "delivery_timing": yamlChanged(c.DeliveryTiming, previous.DeliveryTiming),
+            "load_shedding":   yamlChanged(c.LoadShedding, previous.LoadShedding),
+        } {
+            if changed {
+                h.logger().Warn("config section changed but needs a restart to take effect", "section", section)
+            }
+        }
+    }
+    return nil
+}
+
+// Whether two config sections would be written out differently
+func yamlChanged(a, b interface{}) bool {
+    encodedA, errA := yaml.Marshal(a)
+    encodedB, errB := yaml.Marshal(b)
+    return errA != nil || errB != nil || !bytes.Equal(encodedA, encodedB)
+}
+
+// WatchConfig reloads the config at path on SIGHUP, or when the file changes
+// (checked every few seconds, which also catches Kubernetes swapping a
+// ConfigMap's symlink), until ctx is done. A config that fails to load is
+// logged and ignored, so a typo doesn't take down sampling.
+func WatchConfig(ctx context.Context, path string, h *UserEventsHandler, current *Config) {
+    hup := make(chan os.Signal, 1)
+    signal.Notify(hup, syscall.SIGHUP)
+    defer signal.Stop(hup)
+    ticker := time.NewTicker(5 * time.Second)
+    defer ticker.Stop()
+
+    lastMod := configModTime(path)
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+            mod := configModTime(path)
+            if mod.Equal(lastMod) {
+                continue
+            }
+            lastMod = mod
+        case <-hup:
+        }
+
+        next, err := LoadConfig(path)
+        if err == nil {
+            err = next.Reload(h, current)
+        }
+        if err != nil {
+            h.logger().Error("couldn't reload config", "path", path, "error", err)
+            continue
+        }
+        current = next
+        h.logger().Info("reloaded config", "path", path)
+    }
+}
+
+func configModTime(path string) time.Time {
+    info, err := os.Stat(path)
+    if err != nil {
+        return time.Time{}
+    }
+    return info.ModTime()
+}
+
+func (s SamplingConfig) sampler() (Sampler, error) {
+    byType := map[string]Sampler{}
+    for eventType, rate := range s.ByType {
+        byType[eventType] = StaticSampler(rate)
+    }
+    if s.Dynamic != nil {
+        dynamic, err := NewDynamicSampler(s.Dynamic.GoalRate, s.Dynamic.Fields...)
+        if err != nil {
+            return nil, err
+        }
+        for _, eventType := range s.Dynamic.Types {
+            byType[eventType] = dynamic
+        }
+    }
+    return SamplersByType{Default: StaticSampler(s.Default), ByType: byType}, nil
+}
+
+func (s ScrubbingConfig) scrubber() (*Scrubber, error) {
+    if len(s.Rules) == 0 {
+        return nil, nil
+    }
+    scrubber := &Scrubber{HashSalt: []byte(s.HashSalt)}
+    for _, rule := range s.Rules {
+        action, ok := scrubActions[rule.Action]
+        if !ok {
+            return nil, fmt.Errorf("scrubbing rule for %q: unknown action %q", rule.Field, rule.Action)
+        }
+        scrubber.Rules = append(scrubber.Rules, ScrubRule{Field: rule.Field, Action: action})
+    }
+    return scrubber, nil
+}
+
+func (f FlatteningConfig) flattener() (*Flattener, error) {
+    arrays := ArrayJSON
+    if f.Arrays != "" {
+        policy, ok := arrayPolicies[f.Arrays]
+        if !ok {
+            return nil, fmt.Errorf("flattening: unknown arrays option %q (json, index, or aggregate)", f.Arrays)
+        }
+        arrays = policy
+    }
+    return &Flattener{
+        MaxDepth:      f.MaxDepth,
+        Separator:     f.Separator,
+        Arrays:        arrays,
+        MaxArrayItems: f.MaxArrayItems,
+        Skip:          f.Skip,
+    }, nil
+}
+
+func (c *Config) sink(h *UserEventsHandler) (Sink, error) {
+    if len(c.Sinks) == 0 {
+        return nil, nil // Honeycomb
+    }
+    var outputs []SinkOutput
+    for i, sc := range c.Sinks {
+        output := SinkOutput{Name: sc.Type, SampleRate: sc.SampleRate}
+        switch sc.Type {
+        case "honeycomb":
+            output.Sink = h.HoneycombSink()
+        case "stdout":
+            output.Sink = &JSONLinesSink{W: os.Stdout}
+        case "file":
+            f, err := os.OpenFile(sc.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+            if err != nil {
+                return nil, fmt.Errorf("sink #%d: %v", i+1, err)
+            }
+            output.Sink = &fileSink{JSONLinesSink: &JSONLinesSink{W: f}, file: f}
+        case "kafka":
+            output.Sink = NewKafkaSink(sc.Brokers, sc.Topic)
+        case "parquet":
+            sink, err := NewParquetSink(context.Background(), sc.URL, sc.Prefix)
+            if err != nil {
+                return nil, fmt.Errorf("sink #%d: %v", i+1, err)
+            }
+            sink.Logger = h.logger()
+            output.Sink = sink
+        default:
+            return nil, fmt.Errorf("sink #%d: unknown type %q", i+1, sc.Type)
+        }
+        outputs = append(outputs, output)
+    }
+    if len(outputs) == 1 && outputs[0].SampleRate <= 1 {
+        return outputs[0].Sink, nil
+    }
+    fanOut := NewFanOutSink(outputs...)
+    fanOut.Logger = h.logger()
+    return fanOut, nil
+}
+
+// A JSONLinesSink writing to a file the config opened, which it closes
+type fileSink struct {
+    *JSONLinesSink
+    file *os.File
+}
+
+func (s *fileSink) Close() error {
+    return s.file.Close()
+}
+
+// ReloadableSampler is a Sampler that can be swapped out while the handler is
+// serving.
+type ReloadableSampler struct {
+    current atomic.Value // Of samplerBox
+}
+
+// atomic.Value needs every value stored to be the same concrete type
+type samplerBox struct{ Sampler }
+
+func (s *ReloadableSampler) Set(sampler Sampler) {
+    old, _ := s.current.Load().(samplerBox)
+    s.current.Store(samplerBox{sampler})
+    stopSamplers(old.Sampler, map[Sampler]bool{})
+}
+
+func (s *ReloadableSampler) SampleRate(eventType string, metadata map[string]interface{}) uint {
+    box, ok := s.current.Load().(samplerBox)
+    if !ok || box.Sampler == nil {
+        return 1
+    }
+    return box.Sampler.SampleRate(eventType, metadata)
+}
+
+// Dynamic samplers run a goroutine to recalculate their rates, which we stop
+// once a reload has replaced them. One DynamicSampler can be shared by several
+// types, so only stop each once.
+func stopSamplers(sampler Sampler, stopped map[Sampler]bool) {
+    switch s := sampler.(type) {
+    case SamplersByType:
+        stopSamplers(s.Default, stopped)
+        for _, byType := range s.ByType {
+            stopSamplers(byType, stopped)
+        }
+    case *DynamicSampler:
+        if stopped[s] {
+            return
+        }
+        stopped[s] = true
+        if stopper, ok := s.Sampler.(interface{ Stop() error }); ok {
+            stopper.Stop()
+        }
+    }
+}
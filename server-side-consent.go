@@ -0,0 +1,89 @@
+// Before we can ship this pattern in the EU, events need to respect what the
+// user agreed to. The browser includes its current consent state in each event
+// (the "consent" field, e.g. "denied", "essential", or "analytics"), and a
+// ConsentPolicy decides, per region, what that means for the event: send it
+// with everything, send it anonymized, or don't send it at all.
+//
+//     geo, _ := NewGeoIPEnricher(&MaxMindLookup{Path: "GeoLite2-City.mmdb"}, 10000)
+//     handler.Consent = &ConsentPolicy{
+//         Region: func(r *http.Request) string {
+//             loc, _ := geo.Locate(r.Context(), r)
+//             return loc.Country
+//         },
+//         Regions: map[string]ConsentRules{
+//             "DE": {"analytics": ConsentFull, "essential": ConsentAnonymize, "": ConsentDrop},
+//         },
+//     }
+type ConsentPolicy struct {
+    Region  func(r *http.Request) string // e.g. an ISO country code
+    Regions map[string]ConsentRules      // Region -> rules
+    Default ConsentRules                 // For regions not in Regions; nil means send everything
+
+    // Fields removed from anonymized events. Defaults to anonymizedFields.
+    AnonymizeFields []string
+}
+
+// ConsentRules maps a consent state to what we do with events in that state.
+// "" is the state for events that didn't say. States not listed fall back on
+// the "" rule if there is one, otherwise events are anonymized, since that's
+// the safe choice for a state we don't know about.
+type ConsentRules map[string]ConsentAction
+
+type ConsentAction int
+
+const (
+    ConsentFull      ConsentAction = iota // Send the event with all its fields
+    ConsentAnonymize                      // Send it without anything identifying the user
+    ConsentDrop                           // Don't send it
+)
+
+var anonymizedFields = []string{"user_id", "user_email", "session_id"}
+
+func (p *ConsentPolicy) Decide(r *http.Request, metadata map[string]interface{}) ConsentAction {
+    rules := p.Default
+    if p.Region != nil {
+        if regionRules, ok := p.Regions[p.Region(r)]; ok {
+            rules = regionRules
+        }
+    }
+    if rules == nil {
+        return ConsentFull
+    }
+
+    state, _ := metadata["consent"].(string)
+    if action, ok := rules[state]; ok {
+        return action
+    }
+    if action, ok := rules[""]; ok {
+        return action
+    }
+    return ConsentAnonymize
+}
+
+// Strips identifying fields from a finished event, and truncates its client
+// IP if it has one.
+func (p *ConsentPolicy) anonymize(fields map[string]interface{}) {
+    names := p.AnonymizeFields
+    if names == nil {
+        names = anonymizedFields
+    }
+    for _, name := range names {
+        delete(fields, name)
+    }
+    if raw, ok := fields["client_ip"].(string); ok {
+        if ip := net.ParseIP(raw); ip != nil {
+            fields["client_ip"] = truncateIP(ip).String()
+        } else {
+            delete(fields, "client_ip")
+        }
+    }
+}
+
+// Zeroes the last octet of an IPv4 address, or the last 80 bits of an IPv6
+// one, which is the usual bar for an IP no longer identifying a person.
+func truncateIP(ip net.IP) net.IP {
+    if v4 := ip.To4(); v4 != nil {
+        return v4.Mask(net.CIDRMask(24, 32))
+    }
+    return ip.Mask(net.CIDRMask(48, 128))
+}
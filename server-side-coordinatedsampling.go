@@ -0,0 +1,190 @@
+// A DynamicSampler only sees its own instance's traffic, so with a dozen
+// replicas behind the load balancer each one decides a key is rare when, fleet
+// wide, it isn't, and the rates (and Honeycomb's re-weighted counts) drift.
+// CoordinatedSampler works out rates the same way dynsampler's AvgSampleRate
+// does, but from every instance's key counts, which it shares through Redis:
+//
+//     sampler := &CoordinatedSampler{
+//         GoalSampleRate: 20,
+//         Fields:         []string{"url_path", "status"},
+//         Client:         redisClient,
+//         Prefix:         "user-events:",
+//     }
+//     handler.Sampler = sampler
+//     go sampler.Run(ctx, handler)
+//
+// Counts are kept per Interval-long window, aligned to the clock so every
+// instance agrees on where windows start. At the end of each window, each
+// instance adds its counts to the window's Redis hash, then sets its rates
+// from the window before's hash, which every instance has finished adding to
+// by then. Rates trail traffic by a window or two, but every instance
+// computes the same ones. If Redis is unavailable we fall back to rates from
+// this instance's own counts, which is what a DynamicSampler would do.
+type CoordinatedSampler struct {
+    GoalSampleRate int
+    Fields         []string
+    Client         *redis.Client
+    Prefix         string
+    Interval       time.Duration // Defaults to 30 seconds, like NewDynamicSampler
+    MaxKeys        int           // Distinct keys counted per window; the rest share one. Defaults to 2000.
+
+    mu     sync.Mutex
+    counts map[string]int64 // This instance's, for the current window
+    rates  map[string]uint
+}
+
+// Where keys past MaxKeys are counted, and what they're sampled at
+const overflowSampleKey = "overflow"
+
+var coordinatedSampling = promauto.NewCounterVec(prometheus.CounterOpts{
+    Name: "user_events_coordinated_sampling_updates_total",
+    Help: "Coordinated sample rate updates, by whether they used fleet-wide counts or fell back to local ones.",
+}, []string{"source"})
+
+func (s *CoordinatedSampler) interval() time.Duration {
+    if s.Interval > 0 {
+        return s.Interval
+    }
+    return 30 * time.Second
+}
+
+func (s *CoordinatedSampler) maxKeys() int {
+    if s.MaxKeys > 0 {
+        return s.MaxKeys
+    }
+    return 2000
+}
+
+func (s *CoordinatedSampler) SampleRate(eventType string, metadata map[string]interface{}) uint {
+    key := sampleKey(eventType, s.Fields, metadata)
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if s.counts == nil {
+        s.counts = make(map[string]int64)
+    }
+    if _, seen := s.counts[key]; !seen && len(s.counts) >= s.maxKeys() {
+        key = overflowSampleKey
+    }
+    s.counts[key]++
+    if rate, ok := s.rates[key]; ok {
+        return rate
+    }
+    return 1 // A key nobody saw last window is rare by definition
+}
+
+// Run shares counts and updates rates at the end of every window, until ctx
+// is done.
+func (s *CoordinatedSampler) Run(ctx context.Context, h *UserEventsHandler) {
+    for {
+        // Wake just after the window ends, so we're counting into the next one
+        now := time.Now()
+        next := time.Unix(0, (s.window(now)+1)*int64(s.interval()))
+        select {
+        case <-ctx.Done():
+            return
+        case <-time.After(next.Sub(now)):
+        }
+        s.update(ctx, h, s.window(next)-1)
+    }
+}
+
+func (s *CoordinatedSampler) window(t time.Time) int64 {
+    return t.UnixNano() / int64(s.interval())
+}
+
+func (s *CoordinatedSampler) key(window int64) string {
+    return s.Prefix + "sampling:" + strconv.FormatInt(window, 10)
+}
+
+// Shares the counts for the window that just ended, then sets rates from the
+// whole fleet's counts for the one before
+func (s *CoordinatedSampler) update(ctx context.Context, h *UserEventsHandler, ended int64) {
+    s.mu.Lock()
+    local := s.counts
+    s.counts = nil
+    s.mu.Unlock()
+
+    totals, err := s.share(ctx, ended, local)
+    source := "fleet"
+    if err != nil {
+        h.logger().Warn("couldn't share sampling counts, using this instance's own", "error", err)
+        totals, source = local, "local"
+    }
+    rates := averageSampleRates(totals, s.GoalSampleRate)
+    coordinatedSampling.WithLabelValues(source).Inc()
+
+    s.mu.Lock()
+    s.rates = rates
+    s.mu.Unlock()
+}
+
+func (s *CoordinatedSampler) share(ctx context.Context, ended int64, local map[string]int64) (map[string]int64, error) {
+    ctx, cancel := context.WithTimeout(ctx, stateStoreTimeout)
+    defer cancel()
+    pipe := s.Client.TxPipeline()
+    for key, count := range local {
+        pipe.HIncrBy(ctx, s.key(ended), key, count)
+    }
+    pipe.Expire(ctx, s.key(ended), 3*s.interval())
+    previous := pipe.HGetAll(ctx, s.key(ended-1))
+    if _, err := pipe.Exec(ctx); err != nil {
+        return nil, err
+    }
+
+    totals := make(map[string]int64, len(previous.Val()))
+    for key, raw := range previous.Val() {
+        if n, err := strconv.ParseInt(raw, 10, 64); err == nil {
+            totals[key] = n
+        }
+    }
+    if len(totals) == 0 {
+        // This deployment just started sharing; our own counts beat nothing
+        return local, nil
+    }
+    return totals, nil
+}
+
+// dynsampler's AvgSampleRate: keys get a share of the goal count in
+// proportion to the log of how common they are, so rare keys are kept and
+// common ones sampled hard, with the average rate coming out at goal.
+func averageSampleRates(counts map[string]int64, goal int) map[string]uint {
+    rates := make(map[string]uint, len(counts))
+    if goal < 1 {
+        goal = 1
+    }
+    var sum int64
+    logSum := 0.0
+    for _, count := range counts {
+        sum += count
+        logSum += math.Log10(float64(count))
+    }
+    if sum == 0 || logSum == 0 {
+        return rates // Nothing, or no key seen more than once, so nothing to sample
+    }
+    goalRatio := float64(sum) / float64(goal) / logSum
+
+    keys := make([]string, 0, len(counts))
+    for key := range counts {
+        keys = append(keys, key)
+    }
+    sort.Strings(keys) // Every instance hands out the leftover in the same order
+    extra := 0.0
+    remaining := len(keys)
+    for _, key := range keys {
+        count := float64(counts[key])
+        goalForKey := math.Max(1, math.Log10(count)*goalRatio)
+        extraForKey := extra / float64(remaining)
+        goalForKey += extraForKey
+        extra -= extraForKey
+        remaining--
+        if count <= goalForKey {
+            rates[key] = 1
+            extra += goalForKey - count
+            continue
+        }
+        rate := math.Ceil(count / goalForKey)
+        rates[key] = uint(rate)
+        extra += goalForKey - count/rate
+    }
+    return rates
+}
@@ -0,0 +1,96 @@
+// The browser SDK posts events from our app's subdomains and staging origins,
+// not just the origin this handler is served from. CORSPolicy lets it do that
+// without a separate proxy layer in front: wrap the event endpoints with
+// WithCORS and it answers preflight OPTIONS requests itself, and adds the
+// right headers to the real ones.
+//
+//     handler.CORS = &CORSPolicy{
+//         AllowedOrigins:   []string{"https://app.example.com", "https://*.staging.example.com"},
+//         AllowCredentials: true,
+//     }
+//     mux.Handle("/events/batch", handler.WithCORS(...))
+type CORSPolicy struct {
+    // Exact origins, or "https://*.example.com" for any subdomain. "*" allows
+    // any origin, but can't be combined with AllowCredentials.
+    AllowedOrigins []string
+
+    AllowCredentials bool          // Allow cookies, so we know who the user is
+    AllowedHeaders   []string      // Defaults to defaultCORSHeaders
+    MaxAge           time.Duration // How long browsers can cache a preflight; defaults to 10 minutes
+}
+
+var defaultCORSHeaders = []string{"Content-Type", "Content-Encoding", "traceparent"}
+
+func (h *UserEventsHandler) WithCORS(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        origin := r.Header.Get("Origin")
+        policy := h.CORS
+        if policy == nil || origin == "" {
+            next.ServeHTTP(w, r)
+            return
+        }
+
+        w.Header().Add("Vary", "Origin")
+        preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+        if !policy.allows(origin) {
+            if preflight {
+                w.WriteHeader(http.StatusForbidden)
+                return
+            }
+            // Without the headers, the browser won't let the page see the
+            // response. We still handle the request; auth is separate.
+            next.ServeHTTP(w, r)
+            return
+        }
+
+        w.Header().Set("Access-Control-Allow-Origin", origin)
+        if policy.AllowCredentials {
+            w.Header().Set("Access-Control-Allow-Credentials", "true")
+        }
+        if !preflight {
+            next.ServeHTTP(w, r)
+            return
+        }
+
+        headers := policy.AllowedHeaders
+        if len(headers) == 0 {
+            headers = defaultCORSHeaders
+        }
+        maxAge := policy.MaxAge
+        if maxAge <= 0 {
+            maxAge = 10 * time.Minute
+        }
+        w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+        w.Header().Set("Access-Control-Allow-Headers", strings.Join(headers, ", "))
+        w.Header().Set("Access-Control-Max-Age", strconv.Itoa(int(maxAge.Seconds())))
+        w.WriteHeader(http.StatusNoContent)
+    })
+}
+
+func (p *CORSPolicy) allows(origin string) bool {
+    for _, allowed := range p.AllowedOrigins {
+        if allowed == "*" {
+            return !p.AllowCredentials
+        }
+    }
+    return originAllowed(p.AllowedOrigins, origin)
+}
+
+// Matches origin against exact origins and "https://*.example.com" patterns
+func originAllowed(allowList []string, origin string) bool {
+    for _, allowed := range allowList {
+        switch {
+        case allowed == origin:
+            return true
+        case strings.Contains(allowed, "://*."):
+            // "https://*.example.com" matches "https://a.example.com" and
+            // "https://a.b.example.com", but not "https://example.com"
+            scheme := allowed[:strings.Index(allowed, "://")+3]
+            suffix := allowed[len(scheme)+1:]
+            if strings.HasPrefix(origin, scheme) && strings.HasSuffix(origin, suffix) && len(origin) > len(scheme)+len(suffix) {
+                return true
+            }
+        }
+    }
+    return false
+}
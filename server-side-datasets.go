@@ -0,0 +1,308 @@
+// Honeycomb creates a dataset the first time an event arrives for it, but only
+// if the write key is allowed to, and otherwise drops the events; a new
+// event-type route could send nothing for days before anyone noticed.
+// DatasetSync makes sure every dataset the handler can send to exists, with
+// the settings the config gives it, before any events go out:
+//
+//     datasets:
+//       default: user-events
+//       by_type: {page-error: browser-errors}
+//       settings:
+//         "*": {expand_json_depth: 2}
+//         browser-errors: {description: Uncaught errors from the browser SDK}
+//
+// Settings are by dataset name, with "*" for every dataset without its own.
+// Missing datasets are created with them, and existing ones updated where the
+// config sets something different; a description someone wrote in the UI
+// stays unless the config has one of its own. Tenant-prefixed datasets are
+// covered too, as are the ones only we send to (ops, late events, retention
+// archives). We check the key's permissions before anything else, so a key
+// that can't create datasets fails with that, not a 401 halfway through.
+//
+// Configuration keys are per environment, and the EU's datasets are in an
+// environment of their own, so SyncRegions needs a key for each region the
+// handler sends to: APIKey for the US, and Regions for the rest.
+type DatasetSync struct {
+    APIKey     string // A configuration key with the Create Datasets permission
+    APIHost    string // Defaults to https://api.honeycomb.io
+    HTTPClient *http.Client
+
+    // Regions has the configuration key for each other region's datasets,
+    // e.g. {"eu": {Region: "eu", APIKey: euConfigKey}}, and for "us" too if
+    // APIKey shouldn't be used for it
+    Regions map[string]HoneycombEndpoint
+
+    Log io.Writer // Reports what was created and updated, if set
+}
+
+type DatasetSettings struct {
+    Description     string `yaml:"description" json:"description"`
+    ExpandJSONDepth int    `yaml:"expand_json_depth" json:"expand_json_depth"` // How many levels of nested JSON Honeycomb unpacks into columns, 0 to 10
+}
+
+type honeycombDataset struct {
+    Name            string `json:"name"`
+    Slug            string `json:"slug,omitempty"`
+    Description     string `json:"description"`
+    ExpandJSONDepth int    `json:"expand_json_depth"`
+}
+
+func settingsFor(settings map[string]DatasetSettings, dataset string) DatasetSettings {
+    if s, ok := settings[dataset]; ok {
+        return s
+    }
+    return settings["*"]
+}
+
+// Sync creates each of datasets that doesn't exist yet, and brings the
+// settings of those that do in line with settings.
+func (d *DatasetSync) Sync(ctx context.Context, settings map[string]DatasetSettings, datasets []string) error {
+    for name, s := range settings {
+        if s.ExpandJSONDepth < 0 || s.ExpandJSONDepth > 10 {
+            return fmt.Errorf("dataset %s: expand_json_depth must be between 0 and 10", name)
+        }
+    }
+    if err := d.checkAccess(ctx); err != nil {
+        return err
+    }
+    for _, dataset := range datasets {
+        if err := d.ensure(ctx, dataset, settingsFor(settings, dataset)); err != nil {
+            return fmt.Errorf("dataset %s: %v", dataset, err)
+        }
+    }
+    return nil
+}
+
+// SyncRegions syncs each region's datasets, as DatasetsByRegion gives them,
+// to that region's Honeycomb.
+func (d *DatasetSync) SyncRegions(ctx context.Context, settings map[string]DatasetSettings, byRegion map[string][]string) error {
+    regions := make([]string, 0, len(byRegion))
+    for region := range byRegion {
+        regions = append(regions, region)
+    }
+    sort.Strings(regions)
+    for _, region := range regions {
+        sync, err := d.forRegion(region)
+        if err != nil {
+            return err
+        }
+        if err := sync.Sync(ctx, settings, byRegion[region]); err != nil {
+            return fmt.Errorf("%s region: %v", region, err)
+        }
+    }
+    return nil
+}
+
+func (d *DatasetSync) forRegion(region string) (*DatasetSync, error) {
+    endpoint, ok := d.Regions[region]
+    if !ok {
+        if region != "us" {
+            return nil, fmt.Errorf("datasets in the %s region need a configuration key for it in Regions", region)
+        }
+        return d, nil
+    }
+    if endpoint.Region == "" {
+        endpoint.Region = region
+    }
+    host, err := endpoint.host()
+    if err != nil {
+        return nil, fmt.Errorf("%s region: %v", region, err)
+    }
+    return &DatasetSync{APIKey: endpoint.APIKey, APIHost: host, HTTPClient: d.HTTPClient, Log: d.Log}, nil
+}
+
+// DatasetNames lists every dataset the handler can send to, in any region.
+func (h *UserEventsHandler) DatasetNames() []string {
+    seen := map[string]bool{}
+    var all []string
+    for _, names := range h.DatasetsByRegion() {
+        for _, name := range names {
+            if !seen[name] {
+                seen[name] = true
+                all = append(all, name)
+            }
+        }
+    }
+    sort.Strings(all)
+    return all
+}
+
+// DatasetsByRegion lists every dataset the handler can send to, by the
+// Honeycomb region ("us" or "eu") its events end up in. A tenant's datasets
+// are in its Endpoint's region, and a dataset ByDataset pins to a client in
+// that client's; any other could be sent with any of the Clients (a browser
+// can pick one), so is in each of their regions. Clients we don't know the
+// region of, including the handler's own Libhoney, count as "us", libhoney's
+// default.
+func (h *UserEventsHandler) DatasetsByRegion() map[string][]string {
+    h.clientsMu.RLock()
+    defer h.clientsMu.RUnlock()
+    router := h.Clients
+    anyRegion := []string{"us"}
+    if router != nil {
+        anyRegion = router.regions()
+    }
+
+    seen := map[string]bool{}
+    byRegion := map[string][]string{}
+    add := func(region, dataset string) {
+        if dataset == "" || seen[region+"\x00"+dataset] {
+            return
+        }
+        seen[region+"\x00"+dataset] = true
+        byRegion[region] = append(byRegion[region], dataset)
+    }
+    place := func(name string, tenant *Tenant) {
+        if name == "" {
+            return // Not configured, so no tenant's copy of it either
+        }
+        dataset := name
+        if tenant != nil {
+            dataset = tenant.DatasetPrefix + name
+        }
+        switch {
+        case tenant != nil && tenant.Endpoint != nil:
+            add(tenant.Endpoint.region(), dataset)
+        case tenant != nil && tenant.Client != nil:
+            add("us", dataset)
+        case router != nil && router.pins(name):
+            add(router.regionOf(router.ByDataset[name]), dataset)
+        default:
+            for _, region := range anyRegion {
+                add(region, dataset)
+            }
+        }
+    }
+
+    for _, name := range h.tenantDatasets() {
+        place(name, nil)
+        if h.Tenants != nil {
+            for _, tenant := range h.Tenants.Tenants {
+                place(name, tenant)
+            }
+        }
+    }
+    for _, name := range h.opsDatasets() {
+        place(name, nil)
+    }
+    for _, names := range byRegion {
+        sort.Strings(names)
+    }
+    return byRegion
+}
+
+// The datasets each tenant sends to its own (prefixed) copy of
+func (h *UserEventsHandler) tenantDatasets() []string {
+    names := h.Datasets.all()
+    if h.Late != nil && h.Late.action() == LateRoute {
+        names = append(names, h.Late.dataset())
+    }
+    if h.Retention != nil {
+        names = append(names, h.Retention.EphemeralDataset, h.Retention.LongTermDataset)
+    }
+    if h.Schemas != nil {
+        names = append(names, h.Schemas.MalformedDataset)
+    }
+    return names
+}
+
+// The datasets only we send to, which every tenant shares
+func (h *UserEventsHandler) opsDatasets() []string {
+    var names []string
+    if h.Admin != nil {
+        names = append(names, h.Admin.auditDataset())
+    }
+    if h.Delivery != nil {
+        names = append(names, h.Delivery.dataset())
+    }
+    if h.SelfTrace != nil {
+        names = append(names, h.SelfTrace.dataset())
+    }
+    if h.Drift != nil {
+        names = append(names, h.Drift.Dataset)
+    }
+    if h.Usage != nil {
+        names = append(names, h.Usage.Dataset)
+    }
+    return names
+}
+
+func (d *DatasetSync) checkAccess(ctx context.Context) error {
+    var auth struct {
+        Access struct {
+            CreateDatasets bool `json:"createDatasets"`
+        } `json:"api_key_access"`
+        Environment struct {
+            Name string `json:"name"`
+        } `json:"environment"`
+    }
+    err := d.call(ctx, http.MethodGet, "/1/auth", nil, &auth)
+    switch {
+    case isAPIStatus(err, http.StatusUnauthorized):
+        return errors.New("Honeycomb doesn't recognize the dataset sync API key")
+    case err != nil:
+        return fmt.Errorf("checking the dataset sync API key: %v", err)
+    case !auth.Access.CreateDatasets:
+        return fmt.Errorf("the dataset sync API key for environment %q doesn't have the Create Datasets permission", auth.Environment.Name)
+    }
+    return nil
+}
+
+func (d *DatasetSync) ensure(ctx context.Context, name string, want DatasetSettings) error {
+    var existing honeycombDataset
+    err := d.call(ctx, http.MethodGet, "/1/datasets/"+url.PathEscape(datasetSlug(name)), nil, &existing)
+    if isAPIStatus(err, http.StatusNotFound) {
+        if err := d.call(ctx, http.MethodPost, "/1/datasets", honeycombDataset{Name: name, Description: want.Description, ExpandJSONDepth: want.ExpandJSONDepth}, nil); err != nil {
+            return err
+        }
+        d.logf("created dataset %s", name)
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+
+    // Only what the config actually sets
+    update := existing
+    if want.Description != "" {
+        update.Description = want.Description
+    }
+    if want.ExpandJSONDepth != 0 {
+        update.ExpandJSONDepth = want.ExpandJSONDepth
+    }
+    if update == existing {
+        return nil
+    }
+    if err := d.call(ctx, http.MethodPut, "/1/datasets/"+url.PathEscape(existing.Slug), map[string]interface{}{
+        "description":       update.Description,
+        "expand_json_depth": update.ExpandJSONDepth,
+    }, nil); err != nil {
+        return err
+    }
+    d.logf("updated settings on dataset %s", name)
+    return nil
+}
+
+// Honeycomb's slug for a dataset name: lowercased, with anything but letters,
+// digits, "-" and "_" replaced by "-"
+func datasetSlug(name string) string {
+    return strings.Map(func(r rune) rune {
+        switch {
+        case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-', r == '_':
+            return r
+        case r >= 'A' && r <= 'Z':
+            return r + ('a' - 'A')
+        }
+        return '-'
+    }, name)
+}
+
+func (d *DatasetSync) logf(format string, args ...interface{}) {
+    if d.Log != nil {
+        fmt.Fprintf(d.Log, format+"\n", args...)
+    }
+}
+
+func (d *DatasetSync) call(ctx context.Context, method, path string, body, out interface{}) error {
+    return honeycombAPI(ctx, d.HTTPClient, d.APIHost, d.APIKey, method, path, body, out)
+}
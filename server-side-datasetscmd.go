@@ -0,0 +1,50 @@
+// The datasets command creates the Honeycomb datasets a config file's routes,
+// tenants, and ops events send to, and applies the settings it gives them,
+// without starting the handler:
+//
+//     user-events datasets -configkey $HONEYCOMB_CONFIG_KEY -eu-configkey $HONEYCOMB_EU_CONFIG_KEY -config user-events.yaml
+//
+// It's what the handler does at startup with Config.SyncDatasets, for
+// setting up an environment ahead of a deploy. EU datasets need
+// -eu-configkey, a key for the EU environment. See DatasetSync.
+func datasetsCommand(args []string) {
+    flags := flag.NewFlagSet("datasets", flag.ExitOnError)
+    configKey := flags.String("configkey", os.Getenv("HONEYCOMB_CONFIG_KEY"), "Honeycomb configuration key with the Create Datasets permission")
+    euConfigKey := flags.String("eu-configkey", os.Getenv("HONEYCOMB_EU_CONFIG_KEY"), "configuration key for the EU region's datasets, if there are any")
+    apiHost := flags.String("api-host", "https://api.honeycomb.io", "Honeycomb API host")
+    configPath := flags.String("config", "user-events.yaml", "handler config file")
+    flags.Parse(args)
+    if *configKey == "" {
+        log.Fatal("datasets: -configkey (or $HONEYCOMB_CONFIG_KEY) is required")
+    }
+
+    cfg, err := LoadConfig(*configPath)
+    if err != nil {
+        log.Fatalf("datasets: %v", err)
+    }
+    // Just what decides where events go; nothing here sends any
+    handler := &UserEventsHandler{
+        Datasets:  DatasetRoutes{Default: cfg.Datasets.Default, ByType: cfg.Datasets.ByType},
+        Tenants:   cfg.TenantRegistry(),
+        Late:      cfg.LateEvents,
+        SelfTrace: cfg.SelfTracing,
+        Retention: cfg.Retention,
+        Delivery:  cfg.DeliveryTiming,
+    }
+    if cfg.Honeycomb != nil {
+        handler.Clients = &ClientRouter{ByDataset: cfg.Honeycomb.ByDataset, Regions: map[string]string{}}
+        for name, endpoint := range cfg.Honeycomb.Clients {
+            handler.Clients.Regions[name] = endpoint.Region
+        }
+    }
+
+    ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+    defer cancel()
+    sync := &DatasetSync{APIKey: *configKey, APIHost: *apiHost, Log: os.Stdout}
+    if *euConfigKey != "" {
+        sync.Regions = map[string]HoneycombEndpoint{"eu": {Region: "eu", APIKey: *euConfigKey}}
+    }
+    if err := cfg.SyncDatasets(ctx, handler, sync); err != nil {
+        log.Fatalf("datasets: %v", err)
+    }
+}
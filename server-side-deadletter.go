@@ -0,0 +1,328 @@
+// libhoney sends events in the background and reports how each one went on
+// its responses channel. Without something reading them, a 429, a 5xx, or a
+// network blip meant the event was just gone. The DeadLetterQueue gets every
+// response from WatchResponses, writes events that failed for a retryable
+// reason to a Spool, and retries them with exponential backoff until they land
+// or run out of attempts.
+//
+// Run it alongside the handler:
+//
+//     dlq := &DeadLetterQueue{Spool: &DiskSpool{Dir: "/var/spool/user-events"}, Jitter: 0.5}
+//     handler.DeadLetters = dlq
+//     go handler.WatchResponses(ctx)
+//     go dlq.Run(ctx, handler)
+type DeadLetterQueue struct {
+    // Spool is where failed events wait. Defaults to memory, which rides out
+    // a blip but not a restart; use a DiskSpool or SQLiteSpool for that.
+    Spool     Spool
+    spoolOnce sync.Once
+
+    MaxAttempts int           // Give up on an event after this many sends; defaults to 8
+    BaseBackoff time.Duration // Wait before the first retry, doubled each time after; defaults to 5s
+    MaxBackoff  time.Duration // Defaults to 10 minutes
+
+    // Jitter shortens each backoff by a random fraction up to this much (at
+    // most 1), so everything that failed in the same outage doesn't retry in
+    // the same second. 0 retries at exactly the backoff, e.g. for tests.
+    Jitter float64
+
+    // RetryAfter, if libhoney's transmission is using it, tells us how long
+    // Honeycomb asked us to back off for when it rate limited us. We never
+    // retry sooner than that.
+    RetryAfter *RetryAfterTransport
+}
+
+// SpooledEvent is everything we need to send an event again later.
+type SpooledEvent struct {
+    Client      string                 `json:"client"` // Which of the handler's clients to send with
+    Dataset     string                 `json:"dataset"`
+    Timestamp   time.Time              `json:"timestamp"`
+    SampleRate  uint                   `json:"sample_rate"`
+    Fields      map[string]interface{} `json:"fields"`
+    Attempts    int                    `json:"attempts"`
+    LastError   string                 `json:"last_error,omitempty"`
+    NextAttempt time.Time              `json:"next_attempt"`
+
+    probe *deliveryProbe // If DeliveryTiming is timing it; not spooled
+}
+
+// Spool stores failed events until they're due for another try.
+type Spool interface {
+    Put(ev *SpooledEvent) error
+
+    // Removes and returns up to max events whose NextAttempt is at or before
+    // now.
+    TakeDue(now time.Time, max int) ([]*SpooledEvent, error)
+}
+
+// Called right before an event is sent, so that if it fails we still have a
+// copy of it once libhoney hands it back on the responses channel.
+func (d *DeadLetterQueue) track(ev *libhoney.Event, clientName string) {
+    ev.Metadata = &SpooledEvent{
+        Client:     clientName,
+        Dataset:    ev.Dataset,
+        Timestamp:  ev.Timestamp,
+        SampleRate: ev.SampleRate,
+        Fields:     ev.Fields(),
+        Attempts:   1,
+    }
+}
+
+// Retries spooled events until ctx is done.
+func (d *DeadLetterQueue) Run(ctx context.Context, h *UserEventsHandler) {
+    retryTicker := time.NewTicker(time.Second)
+    defer retryTicker.Stop()
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case now := <-retryTicker.C:
+            d.retryDue(h, now)
+        }
+    }
+}
+
+func (d *DeadLetterQueue) handleResponse(h *UserEventsHandler, resp transmission.Response) {
+    spooled, ok := resp.Metadata.(*SpooledEvent)
+    if !ok || !retryable(resp) {
+        return
+    }
+    if resp.Err != nil {
+        spooled.LastError = resp.Err.Error()
+    } else {
+        spooled.LastError = fmt.Sprintf("HTTP %d: %s", resp.StatusCode, bytes.TrimSpace(resp.Body))
+    }
+
+    if spooled.Attempts >= d.maxAttempts() {
+        h.logger().Warn("giving up on failed event", "dataset", spooled.Dataset, "attempts", spooled.Attempts, "error", spooled.LastError)
+        return
+    }
+    spooled.NextAttempt = time.Now().Add(d.backoff(spooled.Attempts))
+    if d.RetryAfter != nil {
+        if until := d.RetryAfter.Until(spooled.Dataset); until.After(spooled.NextAttempt) {
+            spooled.NextAttempt = until
+        }
+    }
+    if err := d.spool(h).Put(spooled); err != nil {
+        h.logger().Error("couldn't spool failed event", "dataset", spooled.Dataset, "error", err)
+    }
+}
+
+// Network errors, rate limiting, and server errors are worth another try. Any
+// other non-2xx means Honeycomb didn't like the event itself, and sending it
+// again won't change its mind.
+func retryable(resp transmission.Response) bool {
+    if resp.Err != nil {
+        return true
+    }
+    return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+}
+
+func (d *DeadLetterQueue) retryDue(h *UserEventsHandler, now time.Time) {
+    due, err := d.spool(h).TakeDue(now, 100)
+    if err != nil {
+        h.logger().Error("couldn't read dead letter spool", "error", err)
+        return
+    }
+    for _, spooled := range due {
+        // Don't spend an attempt on a client we know is down; wait it out
+        if h.Breaker != nil && !h.Breaker.Allow(spooled.Client) {
+            spooled.NextAttempt = now.Add(h.Breaker.cooldown())
+            if err := d.spool(h).Put(spooled); err != nil {
+                h.logger().Error("couldn't respool event", "dataset", spooled.Dataset, "error", err)
+            }
+            continue
+        }
+        d.resend(h, spooled)
+    }
+}
+
+func (d *DeadLetterQueue) resend(h *UserEventsHandler, spooled *SpooledEvent) {
+    client, done := h.useClient(spooled.Client)
+    defer done()
+    ev := client.NewEvent()
+    ev.Dataset = spooled.Dataset
+    ev.Timestamp = spooled.Timestamp
+    ev.SampleRate = spooled.SampleRate
+    ev.Add(spooled.Fields)
+    if spooled.Attempts > 0 {
+        ev.AddField("meta.retry_count", spooled.Attempts)
+    }
+    ev.Metadata = spooled
+    spooled.Attempts++
+    ev.SendPresampled()
+}
+
+func (d *DeadLetterQueue) spool(h *UserEventsHandler) Spool {
+    d.spoolOnce.Do(func() {
+        if d.Spool == nil {
+            d.Spool = &MemorySpool{}
+        }
+        if s, ok := d.Spool.(interface{ setLogger(*slog.Logger) }); ok {
+            s.setLogger(h.logger())
+        }
+    })
+    return d.Spool
+}
+
+// Our spools log what they have to drop to the handler's Logger, once a
+// DeadLetterQueue has one to give them
+type spoolLog struct {
+    log *slog.Logger
+}
+
+func (s *spoolLog) setLogger(log *slog.Logger) {
+    s.log = log
+}
+
+func (s *spoolLog) logger() *slog.Logger {
+    if s.log != nil {
+        return s.log
+    }
+    return slog.Default()
+}
+
+func (d *DeadLetterQueue) maxAttempts() int {
+    if d.MaxAttempts > 0 {
+        return d.MaxAttempts
+    }
+    return 8
+}
+
+func (d *DeadLetterQueue) backoff(attempts int) time.Duration {
+    base, max := d.BaseBackoff, d.MaxBackoff
+    if base <= 0 {
+        base = 5 * time.Second
+    }
+    if max <= 0 {
+        max = 10 * time.Minute
+    }
+    wait := base << uint(attempts-1)
+    if wait <= 0 || wait > max {
+        wait = max
+    }
+
+    jitter := math.Min(d.Jitter, 1)
+    if jitter <= 0 {
+        return wait
+    }
+    return wait - time.Duration(rand.Float64()*jitter*float64(wait))
+}
+
+// MemorySpool keeps failed events in memory, up to Max of them (default
+// 10000), dropping the oldest beyond that.
+type MemorySpool struct {
+    Max int
+
+    mu     sync.Mutex
+    events []*SpooledEvent
+    spoolLog
+}
+
+func (s *MemorySpool) Put(ev *SpooledEvent) error {
+    max := s.Max
+    if max <= 0 {
+        max = 10000
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    if len(s.events) >= max {
+        s.logger().Warn("memory spool full, dropping oldest failed event", "dataset", s.events[0].Dataset)
+        s.events = s.events[1:]
+    }
+    s.events = append(s.events, ev)
+    return nil
+}
+
+func (s *MemorySpool) Len() (int, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    return len(s.events), nil
+}
+
+func (s *MemorySpool) TakeDue(now time.Time, max int) ([]*SpooledEvent, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    var due []*SpooledEvent
+    kept := s.events[:0]
+    for _, ev := range s.events {
+        if len(due) < max && !ev.NextAttempt.After(now) {
+            due = append(due, ev)
+        } else {
+            kept = append(kept, ev)
+        }
+    }
+    s.events = kept
+    return due, nil
+}
+
+// DiskSpool keeps each failed event in its own JSON file, named so that
+// sorting the directory sorts events by when they're next due.
+type DiskSpool struct {
+    Dir string
+    mu  sync.Mutex
+    spoolLog
+}
+
+func (s *DiskSpool) Put(ev *SpooledEvent) error {
+    buf, err := json.Marshal(ev)
+    if err != nil {
+        return err
+    }
+    if err := os.MkdirAll(s.Dir, 0700); err != nil {
+        return err
+    }
+
+    // Write to a temp file and rename, so TakeDue never sees half an event
+    name := fmt.Sprintf("%020d-%08x.json", ev.NextAttempt.UnixNano(), rand.Uint32())
+    tmp := filepath.Join(s.Dir, "."+name)
+    if err := ioutil.WriteFile(tmp, buf, 0600); err != nil {
+        return err
+    }
+    return os.Rename(tmp, filepath.Join(s.Dir, name))
+}
+
+func (s *DiskSpool) Len() (int, error) {
+    names, err := filepath.Glob(filepath.Join(s.Dir, "[0-9]*.json"))
+    return len(names), err
+}
+
+func (s *DiskSpool) TakeDue(now time.Time, max int) ([]*SpooledEvent, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    names, err := filepath.Glob(filepath.Join(s.Dir, "[0-9]*.json"))
+    if err != nil {
+        return nil, err
+    }
+    sort.Strings(names)
+
+    var due []*SpooledEvent
+    for _, name := range names {
+        if len(due) >= max {
+            break
+        }
+        var nextAttempt int64
+        if _, err := fmt.Sscanf(filepath.Base(name), "%020d-", &nextAttempt); err != nil {
+            continue
+        }
+        if nextAttempt > now.UnixNano() {
+            break // Sorted by due time, so nothing after this is due either
+        }
+
+        buf, err := ioutil.ReadFile(name)
+        if err != nil {
+            return due, err
+        }
+        var ev SpooledEvent
+        if err := json.Unmarshal(buf, &ev); err != nil {
+            s.logger().Warn("dropping corrupt spool file", "file", name, "error", err)
+        } else {
+            due = append(due, &ev)
+        }
+        if err := os.Remove(name); err != nil {
+            return due, err
+        }
+    }
+    return due, nil
+}
@@ -0,0 +1,73 @@
+// sendBeacon and fetch both retry on flaky connections, and with no way to
+// tell a retry from a new event, we double-count page views. The browser now
+// gives each event a random `event_id`, and Deduplicator remembers the IDs
+// it's seen for TTL (in the handler's StateStore, so across instances), and
+// drops any event whose ID it's already seen.
+//
+//     handler.Dedup = &Deduplicator{}
+type Deduplicator struct {
+    TTL time.Duration // How long to remember IDs; defaults to 10 minutes, well past any browser retry
+}
+
+var duplicatesDropped = promauto.NewCounter(prometheus.CounterOpts{
+    Name: "user_events_duplicates_dropped_total",
+    Help: "Events dropped because we'd already received their event_id.",
+})
+
+// Anything longer isn't an ID we handed out, and we don't want browsers
+// picking arbitrarily long StateStore keys
+const maxEventIDLength = 64
+
+// Seen records the event's ID, and says whether we'd already recorded it.
+// Events without an ID are never duplicates, and if the store's down we'd
+// rather risk a double count than drop events.
+func (d *Deduplicator) Seen(store StateStore, tenant *Tenant, metadata map[string]interface{}) bool {
+    _, duplicate := d.claim(store, tenant, metadata)
+    return duplicate
+}
+
+// Seen, also returning the key it claimed the ID with (or "" if it didn't),
+// so ingest can give the ID back if it turns the event away after all: the
+// browser's retry of it isn't a duplicate
+func (d *Deduplicator) claim(store StateStore, tenant *Tenant, metadata map[string]interface{}) (key string, duplicate bool) {
+    id, ok := metadata["event_id"].(string)
+    if !ok || id == "" || len(id) > maxEventIDLength {
+        return "", false
+    }
+    key = "event-id:" + id
+    if tenant != nil {
+        key = "event-id:" + tenant.Name + ":" + id
+    }
+
+    ttl := d.TTL
+    if ttl <= 0 {
+        ttl = 10 * time.Minute
+    }
+    ctx, cancel := context.WithTimeout(context.Background(), stateStoreTimeout)
+    defer cancel()
+    first, err := store.SetIfAbsent(ctx, key, []byte("1"), ttl)
+    if err != nil {
+        return "", false
+    }
+    if first {
+        return key, false
+    }
+    duplicatesDropped.Inc()
+    return "", true
+}
+
+// Gives back IDs (and nonces) ingest claimed for an event it then turned away
+// in a way the browser will retry
+func (h *UserEventsHandler) releaseClaims(keys []string) {
+    ctx, cancel := context.WithTimeout(context.Background(), stateStoreTimeout)
+    defer cancel()
+    if err := h.state().Delete(ctx, keys...); err != nil {
+        h.logger().Warn("couldn't release claimed event IDs", "error", err)
+    }
+}
+
+// Whether the browser will send a dropped event again, going by what the
+// rejection tells it to do
+func retriedDrop(reason string) bool {
+    return reason != "" && actionFor(dropCode(reason)) != ActionDrop
+}
@@ -0,0 +1,189 @@
+// An alert on browser errors is only as quick as the errors are to get to
+// Honeycomb, and until now we couldn't say how quick that was: the browser
+// batches events up, we may queue them, and libhoney batches them again.
+// DeliveryTiming adds the timings we know to every event, as delivery.*
+// fields:
+//
+//     delivery.sent_at     when the browser says it sent it, by its own clock
+//     delivery.received_at when we received it
+//     delivery.browser_ms  from the event happening (skew corrected) to our receiving it
+//     delivery.queue_ms    waiting for a worker
+//     delivery.enrich_ms   enriching and scrubbing it
+//     delivery.server_ms   from our receiving it to handing it to the sink
+//
+// The last step, Honeycomb acknowledging it, only happens once the event's
+// gone, so it can't be on the event itself. Instead, for 1 in SampleRate of
+// the events libhoney sends, we send a delivery-timing event to Dataset once
+// libhoney has Honeycomb's response:
+//
+//     handler.Delivery = &DeliveryTiming{SampleRate: 100}
+//
+// It has the event's delivery.* fields, its type and dataset, and:
+//
+//     delivery.ack_ms      from handing it to libhoney to Honeycomb's response
+//     delivery.total_ms    from the event happening to Honeycomb's response
+//
+// These include any time spent on retries, if the DeadLetterQueue had to
+// retry it. Sinks other than the handler's libhoney clients only get the
+// fields on the event. Timing events wait in a queue of their own to be
+// sent, so a slow sink can't hold up libhoney's responses; if it's full,
+// they're dropped.
+type DeliveryTiming struct {
+    Dataset    string `yaml:"dataset"`     // Defaults to "user-events-ops"
+    Client     string `yaml:"client"`      // The ClientRouter client to send timing events with, if not Default
+    SampleRate uint   `yaml:"sample_rate"` // Send a timing event for 1 in this many events; defaults to 100
+    QueueSize  int    `yaml:"queue_size"`  // Timing events waiting to be sent; defaults to 1000
+
+    startOnce sync.Once
+    pending   chan *Event
+}
+
+// What we remember about an event we're timing, until libhoney says how its
+// send went
+type deliveryProbe struct {
+    eventType  string
+    dataset    string
+    timestamp  time.Time
+    sampleRate uint
+    handedOff  time.Time
+    fields     map[string]interface{} // Its delivery.* fields
+}
+
+const deliveryTimingType = "delivery-timing"
+
+func (d *DeliveryTiming) dataset() string {
+    if d.Dataset != "" {
+        return d.Dataset
+    }
+    return "user-events-ops"
+}
+
+func (d *DeliveryTiming) sampleRate() uint {
+    if d.SampleRate > 0 {
+        return d.SampleRate
+    }
+    return 100
+}
+
+func (d *DeliveryTiming) queueSize() int {
+    if d.QueueSize > 0 {
+        return d.QueueSize
+    }
+    return 1000
+}
+
+func millisecondsBetween(from, to time.Time) float64 {
+    return float64(to.Sub(from)) / float64(time.Millisecond)
+}
+
+// Adds the delivery.* fields to an event process is about to send
+func (d *DeliveryTiming) addFields(ev *Event, metadata map[string]interface{}, receivedAt, started time.Time, enrich time.Duration) {
+    if sentAt, ok := parseClientTime(metadata["sent_at"]); ok {
+        ev.AddField("delivery.sent_at", sentAt.UTC().Format(time.RFC3339Nano))
+    }
+    ev.AddField("delivery.received_at", receivedAt.UTC().Format(time.RFC3339Nano))
+    if _, ok := parseClientTime(metadata["timestamp"]); ok {
+        ev.AddField("delivery.browser_ms", millisecondsBetween(ev.Timestamp, receivedAt))
+    }
+    ev.AddField("delivery.queue_ms", millisecondsBetween(receivedAt, started))
+    ev.AddField("delivery.enrich_ms", float64(enrich)/float64(time.Millisecond))
+    ev.AddField("delivery.server_ms", millisecondsBetween(receivedAt, time.Now()))
+}
+
+// A probe for this event, if it has delivery fields and is in the sample
+func (d *DeliveryTiming) probe(ev Event) *deliveryProbe {
+    if d == nil || ev.Type == deliveryTimingType || rand.Intn(int(d.sampleRate())) != 0 {
+        return nil
+    }
+    fields := ev.Fields()
+    if _, ok := fields["delivery.received_at"]; !ok {
+        return nil // Not one of the browser's, or not one process timed
+    }
+    probe := &deliveryProbe{
+        eventType:  ev.Type,
+        dataset:    ev.Dataset,
+        timestamp:  ev.Timestamp,
+        sampleRate: ev.SampleRate,
+        handedOff:  time.Now(),
+        fields:     make(map[string]interface{}),
+    }
+    for name, value := range fields {
+        if strings.HasPrefix(name, "delivery.") {
+            probe.fields[name] = value
+        }
+    }
+    return probe
+}
+
+// Attaches probe to a libhoney event, alongside anything the DeadLetterQueue
+// needs from its response
+func attachProbe(lev *libhoney.Event, probe *deliveryProbe) {
+    if probe == nil {
+        return
+    }
+    if spooled, ok := lev.Metadata.(*SpooledEvent); ok {
+        spooled.probe = probe
+        return
+    }
+    lev.Metadata = probe
+}
+
+func probeFrom(metadata interface{}) *deliveryProbe {
+    switch m := metadata.(type) {
+    case *deliveryProbe:
+        return m
+    case *SpooledEvent:
+        return m.probe
+    }
+    return nil
+}
+
+// Queues the timing event for a probed event, once libhoney has its response.
+// An event the DeadLetterQueue is going to retry is timed when the retry
+// goes through instead.
+func (d *DeliveryTiming) handleResponse(h *UserEventsHandler, resp transmission.Response) {
+    probe := probeFrom(resp.Metadata)
+    if probe == nil || (h.DeadLetters != nil && retryable(resp)) {
+        return
+    }
+    if !h.beginSend() {
+        return // The clients are closing
+    }
+    acked := time.Now()
+    ev := h.newEvent(deliveryTimingType, nil, nil)
+    ev.Dataset = d.dataset()
+    if d.Client != "" {
+        ev.Client = d.Client
+    }
+    ev.Timestamp = probe.timestamp
+    ev.SampleRate = probe.sampleRate * d.sampleRate() // So it weighs as the events it stands for
+    ev.Add(probe.fields)
+    ev.AddField("delivered_type", probe.eventType)
+    ev.AddField("delivered_dataset", probe.dataset)
+    ev.AddField("delivery.ack_ms", millisecondsBetween(probe.handedOff, acked))
+    ev.AddField("delivery.total_ms", millisecondsBetween(probe.timestamp, acked))
+    ev.AddField("delivery.outcome", classifyResponse(resp).String())
+    if resp.StatusCode != 0 {
+        ev.AddField("delivery.status_code", resp.StatusCode)
+    }
+
+    d.startOnce.Do(func() {
+        d.pending = make(chan *Event, d.queueSize())
+        go d.sendPending(h)
+    })
+    select {
+    case d.pending <- ev: // Still in flight, so Close waits for it
+    default:
+        eventsDropped.WithLabelValues(deliveryTimingType, "queue_full").Inc()
+        h.inflight.Done()
+    }
+}
+
+func (d *DeliveryTiming) sendPending(h *UserEventsHandler) {
+    for ev := range d.pending {
+        ctx, cancel := context.WithTimeout(context.Background(), queueSendTimeout)
+        h.send(ctx, ev)
+        cancel()
+        h.inflight.Done()
+    }
+}
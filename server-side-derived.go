@@ -0,0 +1,97 @@
+// DerivedFields lets operators add fields computed from the others, written
+// as CEL expressions over the event's fields, without a code change:
+//
+//     derived_fields:
+//       - name: is_slow
+//         expression: event.page_load_time_ms > 3000
+//       - name: url_path
+//         expression: regex_replace(event.url, "[?#].*$", "")
+//
+// Fields are evaluated in order, after the enrichers, so an expression can use
+// server-added fields and earlier derived ones. An expression that refers to
+// a field the event doesn't have (or fails for any other reason) just doesn't
+// add its field; use has(event.x) to test for one. Alongside CEL's
+// built-ins, regex_replace(s, pattern, replacement) works like Go's
+// regexp.ReplaceAllString.
+type DerivedFields struct {
+    fields []compiledField
+}
+
+type DerivedField struct {
+    Name       string `yaml:"name"`
+    Expression string `yaml:"expression"`
+}
+
+type compiledField struct {
+    name    string
+    program cel.Program
+}
+
+// Generous for the kind of expressions we expect, but enough to stop a
+// pathological one from eating a worker
+const derivedFieldCostLimit = 10000
+
+func NewDerivedFields(defs []DerivedField) (*DerivedFields, error) {
+    env, err := cel.NewEnv(
+        cel.Variable("event", cel.MapType(cel.StringType, cel.DynType)),
+        cel.CrossTypeNumericComparisons(true), // JSON numbers are all doubles, but people will write 3000
+        cel.Function("regex_replace",
+            cel.Overload("regex_replace_string_string_string",
+                []*cel.Type{cel.StringType, cel.StringType, cel.StringType}, cel.StringType,
+                cel.FunctionBinding(celRegexReplace),
+            ),
+        ),
+    )
+    if err != nil {
+        return nil, err
+    }
+
+    d := &DerivedFields{}
+    for _, def := range defs {
+        ast, issues := env.Compile(def.Expression)
+        if issues != nil && issues.Err() != nil {
+            return nil, fmt.Errorf("derived field %s: %v", def.Name, issues.Err())
+        }
+        program, err := env.Program(ast, cel.CostLimit(derivedFieldCostLimit))
+        if err != nil {
+            return nil, fmt.Errorf("derived field %s: %v", def.Name, err)
+        }
+        d.fields = append(d.fields, compiledField{name: def.Name, program: program})
+    }
+    return d, nil
+}
+
+func (d *DerivedFields) Enrich(ctx context.Context, ev *Event, r *http.Request, user *UserInfo) error {
+    fields := ev.Fields()
+    for _, field := range d.fields {
+        out, _, err := field.program.Eval(map[string]interface{}{"event": fields})
+        if err != nil {
+            continue // Usually a missing field, which is expected on other event types
+        }
+        ev.AddField(field.name, out.Value())
+    }
+    return nil
+}
+
+// Patterns are almost always literals in the expression, so it's worth
+// keeping them compiled
+var celRegexps sync.Map // Pattern -> *regexp.Regexp
+
+func celRegexReplace(args ...ref.Val) ref.Val {
+    s, ok1 := args[0].(celtypes.String)
+    pattern, ok2 := args[1].(celtypes.String)
+    replacement, ok3 := args[2].(celtypes.String)
+    if !ok1 || !ok2 || !ok3 {
+        return celtypes.NewErr("regex_replace takes three strings")
+    }
+
+    re, ok := celRegexps.Load(string(pattern))
+    if !ok {
+        compiled, err := regexp.Compile(string(pattern))
+        if err != nil {
+            return celtypes.NewErr("regex_replace: %v", err)
+        }
+        re, _ = celRegexps.LoadOrStore(string(pattern), compiled)
+    }
+    return celtypes.String(re.(*regexp.Regexp).ReplaceAllString(string(s), string(replacement)))
+}
@@ -0,0 +1,226 @@
+// A new browser SDK release that renames a field, or starts sending a number
+// as a string, quietly breaks every query and board that used the old one,
+// and nobody notices until someone looks. SchemaDrift watches a sample of
+// sessions on two SDK versions (by their sdk_version field) while the new one
+// rolls out, and every Interval sends a schema-drift event for each event type
+// whose fields differ between them:
+//
+//     handler.Drift = &SchemaDrift{Baseline: "2.3.1", Canary: "2.4.0"}
+//     go handler.Drift.Run(ctx, handler)
+//
+// Each report lists the fields the canary added (fields_added), stopped
+// sending (fields_removed), and sends as a different JSON type
+// (fields_retyped, e.g. "duration:number->string"), as the events arrive from
+// the browser, after any Transforms. Field sets are compared per instance, and
+// only once both versions have sent MinEvents of a type, so one odd event
+// doesn't make a report.
+type SchemaDrift struct {
+    Baseline string
+    Canary   string
+
+    SessionSampleRate uint          // Watch 1 in N sessions; defaults to 10
+    Interval          time.Duration // How often to compare and report; defaults to 5 minutes
+    MinEvents         int64         // Per version and event type; defaults to 50
+    Dataset           string        // Where schema-drift events go; defaults to the usual dataset for the type
+
+    mu      sync.Mutex
+    observe map[driftKey]*fieldKinds
+}
+
+const (
+    schemaDriftType  = "schema-drift"
+    sdkVersionField  = "sdk_version"
+    maxDriftFields   = 1000 // Per type and version, so a hostile client can't grow this forever
+    driftFieldsShown = 50
+)
+
+type driftKey struct {
+    eventType string
+    version   string
+}
+
+// How many events have had each field, by JSON type
+type fieldKinds struct {
+    events int64
+    fields map[string]map[string]int64
+}
+
+var schemaDriftReports = promauto.NewCounterVec(prometheus.CounterOpts{
+    Name: "user_events_schema_drift_reports_total",
+    Help: "schema-drift events sent, by the event type whose fields drifted.",
+}, []string{"type"})
+
+func (d *SchemaDrift) sessionSampleRate() uint {
+    if d.SessionSampleRate > 0 {
+        return d.SessionSampleRate
+    }
+    return 10
+}
+
+func (d *SchemaDrift) interval() time.Duration {
+    if d.Interval > 0 {
+        return d.Interval
+    }
+    return 5 * time.Minute
+}
+
+func (d *SchemaDrift) minEvents() int64 {
+    if d.MinEvents > 0 {
+        return d.MinEvents
+    }
+    return 50
+}
+
+// Whether the event is from a watched session on one of the two versions
+func (d *SchemaDrift) watches(metadata map[string]interface{}) (string, bool) {
+    version, _ := metadata[sdkVersionField].(string)
+    if version == "" || (version != d.Baseline && version != d.Canary) {
+        return "", false
+    }
+    session := firstPresent(metadata, "session_id", "page_load_id")
+    if session == "" {
+        return "", false
+    }
+    hash := fnv.New32a()
+    hash.Write([]byte(fmt.Sprint(session)))
+    return version, hash.Sum32()%uint32(d.sessionSampleRate()) == 0
+}
+
+// Notes the fields of an event as it arrives
+func (d *SchemaDrift) record(eventType string, metadata map[string]interface{}) {
+    version, ok := d.watches(metadata)
+    if !ok {
+        return
+    }
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    if d.observe == nil {
+        d.observe = make(map[driftKey]*fieldKinds)
+    }
+    key := driftKey{eventType: eventType, version: version}
+    seen := d.observe[key]
+    if seen == nil {
+        seen = &fieldKinds{fields: make(map[string]map[string]int64)}
+        d.observe[key] = seen
+    }
+    seen.events++
+    for name, value := range metadata {
+        kinds := seen.fields[name]
+        if kinds == nil {
+            if len(seen.fields) >= maxDriftFields {
+                continue
+            }
+            kinds = make(map[string]int64)
+            seen.fields[name] = kinds
+        }
+        kinds[jsonKind(value)]++
+    }
+}
+
+func jsonKind(value interface{}) string {
+    switch value.(type) {
+    case nil:
+        return "null"
+    case string:
+        return "string"
+    case bool:
+        return "bool"
+    case map[string]interface{}:
+        return "object"
+    case []interface{}:
+        return "array"
+    }
+    return "number" // float64 from JSON, but msgpack and protobuf have others
+}
+
+// The type most of the events sent the field as
+func (k *fieldKinds) kind(name string) string {
+    var best string
+    var most int64
+    for kind, n := range k.fields[name] {
+        if n > most || (n == most && kind < best) {
+            best, most = kind, n
+        }
+    }
+    return best
+}
+
+// Run compares the versions and reports drift every Interval, until ctx is
+// done.
+func (d *SchemaDrift) Run(ctx context.Context, h *UserEventsHandler) {
+    ticker := time.NewTicker(d.interval())
+    defer ticker.Stop()
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+            d.report(ctx, h)
+        }
+    }
+}
+
+func (d *SchemaDrift) report(ctx context.Context, h *UserEventsHandler) {
+    d.mu.Lock()
+    observed := d.observe
+    d.observe = nil
+    d.mu.Unlock()
+
+    for key, baseline := range observed {
+        if key.version != d.Baseline {
+            continue
+        }
+        canary := observed[driftKey{eventType: key.eventType, version: d.Canary}]
+        if canary == nil || baseline.events < d.minEvents() || canary.events < d.minEvents() {
+            continue
+        }
+        added, removed, retyped := compareFields(baseline, canary)
+        if len(added)+len(removed)+len(retyped) == 0 {
+            continue
+        }
+
+        schemaDriftReports.WithLabelValues(metricsTypeLabel(key.eventType)).Inc()
+        ev := h.newEvent(schemaDriftType, nil, nil)
+        if d.Dataset != "" {
+            ev.Dataset = d.Dataset
+        }
+        ev.AddField("drift_event_type", key.eventType)
+        ev.AddField("baseline_version", d.Baseline)
+        ev.AddField("canary_version", d.Canary)
+        ev.AddField("baseline_events", baseline.events)
+        ev.AddField("canary_events", canary.events)
+        ev.AddField("fields_added", joinFields(added))
+        ev.AddField("fields_removed", joinFields(removed))
+        ev.AddField("fields_retyped", joinFields(retyped))
+        ev.AddField("fields_changed", len(added)+len(removed)+len(retyped))
+        h.send(ctx, ev)
+    }
+}
+
+func compareFields(baseline, canary *fieldKinds) (added, removed, retyped []string) {
+    for name := range canary.fields {
+        if _, ok := baseline.fields[name]; !ok {
+            added = append(added, name)
+        }
+    }
+    for name := range baseline.fields {
+        if _, ok := canary.fields[name]; !ok {
+            removed = append(removed, name)
+            continue
+        }
+        if from, to := baseline.kind(name), canary.kind(name); from != to {
+            retyped = append(retyped, name+":"+from+"->"+to)
+        }
+    }
+    sort.Strings(added)
+    sort.Strings(removed)
+    sort.Strings(retyped)
+    return added, removed, retyped
+}
+
+func joinFields(names []string) string {
+    if len(names) > driftFieldsShown {
+        return strings.Join(names[:driftFieldsShown], ",") + fmt.Sprintf(",... (%d more)", len(names)-driftFieldsShown)
+    }
+    return strings.Join(names, ",")
+}
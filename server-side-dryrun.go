@@ -0,0 +1,103 @@
+// Before a new scrubbing rule (or a new event type) touches production data,
+// it's nice to see what it would do. With DryRun, events still go through the
+// whole pipeline (validation, sampling, enrichment, scrubbing, processors and
+// the PresendHook) but aren't sent: they're written to Output instead, if
+// there is one, and tallied up for Report.
+//
+//     f, _ := os.Create("/tmp/dry-run.jsonl")
+//     handler.DryRun = &DryRun{Types: []string{"page-error"}, Output: &JSONLinesSink{W: f}}
+//
+// The report is also logged when the handler closes.
+type DryRun struct {
+    All    bool     // Every event type is a dry run
+    Types  []string // ...or just these
+    Output Sink     // Where dry-run events go instead; nil just counts them
+
+    mu      sync.Mutex
+    reports map[string]*dryRunTally
+}
+
+// DryRunReport is what each event type would have sent
+type DryRunReport map[string]DryRunTypeReport
+
+type DryRunTypeReport struct {
+    Events   int      `json:"events"`
+    Datasets []string `json:"datasets"`
+    Fields   []string `json:"fields"` // Every field name seen, sorted
+}
+
+type dryRunTally struct {
+    events   int
+    datasets map[string]bool
+    fields   map[string]bool
+}
+
+var dryRunEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+    Name: "user_events_dry_run_total",
+    Help: "Events that would have been sent if it weren't a dry run.",
+}, []string{"type"})
+
+func (d *DryRun) applies(eventType string) bool {
+    if d == nil {
+        return false
+    }
+    if d.All {
+        return true
+    }
+    for _, t := range d.Types {
+        if t == eventType {
+            return true
+        }
+    }
+    return false
+}
+
+func (d *DryRun) capture(ctx context.Context, h *UserEventsHandler, ev *Event) {
+    dryRunEvents.WithLabelValues(metricsTypeLabel(ev.Type)).Inc()
+
+    d.mu.Lock()
+    if d.reports == nil {
+        d.reports = make(map[string]*dryRunTally)
+    }
+    tally := d.reports[ev.Type]
+    if tally == nil {
+        tally = &dryRunTally{datasets: make(map[string]bool), fields: make(map[string]bool)}
+        d.reports[ev.Type] = tally
+    }
+    tally.events++
+    tally.datasets[ev.Dataset] = true
+    for name := range ev.Fields() {
+        tally.fields[name] = true
+    }
+    d.mu.Unlock()
+
+    if d.Output != nil {
+        if err := d.Output.Send(ctx, *ev); err != nil {
+            h.logger().Warn("couldn't write dry-run event", "type", ev.Type, "error", err)
+        }
+    }
+}
+
+// Report tallies up the events captured so far, by event type.
+func (d *DryRun) Report() DryRunReport {
+    d.mu.Lock()
+    defer d.mu.Unlock()
+    report := make(DryRunReport, len(d.reports))
+    for eventType, tally := range d.reports {
+        report[eventType] = DryRunTypeReport{
+            Events:   tally.events,
+            Datasets: sortedKeys(tally.datasets),
+            Fields:   sortedKeys(tally.fields),
+        }
+    }
+    return report
+}
+
+func sortedKeys(set map[string]bool) []string {
+    keys := make([]string, 0, len(set))
+    for key := range set {
+        keys = append(keys, key)
+    }
+    sort.Strings(keys)
+    return keys
+}
@@ -0,0 +1,209 @@
+// JSON is most of what mobile-web users pay to send us, so /events/batch also
+// takes two more compact encodings of the same events, going by the request's
+// Content-Type:
+//
+//     application/x-protobuf   an EventBatch message (see ingest.proto)
+//     application/msgpack      a MessagePack array of event maps
+//
+// Anything else is read as JSON. Either way the events come out looking
+// exactly like decoded JSON (numbers as float64s, and so on), so nothing
+// downstream needs to know how they arrived. We never read more than
+// MaxBodyBytes, LimitBody or not, and every decoder stops at the
+// PayloadLimits' depth before it's built anything deeper.
+func (h *UserEventsHandler) decodeBatchRequest(w http.ResponseWriter, r *http.Request) ([]map[string]interface{}, error) {
+    body := http.MaxBytesReader(w, r.Body, h.maxBodyBytes())
+    mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+    switch mediaType {
+    case "application/x-protobuf", "application/protobuf":
+        return decodeProtobufBatch(body, h.limits())
+    case "application/msgpack", "application/x-msgpack", "application/vnd.msgpack":
+        return decodeMsgpackBatch(body, h.limits())
+    }
+    return decodeEventBatch(body, h.limits())
+}
+
+// Each level of an event's JSON is at most three levels of messages in
+// structpb (a Struct's map entry, its Value, and the Struct or ListValue in
+// that), under the EventBatch and EventRequest. That's a looser bound than
+// MaxDepth, which apply then checks exactly, but it stops proto.Unmarshal well
+// short of anything expensive.
+func protobufRecursionLimit(limits *PayloadLimits) int {
+    return 2 + 3*(limits.maxDepth()+1)
+}
+
+func decodeProtobufBatch(body io.Reader, limits *PayloadLimits) ([]map[string]interface{}, error) {
+    buf, err := ioutil.ReadAll(body)
+    if err != nil {
+        return nil, fmt.Errorf("reading events: %w", err)
+    }
+    var batch ingestpb.EventBatch
+    if err := (proto.UnmarshalOptions{RecursionLimit: protobufRecursionLimit(limits)}).Unmarshal(buf, &batch); err != nil {
+        return nil, fmt.Errorf("invalid protobuf EventBatch: %v", err)
+    }
+    events := make([]map[string]interface{}, 0, len(batch.GetEvents()))
+    for _, req := range batch.GetEvents() {
+        metadata := req.GetFields().AsMap() // structpb already gives us JSON-shaped values
+        if req.GetType() != "" {
+            metadata["type"] = req.GetType()
+        }
+        events = append(events, metadata)
+    }
+    return events, nil
+}
+
+// msgpack.Unmarshal will build whatever the body describes, however deep, so
+// we decode maps and arrays ourselves, checking MaxDepth before going into
+// each one and the declared lengths against MaxFields and MaxValues before
+// allocating for them. Scalars are left to the msgpack decoder.
+func decodeMsgpackBatch(body io.Reader, limits *PayloadLimits) ([]map[string]interface{}, error) {
+    dec := msgpack.NewDecoder(body)
+    n, err := dec.DecodeArrayLen()
+    if err != nil {
+        return nil, fmt.Errorf("invalid MessagePack array of events: %w", err)
+    }
+    if n < 0 {
+        return nil, nil // A nil array
+    }
+    if n > maxBatchEvents {
+        return nil, errTooManyEvents
+    }
+    events := make([]map[string]interface{}, 0, n)
+    for i := 0; i < n; i++ {
+        d := msgpackLimitDecoder{dec: dec, limits: limits}
+        code, err := dec.PeekCode()
+        if err != nil {
+            return nil, fmt.Errorf("invalid MessagePack event #%d: %w", i+1, err)
+        }
+        if !msgpackMap(code) {
+            return nil, fmt.Errorf("invalid MessagePack event #%d: not a map", i+1)
+        }
+        metadata, err := d.object(1)
+        if err != nil {
+            return nil, fmt.Errorf("invalid MessagePack event #%d: %w", i+1, err)
+        }
+        events = append(events, metadata)
+    }
+    return events, nil
+}
+
+type msgpackLimitDecoder struct {
+    dec    *msgpack.Decoder
+    limits *PayloadLimits
+    values int // In the event so far
+}
+
+func msgpackMap(code byte) bool {
+    return msgpcode.IsFixedMap(code) || code == msgpcode.Map16 || code == msgpcode.Map32
+}
+
+func msgpackArray(code byte) bool {
+    return msgpcode.IsFixedArray(code) || code == msgpcode.Array16 || code == msgpcode.Array32
+}
+
+func (d *msgpackLimitDecoder) count(n int) error {
+    d.values += n
+    if d.values > d.limits.maxValues() {
+        return fmt.Errorf("has more than the %d values allowed", d.limits.maxValues())
+    }
+    return nil
+}
+
+func (d *msgpackLimitDecoder) object(depth int) (map[string]interface{}, error) {
+    n, err := d.dec.DecodeMapLen()
+    if err != nil || n < 0 {
+        return nil, err
+    }
+    if depth == 1 && n > d.limits.maxFields() {
+        return nil, fmt.Errorf("has %d fields, more than the %d allowed", n, d.limits.maxFields())
+    }
+    if err := d.count(n); err != nil {
+        return nil, err
+    }
+    object := make(map[string]interface{}, n)
+    for i := 0; i < n; i++ {
+        name, err := d.dec.DecodeString()
+        if err != nil {
+            return nil, err
+        }
+        value, err := d.value(name, depth)
+        if err != nil {
+            return nil, err
+        }
+        object[name] = value
+    }
+    return object, nil
+}
+
+// Decodes a value in an object or array at depth, so any map or array it is
+// goes one deeper
+func (d *msgpackLimitDecoder) value(name string, depth int) (interface{}, error) {
+    code, err := d.dec.PeekCode()
+    if err != nil {
+        return nil, err
+    }
+    nested := msgpackMap(code) || msgpackArray(code)
+    if nested && depth >= d.limits.maxDepth() {
+        return nil, fmt.Errorf("%s nests deeper than %d levels", truncateName(name), d.limits.maxDepth())
+    }
+    switch {
+    case msgpackMap(code):
+        return d.object(depth + 1)
+    case msgpackArray(code):
+        n, err := d.dec.DecodeArrayLen()
+        if err != nil || n < 0 {
+            return nil, err
+        }
+        if err := d.count(n); err != nil {
+            return nil, err
+        }
+        items := make([]interface{}, n)
+        for i := range items {
+            if items[i], err = d.value(name, depth+1); err != nil {
+                return nil, err
+            }
+        }
+        return items, nil
+    }
+    value, err := d.dec.DecodeInterface()
+    return jsonShaped(value), err
+}
+
+// MessagePack keeps integer widths and has binary and timestamp types, none
+// of which JSON does
+func jsonShaped(value interface{}) interface{} {
+    switch v := value.(type) {
+    case int8:
+        return float64(v)
+    case int16:
+        return float64(v)
+    case int32:
+        return float64(v)
+    case int64:
+        return float64(v)
+    case uint8:
+        return float64(v)
+    case uint16:
+        return float64(v)
+    case uint32:
+        return float64(v)
+    case uint64:
+        return float64(v)
+    case float32:
+        return float64(v)
+    case []byte:
+        return string(v)
+    case time.Time:
+        return v.Format(time.RFC3339Nano)
+    case []interface{}:
+        for i := range v {
+            v[i] = jsonShaped(v[i])
+        }
+        return v
+    case map[string]interface{}:
+        for name := range v {
+            v[name] = jsonShaped(v[name])
+        }
+        return v
+    }
+    return value
+}
@@ -0,0 +1,137 @@
+// Some of our datasets are shared with contractors, who mustn't be able to
+// read PII in them. Hashing (see Scrubber) hides a value for good;
+// FieldEncryptor encrypts it instead, with AES-256-GCM under an org key, so
+// the few people holding the key can still decrypt it with the decrypt
+// command when they need to:
+//
+//     handler.Encryptor = &FieldEncryptor{
+//         Fields: []string{"user_email", "user_*_name"},
+//         KeyID:  "2024-01",
+//         Key:    key, // 32 bytes
+//     }
+//
+// Encrypted values look like "enc:v1:<key ID>:<base64 nonce+ciphertext>". The
+// field name is bound in as additional data, so a value can't be passed off
+// as some other field's. With Deterministic set the same value always
+// encrypts the same way, so it's still groupable in Honeycomb, at the cost of
+// revealing which events share a value. Its nonces come from an HMAC under a
+// subkey HKDF derives from Key, never Key itself.
+type FieldEncryptor struct {
+    Fields        []string // Exact field names, or path.Match globs
+    KeyID         string   // Recorded in each value, so we know which key to decrypt with
+    Key           []byte   // 32 bytes
+    Deterministic bool
+
+    once     sync.Once
+    aead     cipher.AEAD
+    nonceKey []byte // For Deterministic nonces
+    err      error
+}
+
+const (
+    encryptedPrefix = "enc:v1:"
+
+    // HKDF's info for the deterministic nonce subkey, so it can't collide
+    // with anything else we might derive from the same key
+    nonceKeyInfo = "user-events field encryption: deterministic nonce"
+)
+
+func (e *FieldEncryptor) aeadCipher() (cipher.AEAD, error) {
+    e.once.Do(func() {
+        e.aead, e.err = newFieldCipher(e.Key)
+        if e.err != nil {
+            return
+        }
+        e.nonceKey = make([]byte, 32)
+        _, e.err = io.ReadFull(hkdf.New(sha256.New, e.Key, nil, []byte(nonceKeyInfo)), e.nonceKey)
+    })
+    return e.aead, e.err
+}
+
+func newFieldCipher(key []byte) (cipher.AEAD, error) {
+    if len(key) != 32 {
+        return nil, fmt.Errorf("field encryption key must be 32 bytes, got %d", len(key))
+    }
+    block, err := aes.NewCipher(key)
+    if err != nil {
+        return nil, err
+    }
+    return cipher.NewGCM(block)
+}
+
+// Encrypt replaces every configured field in fields with its encrypted value.
+// If the key is unusable we drop the fields rather than send them in the
+// clear.
+func (e *FieldEncryptor) Encrypt(fields map[string]interface{}) error {
+    aead, err := e.aeadCipher()
+    for name, value := range fields {
+        if !e.covers(name) || value == nil {
+            continue
+        }
+        if err != nil {
+            delete(fields, name)
+            continue
+        }
+        plaintext := fmt.Sprint(value)
+        if strings.HasPrefix(plaintext, encryptedPrefix) {
+            continue // Already done, e.g. by an upstream instance
+        }
+        fields[name] = e.seal(aead, name, plaintext)
+    }
+    return err
+}
+
+func (e *FieldEncryptor) covers(name string) bool {
+    for _, pattern := range e.Fields {
+        if pattern == name {
+            return true
+        }
+        if matched, _ := path.Match(pattern, name); matched {
+            return true
+        }
+    }
+    return false
+}
+
+func (e *FieldEncryptor) seal(aead cipher.AEAD, name, plaintext string) string {
+    nonce := make([]byte, aead.NonceSize())
+    if e.Deterministic {
+        mac := hmac.New(sha256.New, e.nonceKey)
+        mac.Write([]byte(name + "\x00" + plaintext))
+        copy(nonce, mac.Sum(nil))
+    } else {
+        crand.Read(nonce)
+    }
+    sealed := aead.Seal(nonce, nonce, []byte(plaintext), []byte(name))
+    return encryptedPrefix + e.KeyID + ":" + base64.RawURLEncoding.EncodeToString(sealed)
+}
+
+// DecryptField reverses FieldEncryptor for one value of the named field,
+// looking the key up by the ID recorded in the value. Values that aren't
+// encrypted are returned as-is.
+func DecryptField(name, value string, keys map[string][]byte) (string, error) {
+    if !strings.HasPrefix(value, encryptedPrefix) {
+        return value, nil
+    }
+    keyID, encoded, ok := strings.Cut(strings.TrimPrefix(value, encryptedPrefix), ":")
+    if !ok {
+        return "", errors.New("malformed encrypted value")
+    }
+    key, ok := keys[keyID]
+    if !ok {
+        return "", fmt.Errorf("no key with ID %q", keyID)
+    }
+    aead, err := newFieldCipher(key)
+    if err != nil {
+        return "", err
+    }
+    sealed, err := base64.RawURLEncoding.DecodeString(encoded)
+    if err != nil || len(sealed) < aead.NonceSize() {
+        return "", errors.New("malformed encrypted value")
+    }
+    plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(name))
+    if err != nil {
+        return "", fmt.Errorf("decrypting %s: %v", name, err)
+    }
+    return string(plaintext), nil
+}
@@ -0,0 +1,83 @@
+// An Enricher adds server-side fields to a browser event before we send it on
+// to Honeycomb. Teams can append their own (geo, A/B tests, deploy metadata)
+// to UserEventsHandler.Enrichers without having to fork the handler.
+//
+// ctx carries the deadline for processing the event, which isn't r's: with a
+// Queue, the request is likely over by the time enrichers run. Anything that
+// makes a network call, or could otherwise be slow, should give up when ctx
+// is done rather than hold up the worker.
+type Enricher interface {
+    Enrich(ctx context.Context, ev *Event, r *http.Request, user *UserInfo) error
+}
+
+// EnricherFunc lets a plain function be used as an Enricher.
+type EnricherFunc func(ctx context.Context, ev *Event, r *http.Request, user *UserInfo) error
+
+func (f EnricherFunc) Enrich(ctx context.Context, ev *Event, r *http.Request, user *UserInfo) error {
+    return f(ctx, ev, r, user)
+}
+
+// UserEnricher adds the fields we have easy access to because we know who the
+// current user is (see UserResolver). Anonymous visitors get a visitor_id
+// instead of a user_id.
+type UserEnricher struct{}
+
+func (UserEnricher) Enrich(ctx context.Context, ev *Event, r *http.Request, user *UserInfo) error {
+    if user == nil {
+        return nil
+    }
+    if user.Unresolved {
+        ev.AddField("user_resolution", "failed")
+        ev.AddField("session_cookie_hash", user.ID)
+        return nil
+    }
+    if user.Anonymous {
+        ev.AddField("visitor_id", user.ID)
+        return nil
+    }
+    ev.AddField("user_id", user.ID)
+    if user.Email != "" {
+        ev.AddField("user_email", user.Email)
+    }
+    for name, value := range user.Attributes {
+        ev.AddField("user_"+name, value)
+    }
+    return nil
+}
+
+// UserAgentEnricher parses the request's User-Agent header into structured
+// fields. The browser can't reliably classify itself, and doing it once here
+// keeps the client payload small.
+type UserAgentEnricher struct{}
+
+func (UserAgentEnricher) Enrich(ctx context.Context, ev *Event, r *http.Request, user *UserInfo) error {
+    header := r.UserAgent()
+    if header == "" {
+        return nil
+    }
+    ua := user_agent.New(header)
+
+    browserName, browserVersion := ua.Browser()
+    os := ua.OSInfo()
+    ev.AddField("browser_name", browserName)
+    ev.AddField("browser_version", browserVersion)
+    ev.AddField("os_name", os.Name)
+    ev.AddField("os_version", os.Version)
+    ev.AddField("device_type", deviceType(ua, header))
+    return nil
+}
+
+// One of "bot", "tablet", "mobile", or "desktop"
+func deviceType(ua *user_agent.UserAgent, header string) string {
+    switch {
+    case ua.Bot():
+        return "bot"
+    case strings.Contains(header, "iPad"),
+        strings.Contains(header, "Android") && !strings.Contains(header, "Mobile"):
+        return "tablet"
+    case ua.Mobile():
+        return "mobile"
+    default:
+        return "desktop"
+    }
+}
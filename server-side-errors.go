@@ -0,0 +1,120 @@
+// Browser errors (see page-error.js) arrive as an "error" event with the
+// message, stack, and source location the browser gave us. Stacks from
+// minified bundles differ between browsers and between builds, so we parse
+// them into frames, normalize those, and hash the result into an
+// `error_fingerprint` that stays the same for the same bug. Grouping by
+// fingerprint in Honeycomb then works like a lightweight JS error tracker.
+const errorEventType = "error"
+
+// StackFrame is one parsed line of a browser stack trace.
+type StackFrame struct {
+    Function string `json:"function,omitempty"`
+    File     string `json:"file"`
+    Line     int    `json:"line"`
+    Column   int    `json:"column"`
+}
+
+var (
+    // Chrome/Edge: "    at fn (https://example.com/main.js:1:2345)" or
+    // "    at https://example.com/main.js:1:2345"
+    chromeFrame = regexp.MustCompile(`^\s*at (?:(.+?) \()?(.+?):(\d+):(\d+)\)?$`)
+
+    // Firefox/Safari: "fn@https://example.com/main.js:1:2345"
+    geckoFrame = regexp.MustCompile(`^\s*(.*?)@(.+?):(\d+):(\d+)$`)
+
+    // Build hashes in bundle names, e.g. main.3f9a2c1b.js -> main.js
+    bundleHash = regexp.MustCompile(`\.[0-9a-f]{6,}(\.\w+)$`)
+
+    // Numbers and quoted strings in messages, which vary between occurrences
+    // of the same error ("Cannot read property 'x' of undefined")
+    messageNoise = regexp.MustCompile(`'[^']*'|"[^"]*"|\b\d+\b`)
+)
+
+// How many of the innermost frames go into the fingerprint. Outer frames are
+// mostly framework code, and differ with how we got to the bug, not the bug.
+const fingerprintFrames = 5
+
+func (h *UserEventsHandler) addErrorFields(ev *Event, metadata map[string]interface{}) {
+    message, _ := metadata["error_message"].(string)
+    name, _ := metadata["error_name"].(string)
+    stack, _ := metadata["error_stack"].(string)
+
+    frames := parseStack(stack)
+    if len(frames) == 0 {
+        // No stack, e.g. a cross-origin "Script error.". Fall back on the
+        // location the browser reported.
+        if source, ok := metadata["error_source"].(string); ok && source != "" {
+            line, _ := metadata["error_lineno"].(float64)
+            col, _ := metadata["error_colno"].(float64)
+            frames = []StackFrame{{File: source, Line: int(line), Column: int(col)}}
+        }
+    }
+
+    ev.AddField("error_frame_count", len(frames))
+    ev.AddField("error_stack_normalized", formatStack(frames))
+
+    // Original source locations are both readable and the same from build to
+    // build, so when we can resolve them they're what we fingerprint on
+    groupFrames := frames
+    if release, _ := metadata["release"].(string); h.SourceMaps != nil && release != "" {
+        if resolved, ok := h.SourceMaps.Resolve(release, frames); ok {
+            ev.AddField("error_stack_resolved", formatStack(resolved))
+            groupFrames = resolved
+        }
+    }
+    if len(groupFrames) > 0 {
+        top := groupFrames[0]
+        ev.AddField("error_top_frame", fmt.Sprintf("%s (%s:%d:%d)", top.Function, normalizeFile(top.File), top.Line, top.Column))
+        ev.AddField("error_file", normalizeFile(top.File))
+    }
+    ev.AddField("error_fingerprint", errorFingerprint(name, message, groupFrames))
+}
+
+func formatStack(frames []StackFrame) string {
+    lines := make([]string, len(frames))
+    for i, frame := range frames {
+        lines[i] = fmt.Sprintf("%s (%s:%d:%d)", frame.Function, normalizeFile(frame.File), frame.Line, frame.Column)
+    }
+    return strings.Join(lines, "\n")
+}
+
+func parseStack(stack string) []StackFrame {
+    var frames []StackFrame
+    for _, line := range strings.Split(stack, "\n") {
+        m := chromeFrame.FindStringSubmatch(line)
+        if m == nil {
+            m = geckoFrame.FindStringSubmatch(line)
+        }
+        if m == nil {
+            continue // The message line, or something we don't recognize
+        }
+        lineNo, _ := strconv.Atoi(m[3])
+        col, _ := strconv.Atoi(m[4])
+        frames = append(frames, StackFrame{Function: m[1], File: m[2], Line: lineNo, Column: col})
+    }
+    return frames
+}
+
+// Strips the origin, query string, and build hash from a script URL, so the
+// same file fingerprints the same across CDNs and deploys.
+func normalizeFile(file string) string {
+    if u, err := url.Parse(file); err == nil && u.Path != "" {
+        file = u.Path
+    }
+    return bundleHash.ReplaceAllString(file, "$1")
+}
+
+// Line and column numbers change with every build of a minified bundle, so
+// the fingerprint uses just the error name, message (minus the bits that vary
+// between occurrences), and the files & functions of the innermost frames.
+func errorFingerprint(name, message string, frames []StackFrame) string {
+    h := sha1.New()
+    fmt.Fprintf(h, "%s\n%s\n", name, messageNoise.ReplaceAllString(message, "_"))
+    for i, frame := range frames {
+        if i >= fingerprintFrames {
+            break
+        }
+        fmt.Fprintf(h, "%s %s\n", normalizeFile(frame.File), frame.Function)
+    }
+    return hex.EncodeToString(h.Sum(nil))[:16]
+}
@@ -0,0 +1,151 @@
+// Event is a browser (or synthesized) event on its way through the handler:
+// its fields, plus where it's going. It has the same AddField/Add/Fields
+// methods as a libhoney event, so enrichers read the same either way, but
+// isn't tied to libhoney, so a Sink can send it anywhere.
+type Event struct {
+    Type       string
+    Dataset    string
+    Timestamp  time.Time
+    SampleRate uint   // The event stands for this many events; 1 if unsampled
+    Client     string // Which Honeycomb client to send with (see ClientRouter)
+
+    tenant *Tenant   // Who the request it came from authenticated as, if anyone
+    user   *UserInfo // The signed-in user it came from, if any (and they consented)
+    fields map[string]interface{}
+}
+
+func (e *Event) AddField(name string, value interface{}) {
+    if e.fields == nil {
+        e.fields = make(map[string]interface{})
+    }
+    e.fields[name] = value
+}
+
+func (e *Event) Add(fields map[string]interface{}) {
+    for name, value := range fields {
+        e.AddField(name, value)
+    }
+}
+
+// Fields returns the event's actual field map (not a copy), so stages like the
+// Scrubber can edit it in place.
+func (e *Event) Fields() map[string]interface{} {
+    if e.fields == nil {
+        e.fields = make(map[string]interface{})
+    }
+    return e.fields
+}
+
+// Starts an event of the given type, routed to the dataset and Honeycomb
+// client configured for it. metadata and r are only used for routing, and may
+// be nil for events we synthesize ourselves.
+func (h *UserEventsHandler) newEvent(eventType string, metadata map[string]interface{}, r *http.Request) *Event {
+    dataset := h.Datasets.datasetFor(eventType)
+    clientName, _ := h.clientFor(eventType, dataset, metadata, r)
+    ev := &Event{
+        Type:       eventType,
+        Dataset:    dataset,
+        Timestamp:  time.Now(),
+        SampleRate: 1,
+        Client:     clientName,
+    }
+    ev.AddField("type", eventType)
+
+    // We've already turned away requests with a bad token by now, so the
+    // error doesn't matter here
+    if tenant, _ := h.Tenants.resolve(r); tenant != nil {
+        ev.tenant = tenant
+        ev.Dataset = tenant.DatasetPrefix + ev.Dataset
+        if tenant.Client != nil {
+            ev.Client = tenant.clientName()
+        }
+        ev.AddField("tenant", tenant.Name)
+    }
+    return ev
+}
+
+// Hands a finished event to the sink. Sinks are allowed to block (e.g. on a
+// Kafka write) for as long as ctx lets them. Every event goes through here,
+// ours as well as the browser's, so this is where Retention takes out the
+// fields that mustn't stay in its dataset.
+func (h *UserEventsHandler) send(ctx context.Context, ev *Event) {
+    var retained []*Event
+    if h.Retention != nil {
+        retained = h.Retention.apply(ev, ev.tenant)
+    }
+    h.deliverEvent(ctx, ev)
+    for _, split := range retained {
+        h.deliverEvent(ctx, split)
+    }
+}
+
+func (h *UserEventsHandler) deliverEvent(ctx context.Context, ev *Event) {
+    if h.PresendHook != nil {
+        fields := h.PresendHook(ev.Fields())
+        if fields == nil {
+            eventsDropped.WithLabelValues(metricsTypeLabel(ev.Type), "presend").Inc()
+            return
+        }
+        ev.fields = fields
+    }
+    if dry := h.dryRunFor(ev.Type); dry != nil {
+        dry.capture(ctx, h, ev)
+        return
+    }
+    if err := h.sinkSend(ctx, ev); errors.Is(err, ErrCircuitOpen) {
+        eventsDropped.WithLabelValues(metricsTypeLabel(ev.Type), "circuit_open").Inc()
+        return
+    } else if err == errSinksClosed {
+        eventsDropped.WithLabelValues(metricsTypeLabel(ev.Type), "closed").Inc()
+        return
+    } else if err != nil {
+        h.logger().Error("couldn't send event", "type", ev.Type, "dataset", ev.Dataset, "error", err)
+        return
+    }
+    eventsSent.WithLabelValues(metricsTypeLabel(ev.Type)).Inc()
+    if h.Recent != nil {
+        h.Recent.record(ev)
+    }
+    if h.Tail != nil {
+        h.Tail.publish(ev)
+    }
+    if h.Timeline != nil {
+        h.Timeline.record(h, ev)
+    }
+    if h.Usage != nil {
+        h.Usage.record(ev)
+    }
+}
+
+// Sends one of our own diagnostic events (pipeline spans) straight to
+// Honeycomb: not through the Sink, so not to whatever sits beside Honeycomb
+// in it, and without the Recent, Tail, Timeline or Usage bookkeeping, which
+// is all about the browser's events.
+func (h *UserEventsHandler) sendDiagnostic(ctx context.Context, ev *Event) {
+    h.sinkMu.RLock()
+    defer h.sinkMu.RUnlock()
+    if h.sinksClosed {
+        eventsDropped.WithLabelValues(metricsTypeLabel(ev.Type), "closed").Inc()
+        return
+    }
+    if err := (honeycombSink{h}).Send(ctx, *ev); errors.Is(err, ErrCircuitOpen) {
+        eventsDropped.WithLabelValues(metricsTypeLabel(ev.Type), "circuit_open").Inc()
+        return
+    } else if err != nil {
+        h.logger().Error("couldn't send event", "type", ev.Type, "dataset", ev.Dataset, "error", err)
+        return
+    }
+    eventsSent.WithLabelValues(metricsTypeLabel(ev.Type)).Inc()
+}
+
+// Not every send comes from a request Close waits for: spans, summaries and
+// rollups can be made at any time, so a send after Close has closed the
+// sinks is dropped here rather than let through to a closed client.
+func (h *UserEventsHandler) sinkSend(ctx context.Context, ev *Event) error {
+    h.sinkMu.RLock()
+    defer h.sinkMu.RUnlock()
+    if h.sinksClosed {
+        return errSinksClosed
+    }
+    return h.sink().Send(ctx, *ev)
+}
@@ -1,15 +1,638 @@
-func (h *UserEventsHandler) sendToHoneycombAPI(eventType string, metadata map[string]interface{}, user *types.User) {
-    ev := h.Libhoney.NewEvent()
-    ev.Dataset = "user-events"      // Name of the Honeycomb dataset we'll send these events to
-    ev.AddField("type", eventType)  // Name of the type of event, in our case either "page-load" or "page-unload"
-    ev.Add(metadata)                // All those event fields we constructed in the browser
-
-    // And then we add some fields we have easy access to, because we know the
-    // current user by their session:
-    ev.AddField("user_id", user.ID)
-    ev.AddField("user_email", user.Email)
-
-    // Send the event to the Honeycomb API (goes to our internal Dogfood
-    // Honeycomb cluster when called in Production).
-    ev.Send()
+type UserEventsHandler struct {
+    // Libhoney is the client events are sent with, unless Clients routes
+    // them somewhere else
+    Libhoney   *libhoney.Client
+    Clients    *ClientRouter
+    clientsMu  sync.RWMutex // Guards the clients above, which KeyRotator swaps out
+    clientUses clientUses   // Sends using each client, so KeyRotator can wait out a replaced one's
+
+    // Enrichers add server-side fields to each event, in order, after the
+    // browser's own fields. Defaults to the current user, their parsed
+    // User-Agent, and trace context.
+    Enrichers []Enricher
+
+    // Datasets routes each event type to a Honeycomb dataset. The zero value
+    // sends everything to "user-events", except errors to "browser-errors".
+    Datasets DatasetRoutes
+
+    // Sampler picks a sample rate for each event. nil keeps every event.
+    Sampler Sampler
+
+    // Admission samples harder while Honeycomb is rate limiting us. nil
+    // leaves sample rates alone.
+    Admission *AdmissionController
+
+    // Priorities ranks event types, so the least important are dropped
+    // first when we're backed up or over quota. Types without an entry are
+    // PriorityNormal.
+    Priorities map[string]Priority
+
+    // Scrubber strips or hashes sensitive fields right before each event is
+    // sent. nil sends fields as-is.
+    Scrubber *Scrubber
+
+    // Encryptor encrypts sensitive fields, after scrubbing, so only key
+    // holders can read them. nil leaves them readable.
+    Encryptor *FieldEncryptor
+
+    // Pseudonyms replaces user IDs and emails with pseudonyms, before
+    // scrubbing. nil sends them as they are.
+    Pseudonyms Pseudonymizer
+
+    // PseudonymFields are the fields Pseudonyms replaces. nil means user_id
+    // and user_email.
+    PseudonymFields []string
+
+    // PresendHook, if set, gets the last look at every event's fields (ours
+    // as well as the browser's), after enrichment, scrubbing and processors,
+    // and returns the fields to actually send. It can edit the map in place
+    // and return it, or return nil to drop the event.
+    PresendHook func(fields map[string]interface{}) map[string]interface{}
+
+    // DryRun runs some (or all) event types through the pipeline without
+    // sending them. nil sends everything.
+    DryRun *DryRun
+
+    // Dedup drops events whose event_id we've already seen, e.g. from a
+    // browser retrying a request. nil sends duplicates.
+    Dedup *Deduplicator
+
+    // RateLimiter caps how many events each user (or IP) can send. nil means
+    // no limit.
+    RateLimiter *RateLimiter
+
+    // Schemas validates browser events before we send them. nil only checks
+    // the built-in schemas (for long-task and interaction events).
+    Schemas *SchemaRegistry
+
+    // DeadLetters spools and retries events Honeycomb didn't accept. nil
+    // means failed sends are dropped.
+    DeadLetters *DeadLetterQueue
+
+    // OnResponse, if set, is called with the outcome of every event sent to
+    // Honeycomb, e.g. to alert when we start getting rate limited. It's
+    // called from WatchResponses, so it shouldn't block.
+    OnResponse func(client string, outcome SendOutcome, resp transmission.Response)
+
+    // Breaker stops sending to Honeycomb while it's failing, spooling events
+    // to DeadLetters instead. nil always sends.
+    Breaker *CircuitBreaker
+
+    // Aggregator rolls up very frequent event types into periodic summary
+    // events instead of sending each one. nil sends everything individually.
+    Aggregator *Aggregator
+
+    // Sink is where finished events are sent. nil means Honeycomb, via
+    // Libhoney and Clients.
+    Sink Sink
+
+    // MaxBodyBytes caps the (decompressed) size of request bodies read via
+    // LimitBody. Defaults to 1MB.
+    MaxBodyBytes int64
+
+    // Sessions adds session_id and session_sequence_number to every event,
+    // and sends a session-end event once a session goes idle. nil means no
+    // session tracking.
+    Sessions *SessionTracker
+
+    // Visitors gives logged-out browsers a visitor_id, and links it to their
+    // user_id once they log in. nil doesn't track visitors.
+    Visitors *VisitorTracker
+
+    // SourceMaps de-minifies error stack traces. nil leaves them minified.
+    SourceMaps *SourceMapStore
+
+    // Bots tags (and optionally drops or samples) events from crawlers and
+    // uptime checkers. nil doesn't check.
+    Bots *BotFilter
+
+    // Consent decides, from the consent state the browser sends, whether each
+    // event is sent in full, anonymized, or not at all. nil sends everything.
+    Consent *ConsentPolicy
+
+    // FieldGuard limits which field names the browser can send, so a buggy
+    // client can't blow up a dataset's schema. nil allows anything.
+    FieldGuard *FieldGuard
+
+    // Queue hands events off to a pool of workers for enrichment and
+    // sending, so slow sends don't hold browser connections open. nil does
+    // it all before responding.
+    Queue *EventQueue
+
+    // Bulkheads gives some event types a queue of their own (see
+    // NewBulkhead), so they can't starve the rest. Types not listed use
+    // Queue.
+    Bulkheads map[string]*EventQueue
+
+    // CORS lets the browser SDK post events from other origins, via
+    // WithCORS. nil sends no CORS headers.
+    CORS *CORSPolicy
+
+    // RequestAuth checks that requests come from our own pages (and
+    // optionally that they're signed), via Authenticate. nil checks nothing.
+    RequestAuth *RequestAuth
+
+    // Tenants lets one handler serve several teams, each with their own
+    // Honeycomb client, dataset prefix, and quota. nil is a single tenant.
+    Tenants *TenantRegistry
+
+    // WebSocket configures HandleWebSocket's per-connection limits. nil uses
+    // the defaults.
+    WebSocket *WebSocketConfig
+
+    // Health sets the thresholds HandleReadyz uses. nil uses the defaults.
+    Health *HealthConfig
+
+    // Logger is where the handler logs to. Defaults to slog.Default().
+    Logger *slog.Logger
+
+    // Debug logs the full journey of selected events through the pipeline.
+    // nil traces nothing.
+    Debug *DebugTrace
+
+    // Users works out who sent each request, from a session cookie, a bearer
+    // token, or however else the app does auth. nil treats every request as
+    // coming from nobody in particular.
+    Users UserResolver
+
+    // Limits bounds the size and shape of the events the browser sends.
+    // nil uses PayloadLimits' defaults.
+    Limits *PayloadLimits
+
+    // Transforms rename, move, and cast the browser's fields as they
+    // arrive, to smooth over differences between SDK versions. nil leaves
+    // them as they are.
+    Transforms *Transforms
+
+    // Flatten turns nested objects and arrays into flat, dotted fields as
+    // they arrive. nil sends them as libhoney would, as JSON strings.
+    Flatten *Flattener
+
+    // Late decides what happens to events that arrive long after they
+    // happened. nil sends them like any other.
+    Late *LateEvents
+
+    // Drift compares the fields two SDK versions send while one rolls out.
+    // nil compares nothing.
+    Drift *SchemaDrift
+
+    // Nonces turns away unload events that don't carry a fresh, unused page
+    // nonce. nil accepts them without one.
+    Nonces *PageNonces
+
+    // Retention strips fields that mustn't be kept as long as the rest of
+    // the event, and copies ones to keep longer elsewhere. nil sends every
+    // field to the event's dataset.
+    Retention *RetentionPolicy
+
+    // SelfTrace traces our own pipeline, for requests that come through
+    // TracePipeline. nil traces nothing.
+    SelfTrace *SelfTracing
+
+    // Coalesce folds runs of identical events from a session into one, with
+    // a repeat_count. nil sends every one.
+    Coalesce *Coalescer
+
+    // Delivery adds delivery.* latency fields to events, and times some of
+    // them through to Honeycomb's ack. nil adds none.
+    Delivery *DeliveryTiming
+
+    // LoadShed sheds low-priority events while the service is under
+    // pressure. nil keeps taking everything.
+    LoadShed *LoadShedder
+
+    // Admin lets operators change sampling, scrubbing, and dry runs, or turn
+    // event types off, at runtime. nil leaves the config as it is.
+    Admin *AdminAPI
+
+    // Auth authenticates requests that come through Identify, in place of
+    // Users. nil leaves it all to Users.
+    Auth *AuthStack
+
+    // UserFallback keeps events coming while the user store is down, and
+    // fills in their users once it's back. nil sends them without a user.
+    UserFallback *UserFallback
+
+    // Recent keeps the last events sent, for HandleDebugEvents. nil keeps
+    // nothing.
+    Recent *RecentEvents
+
+    // Tail streams events as they're sent to operators on HandleTail. nil
+    // streams nothing.
+    Tail *LiveTail
+
+    // Timeline keeps each user's recent events for HandleTimeline. nil keeps
+    // nothing.
+    Timeline *UserTimeline
+
+    // Usage counts what we forward per tenant and event type, for
+    // HandleUsage. nil counts nothing.
+    Usage *UsageAccounting
+
+    // State is shared state for sessions, rate limits, and page-view
+    // pairing. Defaults to in-memory, which is fine for a single instance;
+    // use a RedisStore behind a load balancer.
+    State     StateStore
+    stateOnce sync.Once
+
+    processors map[string][]Processor // Registered with On
+    receivers  map[string][]Processor // Registered with OnReceive
+
+    closeMu  sync.RWMutex
+    closed   bool
+    inflight sync.WaitGroup
+
+    // Held around every sink send, so Close can't close the sinks (and
+    // clients) under one; sinksClosed is set once it has
+    sinkMu      sync.RWMutex
+    sinksClosed bool
+}
+
+func NewUserEventsHandler(client *libhoney.Client, enrichers ...Enricher) *UserEventsHandler {
+    if len(enrichers) == 0 {
+        enrichers = []Enricher{UserEnricher{}, UserAgentEnricher{}, TraceEnricher{}}
+    }
+    return &UserEventsHandler{Libhoney: client, Enrichers: enrichers}
+}
+
+// Returns a *ValidationError if the event doesn't match its schema,
+// ErrUnknownTenant or ErrQuotaExceeded if its tenant can't send it, or
+// ErrQueueFull if we're too backed up to take it, so the caller can tell the
+// browser. Everything else (rate limiting, sampling) is a silent drop.
+//
+// The checks that decide whether we keep the event at all happen right here,
+// while the browser waits. Building and sending the event happens in process,
+// which runs on the Queue's workers if there is one. Without a Queue, process
+// gets ctx (usually the request's), capped at queueSendTimeout so a slow
+// enricher or sink can't hold the browser's connection open indefinitely.
+func (h *UserEventsHandler) sendToHoneycombAPI(ctx context.Context, eventType string, metadata map[string]interface{}, r *http.Request, user *UserInfo) error {
+    _, err := h.ingest(ctx, eventType, metadata, r, user)
+    return err
+}
+
+// sendToHoneycombAPI, also saying why the event was dropped, if it was
+// silently (one of the eventsDropped reasons), for batch results
+func (h *UserEventsHandler) ingest(ctx context.Context, eventType string, metadata map[string]interface{}, r *http.Request, user *UserInfo) (dropped string, err error) {
+    typeLabel := metricsTypeLabel(eventType)
+    eventsReceived.WithLabelValues(typeLabel).Inc()
+
+    traced := h.Debug.traces(r, user)
+    if traced {
+        h.logger().Info("traced event received", "type", eventType, "fields", metadata)
+    }
+    drop := func(reason string) {
+        dropped = reason
+        eventsDropped.WithLabelValues(typeLabel, reason).Inc()
+        if traced {
+            h.logger().Info("traced event dropped", "type", eventType, "reason", reason)
+        }
+    }
+
+    if !h.beginSend() {
+        drop("closed")
+        return dropped, nil
+    }
+    defer h.inflight.Done()
+    // Ended before inflight is done, so Close waits for it to be sent
+    span := spanFrom(ctx).child("ingest")
+    span.add("event.type", eventType)
+    defer func() {
+        if dropped != "" {
+            span.add("dropped", dropped)
+        }
+        if err != nil {
+            span.add("error", err.Error())
+        }
+        span.end()
+    }()
+
+    if reason := h.Admin.dropReason(eventType); reason != "" {
+        drop(reason)
+        return dropped, nil
+    }
+    // Before any of the state store round trips below, so shedding saves them
+    keep, shedRate := h.LoadShed.admit(eventType, h.priority(eventType))
+    if !keep {
+        drop(shedDropReason)
+        return dropped, nil
+    }
+    tenant, err := h.Tenants.resolve(r)
+    if err != nil {
+        drop("unknown_tenant")
+        return dropped, err
+    }
+    if tenant != nil && !tenant.allow(h.state()) {
+        drop("quota")
+        return dropped, ErrQuotaExceeded
+    }
+
+    // So the limits, FieldGuard and the rest see the names that get sent.
+    // Transforms first, since theirs are the nested paths the SDKs send.
+    h.Transforms.apply(eventType, metadata)
+    if h.Flatten != nil {
+        h.Flatten.applyMetadata(eventType, metadata)
+    }
+    // Before anything else looks inside metadata. Unlike a schema failure, we
+    // don't send these on to the malformed dataset: they could be huge.
+    schema, _ := h.Schemas.schemaFor(eventType)
+    limits := span.child("limits")
+    err = h.limits().apply(eventType, metadata, schema)
+    limits.end()
+    if err != nil {
+        drop("invalid")
+        return dropped, err
+    }
+    if h.Drift != nil {
+        h.Drift.record(eventType, metadata)
+    }
+
+    // Claimed before we know we'll keep the event, so they're given back if
+    // it's turned away in a way the browser will retry (queue full, rate
+    // limited, over quota), or its retry would be taken for a replay
+    var claims []string
+    defer func() {
+        if len(claims) > 0 && (err != nil || retriedDrop(dropped)) {
+            h.releaseClaims(claims)
+        }
+    }()
+    // Before the rate limiter, so a browser retrying doesn't use up its limit
+    if h.Dedup != nil {
+        key, duplicate := h.Dedup.claim(h.state(), tenant, metadata)
+        if duplicate {
+            drop("duplicate")
+            return dropped, nil
+        }
+        if key != "" {
+            claims = append(claims, key)
+        }
+    }
+    if h.Nonces != nil {
+        key, err := h.Nonces.check(ctx, h.state(), eventType, metadata)
+        if err != nil {
+            drop("nonce")
+            return dropped, err
+        }
+        if key != "" {
+            claims = append(claims, key)
+        }
+    } else {
+        delete(metadata, (&PageNonces{}).field())
+    }
+
+    if h.rateLimited(r, user) {
+        drop("rate_limited")
+        return dropped, nil
+    }
+
+    consent := ConsentFull
+    if h.Consent != nil {
+        consent = h.Consent.Decide(r, metadata)
+    }
+    switch consent {
+    case ConsentDrop:
+        drop("consent")
+        return dropped, nil
+    case ConsentAnonymize:
+        user = nil // So nothing downstream can attach who this was
+    }
+
+    validate := span.child("validate")
+    err = h.Schemas.Validate(eventType, metadata)
+    validate.end()
+    if err != nil {
+        drop("invalid")
+        h.sendMalformed(ctx, eventType, metadata, err, r, user)
+        return dropped, err
+    }
+
+    if h.FieldGuard != nil {
+        h.FieldGuard.Apply(eventType, metadata)
+    }
+    if tenant != nil && tenant.Fields != nil {
+        tenant.Fields.apply(h, tenant, eventType, metadata)
+    }
+
+    if h.Visitors != nil && consent == ConsentFull {
+        h.Visitors.Touch(h, r, metadata, user)
+    }
+
+    if h.Sessions != nil && consent == ConsentFull {
+        h.Sessions.Touch(h, r, eventType, metadata, user)
+    }
+
+    if consent == ConsentFull && !h.runReceivers(eventType, metadata, r, user) {
+        drop("processor")
+        return dropped, nil
+    }
+
+    if h.Aggregator != nil && h.Aggregator.Absorb(eventType, metadata, user) {
+        drop("aggregated")
+        return dropped, nil
+    }
+
+    job := &eventJob{
+        eventType:  eventType,
+        metadata:   metadata,
+        r:          r,
+        user:       user,
+        consent:    consent,
+        shedRate:   shedRate,
+        receivedAt: time.Now(),
+        traced:     traced,
+        span:       span,
+    }
+    if h.Coalesce != nil {
+        switch h.Coalesce.absorb(h, job) {
+        case coalesceRepeat:
+            drop("coalesced")
+            return dropped, nil
+        case coalesceHeld:
+            return dropped, nil // Sent once its run is over
+        }
+    }
+    return h.dispatch(ctx, job)
+}
+
+// The rest of ingest, from sampling on: for events ingest has decided to
+// keep, and for runs Coalesce held back, once they're over
+func (h *UserEventsHandler) dispatch(ctx context.Context, job *eventJob) (dropped string, err error) {
+    drop := func(reason string) {
+        dropped = reason
+        eventsDropped.WithLabelValues(metricsTypeLabel(job.eventType), reason).Inc()
+        if job.traced {
+            h.logger().Info("traced event dropped", "type", job.eventType, "reason", reason)
+        }
+    }
+
+    // Make the sampling decision up front, so we don't bother enriching
+    // events we're about to drop anyway
+    keep, sampleRate := h.sample(job.eventType, job.metadata)
+    if !keep {
+        drop("sampled")
+        return dropped, nil
+    }
+    sampleRate *= job.shedRate
+
+    var botReason string
+    if h.Bots != nil {
+        botReason = h.Bots.Classify(job.r, job.metadata, job.user)
+    }
+    if botReason != "" {
+        keepBot, botRate := h.Bots.sample()
+        if !keepBot {
+            drop("bot")
+            return dropped, nil
+        }
+        sampleRate *= botRate
+    }
+
+    job.sampleRate = sampleRate
+    job.botReason = botReason
+    job.priority = h.priority(job.eventType)
+    if job.user != nil && job.user.Unresolved && h.UserFallback.backfill(h, job) {
+        return dropped, nil // Delivered once we know who it was, or have given up
+    }
+    return dropped, h.deliver(ctx, job)
+}
+
+// Hands job to its queue, or processes it right here
+func (h *UserEventsHandler) deliver(ctx context.Context, job *eventJob) error {
+    if queue := h.queueFor(job.eventType); queue != nil {
+        return queue.enqueue(ctx, job)
+    }
+    ctx, cancel := context.WithTimeout(ctx, queueSendTimeout)
+    defer cancel()
+    h.process(ctx, job)
+    return nil
+}
+
+// Everything we've decided about an event in sendToHoneycombAPI, for process
+// to pick up from
+type eventJob struct {
+    eventType  string
+    metadata   map[string]interface{}
+    r          *http.Request // Only for the headers & context values; the request may be finished by now
+    user       *UserInfo
+    consent    ConsentAction
+    shedRate   uint // What LoadShed scaled its sample rate by, if it was shedding
+    sampleRate uint
+    botReason  string
+    receivedAt time.Time
+    traced     bool // Log what becomes of it (see DebugTrace)
+    priority   Priority
+    span       *pipelineSpan // Its ingest span, if SelfTrace is tracing its request
+}
+
+func (h *UserEventsHandler) process(ctx context.Context, job *eventJob) {
+    started := time.Now()
+    span := job.span.child("process")
+    defer span.end()
+    metadata := job.metadata
+    ev := h.newEvent(job.eventType, metadata, job.r) // Routed to the dataset (and Honeycomb) configured for this event type
+    ev.SampleRate = job.sampleRate                   // So Honeycomb can re-weight counts for the events we did keep
+    ev.user = job.user
+    if h.Admission != nil {
+        ev.AddField("effective_sample_rate", job.sampleRate)
+    }
+    ev.Add(metadata) // All those event fields we constructed in the browser
+    if ev.tenant != nil {
+        ev.AddField("tenant", ev.tenant.Name) // Whatever the browser said
+    }
+    if h.Bots != nil {
+        ev.AddField("is_bot", job.botReason != "")
+        if job.botReason != "" {
+            ev.AddField("bot_reason", job.botReason)
+        }
+    }
+    correctClockSkew(ev, metadata, job.receivedAt)
+    if h.Late != nil {
+        tenant, _ := h.Tenants.resolve(job.r)
+        if !h.Late.apply(ev, tenant, job.receivedAt) {
+            eventsDropped.WithLabelValues(metricsTypeLabel(job.eventType), "late").Inc()
+            if job.traced {
+                h.logger().Info("traced event dropped", "type", job.eventType, "reason", "late")
+            }
+            return
+        }
+    }
+    addPerformanceFields(ev, metadata)
+    addInteractivityFields(ev, metadata)
+    if job.eventType == errorEventType {
+        h.addErrorFields(ev, metadata)
+    }
+    enrich := span.child("enrich")
+    enrichStart := time.Now()
+    h.enrich(ctx, ev, job.eventType, job.r, job.user)
+    enrichDuration := time.Since(enrichStart)
+    enrich.end()
+    if job.consent == ConsentAnonymize {
+        h.Consent.anonymize(ev.Fields())
+    }
+    if !h.runProcessors(ev) {
+        eventsDropped.WithLabelValues(metricsTypeLabel(job.eventType), "processor").Inc()
+        if job.traced {
+            h.logger().Info("traced event dropped", "type", job.eventType, "reason", "processor")
+        }
+        return
+    }
+    if err := ctx.Err(); err != nil {
+        // Out of time before we got to send it; better to count it than to
+        // hand a sink an already-expired context
+        reason := "canceled"
+        if errors.Is(err, context.DeadlineExceeded) {
+            reason = "deadline"
+        }
+        eventsDropped.WithLabelValues(metricsTypeLabel(job.eventType), reason).Inc()
+        if job.traced {
+            h.logger().Info("traced event dropped", "type", job.eventType, "reason", reason)
+        }
+        return
+    }
+    if h.Flatten != nil {
+        h.Flatten.apply(ev) // Anything enrichers or processors nested
+    }
+    if h.Delivery != nil {
+        h.Delivery.addFields(ev, metadata, job.receivedAt, started, enrichDuration)
+    }
+    if job.traced {
+        h.logger().Info("traced event sent", "type", ev.Type, "dataset", ev.Dataset, "client", ev.Client, "sample_rate", ev.SampleRate, "fields", ev.Fields())
+    }
+
+    // Send the event on to the Honeycomb API (or wherever Sink says)
+    send := span.child("send")
+    h.send(ctx, ev)
+    send.end()
+}
+
+// Adds the fields we have easy access to on the server, like the current user
+// from their session, then scrubs the finished event. A failing enricher just
+// means a few missing fields, so we carry on regardless, unless ctx is done,
+// in which case we skip the rest (but still scrub).
+func (h *UserEventsHandler) enrich(ctx context.Context, ev *Event, eventType string, r *http.Request, user *UserInfo) {
+    for _, enricher := range h.Enrichers {
+        if ctx.Err() != nil {
+            h.logger().Warn("ran out of time enriching event", "enricher", fmt.Sprintf("%T", enricher), "type", eventType, "error", ctx.Err())
+            break
+        }
+        if err := enricher.Enrich(ctx, ev, r, user); err != nil {
+            h.logger().Warn("enricher failed", "enricher", fmt.Sprintf("%T", enricher), "type", eventType, "error", err)
+        }
+    }
+
+    h.scrub(ctx, ev)
+}
+
+// Pseudonymizes, scrubs, then encrypts, the event's fields. Events we
+// synthesize without enriching still need this.
+func (h *UserEventsHandler) scrub(ctx context.Context, ev *Event) {
+    h.pseudonymize(ctx, ev)
+    h.Admin.dropFields(ev.Fields())
+    if h.Scrubber != nil {
+        h.Scrubber.Scrub(ev.Fields())
+    }
+    if h.Encryptor != nil {
+        if err := h.Encryptor.Encrypt(ev.Fields()); err != nil {
+            h.logger().Error("couldn't encrypt fields, so dropped them", "type", ev.Type, "error", err)
+        }
+    }
 }
@@ -0,0 +1,167 @@
+// To analyze an A/B test in Honeycomb, every event needs to say which variant
+// its user was in. ExperimentEnricher asks an ExperimentProvider for the
+// user's active assignments and adds each as an `experiment.<name>` field,
+// e.g. experiment.new_checkout=treatment.
+//
+//     experiments, _ := NewExperimentEnricher(LocalExperiments{
+//         {Name: "new_checkout", Variants: []string{"control", "treatment"}},
+//     }, 10000)
+//     handler.Enrichers = append(handler.Enrichers, experiments)
+type ExperimentProvider interface {
+    // Assignments returns experiment name -> variant for everything the user
+    // is enrolled in
+    Assignments(ctx context.Context, user *UserInfo, r *http.Request) (map[string]string, error)
+}
+
+// ExperimentEnricher keeps each user's assignments in an LRU cache for TTL,
+// since the provider may well be a network call to a feature-flag service.
+// A failed lookup is cached too, for ErrorTTL, so while the service is down
+// each user costs it a call every few seconds rather than one per event.
+// Events from requests with no user (or visitor) ID aren't assigned.
+type ExperimentEnricher struct {
+    Provider  ExperimentProvider
+    TTL       time.Duration // Defaults to a minute
+    ErrorTTL  time.Duration // Defaults to 5 seconds
+    Timeout   time.Duration // For each provider call; defaults to 50ms
+    CacheSize int           // Users to keep assignments for; defaults to 10000
+
+    cacheOnce sync.Once
+    cache     *lru.Cache
+}
+
+type cachedAssignments struct {
+    variants map[string]string
+    err      error
+    fetched  time.Time
+}
+
+func NewExperimentEnricher(provider ExperimentProvider, cacheSize int) (*ExperimentEnricher, error) {
+    cache, err := lru.New(cacheSize)
+    if err != nil {
+        return nil, err
+    }
+    return &ExperimentEnricher{Provider: provider, CacheSize: cacheSize, cache: cache}, nil
+}
+
+// The cache is made on first use if we weren't built by
+// NewExperimentEnricher, so a plain &ExperimentEnricher{Provider: p} works
+func (e *ExperimentEnricher) assignments() *lru.Cache {
+    e.cacheOnce.Do(func() {
+        if e.cache != nil {
+            return
+        }
+        size := e.CacheSize
+        if size <= 0 {
+            size = 10000
+        }
+        e.cache, _ = lru.New(size) // Only fails for a size below 1
+    })
+    return e.cache
+}
+
+func (e *ExperimentEnricher) Enrich(ctx context.Context, ev *Event, r *http.Request, user *UserInfo) error {
+    if user == nil {
+        return nil
+    }
+    ttl, errorTTL, timeout := e.TTL, e.ErrorTTL, e.Timeout
+    if ttl <= 0 {
+        ttl = time.Minute
+    }
+    if errorTTL <= 0 {
+        errorTTL = 5 * time.Second
+    }
+    if timeout <= 0 {
+        timeout = 50 * time.Millisecond
+    }
+
+    cache := e.assignments()
+    var variants map[string]string
+    cached, ok := cache.Get(user.ID)
+    entry, _ := cached.(cachedAssignments)
+    switch {
+    case ok && entry.err != nil && time.Since(entry.fetched) < errorTTL:
+        return entry.err
+    case ok && entry.err == nil && time.Since(entry.fetched) < ttl:
+        variants = entry.variants
+    default:
+        ctx, cancel := context.WithTimeout(ctx, timeout)
+        defer cancel()
+        fetched, err := e.Provider.Assignments(ctx, user, r)
+        cache.Add(user.ID, cachedAssignments{variants: fetched, err: err, fetched: time.Now()})
+        if err != nil {
+            return err
+        }
+        variants = fetched
+    }
+
+    for name, variant := range variants {
+        ev.AddField("experiment."+name, variant)
+    }
+    return nil
+}
+
+// LocalExperiments assigns users to experiments defined in config, by hashing
+// their ID, so a user lands in the same variant on every instance without any
+// shared state.
+type LocalExperiments []Experiment
+
+type Experiment struct {
+    Name     string   `yaml:"name"`
+    Variants []string `yaml:"variants"` // Split evenly, unless Weights says otherwise
+    Weights  []uint   `yaml:"weights"`
+
+    // Exposure is the fraction of users (0 to 1) enrolled at all. Defaults to
+    // everyone.
+    Exposure float64 `yaml:"exposure"`
+}
+
+func (l LocalExperiments) Assignments(ctx context.Context, user *UserInfo, r *http.Request) (map[string]string, error) {
+    assignments := map[string]string{}
+    for _, exp := range l {
+        if variant := exp.assign(user.ID); variant != "" {
+            assignments[exp.Name] = variant
+        }
+    }
+    return assignments, nil
+}
+
+func (e Experiment) assign(userID string) string {
+    if len(e.Variants) == 0 {
+        return ""
+    }
+    // Hashing the name in too means users aren't in the same bucket for
+    // every experiment
+    sum := sha256.Sum256([]byte(e.Name + ":" + userID))
+    bucket := float64(binary.BigEndian.Uint64(sum[:8])) / float64(math.MaxUint64)
+
+    if e.Exposure > 0 && e.Exposure < 1 {
+        if bucket >= e.Exposure {
+            return ""
+        }
+        bucket /= e.Exposure // Spread the enrolled users back over the variants
+    }
+
+    weights := e.Weights
+    if len(weights) != len(e.Variants) {
+        weights = make([]uint, len(e.Variants))
+        for i := range weights {
+            weights[i] = 1
+        }
+    }
+    var total uint
+    for _, w := range weights {
+        total += w
+    }
+    if total == 0 {
+        return ""
+    }
+    point := bucket * float64(total)
+    var cumulative float64
+    for i, w := range weights {
+        cumulative += float64(w)
+        if point < cumulative {
+            return e.Variants[i]
+        }
+    }
+    return e.Variants[len(e.Variants)-1]
+}
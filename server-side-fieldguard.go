@@ -0,0 +1,96 @@
+// A buggy client build once sent thousands of unique field names, which
+// wrecked our dataset's schema. FieldGuard keeps browser fields in check
+// before they reach Honeycomb: only fields on the allow-list (if there is one)
+// get through, and each event type can only ever introduce MaxKeysPerType
+// distinct field names. Everything else is dropped, or folded into a single
+// `extra_fields_json` field so it's still there to debug with.
+//
+// Only the browser's fields are checked; fields we add server-side are
+// trusted.
+type FieldGuard struct {
+    // Per event type; "*" applies to types without their own list. If neither
+    // exists, any field name is allowed (subject to MaxKeysPerType).
+    AllowList map[string][]string
+
+    MaxKeysPerType int  // 0 means no cap
+    Fold           bool // Fold rejected fields into extra_fields_json instead of dropping them
+
+    mu       sync.Mutex
+    allowed  map[string]map[string]bool // Built lazily from AllowList
+    seenKeys map[string]map[string]bool // Event type -> field names seen so far
+}
+
+// Fields that are always allowed, since the pipeline itself depends on them
+var guardExemptFields = map[string]bool{"type": true, "sent_at": true, "timestamp": true}
+
+// Apply removes disallowed fields from metadata in place.
+func (g *FieldGuard) Apply(eventType string, metadata map[string]interface{}) {
+    g.mu.Lock()
+    defer g.mu.Unlock()
+
+    allowed := g.allowListFor(eventType)
+    var extra map[string]interface{}
+    for name, value := range metadata {
+        if guardExemptFields[name] || g.admit(eventType, name, allowed) {
+            continue
+        }
+        delete(metadata, name)
+        if g.Fold {
+            if extra == nil {
+                extra = make(map[string]interface{})
+            }
+            extra[name] = value
+        }
+    }
+
+    if len(extra) > 0 {
+        if buf, err := json.Marshal(extra); err == nil {
+            metadata["extra_fields_json"] = string(buf)
+        }
+    }
+}
+
+// Called with g.mu held
+func (g *FieldGuard) admit(eventType, name string, allowed map[string]bool) bool {
+    if allowed != nil && !allowed[name] {
+        return false
+    }
+    if g.MaxKeysPerType <= 0 {
+        return true
+    }
+
+    if g.seenKeys == nil {
+        g.seenKeys = make(map[string]map[string]bool)
+    }
+    seen := g.seenKeys[eventType]
+    if seen == nil {
+        seen = make(map[string]bool)
+        g.seenKeys[eventType] = seen
+    }
+    if seen[name] {
+        return true
+    }
+    if len(seen) >= g.MaxKeysPerType {
+        return false
+    }
+    seen[name] = true
+    return true
+}
+
+// Called with g.mu held. Returns nil if every field name is allowed.
+func (g *FieldGuard) allowListFor(eventType string) map[string]bool {
+    if g.allowed == nil {
+        g.allowed = make(map[string]map[string]bool, len(g.AllowList))
+        for t, names := range g.AllowList {
+            set := make(map[string]bool, len(names))
+            for _, name := range names {
+                set[name] = true
+            }
+            g.allowed[t] = set
+        }
+    }
+    if set, ok := g.allowed[eventType]; ok {
+        return set
+    }
+    return g.allowed["*"]
+}
@@ -0,0 +1,61 @@
+// Tenants share one pipeline, but not the same trust: one team's pages
+// mustn't be able to send user_email, and another's mustn't be able to set
+// deploy_environment themselves and make their staging traffic look like
+// production. A Tenant's FieldPolicy says which fields its browsers may
+// write:
+//
+//     &Tenant{Name: "marketing", Fields: &FieldPolicy{Deny: []string{"user_email", "user_*"}}}
+//     &Tenant{Name: "checkout", Fields: &FieldPolicy{Deny: []string{"deploy_environment"}}}
+//
+// Names are exact field names or path.Match globs. With an Allow list, only
+// fields on it get through; Deny wins over Allow. Fields the policy doesn't
+// allow are stripped, not rejected, so a misconfigured page still sends the
+// rest of its event; each stripped field is counted, and the first one each
+// rule strips is logged. The policy only covers what the browser sends:
+// fields we add server-side (like deploy_environment from an enricher) aren't
+// affected, which is what makes "may not override" work.
+type FieldPolicy struct {
+    Allow []string
+    Deny  []string
+
+    logged sync.Map // "<tenant>|<rule>" -> true, once logged
+}
+
+var fieldPolicyViolations = promauto.NewCounterVec(prometheus.CounterOpts{
+    Name: "user_events_field_policy_violations_total",
+    Help: "Browser fields stripped because the tenant's field policy doesn't allow them, by tenant and rule.",
+}, []string{"tenant", "rule"})
+
+func matchesAny(patterns []string, name string) (string, bool) {
+    for _, pattern := range patterns {
+        if matched, _ := path.Match(pattern, name); matched {
+            return pattern, true
+        }
+    }
+    return "", false
+}
+
+// Strips the fields tenant may not set from metadata in place
+func (p *FieldPolicy) apply(h *UserEventsHandler, tenant *Tenant, eventType string, metadata map[string]interface{}) {
+    for name := range metadata {
+        if guardExemptFields[name] {
+            continue
+        }
+        // The rule goes in the metric label, not the field name, since with
+        // an Allow list the names are whatever the browser made up
+        rule := ""
+        if pattern, denied := matchesAny(p.Deny, name); denied {
+            rule = "deny:" + pattern
+        } else if _, allowed := matchesAny(p.Allow, name); len(p.Allow) > 0 && !allowed {
+            rule = "not_allowed"
+        }
+        if rule == "" {
+            continue
+        }
+        delete(metadata, name)
+        fieldPolicyViolations.WithLabelValues(tenant.Name, rule).Inc()
+        if _, seen := p.logged.LoadOrStore(tenant.Name+"|"+rule, true); !seen {
+            h.logger().Warn("stripped field the tenant may not set", "tenant", tenant.Name, "field", truncateName(name), "type", eventType, "rule", rule)
+        }
+    }
+}
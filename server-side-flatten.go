@@ -0,0 +1,179 @@
+// Honeycomb columns are flat, and libhoney sends a nested object or array as
+// one opaque JSON string, which can't be queried or graphed. Flattener turns
+// nesting into dotted field names (perf.timing.lcp) as the browser's fields
+// arrive, before the payload limits, FieldGuard, field policies and the
+// Scrubber look at them, so the names those are written for are the ones
+// that get sent. Anything an enricher or processor nests is flattened again
+// just before the event is sent:
+//
+//     handler.Flatten = &Flattener{MaxDepth: 3, Arrays: ArrayAggregate}
+//
+// Anything nested deeper than MaxDepth is kept as a JSON string under the
+// name it had reached, so nothing is lost. Arrays are handled per Arrays:
+//
+//   - ArrayJSON (the default) keeps each array as a JSON string
+//   - ArrayIndex spreads the first MaxArrayItems items out as name.0, name.1,
+//     ... with name.length holding the full length
+//   - ArrayAggregate sums up arrays of numbers as name.count, name.min,
+//     name.max, name.sum and name.avg, and keeps other arrays as name.count
+//     plus a JSON string
+type Flattener struct {
+    MaxDepth      int    // Levels of nesting to flatten; defaults to 3
+    Separator     string // Defaults to "."
+    Arrays        ArrayPolicy
+    MaxArrayItems int // For ArrayIndex; defaults to 10
+
+    // Skip leaves these top-level fields as they are
+    Skip []string
+}
+
+type ArrayPolicy int
+
+const (
+    ArrayJSON ArrayPolicy = iota
+    ArrayIndex
+    ArrayAggregate
+)
+
+var arrayPolicies = map[string]ArrayPolicy{"json": ArrayJSON, "index": ArrayIndex, "aggregate": ArrayAggregate}
+
+func (f *Flattener) maxDepth() int {
+    if f.MaxDepth > 0 {
+        return f.MaxDepth
+    }
+    return 3
+}
+
+func (f *Flattener) separator() string {
+    if f.Separator != "" {
+        return f.Separator
+    }
+    return "."
+}
+
+func (f *Flattener) maxArrayItems() int {
+    if f.MaxArrayItems > 0 {
+        return f.MaxArrayItems
+    }
+    return 10
+}
+
+// Flattens the event's fields in place
+func (f *Flattener) apply(ev *Event) {
+    f.applyFields(ev.Fields(), nil)
+}
+
+// Fields our own processors read nested, left for them by the flattening in
+// ingest: ResourceTimings turns resource-timing's array into child events
+var flattenLater = map[string][]string{"resource-timing": {"resources"}}
+
+// Flattens the browser's fields for an event of this type, in place
+func (f *Flattener) applyMetadata(eventType string, metadata map[string]interface{}) {
+    f.applyFields(metadata, flattenLater[eventType])
+}
+
+func (f *Flattener) applyFields(fields map[string]interface{}, keep []string) {
+    var nested []string
+    for name, value := range fields {
+        switch value.(type) {
+        case map[string]interface{}, []interface{}:
+            nested = append(nested, name)
+        }
+    }
+    for _, name := range nested {
+        if f.skips(name) || containsString(keep, name) {
+            continue
+        }
+        value := fields[name]
+        delete(fields, name)
+        f.flatten(fields, name, value, 1)
+    }
+}
+
+func (f *Flattener) skips(name string) bool {
+    for _, skip := range f.Skip {
+        if skip == name {
+            return true
+        }
+    }
+    return false
+}
+
+// Adds value to fields under name, flattening as it goes. Fields that are
+// already there win, so the browser's own dotted names aren't overwritten.
+func (f *Flattener) flatten(fields map[string]interface{}, name string, value interface{}, depth int) {
+    set := func(key string, v interface{}) {
+        if _, exists := fields[key]; !exists {
+            fields[key] = v
+        }
+    }
+    sep := f.separator()
+
+    switch v := value.(type) {
+    case map[string]interface{}:
+        if depth > f.maxDepth() {
+            set(name, jsonString(v))
+            return
+        }
+        for key, inner := range v {
+            f.flatten(fields, name+sep+key, inner, depth+1)
+        }
+    case []interface{}:
+        switch {
+        case f.Arrays == ArrayIndex && depth <= f.maxDepth():
+            set(name+sep+"length", len(v))
+            for i, item := range v {
+                if i >= f.maxArrayItems() {
+                    break
+                }
+                f.flatten(fields, name+sep+strconv.Itoa(i), item, depth+1)
+            }
+        case f.Arrays == ArrayAggregate:
+            set(name+sep+"count", len(v))
+            if stats, ok := numberStats(v); ok {
+                set(name+sep+"min", stats.min)
+                set(name+sep+"max", stats.max)
+                set(name+sep+"sum", stats.sum)
+                set(name+sep+"avg", stats.sum/float64(len(v)))
+            } else {
+                set(name, jsonString(v))
+            }
+        default:
+            set(name, jsonString(v))
+        }
+    default:
+        set(name, v)
+    }
+}
+
+type arrayStats struct{ min, max, sum float64 }
+
+// Only for non-empty arrays of nothing but numbers
+func numberStats(items []interface{}) (arrayStats, bool) {
+    if len(items) == 0 {
+        return arrayStats{}, false
+    }
+    var stats arrayStats
+    for i, item := range items {
+        n, ok := item.(float64)
+        if !ok {
+            return arrayStats{}, false
+        }
+        if i == 0 || n < stats.min {
+            stats.min = n
+        }
+        if i == 0 || n > stats.max {
+            stats.max = n
+        }
+        stats.sum += n
+    }
+    return stats, true
+}
+
+func jsonString(value interface{}) string {
+    buf, err := json.Marshal(value)
+    if err != nil {
+        return fmt.Sprint(value)
+    }
+    return string(buf)
+}
@@ -0,0 +1,289 @@
+// Click events say what was clicked, not whether the user got anything for
+// it. FrustrationDetector watches each session's clicks for the two signs they
+// didn't, and sends a ux-frustration event for each:
+//
+//     rage_click  RageClicks clicks on the same target within RageWindow
+//     dead_click  a click with no navigation or request after it within DeadClickWait
+//
+// Register it, and run its loop alongside the handler:
+//
+//     detector := &FrustrationDetector{}
+//     detector.Register(handler)
+//     go detector.Run(ctx, handler)
+//
+// Clicks on the same target, each within RageWindow of the one before, are
+// one burst, and get one event between them (with click_count and
+// duration_ms) however long the user kept at it; a burst is dead if nothing
+// came of any of its clicks. What counts as something coming of a click is
+// any of ActivityTypes from the same session, by event timestamp, since a
+// page's events can arrive in any order in different batches; so we only
+// decide about a burst once Settle has passed since its last click arrived.
+// The event carries the target and the click's page and session fields,
+// and goes to the click's dataset. Clicks and activity are watched as they
+// arrive, before sampling, so a sampled-out click still counts towards a
+// burst, and sampled-out activity still answers one; the event is scrubbed
+// like any other before it's sent. A Coalescer's repeat_count is counted
+// as that many clicks. Sessions are tracked per instance, which is fine as
+// long as a page's batches mostly reach the same one.
+type FrustrationDetector struct {
+    ClickType     string        // Defaults to "click"
+    TargetField   string        // Defaults to "target_selector"
+    RageClicks    int           // Defaults to 3
+    RageWindow    time.Duration // Defaults to a second
+    DeadClickWait time.Duration // Defaults to 2 seconds
+    ActivityTypes []string      // Defaults to page-load, page-unload, route-change, xhr, and fetch
+    Settle        time.Duration // Defaults to 10 seconds
+
+    mu       sync.Mutex
+    sessions map[string]*frustrationSession
+}
+
+type frustrationSession struct {
+    bursts   []*clickBurst
+    activity []time.Time // Recent ActivityTypes timestamps, newest last
+    seen     time.Time   // When anything of its last arrived
+}
+
+type clickBurst struct {
+    target      string
+    first, last time.Time   // Click timestamps
+    recent      []time.Time // The last RageClicks clicks, for the sliding window
+    count       int
+    rage        bool
+    arrived     time.Time // When its last click arrived
+    fields      map[string]interface{}
+    dataset     string
+    client      string
+    user        *UserInfo
+    tenant      *Tenant
+}
+
+const (
+    frustrationEventType = "ux-frustration"
+    maxSessionActivity   = 32
+    maxSessionBursts     = 32
+)
+
+var frustrations = promauto.NewCounterVec(prometheus.CounterOpts{
+    Name: "user_events_frustrations_total",
+    Help: "Rage and dead clicks FrustrationDetector found, by type.",
+}, []string{"type"})
+
+func (d *FrustrationDetector) clickType() string {
+    if d.ClickType != "" {
+        return d.ClickType
+    }
+    return "click"
+}
+
+func (d *FrustrationDetector) targetField() string {
+    if d.TargetField != "" {
+        return d.TargetField
+    }
+    return "target_selector"
+}
+
+func (d *FrustrationDetector) rageClicks() int {
+    if d.RageClicks > 0 {
+        return d.RageClicks
+    }
+    return 3
+}
+
+func (d *FrustrationDetector) rageWindow() time.Duration {
+    if d.RageWindow > 0 {
+        return d.RageWindow
+    }
+    return time.Second
+}
+
+func (d *FrustrationDetector) deadClickWait() time.Duration {
+    if d.DeadClickWait > 0 {
+        return d.DeadClickWait
+    }
+    return 2 * time.Second
+}
+
+func (d *FrustrationDetector) activityTypes() []string {
+    if len(d.ActivityTypes) > 0 {
+        return d.ActivityTypes
+    }
+    return []string{"page-load", "page-unload", "route-change", "xhr", "fetch"}
+}
+
+func (d *FrustrationDetector) settle() time.Duration {
+    if d.Settle > 0 {
+        return d.Settle
+    }
+    return 10 * time.Second
+}
+
+// Register adds the receive processors that watch clicks and activity to h.
+// Call it before the handler starts serving.
+func (d *FrustrationDetector) Register(h *UserEventsHandler) {
+    h.OnReceive(d.clickType(), d.click)
+    for _, eventType := range d.activityTypes() {
+        h.OnReceive(eventType, d.activity)
+    }
+}
+
+// Locks d, and returns the event's session, creating it if need be
+func (d *FrustrationDetector) session(ev *Event) *frustrationSession {
+    id := idString(firstPresent(ev.Fields(), "session_id", "page_load_id"))
+    if id == "" {
+        return nil
+    }
+    d.mu.Lock()
+    if d.sessions == nil {
+        d.sessions = make(map[string]*frustrationSession)
+    }
+    s := d.sessions[id]
+    if s == nil {
+        s = &frustrationSession{}
+        d.sessions[id] = s
+    }
+    s.seen = time.Now()
+    return s
+}
+
+func (d *FrustrationDetector) click(ev *Event) error {
+    target := idString(ev.Fields()[d.targetField()])
+    if target == "" {
+        return nil
+    }
+    s := d.session(ev)
+    if s == nil {
+        return nil
+    }
+    defer d.mu.Unlock()
+
+    clicks := 1
+    var spread time.Duration
+    if count, ok := numberValue(ev.Fields()["repeat_count"]); ok && count > 1 {
+        clicks = int(count)
+        if ms, ok := numberValue(ev.Fields()["repeat_duration_ms"]); ok {
+            spread = time.Duration(ms) * time.Millisecond
+        }
+    }
+
+    var burst *clickBurst
+    for _, b := range s.bursts {
+        if b.target == target && ev.Timestamp.Sub(b.last) <= d.rageWindow() && !ev.Timestamp.Before(b.first) {
+            burst = b
+            break
+        }
+    }
+    if burst == nil {
+        if len(s.bursts) >= maxSessionBursts {
+            return nil // Someone's clicking everything; the bursts we have will do
+        }
+        burst = &clickBurst{target: target, first: ev.Timestamp, fields: pageContext(ev.Fields()), dataset: ev.Dataset, client: ev.Client, user: ev.user, tenant: ev.tenant}
+        burst.fields[d.targetField()] = target
+        s.bursts = append(s.bursts, burst)
+    }
+    burst.arrived = time.Now()
+    for i := 0; i < clicks; i++ {
+        // A coalesced run's clicks, spread evenly over it
+        at := ev.Timestamp
+        if clicks > 1 {
+            at = at.Add(spread * time.Duration(i) / time.Duration(clicks-1))
+        }
+        burst.count++
+        if at.After(burst.last) {
+            burst.last = at
+        }
+        burst.recent = append(burst.recent, at)
+        if len(burst.recent) > d.rageClicks() {
+            burst.recent = burst.recent[1:]
+        }
+        if len(burst.recent) == d.rageClicks() && burst.recent[len(burst.recent)-1].Sub(burst.recent[0]) <= d.rageWindow() {
+            burst.rage = true
+        }
+    }
+    return nil
+}
+
+func (d *FrustrationDetector) activity(ev *Event) error {
+    s := d.session(ev)
+    if s == nil {
+        return nil
+    }
+    defer d.mu.Unlock()
+    s.activity = append(s.activity, ev.Timestamp)
+    if len(s.activity) > maxSessionActivity {
+        s.activity = s.activity[1:]
+    }
+    return nil
+}
+
+// Whether any of the session's activity came of the burst's clicks
+func (s *frustrationSession) answered(b *clickBurst, wait time.Duration) bool {
+    for _, at := range s.activity {
+        if !at.Before(b.first) && !at.After(b.last.Add(wait)) {
+            return true
+        }
+    }
+    return false
+}
+
+// Run sends ux-frustration events for bursts as they settle, until ctx is
+// done.
+func (d *FrustrationDetector) Run(ctx context.Context, h *UserEventsHandler) {
+    ticker := time.NewTicker(time.Second)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case now := <-ticker.C:
+            d.decide(ctx, h, now)
+        }
+    }
+}
+
+func (d *FrustrationDetector) decide(ctx context.Context, h *UserEventsHandler, now time.Time) {
+    var events []*Event
+    d.mu.Lock()
+    for id, s := range d.sessions {
+        kept := s.bursts[:0]
+        for _, b := range s.bursts {
+            if now.Sub(b.arrived) < d.settle() {
+                kept = append(kept, b)
+                continue
+            }
+            if b.rage {
+                events = append(events, d.frustration(h, b, "rage_click"))
+            }
+            if !s.answered(b, d.deadClickWait()) {
+                events = append(events, d.frustration(h, b, "dead_click"))
+            }
+        }
+        s.bursts = kept
+        if len(s.bursts) == 0 && now.Sub(s.seen) >= time.Minute {
+            delete(d.sessions, id) // Long enough that no late activity can still matter
+        }
+    }
+    d.mu.Unlock()
+
+    for _, ev := range events {
+        h.scrub(ctx, ev) // We saw the click as it arrived
+        h.send(ctx, ev)
+    }
+}
+
+func (d *FrustrationDetector) frustration(h *UserEventsHandler, b *clickBurst, kind string) *Event {
+    frustrations.WithLabelValues(kind).Inc()
+    ev := h.newEvent(frustrationEventType, nil, nil)
+    ev.Timestamp = b.first
+    ev.Dataset, ev.Client = b.dataset, b.client
+    ev.user, ev.tenant = b.user, b.tenant
+    ev.Add(b.fields)
+    UserEnricher{}.Enrich(context.Background(), ev, nil, b.user)
+    if b.tenant != nil {
+        ev.AddField("tenant", b.tenant.Name)
+    }
+    ev.AddField("frustration_type", kind)
+    ev.AddField("click_count", b.count)
+    ev.AddField("duration_ms", b.last.Sub(b.first).Milliseconds())
+    return ev
+}
@@ -0,0 +1,129 @@
+// GeoLocation is what we know about where a client IP is.
+type GeoLocation struct {
+    Country string // ISO country code, e.g. "US"
+    Region  string
+    City    string
+}
+
+// GeoLookup resolves an IP to a location. MaxMindLookup is the one we use, but
+// anything that can do IP -> location (a vendor API, a test stub) will work.
+type GeoLookup interface {
+    Lookup(ctx context.Context, ip net.IP) (GeoLocation, error)
+}
+
+// MaxMindLookup reads a GeoLite2/GeoIP2 City database from disk. The database
+// isn't opened until the first lookup, so a handler that never sees traffic
+// (or a misconfigured path) doesn't slow down startup. If it can't be opened
+// (say it's still being downloaded), lookups fail with that error for a
+// while, and then we try opening it again.
+type MaxMindLookup struct {
+    Path string
+
+    mu       sync.Mutex
+    db       *geoip2.Reader
+    err      error
+    failedAt time.Time
+}
+
+// How long after failing to open the database we try again
+const maxMindRetryInterval = 30 * time.Second
+
+func (m *MaxMindLookup) open() (*geoip2.Reader, error) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    if m.db == nil && (m.err == nil || time.Since(m.failedAt) >= maxMindRetryInterval) {
+        m.db, m.err = geoip2.Open(m.Path)
+        m.failedAt = time.Now()
+    }
+    return m.db, m.err
+}
+
+func (m *MaxMindLookup) Lookup(ctx context.Context, ip net.IP) (GeoLocation, error) {
+    db, err := m.open()
+    if err != nil {
+        return GeoLocation{}, err
+    }
+
+    record, err := db.City(ip)
+    if err != nil {
+        return GeoLocation{}, err
+    }
+    loc := GeoLocation{
+        Country: record.Country.IsoCode,
+        City:    record.City.Names["en"],
+    }
+    if len(record.Subdivisions) > 0 {
+        loc.Region = record.Subdivisions[0].Names["en"]
+    }
+    return loc, nil
+}
+
+// GeoIPEnricher adds geo_country, geo_region, and geo_city fields based on the
+// requester's IP. The same handful of IPs tend to send us lots of events, so
+// recent lookups are kept in an LRU cache to keep this off the ingest path's
+// latency budget.
+type GeoIPEnricher struct {
+    Lookup GeoLookup
+    cache  *lru.Cache
+}
+
+func NewGeoIPEnricher(lookup GeoLookup, cacheSize int) (*GeoIPEnricher, error) {
+    cache, err := lru.New(cacheSize)
+    if err != nil {
+        return nil, err
+    }
+    return &GeoIPEnricher{Lookup: lookup, cache: cache}, nil
+}
+
+func (g *GeoIPEnricher) Enrich(ctx context.Context, ev *Event, r *http.Request, user *UserInfo) error {
+    loc, err := g.Locate(ctx, r)
+    if err != nil {
+        return err
+    }
+    if loc == (GeoLocation{}) {
+        return nil
+    }
+
+    ev.AddField("geo_country", loc.Country)
+    ev.AddField("geo_region", loc.Region)
+    ev.AddField("geo_city", loc.City)
+    return nil
+}
+
+// Locate looks up (or remembers) where the request came from, for anything
+// else that needs to know. No client IP means an empty GeoLocation.
+func (g *GeoIPEnricher) Locate(ctx context.Context, r *http.Request) (GeoLocation, error) {
+    ip := clientIP(r)
+    if ip == nil {
+        return GeoLocation{}, nil
+    }
+    if cached, ok := g.cache.Get(ip.String()); ok {
+        return cached.(GeoLocation), nil
+    }
+    if err := ctx.Err(); err != nil {
+        return GeoLocation{}, err // Out of time; a cache miss isn't worth the wait
+    }
+    loc, err := g.Lookup.Lookup(ctx, ip)
+    if err != nil {
+        return GeoLocation{}, err
+    }
+    g.cache.Add(ip.String(), loc)
+    return loc, nil
+}
+
+// The browser's IP, as best we can tell. Behind our load balancer the remote
+// address is the LB itself, so we prefer the first (client-most) address in
+// X-Forwarded-For when there is one.
+func clientIP(r *http.Request) net.IP {
+    if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+        first := strings.TrimSpace(strings.Split(forwarded, ",")[0])
+        if ip := net.ParseIP(first); ip != nil {
+            return ip
+        }
+    }
+    host, _, err := net.SplitHostPort(r.RemoteAddr)
+    if err != nil {
+        host = r.RemoteAddr
+    }
+    return net.ParseIP(host)
+}
@@ -0,0 +1,112 @@
+// ingestpb is generated from ingest.proto, with protoc-gen-go and
+// protoc-gen-go-grpc on the PATH
+//go:generate protoc --go_out=. --go_opt=module=github.com/eanakashima/honeycombio-browser-js-example --go-grpc_out=. --go-grpc_opt=module=github.com/eanakashima/honeycombio-browser-js-example ingest.proto
+
+// GRPCServer serves the Ingest service from ingest.proto, so native apps and
+// internal services can send events without going through HTTP:
+//
+//     server := grpc.NewServer()
+//     ingestpb.RegisterIngestServer(server, &GRPCServer{Handler: handler})
+//
+// Everything in our pipeline (rate limits, tenants, consent, the User-Agent
+// enricher...) reads what it needs off an *http.Request, so rather than teach
+// each of them about gRPC, we build a stand-in request from the call's
+// metadata and peer address. That includes the user, who's resolved from
+// whatever cookie or bearer token the caller sent as metadata. gRPC metadata
+// keys are just lowercased header names, so "user-agent", "x-ingest-token",
+// "traceparent" and so on all carry over as-is.
+type GRPCServer struct {
+    ingestpb.UnimplementedIngestServer
+
+    Handler *UserEventsHandler
+}
+
+func (s *GRPCServer) IngestEvent(ctx context.Context, req *ingestpb.IngestEventRequest) (*ingestpb.IngestEventResponse, error) {
+    r := grpcRequest(ctx, "/userevents.v1.Ingest/IngestEvent")
+    if err := s.ingest(ctx, req, r, s.Handler.currentUser(r)); err != nil {
+        return nil, err
+    }
+    return &ingestpb.IngestEventResponse{}, nil
+}
+
+func (s *GRPCServer) IngestEventStream(stream ingestpb.Ingest_IngestEventStreamServer) error {
+    r := grpcRequest(stream.Context(), "/userevents.v1.Ingest/IngestEventStream")
+    user := s.Handler.currentUser(r) // Once per stream, not once per event
+
+    resp := &ingestpb.IngestEventStreamResponse{}
+    for index := uint64(0); ; index++ {
+        req, err := stream.Recv()
+        if err == io.EOF {
+            return stream.SendAndClose(resp)
+        }
+        if err != nil {
+            return err
+        }
+
+        if err := s.ingest(stream.Context(), req, r, user); err != nil {
+            // A full queue or a spent quota won't fix itself by the next
+            // event, so end the stream and let the client back off
+            if code := status.Code(err); code == codes.Unavailable || code == codes.ResourceExhausted {
+                return err
+            }
+            resp.Rejected = append(resp.Rejected, &ingestpb.Rejection{Index: index, Reason: status.Convert(err).Message()})
+            continue
+        }
+        resp.Accepted++
+    }
+}
+
+func (s *GRPCServer) ingest(ctx context.Context, req *ingestpb.IngestEventRequest, r *http.Request, user *UserInfo) error {
+    if req.GetType() == "" {
+        return status.Error(codes.InvalidArgument, "event has no type")
+    }
+    metadata := req.GetFields().AsMap()
+    metadata["type"] = req.GetType()
+    return grpcStatus(s.Handler.sendToHoneycombAPI(ctx, req.GetType(), metadata, r, user))
+}
+
+func grpcRequest(ctx context.Context, method string) *http.Request {
+    r, _ := http.NewRequestWithContext(ctx, http.MethodPost, method, nil)
+    if md, ok := metadata.FromIncomingContext(ctx); ok {
+        for key, values := range md {
+            if strings.HasPrefix(key, ":") || strings.HasPrefix(key, "grpc-") {
+                continue // Pseudo-headers and gRPC's own
+            }
+            for _, value := range values {
+                r.Header.Add(key, value)
+            }
+        }
+    }
+    if p, ok := peer.FromContext(ctx); ok && p.Addr != nil {
+        r.RemoteAddr = p.Addr.String()
+    }
+    if authority := metadata.ValueFromIncomingContext(ctx, ":authority"); len(authority) > 0 {
+        r.Host = authority[0]
+    }
+    return r
+}
+
+// The gRPC status for each error sendToHoneycombAPI can give us, matching
+// what rejectEvents does over HTTP. The message is prefixed with the
+// ErrorCode, so gRPC clients can tell rejections apart the same way.
+func grpcStatus(err error) error {
+    if err == nil {
+        return nil
+    }
+    var invalid *ValidationError
+    message := string(errorCodeFor(err)) + ": " + err.Error()
+    switch {
+    case errors.Is(err, ErrQueueFull):
+        return status.Error(codes.Unavailable, message)
+    case errors.Is(err, ErrQuotaExceeded):
+        return status.Error(codes.ResourceExhausted, message)
+    case errors.Is(err, ErrUnknownTenant):
+        return status.Error(codes.Unauthenticated, message)
+    case errors.Is(err, ErrInvalidNonce):
+        return status.Error(codes.PermissionDenied, message)
+    case errors.As(err, &invalid):
+        return status.Error(codes.InvalidArgument, message)
+    default:
+        return status.Error(codes.Internal, message)
+    }
+}
@@ -0,0 +1,149 @@
+// HandleHealthz and HandleReadyz are for Kubernetes' liveness and readiness
+// probes. Liveness only says the process is up and serving: restarting us
+// won't fix Honeycomb. Readiness checks the pipeline behind the handler, so
+// an instance that's wedged (queue full, spool piling up, state store
+// unreachable, nothing landing in Honeycomb) is taken out of rotation until
+// it recovers:
+//
+//     mux.HandleFunc("/healthz", handler.HandleHealthz)
+//     mux.HandleFunc("/readyz", handler.HandleReadyz)
+type HealthConfig struct {
+    MaxQueueFill   float64       // Not ready once the Queue is this full; defaults to 0.9
+    MaxDeadLetters int           // ...or this many events are spooled; defaults to 10000
+    MaxSilence     time.Duration // ...or there have been failures and no successful send for this long; defaults to 5 minutes
+}
+
+// The result of one readiness check
+type healthCheck struct {
+    OK     bool   `json:"ok"`
+    Detail string `json:"detail,omitempty"`
+}
+
+// When Honeycomb last accepted a batch from us, and when a send last failed,
+// in Unix nanoseconds. Updated from WatchResponses.
+var lastSendOK, lastSendFailed int64
+
+func recordSendOutcome(resp transmission.Response) {
+    now := time.Now().UnixNano()
+    if resp.Err == nil && resp.StatusCode < 300 {
+        atomic.StoreInt64(&lastSendOK, now)
+    } else if retryable(resp) {
+        atomic.StoreInt64(&lastSendFailed, now)
+    }
+}
+
+func (h *UserEventsHandler) HandleHealthz(w http.ResponseWriter, r *http.Request) {
+    w.Write([]byte("ok\n"))
+}
+
+func (h *UserEventsHandler) HandleReadyz(w http.ResponseWriter, r *http.Request) {
+    ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+    defer cancel()
+
+    checks := h.readinessChecks(ctx)
+    status := http.StatusOK
+    for _, check := range checks {
+        if !check.OK {
+            status = http.StatusServiceUnavailable
+        }
+    }
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(status)
+    json.NewEncoder(w).Encode(map[string]interface{}{"ready": status == http.StatusOK, "checks": checks})
+}
+
+func (h *UserEventsHandler) readinessChecks(ctx context.Context) map[string]healthCheck {
+    cfg := h.Health
+    if cfg == nil {
+        cfg = &HealthConfig{}
+    }
+    checks := map[string]healthCheck{}
+
+    h.closeMu.RLock()
+    closed := h.closed
+    h.closeMu.RUnlock()
+    checks["accepting"] = healthCheck{OK: !closed}
+    if closed {
+        checks["accepting"] = healthCheck{Detail: "shutting down"}
+    }
+
+    for _, queue := range h.allQueues() {
+        maxFill := cfg.MaxQueueFill
+        if maxFill <= 0 {
+            maxFill = 0.9
+        }
+        depth, size := queue.Len(), cap(queue.jobs)
+        check := healthCheck{
+            OK:     size == 0 || float64(depth)/float64(size) < maxFill,
+            Detail: fmt.Sprintf("%d of %d queued", depth, size),
+        }
+        if queue.name != defaultQueueName {
+            // A full bulkhead only holds up its own event types, which is
+            // the point of it; taking the instance out of rotation would
+            // hold up everything else too
+            check.OK = true
+            checks["queue:"+queue.name] = check
+            continue
+        }
+        checks["queue"] = check
+    }
+
+    if h.DeadLetters != nil {
+        if counter, ok := h.DeadLetters.spool(h).(interface{ Len() (int, error) }); ok {
+            maxSpooled := cfg.MaxDeadLetters
+            if maxSpooled <= 0 {
+                maxSpooled = 10000
+            }
+            n, err := counter.Len()
+            if err != nil {
+                checks["dead_letters"] = healthCheck{Detail: err.Error()}
+            } else {
+                checks["dead_letters"] = healthCheck{OK: n < maxSpooled, Detail: fmt.Sprintf("%d spooled", n)}
+            }
+        }
+    }
+
+    // Only stores that talk to something else can be unreachable
+    if pinger, ok := h.state().(interface{ Ping(context.Context) error }); ok {
+        if err := pinger.Ping(ctx); err != nil {
+            checks["state_store"] = healthCheck{Detail: err.Error()}
+        } else {
+            checks["state_store"] = healthCheck{OK: true}
+        }
+    }
+
+    checks["honeycomb"] = h.transmissionHealth(cfg)
+    return checks
+}
+
+// Sends are wedged if they've been failing and nothing has gotten through in
+// a while. An instance that's simply had no traffic is fine.
+func (h *UserEventsHandler) transmissionHealth(cfg *HealthConfig) healthCheck {
+    maxSilence := cfg.MaxSilence
+    if maxSilence <= 0 {
+        maxSilence = 5 * time.Minute
+    }
+    ok, failed := atomic.LoadInt64(&lastSendOK), atomic.LoadInt64(&lastSendFailed)
+    check := healthCheck{OK: true}
+    if failed > ok && time.Since(time.Unix(0, ok)) > maxSilence {
+        check.OK = false
+        check.Detail = "sends failing"
+        if ok > 0 {
+            check.Detail += fmt.Sprintf(", last success %s ago", time.Since(time.Unix(0, ok)).Round(time.Second))
+        }
+    }
+
+    if h.Breaker != nil {
+        var open []string
+        for name := range h.allClients() {
+            if state := h.Breaker.State(name); state != BreakerClosed {
+                open = append(open, fmt.Sprintf("%s %s", name, state))
+            }
+        }
+        if len(open) > 0 {
+            sort.Strings(open)
+            check.Detail = strings.TrimPrefix(check.Detail+"; circuits: "+strings.Join(open, ", "), "; ")
+        }
+    }
+    return check
+}
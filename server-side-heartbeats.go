@@ -0,0 +1,201 @@
+// Time-on-page says how long a tab was open, not how long anyone was looking
+// at it. The browser SDK can send a heartbeat event every Interval while its
+// page is visible and being interacted with; HeartbeatTracker counts them per
+// page view instead of sending them, and adds the total to the page view's
+// unload as `active_time_seconds` (and `heartbeats`):
+//
+//     tracker := &HeartbeatTracker{Interval: 15 * time.Second}
+//     tracker.Register(handler)
+//     go tracker.Run(ctx, handler)
+//
+// Plenty of page views never send an unload (the tab crashed, or mobile
+// Safari killed it), so a page view that's gone quiet for Expiry gets a
+// page-view-activity event of its own instead, with the same fields plus the
+// session and page it was for. Counts live in the handler's StateStore, so a
+// page view's heartbeats can land on any instance. If heartbeats are
+// sampled, each one kept counts for its sample rate's worth, so active time
+// comes out right on average.
+type HeartbeatTracker struct {
+    Type     string        // The browser's heartbeat event type; defaults to "heartbeat"
+    Interval time.Duration // How often the browser sends them, each counted as this much active time; defaults to 15 seconds
+    Expiry   time.Duration // How long after the last heartbeat to give up waiting for an unload; defaults to 30 minutes
+
+    store StateStore
+
+    mu      sync.Mutex
+    pending map[string]heartbeatPageView // Page views whose last heartbeat came here
+}
+
+// What we say about a page view that expired, from its last heartbeat
+type heartbeatPageView struct {
+    last    time.Time
+    fields  map[string]interface{}
+    dataset string // The heartbeat's, so the tenant's prefix and client carry over
+    client  string
+}
+
+const pageViewActivityType = "page-view-activity"
+
+// What an event we derive from a browser event carries over from it, so it
+// can be found alongside it
+var pageContextFields = []string{"session_id", "user_id", "page_url", "page_path", "tenant"}
+
+func pageContext(fields map[string]interface{}) map[string]interface{} {
+    carried := make(map[string]interface{}, len(pageContextFields))
+    for _, name := range pageContextFields {
+        if value, ok := fields[name]; ok {
+            carried[name] = value
+        }
+    }
+    return carried
+}
+
+func (t *HeartbeatTracker) eventType() string {
+    if t.Type != "" {
+        return t.Type
+    }
+    return "heartbeat"
+}
+
+func (t *HeartbeatTracker) interval() time.Duration {
+    if t.Interval > 0 {
+        return t.Interval
+    }
+    return 15 * time.Second
+}
+
+func (t *HeartbeatTracker) expiry() time.Duration {
+    if t.Expiry > 0 {
+        return t.Expiry
+    }
+    return 30 * time.Minute
+}
+
+func (t *HeartbeatTracker) Register(h *UserEventsHandler) {
+    t.store = h.state()
+    h.On(t.eventType(), t.heartbeat)
+    h.On("page-unload", t.pageUnload)
+}
+
+// Counts a heartbeat, and drops it. Processors only see the heartbeats that
+// were sampled, so each counts as the heartbeats it stands for.
+func (t *HeartbeatTracker) heartbeat(ev *Event) error {
+    id := pageViewID(ev.Fields())
+    if id == "" {
+        return ErrDropEvent // Nothing to add it to
+    }
+    weight := int64(ev.SampleRate)
+    if weight < 1 {
+        weight = 1
+    }
+    ctx, cancel := context.WithTimeout(context.Background(), stateStoreTimeout)
+    defer cancel()
+    if _, err := t.store.IncrBy(ctx, "heartbeats:"+id, weight, t.expiry()*2); err != nil {
+        return fmt.Errorf("couldn't count heartbeat: %v", err) // So the heartbeat's sent rather than lost
+    }
+    t.store.Set(ctx, "heartbeat-last:"+id, encodeTime(ev.Timestamp), t.expiry()*2)
+
+    fields := pageContext(ev.Fields())
+    t.mu.Lock()
+    if t.pending == nil {
+        t.pending = make(map[string]heartbeatPageView)
+    }
+    t.pending[id] = heartbeatPageView{last: ev.Timestamp, fields: fields, dataset: ev.Dataset, client: ev.Client}
+    t.mu.Unlock()
+    return ErrDropEvent
+}
+
+func (t *HeartbeatTracker) pageUnload(ev *Event) error {
+    id := pageViewID(ev.Fields())
+    if id == "" {
+        return nil
+    }
+    t.mu.Lock()
+    delete(t.pending, id)
+    t.mu.Unlock()
+
+    ctx, cancel := context.WithTimeout(context.Background(), stateStoreTimeout)
+    defer cancel()
+    count, err := t.take(ctx, id)
+    if err != nil {
+        return err
+    }
+    t.addActivity(ev, count)
+    return nil
+}
+
+// Takes the page view's heartbeat count, so it's only ever reported once
+func (t *HeartbeatTracker) take(ctx context.Context, id string) (int64, error) {
+    raw, _, err := t.store.Take(ctx, "heartbeats:"+id)
+    if err != nil {
+        return 0, err
+    }
+    t.store.Delete(ctx, "heartbeat-last:"+id)
+    count, _ := strconv.ParseInt(string(raw), 10, 64)
+    return count, nil
+}
+
+func (t *HeartbeatTracker) addActivity(ev *Event, count int64) {
+    ev.AddField("heartbeats", count)
+    ev.AddField("active_time_seconds", float64(count)*t.interval().Seconds())
+}
+
+// Run sends page-view-activity events for page views that have gone quiet,
+// until ctx is done.
+func (t *HeartbeatTracker) Run(ctx context.Context, h *UserEventsHandler) {
+    ticker := time.NewTicker(t.expiry() / 4)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case now := <-ticker.C:
+            t.expire(ctx, h, now)
+        }
+    }
+}
+
+func (t *HeartbeatTracker) expire(ctx context.Context, h *UserEventsHandler, now time.Time) {
+    t.mu.Lock()
+    var quiet []string
+    views := map[string]heartbeatPageView{}
+    for id, view := range t.pending {
+        if now.Sub(view.last) >= t.expiry() {
+            quiet = append(quiet, id)
+            views[id] = view
+            delete(t.pending, id)
+        }
+    }
+    t.mu.Unlock()
+
+    for _, id := range quiet {
+        storeCtx, cancel := context.WithTimeout(ctx, stateStoreTimeout)
+        // Another instance may have had a later heartbeat, in which case
+        // it's the one waiting on this page view now
+        if raw, ok, err := t.store.Get(storeCtx, "heartbeat-last:"+id); err == nil && ok {
+            if last, ok := decodeTime(raw); ok && now.Sub(last) < t.expiry() {
+                cancel()
+                continue
+            }
+        }
+        count, err := t.take(storeCtx, id)
+        cancel()
+        if err != nil {
+            h.logger().Warn("couldn't read heartbeats for expired page view", "page_view_id", id, "error", err)
+            continue
+        }
+        if count == 0 {
+            continue // Its unload got there first
+        }
+
+        view := views[id]
+        ev := h.newEvent(pageViewActivityType, nil, nil)
+        ev.Timestamp = view.last
+        ev.Dataset, ev.Client = view.dataset, view.client
+        ev.Add(view.fields)
+        ev.AddField("page_view_id", id)
+        ev.AddField("ended", "expired")
+        t.addActivity(ev, count)
+        h.send(ctx, ev) // The heartbeat's fields were scrubbed before we saw them
+    }
+}
@@ -0,0 +1,58 @@
+// Makes one call to Honeycomb's REST API (everything but event sending, which
+// libhoney does), JSON in and out. body and out may be nil. host defaults to
+// https://api.honeycomb.io, and client to one with a 30 second timeout.
+func honeycombAPI(ctx context.Context, client *http.Client, host, key, method, path string, body, out interface{}) error {
+    if host == "" {
+        host = defaultAPIHost
+    }
+    var reqBody io.Reader
+    if body != nil {
+        buf, err := json.Marshal(body)
+        if err != nil {
+            return err
+        }
+        reqBody = bytes.NewReader(buf)
+    }
+    req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(host, "/")+path, reqBody)
+    if err != nil {
+        return err
+    }
+    req.Header.Set("X-Honeycomb-Team", key)
+    req.Header.Set("Content-Type", "application/json")
+
+    if client == nil {
+        client = &http.Client{Timeout: 30 * time.Second}
+    }
+    resp, err := client.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode >= 300 {
+        msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+        return &HoneycombAPIError{StatusCode: resp.StatusCode, Status: resp.Status, Method: method, Path: path, Message: string(bytes.TrimSpace(msg))}
+    }
+    if out == nil {
+        return nil
+    }
+    return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// HoneycombAPIError is an error response from the REST API, for callers that
+// care which one (a 404 for something that doesn't exist yet, say).
+type HoneycombAPIError struct {
+    StatusCode int
+    Status     string
+    Method     string
+    Path       string
+    Message    string
+}
+
+func (e *HoneycombAPIError) Error() string {
+    return fmt.Sprintf("honeycomb API returned %s for %s %s: %s", e.Status, e.Method, e.Path, e.Message)
+}
+
+func isAPIStatus(err error, status int) bool {
+    var apiErr *HoneycombAPIError
+    return errors.As(err, &apiErr) && apiErr.StatusCode == status
+}
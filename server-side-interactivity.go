@@ -0,0 +1,87 @@
+// Page-load timings say nothing about how a page feels once it's up. The
+// browser also reports `long-task` events (from the Long Tasks API: anything
+// that blocked the main thread for 50ms or more) and `interaction` events
+// (from the Event Timing API, which is what INP is computed from). Both carry
+// the page_view_id of the page they happened on, and their url, so they pick
+// up url_route, app_version and the rest like any other event, and
+// interactivity regressions can be broken down by route and release.
+
+// Built-in schemas for these event types, used unless a SchemaRegistry
+// registers its own. Attribution fields vary a lot between browsers, so only
+// the durations are required.
+var interactivitySchemas = map[string]EventSchema{
+    "long-task": {
+        "duration_ms":      {Type: NumberType, Required: true},
+        "start_time_ms":    {Type: NumberType},
+        "attribution_name": {Type: StringType, MaxLength: 100},
+        "container_type":   {Type: StringType, MaxLength: 100},
+        "container_src":    {Type: StringType, MaxLength: 2000},
+        "container_id":     {Type: StringType, MaxLength: 200},
+        "container_name":   {Type: StringType, MaxLength: 200},
+    },
+    "interaction": {
+        "duration_ms":           {Type: NumberType, Required: true},
+        "interaction_type":      {Type: StringType, Required: true, MaxLength: 50},
+        "interaction_target":    {Type: StringType, MaxLength: 500},
+        "input_delay_ms":        {Type: NumberType},
+        "processing_ms":         {Type: NumberType},
+        "presentation_delay_ms": {Type: NumberType},
+    },
+}
+
+// Long tasks don't have official thresholds like the Web Vitals do; these
+// match the buckets Lighthouse reports total blocking time in
+var longTaskBuckets = []struct {
+    upTo  float64
+    label string
+}{
+    {100, "50-100ms"},
+    {250, "100-250ms"},
+    {500, "250-500ms"},
+    {1000, "500ms-1s"},
+}
+
+func addInteractivityFields(ev *Event, metadata map[string]interface{}) {
+    if ev.Type != "long-task" && ev.Type != "interaction" {
+        return
+    }
+    // Older builds only send page_load_id
+    if id := pageViewID(metadata); id != "" {
+        ev.AddField("page_view_id", id)
+    }
+
+    duration, ok := timingField(metadata, "duration_ms")
+    if !ok {
+        return
+    }
+    switch ev.Type {
+    case "long-task":
+        ev.AddField("long_task_bucket", longTaskBucket(duration))
+        // Blocking time is the part over 50ms, as in total blocking time, so
+        // summing it per page view gives that page's TBT
+        ev.AddField("blocking_time_ms", math.Max(duration-50, 0))
+    case "interaction":
+        // Thresholds from https://web.dev/inp/
+        ev.AddField("inp_bucket", vitalsBucket(duration, 200, 500))
+        if processing, ok := timingField(metadata, "processing_ms"); ok {
+            // Which of the three phases to go after first
+            phase := "processing"
+            if delay, ok := timingField(metadata, "input_delay_ms"); ok && delay > processing {
+                phase, processing = "input_delay", delay
+            }
+            if presentation, ok := timingField(metadata, "presentation_delay_ms"); ok && presentation > processing {
+                phase = "presentation_delay"
+            }
+            ev.AddField("interaction_slowest_phase", phase)
+        }
+    }
+}
+
+func longTaskBucket(duration float64) string {
+    for _, bucket := range longTaskBuckets {
+        if duration < bucket.upTo {
+            return bucket.label
+        }
+    }
+    return "1s+"
+}
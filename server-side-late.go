@@ -0,0 +1,93 @@
+// Mobile browsers suspend background tabs, and a tab's queued events
+// (unloads especially) can go out hours later when it wakes up. Honeycomb
+// files them under when they happened, so they land in time buckets people
+// have already looked at, and spike graphs that were fine at the time.
+// LateEvents decides what happens to events older than MaxAge (by their
+// clock-skew-corrected timestamp) when they arrive:
+//
+//     handler.Late = &LateEvents{MaxAge: time.Hour, Action: LateRoute}
+//
+// What that is depends on the Action:
+//
+//   - LateDrop drops them
+//   - LateRetimestamp sends them as if they happened when they arrived, with
+//     late_arrival=true so they can be filtered out of time series
+//   - LateRoute sends them, as they are, to Dataset instead
+//
+// Whatever the action, events it keeps get late_arrival and late_by_ms
+// fields.
+type LateEvents struct {
+    MaxAge       time.Duration            `yaml:"max_age"`         // Defaults to an hour
+    MaxAgeByType map[string]time.Duration `yaml:"max_age_by_type"` // Overrides MaxAge for some event types
+    Action       LateAction               `yaml:"action"`          // Defaults to LateDrop
+    Dataset      string                   `yaml:"dataset"`         // For LateRoute; defaults to "late-events", after any tenant prefix
+}
+
+type LateAction string
+
+const (
+    LateDrop        LateAction = "drop"
+    LateRetimestamp LateAction = "retimestamp"
+    LateRoute       LateAction = "route"
+)
+
+var lateEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+    Name: "user_events_late_events_total",
+    Help: "Events that arrived after their max age, by what we did with them.",
+}, []string{"type", "action"})
+
+func (l *LateEvents) maxAge(eventType string) time.Duration {
+    if age, ok := l.MaxAgeByType[eventType]; ok {
+        return age
+    }
+    if l.MaxAge > 0 {
+        return l.MaxAge
+    }
+    return time.Hour
+}
+
+func (l *LateEvents) dataset() string {
+    if l.Dataset != "" {
+        return l.Dataset
+    }
+    return "late-events"
+}
+
+func (l *LateEvents) action() LateAction {
+    if l.Action != "" {
+        return l.Action
+    }
+    return LateDrop
+}
+
+func (l *LateEvents) validate() error {
+    switch l.action() {
+    case LateDrop, LateRetimestamp, LateRoute:
+        return nil
+    }
+    return fmt.Errorf("late_events: unknown action %q (drop, retimestamp, or route)", l.Action)
+}
+
+// Applies the policy to an event whose timestamp has been corrected, and
+// returns whether to keep it.
+func (l *LateEvents) apply(ev *Event, tenant *Tenant, receivedAt time.Time) bool {
+    age := receivedAt.Sub(ev.Timestamp)
+    if age <= l.maxAge(ev.Type) {
+        return true
+    }
+    lateEvents.WithLabelValues(metricsTypeLabel(ev.Type), string(l.action())).Inc()
+    switch l.action() {
+    case LateDrop:
+        return false
+    case LateRetimestamp:
+        ev.Timestamp = receivedAt
+    case LateRoute:
+        ev.Dataset = l.dataset()
+        if tenant != nil {
+            ev.Dataset = tenant.DatasetPrefix + ev.Dataset
+        }
+    }
+    ev.AddField("late_arrival", true)
+    ev.AddField("late_by_ms", age.Milliseconds())
+    return true
+}
@@ -0,0 +1,181 @@
+// A burst of traffic (or a slow sink) can back events up until the ingest
+// service runs out of memory, and then we lose all of them, errors included.
+// LoadShedder watches for the signs of that coming: queues filling up, the
+// heap growing, goroutines piling up behind slow sends. While any of them is
+// over its threshold, it sheds events as they arrive, before any state store
+// round trips, enriching, or queueing:
+//
+//     handler.LoadShed = &LoadShedder{MaxHeapBytes: 2 << 30, MaxGoroutines: 20000}
+//     go handler.LoadShed.Run(ctx, handler)
+//
+// What's kept while it's shedding:
+//
+//     high priority and Protected types  all of them (Protected defaults to "error")
+//     Sampled types                      1 in N of them (defaults to 1 in 10 page-loads)
+//     everything else                    nothing
+//
+// Kept events' sample rates are scaled up to match, so counts in Honeycomb
+// stay right. Shed events count as accepted, since there's no point the
+// browser retrying them into the same pressure: a batch with some gets a 202
+// rather than a 204. Signals are read every Interval, and shedding carries on
+// for Cooldown after the last reading over a threshold, so it doesn't flap.
+// user_events_shed_ratio is the share of events shed in the last Interval.
+type LoadShedder struct {
+    MaxQueueFill  float64         `yaml:"max_queue_fill"` // How full any queue may get, from 0 to 1; defaults to 0.8
+    MaxHeapBytes  uint64          `yaml:"max_heap_bytes"` // 0 doesn't check the heap
+    MaxGoroutines int             `yaml:"max_goroutines"` // 0 doesn't check goroutines
+    Protected     []string        `yaml:"protected"`      // Types never shed; defaults to "error"
+    Sampled       map[string]uint `yaml:"sampled"`        // Types to keep 1 in N of while shedding; defaults to {"page-load": 10}
+    Interval      time.Duration   `yaml:"interval"`       // Defaults to a second
+    Cooldown      time.Duration   `yaml:"cooldown"`       // Defaults to 10 seconds
+
+    shedUntil int64 // Unix nanoseconds
+    shed      int64 // Since the last reading
+    kept      int64
+}
+
+// The eventsDropped reason for a shed event
+const shedDropReason = "shed_pressure"
+
+var loadPressure = promauto.NewGaugeVec(prometheus.GaugeOpts{
+    Name: "user_events_load_pressure",
+    Help: "The last reading of each load-shedding signal, as a fraction of its threshold.",
+}, []string{"signal"})
+
+var shedRatio = promauto.NewGauge(prometheus.GaugeOpts{
+    Name: "user_events_shed_ratio",
+    Help: "The share of events shed for load over the last interval.",
+})
+
+func (s *LoadShedder) maxQueueFill() float64 {
+    if s.MaxQueueFill > 0 {
+        return s.MaxQueueFill
+    }
+    return 0.8
+}
+
+func (s *LoadShedder) protected() []string {
+    if s.Protected != nil {
+        return s.Protected
+    }
+    return []string{"error"}
+}
+
+func (s *LoadShedder) sampled() map[string]uint {
+    if s.Sampled != nil {
+        return s.Sampled
+    }
+    return map[string]uint{"page-load": 10}
+}
+
+func (s *LoadShedder) interval() time.Duration {
+    if s.Interval > 0 {
+        return s.Interval
+    }
+    return time.Second
+}
+
+func (s *LoadShedder) cooldown() time.Duration {
+    if s.Cooldown > 0 {
+        return s.Cooldown
+    }
+    return 10 * time.Second
+}
+
+func (s *LoadShedder) validate() error {
+    if s.MaxQueueFill < 0 || s.MaxQueueFill > 1 {
+        return fmt.Errorf("load_shedding: max_queue_fill must be between 0 and 1, not %v", s.MaxQueueFill)
+    }
+    for eventType, rate := range s.Sampled {
+        if rate < 1 {
+            return fmt.Errorf("load_shedding: sampled rate for %s must be at least 1", eventType)
+        }
+    }
+    return nil
+}
+
+// Shedding says whether we're shedding load right now.
+func (s *LoadShedder) Shedding() bool {
+    return s != nil && time.Now().UnixNano() < atomic.LoadInt64(&s.shedUntil)
+}
+
+// Whether to keep an event, and what to scale its sample rate by if so. s
+// may be nil.
+func (s *LoadShedder) admit(eventType string, priority Priority) (keep bool, rate uint) {
+    if !s.Shedding() {
+        if s != nil {
+            atomic.AddInt64(&s.kept, 1)
+        }
+        return true, 1
+    }
+    keep, rate = false, 1
+    switch {
+    case priority > PriorityNormal || containsString(s.protected(), eventType):
+        keep = true
+    case s.sampled()[eventType] > 0:
+        rate = s.sampled()[eventType]
+        keep = rand.Intn(int(rate)) == 0
+    }
+    if keep {
+        atomic.AddInt64(&s.kept, 1)
+    } else {
+        atomic.AddInt64(&s.shed, 1)
+    }
+    return keep, rate
+}
+
+// Run reads the pressure signals every Interval until ctx is done.
+func (s *LoadShedder) Run(ctx context.Context, h *UserEventsHandler) {
+    ticker := time.NewTicker(s.interval())
+    defer ticker.Stop()
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+            s.check(h, time.Now())
+        }
+    }
+}
+
+func (s *LoadShedder) check(h *UserEventsHandler, now time.Time) {
+    readings := map[string]float64{}
+    for _, queue := range h.allQueues() {
+        if capacity := cap(queue.jobs); capacity > 0 {
+            fill := float64(queue.Len()) / float64(capacity) / s.maxQueueFill()
+            if fill > readings["queue"] {
+                readings["queue"] = fill
+            }
+        }
+    }
+    if s.MaxHeapBytes > 0 {
+        var mem runtime.MemStats
+        runtime.ReadMemStats(&mem)
+        readings["heap"] = float64(mem.HeapAlloc) / float64(s.MaxHeapBytes)
+    }
+    if s.MaxGoroutines > 0 {
+        readings["goroutines"] = float64(runtime.NumGoroutine()) / float64(s.MaxGoroutines)
+    }
+
+    var over []string
+    for signal, reading := range readings {
+        loadPressure.WithLabelValues(signal).Set(reading)
+        if reading >= 1 {
+            over = append(over, signal)
+        }
+    }
+    if len(over) > 0 {
+        if !s.Shedding() {
+            sort.Strings(over)
+            h.logger().Warn("shedding load", "signals", over)
+        }
+        atomic.StoreInt64(&s.shedUntil, now.Add(s.cooldown()).UnixNano())
+    }
+
+    shed, kept := atomic.SwapInt64(&s.shed, 0), atomic.SwapInt64(&s.kept, 0)
+    if shed+kept > 0 {
+        shedRatio.Set(float64(shed) / float64(shed+kept))
+    } else {
+        shedRatio.Set(0)
+    }
+}
@@ -0,0 +1,58 @@
+// Everything the handler logs goes through Logger, as structured slog records,
+// so it can be filtered by level and shipped as JSON along with the rest of
+// our service logs.
+func (h *UserEventsHandler) logger() *slog.Logger {
+    if h.Logger != nil {
+        return h.Logger
+    }
+    return slog.Default()
+}
+
+// "Why is this field missing in Honeycomb?" is hard to answer when all you
+// can see is what landed. DebugTrace logs what happened to an event along the
+// way: the fields the browser sent, and either why we dropped it or the full
+// enriched event exactly as it went to the sink. Turn it on for a tiny
+// fraction of traffic, or for the one user who's reporting the problem:
+//
+//     handler.Debug = &DebugTrace{UserIDs: []string{"12345"}}
+//
+// Traced events are logged at Info, so they show up without turning the whole
+// logger's level down. Scrubbing has already happened by the time we log the
+// finished event, but the browser's raw fields are logged before it, so keep
+// traces short-lived.
+type DebugTrace struct {
+    // SampleRate is the fraction (0 to 1) of requests to trace. Requests
+    // that came through TraceIngest are traced (or not) as a whole, so every
+    // event in a batch shows up together.
+    SampleRate float64
+    UserIDs    []string // Always trace these users' events
+}
+
+func (d *DebugTrace) traces(r *http.Request, user *UserInfo) bool {
+    if d == nil {
+        return false
+    }
+    if user != nil {
+        for _, traced := range d.UserIDs {
+            if traced == user.ID {
+                return true
+            }
+        }
+    }
+    if d.SampleRate <= 0 {
+        return false
+    }
+    if r != nil {
+        if tc, ok := r.Context().Value(traceContextKey{}).(traceContext); ok {
+            // We generate the request's span ID at random, so its last 8 hex
+            // digits are as good a coin to flip as any, and the same for
+            // every event in the request
+            if len(tc.SpanID) >= 8 {
+                if n, err := strconv.ParseUint(tc.SpanID[len(tc.SpanID)-8:], 16, 32); err == nil {
+                    return float64(n) < d.SampleRate*float64(1<<32)
+                }
+            }
+        }
+    }
+    return rand.Float64() < d.SampleRate
+}
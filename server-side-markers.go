@@ -0,0 +1,216 @@
+// When a page-load regression shows up on a board, the first question is
+// always "did we just deploy?". MarkerClient answers it by creating a
+// Honeycomb marker the first time we see each new release in incoming events,
+// so deploy boundaries are drawn right on the graphs. Releases are only marked
+// once, however many instances see them, since we remember them in the
+// handler's StateStore. The release comes from the browser, so only
+// releases the ReleaseEnricher knows about, or that match ReleasePattern,
+// are marked, and they share HandleCreate's PerMinute.
+//
+//     markers := &MarkerClient{APIKey: os.Getenv("HONEYCOMB_API_KEY"), Token: os.Getenv("MARKERS_TOKEN"), Releases: releases}
+//     markers.Register(handler)
+//     mux.HandleFunc("/admin/markers", markers.HandleCreate)
+type MarkerClient struct {
+    APIKey  string
+    APIHost string // Defaults to https://api.honeycomb.io
+
+    // Token is required as "Authorization: Bearer <token>" by HandleCreate;
+    // with no Token, every request is refused
+    Token string
+    // PerMinute is how many markers HandleCreate makes a minute, across
+    // callers. Defaults to 10.
+    PerMinute int
+
+    // Datasets to mark. Defaults to "__all__", which marks every dataset in
+    // the environment.
+    Datasets []string
+
+    // ReleaseField is the event field holding the client's release. Defaults
+    // to "release".
+    ReleaseField string
+
+    // Which releases from events get markers: those Releases has registered,
+    // and those matching ReleasePattern (e.g. `^\d{4}\.\d{2}\.\d+$`). With
+    // neither, events don't make markers at all.
+    Releases       *ReleaseEnricher
+    ReleasePattern *regexp.Regexp
+
+    HTTPClient *http.Client // Defaults to one with a 10 second timeout
+
+    store       StateStore
+    log         *slog.Logger
+    limiterOnce sync.Once
+    limiter     *rate.Limiter
+}
+
+// Marker is the body of Honeycomb's Markers API
+type Marker struct {
+    Message   string `json:"message,omitempty"`
+    Type      string `json:"type,omitempty"` // e.g. "deploy", "incident"
+    URL       string `json:"url,omitempty"`
+    StartTime int64  `json:"start_time,omitempty"` // Unix seconds
+    EndTime   int64  `json:"end_time,omitempty"`
+}
+
+const (
+    defaultAPIHost = "https://api.honeycomb.io"
+    allDatasets    = "__all__"
+
+    // How long we remember a release, so we don't mark it again when an old
+    // tab that's still open on it sends an event next week
+    releaseMemory = 90 * 24 * time.Hour
+
+    // Longer than any release name we'd give a build
+    maxReleaseLength = 128
+)
+
+func (m *MarkerClient) perMinute() int {
+    if m.PerMinute > 0 {
+        return m.PerMinute
+    }
+    return 10
+}
+
+func (m *MarkerClient) allow() bool {
+    m.limiterOnce.Do(func() {
+        m.limiter = rate.NewLimiter(rate.Every(time.Minute/time.Duration(m.perMinute())), m.perMinute())
+    })
+    return m.limiter.Allow()
+}
+
+func (m *MarkerClient) Register(h *UserEventsHandler) {
+    m.store = h.state()
+    m.log = h.logger()
+    h.On("*", m.watchRelease)
+}
+
+func (m *MarkerClient) watchRelease(ev *Event) error {
+    field := m.ReleaseField
+    if field == "" {
+        field = "release"
+    }
+    release, ok := ev.Fields()[field].(string)
+    if !ok || !m.markable(release) {
+        return nil
+    }
+
+    ctx, cancel := context.WithTimeout(context.Background(), stateStoreTimeout)
+    defer cancel()
+    first, err := m.store.SetIfAbsent(ctx, "release-seen:"+release, encodeTime(ev.Timestamp), releaseMemory)
+    if err != nil || !first {
+        return err
+    }
+    if !m.allow() {
+        // Forget we saw it, so a later event can mark it once there's room
+        m.store.Delete(ctx, "release-seen:"+release)
+        m.log.Warn("not marking release yet, over the markers rate limit", "release", release)
+        return nil
+    }
+
+    // Don't hold up the event on a call to the Honeycomb API
+    go func() {
+        ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+        defer cancel()
+        marker := Marker{Message: "release " + release, Type: "deploy", StartTime: ev.Timestamp.Unix()}
+        if err := m.Create(ctx, marker); err != nil {
+            m.log.Error("couldn't create marker", "release", release, "error", err)
+        }
+    }()
+    return nil
+}
+
+// Whether a release from an event is one we'd mark
+func (m *MarkerClient) markable(release string) bool {
+    if release == "" || len(release) > maxReleaseLength {
+        return false
+    }
+    if m.Releases != nil && m.Releases.known(release) {
+        return true
+    }
+    return m.ReleasePattern != nil && m.ReleasePattern.MatchString(release)
+}
+
+// Create adds the marker to each of our datasets
+func (m *MarkerClient) Create(ctx context.Context, marker Marker) error {
+    if marker.StartTime == 0 {
+        marker.StartTime = time.Now().Unix()
+    }
+    body, err := json.Marshal(marker)
+    if err != nil {
+        return err
+    }
+
+    datasets := m.Datasets
+    if len(datasets) == 0 {
+        datasets = []string{allDatasets}
+    }
+    for _, dataset := range datasets {
+        if err := m.post(ctx, dataset, body); err != nil {
+            return fmt.Errorf("dataset %s: %w", dataset, err)
+        }
+    }
+    return nil
+}
+
+func (m *MarkerClient) post(ctx context.Context, dataset string, body []byte) error {
+    host := m.APIHost
+    if host == "" {
+        host = defaultAPIHost
+    }
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(host, "/")+"/1/markers/"+url.PathEscape(dataset), bytes.NewReader(body))
+    if err != nil {
+        return err
+    }
+    req.Header.Set("X-Honeycomb-Team", m.APIKey)
+    req.Header.Set("Content-Type", "application/json")
+
+    client := m.HTTPClient
+    if client == nil {
+        client = &http.Client{Timeout: 10 * time.Second}
+    }
+    resp, err := client.Do(req)
+    if err != nil {
+        return err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode >= 300 {
+        msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+        return fmt.Errorf("markers API returned %s: %s", resp.Status, bytes.TrimSpace(msg))
+    }
+    return nil
+}
+
+// HandleCreate lets deploy scripts and incident tooling create markers too,
+// by POSTing a Marker as JSON with the Token. Past PerMinute, callers get a
+// 429 until the limit refills, so a looping script can't fill every graph
+// with markers.
+func (m *MarkerClient) HandleCreate(w http.ResponseWriter, r *http.Request) {
+    if !bearerTokenOK(r, m.Token) {
+        http.Error(w, "unauthorized", http.StatusUnauthorized)
+        return
+    }
+    if r.Method != http.MethodPost {
+        w.Header().Set("Allow", http.MethodPost)
+        http.Error(w, "markers must be POSTed", http.StatusMethodNotAllowed)
+        return
+    }
+    if !m.allow() {
+        w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(60/float64(m.perMinute())))))
+        http.Error(w, "too many markers", http.StatusTooManyRequests)
+        return
+    }
+    var marker Marker
+    if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&marker); err != nil {
+        http.Error(w, fmt.Sprintf("invalid marker: %v", err), http.StatusBadRequest)
+        return
+    }
+    if marker.Message == "" {
+        http.Error(w, "marker needs a message", http.StatusBadRequest)
+        return
+    }
+    if err := m.Create(r.Context(), marker); err != nil {
+        http.Error(w, err.Error(), http.StatusBadGateway)
+        return
+    }
+    w.WriteHeader(http.StatusCreated)
+}
@@ -0,0 +1,101 @@
+// We had zero visibility into whether the forwarder itself was healthy. These
+// are exported at /metrics for Prometheus to scrape:
+//
+//     mux.Handle("/metrics", promhttp.Handler())
+//     mux.Handle("/events/batch", handler.Instrument("batch", ...))
+var (
+    eventsReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+        Name: "user_events_received_total",
+        Help: "Browser events received, by event type.",
+    }, []string{"type"})
+
+    eventsSent = promauto.NewCounterVec(prometheus.CounterOpts{
+        Name: "user_events_sent_total",
+        Help: "Events handed to libhoney for sending, by event type.",
+    }, []string{"type"})
+
+    eventsDropped = promauto.NewCounterVec(prometheus.CounterOpts{
+        Name: "user_events_dropped_total",
+        Help: "Events we chose not to send, by event type and reason.",
+    }, []string{"type", "reason"})
+
+    sendResponses = promauto.NewCounterVec(prometheus.CounterOpts{
+        Name: "user_events_send_responses_total",
+        Help: "Responses from the Honeycomb API, by HTTP status (or \"error\" for network errors).",
+    }, []string{"status"})
+
+    sendDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+        Name:    "user_events_send_duration_seconds",
+        Help:    "How long libhoney took to send each batch of events to Honeycomb.",
+        Buckets: prometheus.DefBuckets,
+    })
+
+    payloadSize = promauto.NewHistogramVec(prometheus.HistogramOpts{
+        Name:    "user_events_payload_bytes",
+        Help:    "Size of request bodies received from the browser, by route.",
+        Buckets: prometheus.ExponentialBuckets(256, 4, 8), // 256B to 4MB
+    }, []string{"route"})
+
+    handlerDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+        Name:    "user_events_handler_duration_seconds",
+        Help:    "Time spent handling requests from the browser, by route.",
+        Buckets: prometheus.DefBuckets,
+    }, []string{"route"})
+)
+
+// Event types come from the browser, so anyone can make up new ones. We only
+// give the first maxTypeLabels types we see their own metric label, and lump
+// the rest together as "other", so a bad client can't blow up our metrics.
+const maxTypeLabels = 50
+
+var (
+    typeLabelsMu sync.Mutex
+    typeLabels   = map[string]bool{}
+)
+
+func metricsTypeLabel(eventType string) string {
+    typeLabelsMu.Lock()
+    defer typeLabelsMu.Unlock()
+    if typeLabels[eventType] {
+        return eventType
+    }
+    if len(typeLabels) >= maxTypeLabels {
+        return "other"
+    }
+    typeLabels[eventType] = true
+    return eventType
+}
+
+// Instrument records payload size and latency for one of the event endpoints.
+func (h *UserEventsHandler) Instrument(route string, next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        start := time.Now()
+        body := &countingReader{ReadCloser: r.Body}
+        r.Body = body
+
+        next.ServeHTTP(w, r)
+
+        payloadSize.WithLabelValues(route).Observe(float64(body.n))
+        handlerDuration.WithLabelValues(route).Observe(time.Since(start).Seconds())
+    })
+}
+
+func observeResponse(resp transmission.Response) {
+    status := "error"
+    if resp.Err == nil {
+        status = strconv.Itoa(resp.StatusCode)
+    }
+    sendResponses.WithLabelValues(status).Inc()
+    sendDuration.Observe(resp.Duration.Seconds())
+}
+
+type countingReader struct {
+    io.ReadCloser
+    n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+    n, err := c.ReadCloser.Read(p)
+    c.n += int64(n)
+    return n, err
+}
@@ -0,0 +1,118 @@
+// Unload beacons are what time-on-page and engagement numbers are built from,
+// and a beacon is just a POST, so anyone who captures one can send it again
+// (a thousand times). PageNonces ties each page view to a nonce we issue when
+// the page is rendered, and accepts each one on an unload event only once:
+//
+//     handler.Nonces = &PageNonces{Secret: nonceSecret}
+//     page.Nonce = handler.Nonces.Issue() // For <meta name="page-nonce" content="{{ .Nonce }}">
+//
+// The check is opt-in: with no Nonces, page_nonce is just dropped. Only turn
+// it on once pages render the meta tag, since page-unload.js sends the nonce
+// from it in each event's page_nonce field, and an event of one of Types
+// without one is rejected. Nonces are signed and carry when they were issued,
+// so any instance can check them without having stored them; once a nonce is
+// used, the handler's State remembers it until it would have expired anyway
+// (MaxAge), so every instance turns away a second use. A nonce that's missing,
+// forged, expired, or used before gets the event rejected. If State can't be
+// reached we only check the signature and age, rather than lose every unload.
+type PageNonces struct {
+    Secret []byte
+    Types  []string      // Event types that need a nonce; defaults to page-unload
+    MaxAge time.Duration // How long after issue a nonce is good for; defaults to 12 hours
+    Field  string        // Defaults to "page_nonce"
+}
+
+var ErrInvalidNonce = errors.New("invalid page nonce")
+
+var nonceChecks = promauto.NewCounterVec(prometheus.CounterOpts{
+    Name: "user_events_page_nonce_checks_total",
+    Help: "Page nonce checks on events that need one, by outcome.",
+}, []string{"outcome"})
+
+func (n *PageNonces) maxAge() time.Duration {
+    if n.MaxAge > 0 {
+        return n.MaxAge
+    }
+    return 12 * time.Hour
+}
+
+func (n *PageNonces) field() string {
+    if n.Field != "" {
+        return n.Field
+    }
+    return "page_nonce"
+}
+
+func (n *PageNonces) requires(eventType string) bool {
+    if len(n.Types) == 0 {
+        return eventType == "page-unload"
+    }
+    for _, t := range n.Types {
+        if t == eventType {
+            return true
+        }
+    }
+    return false
+}
+
+// Issue makes a nonce for one page view. Nonces look like
+// "<random>.<issued, unix seconds>.<signature>".
+func (n *PageNonces) Issue() string {
+    random := make([]byte, 16)
+    if _, err := rand.Read(random); err != nil {
+        panic(err) // crypto/rand doesn't fail on any platform we run on
+    }
+    payload := base64.RawURLEncoding.EncodeToString(random) + "." + strconv.FormatInt(time.Now().Unix(), 10)
+    return payload + "." + n.signature(payload)
+}
+
+func (n *PageNonces) signature(payload string) string {
+    mac := hmac.New(sha256.New, n.Secret)
+    mac.Write([]byte("page-nonce:" + payload))
+    return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Checks the nonce on an event that needs one, claiming it so it can't be
+// used again, and takes it out of metadata (it's no use in Honeycomb).
+// Returns the key it claimed it with, if it did, for ingest to give back if
+// the event's turned away after all.
+func (n *PageNonces) check(ctx context.Context, store StateStore, eventType string, metadata map[string]interface{}) (string, error) {
+    nonce, _ := metadata[n.field()].(string)
+    delete(metadata, n.field())
+    if !n.requires(eventType) {
+        return "", nil
+    }
+    if nonce == "" {
+        nonceChecks.WithLabelValues("missing").Inc()
+        return "", fmt.Errorf("%w: %s has no %s", ErrInvalidNonce, eventType, n.field())
+    }
+
+    parts := strings.Split(nonce, ".")
+    if len(parts) != 3 || !hmac.Equal([]byte(parts[2]), []byte(n.signature(parts[0]+"."+parts[1]))) {
+        nonceChecks.WithLabelValues("bad_signature").Inc()
+        return "", fmt.Errorf("%w: signature doesn't match", ErrInvalidNonce)
+    }
+    issued, err := strconv.ParseInt(parts[1], 10, 64)
+    age := time.Since(time.Unix(issued, 0))
+    if err != nil || age > n.maxAge() || age < -time.Minute {
+        nonceChecks.WithLabelValues("expired").Inc()
+        return "", fmt.Errorf("%w: expired", ErrInvalidNonce)
+    }
+
+    // Per type, so a page view's unload and, say, its final heartbeat can
+    // share a nonce
+    claimCtx, cancel := context.WithTimeout(ctx, stateStoreTimeout)
+    defer cancel()
+    key := "nonce:" + eventType + ":" + parts[0]
+    claimed, err := store.SetIfAbsent(claimCtx, key, []byte("1"), n.maxAge()-age+time.Minute)
+    switch {
+    case err != nil:
+        nonceChecks.WithLabelValues("unchecked").Inc()
+        return "", nil
+    case !claimed:
+        nonceChecks.WithLabelValues("replayed").Inc()
+        return "", fmt.Errorf("%w: already used", ErrInvalidNonce)
+    }
+    nonceChecks.WithLabelValues("ok").Inc()
+    return key, nil
+}
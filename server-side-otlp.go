@@ -0,0 +1,228 @@
+// So the browser side can move to the standard OpenTelemetry SDK without us
+// rewriting the server, HandleOTLPTraces and HandleOTLPLogs accept OTLP/HTTP
+// exports (mount them at /v1/traces and /v1/logs), as either protobuf or
+// JSON. Each span or log record becomes one flat event, with its resource's
+// attributes (service.name, browser.*, ...) merged in under its own, and goes
+// through the same pipeline as any other browser event.
+//
+// Spans are sent as "span" events using Honeycomb's usual trace field names,
+// so they show up in the trace view. Log records are "log" events, or get
+// their type from the event.name attribute if they have one (so a log made
+// with the OTel events API for "page-load" is a "page-load" event).
+func (h *UserEventsHandler) HandleOTLPTraces(w http.ResponseWriter, r *http.Request) {
+    req := &coltracepb.ExportTraceServiceRequest{}
+    if !h.decodeOTLP(w, r, req) {
+        return
+    }
+    var events []map[string]interface{}
+    for _, rs := range req.GetResourceSpans() {
+        resource := otlpAttributes(rs.GetResource().GetAttributes())
+        for _, ss := range rs.GetScopeSpans() {
+            for _, span := range ss.GetSpans() {
+                events = append(events, otlpSpanEvent(resource, ss.GetScope(), span))
+            }
+        }
+    }
+    h.sendOTLP(w, r, events, &coltracepb.ExportTraceServiceResponse{})
+}
+
+func (h *UserEventsHandler) HandleOTLPLogs(w http.ResponseWriter, r *http.Request) {
+    req := &collogspb.ExportLogsServiceRequest{}
+    if !h.decodeOTLP(w, r, req) {
+        return
+    }
+    var events []map[string]interface{}
+    for _, rl := range req.GetResourceLogs() {
+        resource := otlpAttributes(rl.GetResource().GetAttributes())
+        for _, sl := range rl.GetScopeLogs() {
+            for _, record := range sl.GetLogRecords() {
+                events = append(events, otlpLogEvent(resource, sl.GetScope(), record))
+            }
+        }
+    }
+    h.sendOTLP(w, r, events, &collogspb.ExportLogsServiceResponse{})
+}
+
+func otlpSpanEvent(resource map[string]interface{}, scope *commonpb.InstrumentationScope, span *tracepb.Span) map[string]interface{} {
+    metadata := mergeFields(resource, otlpAttributes(span.GetAttributes()))
+    metadata["type"] = "span"
+    metadata["name"] = span.GetName()
+    metadata["trace.trace_id"] = otlpID(span.GetTraceId(), 16)
+    metadata["trace.span_id"] = otlpID(span.GetSpanId(), 8)
+    if parent := span.GetParentSpanId(); len(parent) > 0 {
+        metadata["trace.parent_id"] = otlpID(parent, 8)
+    }
+    metadata["span.kind"] = strings.ToLower(strings.TrimPrefix(span.GetKind().String(), "SPAN_KIND_"))
+    metadata["timestamp"] = float64(span.GetStartTimeUnixNano()) / 1e6
+    if end := span.GetEndTimeUnixNano(); end > span.GetStartTimeUnixNano() {
+        metadata["duration_ms"] = float64(end-span.GetStartTimeUnixNano()) / 1e6
+    }
+    if st := span.GetStatus(); st != nil {
+        metadata["status_code"] = strings.ToLower(strings.TrimPrefix(st.GetCode().String(), "STATUS_CODE_"))
+        if st.GetMessage() != "" {
+            metadata["status_message"] = st.GetMessage()
+        }
+        metadata["error"] = st.GetCode() == tracepb.Status_STATUS_CODE_ERROR
+    }
+    addOTLPScope(metadata, scope)
+    return metadata
+}
+
+func otlpLogEvent(resource map[string]interface{}, scope *commonpb.InstrumentationScope, record *logspb.LogRecord) map[string]interface{} {
+    metadata := mergeFields(resource, otlpAttributes(record.GetAttributes()))
+    metadata["type"] = "log"
+    if name, ok := metadata["event.name"].(string); ok && name != "" {
+        metadata["type"] = name
+    }
+    if body := record.GetBody(); body != nil {
+        metadata["body"] = otlpValue(body)
+    }
+    if record.GetSeverityText() != "" {
+        metadata["severity"] = record.GetSeverityText()
+    }
+    if record.GetSeverityNumber() != 0 {
+        metadata["severity_number"] = int64(record.GetSeverityNumber())
+    }
+    timestamp := record.GetTimeUnixNano()
+    if timestamp == 0 {
+        timestamp = record.GetObservedTimeUnixNano()
+    }
+    if timestamp > 0 {
+        metadata["timestamp"] = float64(timestamp) / 1e6
+    }
+    if len(record.GetTraceId()) > 0 {
+        metadata["trace.trace_id"] = otlpID(record.GetTraceId(), 16)
+        metadata["trace.parent_id"] = otlpID(record.GetSpanId(), 8)
+    }
+    addOTLPScope(metadata, scope)
+    return metadata
+}
+
+func addOTLPScope(metadata map[string]interface{}, scope *commonpb.InstrumentationScope) {
+    if scope.GetName() != "" {
+        metadata["library.name"] = scope.GetName()
+    }
+    if scope.GetVersion() != "" {
+        metadata["library.version"] = scope.GetVersion()
+    }
+}
+
+// Reads and unmarshals the export, picking protobuf or JSON from its
+// Content-Type the way OTLP/HTTP specifies. Writes an error response and
+// returns false if it can't.
+func (h *UserEventsHandler) decodeOTLP(w http.ResponseWriter, r *http.Request, req proto.Message) bool {
+    if r.Method != http.MethodPost {
+        w.Header().Set("Allow", http.MethodPost)
+        http.Error(w, "OTLP exports must be POSTed", http.StatusMethodNotAllowed)
+        return false
+    }
+    body, err := ioutil.ReadAll(r.Body)
+    if err != nil {
+        http.Error(w, err.Error(), bodyErrorStatus(err))
+        return false
+    }
+
+    mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+    switch mediaType {
+    case "application/x-protobuf":
+        err = proto.Unmarshal(body, req)
+    case "application/json":
+        err = protojson.UnmarshalOptions{DiscardUnknown: true}.Unmarshal(body, req)
+    default:
+        http.Error(w, "Content-Type must be application/x-protobuf or application/json", http.StatusUnsupportedMediaType)
+        return false
+    }
+    if err != nil {
+        http.Error(w, fmt.Sprintf("invalid OTLP payload: %v", err), http.StatusBadRequest)
+        return false
+    }
+    return true
+}
+
+func (h *UserEventsHandler) sendOTLP(w http.ResponseWriter, r *http.Request, events []map[string]interface{}, resp proto.Message) {
+    // The OTel exporter may not send cookies, in which case there's no user;
+    // that's fine
+    if results, errs := h.sendBatchToHoneycombAPI(r.Context(), events, r, h.currentUser(r)); len(errs) > 0 {
+        rejectEvents(w, errs, results)
+        return
+    }
+
+    // Exporters expect an (empty) response in the encoding they sent
+    var body []byte
+    if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+        body, _ = protojson.Marshal(resp)
+    } else {
+        body, _ = proto.Marshal(resp)
+    }
+    w.Header().Set("Content-Type", r.Header.Get("Content-Type"))
+    w.Write(body)
+}
+
+// Flattens OTLP attributes into event fields. Nested key/value lists become
+// dotted field names; arrays become JSON strings, since Honeycomb fields
+// can't hold them.
+func otlpAttributes(attrs []*commonpb.KeyValue) map[string]interface{} {
+    fields := make(map[string]interface{}, len(attrs))
+    for _, kv := range attrs {
+        addOTLPAttribute(fields, kv.GetKey(), kv.GetValue())
+    }
+    return fields
+}
+
+func addOTLPAttribute(fields map[string]interface{}, key string, value *commonpb.AnyValue) {
+    if kvlist := value.GetKvlistValue(); kvlist != nil {
+        for _, kv := range kvlist.GetValues() {
+            addOTLPAttribute(fields, key+"."+kv.GetKey(), kv.GetValue())
+        }
+        return
+    }
+    fields[key] = otlpValue(value)
+}
+
+func otlpValue(value *commonpb.AnyValue) interface{} {
+    switch v := value.GetValue().(type) {
+    case *commonpb.AnyValue_StringValue:
+        return v.StringValue
+    case *commonpb.AnyValue_BoolValue:
+        return v.BoolValue
+    case *commonpb.AnyValue_IntValue:
+        return v.IntValue
+    case *commonpb.AnyValue_DoubleValue:
+        return v.DoubleValue
+    case *commonpb.AnyValue_BytesValue:
+        return base64.StdEncoding.EncodeToString(v.BytesValue)
+    case *commonpb.AnyValue_ArrayValue:
+        values := make([]interface{}, len(v.ArrayValue.GetValues()))
+        for i, elem := range v.ArrayValue.GetValues() {
+            values[i] = otlpValue(elem)
+        }
+        encoded, _ := json.Marshal(values)
+        return string(encoded)
+    case *commonpb.AnyValue_KvlistValue:
+        encoded, _ := json.Marshal(otlpAttributes(v.KvlistValue.GetValues()))
+        return string(encoded)
+    }
+    return nil
+}
+
+// Formats a trace or span ID as hex. OTLP/JSON sends IDs as hex strings, but
+// protojson decodes bytes fields as base64, so a JSON export's 16-byte trace
+// ID comes out as 24 bytes of nonsense. Re-encoding those as base64 gives us
+// back the hex string that was sent.
+func otlpID(id []byte, size int) string {
+    if len(id) == size*3/2 {
+        return base64.StdEncoding.EncodeToString(id)
+    }
+    return hex.EncodeToString(id)
+}
+
+func mergeFields(base, overrides map[string]interface{}) map[string]interface{} {
+    merged := make(map[string]interface{}, len(base)+len(overrides))
+    for k, v := range base {
+        merged[k] = v
+    }
+    for k, v := range overrides {
+        merged[k] = v
+    }
+    return merged
+}
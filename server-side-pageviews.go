@@ -0,0 +1,94 @@
+// Working out time-on-page in Honeycomb means joining each page-unload event
+// to its page-load, which queries really aren't built for. PageViewPairer
+// remembers when each page view loaded (keyed by the page_load_id both events
+// carry), and when the unload arrives adds `time_on_page_ms` and `engaged`
+// to it. Load times are kept in the handler's StateStore, so the load and
+// unload don't need to hit the same instance. Both are paired as they're
+// received, before sampling, so a load that's sampled out still pairs with
+// its unload; like other receive processors, that leaves out events without
+// full consent.
+//
+//     pairer := &PageViewPairer{}
+//     pairer.Register(handler)
+type PageViewPairer struct {
+    EngagedAfter time.Duration // Time on page to count as engaged; defaults to 10s
+    TTL          time.Duration // How long to wait for an unload; defaults to 12 hours
+
+    store StateStore
+}
+
+func (p *PageViewPairer) Register(h *UserEventsHandler) {
+    p.store = h.state()
+    h.OnReceive("page-load", p.pageLoad)
+    h.OnReceive("page-unload", p.pageUnload)
+}
+
+func (p *PageViewPairer) pageLoad(ev *Event) error {
+    id := pageViewID(ev.Fields())
+    if id == "" {
+        return nil
+    }
+    ctx, cancel := context.WithTimeout(context.Background(), stateStoreTimeout)
+    defer cancel()
+    return p.store.Set(ctx, "pageview:"+id, encodeTime(ev.Timestamp), p.ttl())
+}
+
+func (p *PageViewPairer) pageUnload(ev *Event) error {
+    id := pageViewID(ev.Fields())
+    if id == "" {
+        return nil
+    }
+    ctx, cancel := context.WithTimeout(context.Background(), stateStoreTimeout)
+    defer cancel()
+    raw, _, err := p.store.Take(ctx, "pageview:"+id)
+    if err != nil {
+        return err
+    }
+    loadedAt, ok := decodeTime(raw)
+    if !ok {
+        // We never saw the load: it expired, went without full consent, or
+        // happened before a restart of an in-memory store
+        ev.AddField("page_load_paired", false)
+        return nil
+    }
+
+    timeOnPage := ev.Timestamp.Sub(loadedAt)
+    ev.AddField("page_load_paired", true)
+    ev.AddField("time_on_page_ms", timeOnPage.Nanoseconds()/int64(time.Millisecond))
+    ev.AddField("engaged", timeOnPage >= p.engagedAfter())
+    return nil
+}
+
+func (p *PageViewPairer) engagedAfter() time.Duration {
+    if p.EngagedAfter > 0 {
+        return p.EngagedAfter
+    }
+    return 10 * time.Second
+}
+
+func (p *PageViewPairer) ttl() time.Duration {
+    if p.TTL > 0 {
+        return p.TTL
+    }
+    return 12 * time.Hour
+}
+
+// Newer SDKs send page_view_id; page-load.js sends page_load_id
+func pageViewID(fields map[string]interface{}) string {
+    return idString(firstPresent(fields, "page_view_id", "page_load_id"))
+}
+
+// IDs from the browser are often numbers, which JSON gives us as float64s;
+// fmt.Sprint would turn 12345678 into "1.2345678e+07"
+func idString(value interface{}) string {
+    switch v := value.(type) {
+    case string:
+        return v
+    case float64:
+        return strconv.FormatFloat(v, 'f', -1, 64)
+    case nil:
+        return ""
+    default:
+        return fmt.Sprint(v)
+    }
+}
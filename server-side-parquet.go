@@ -0,0 +1,319 @@
+// The data science team wants the same enriched events we send to Honeycomb,
+// in their warehouse's lake, without running a pipeline of their own.
+// ParquetSink buffers events and writes them to object storage as Parquet
+// files once an hour, laid out so Athena, BigQuery, or Spark can read them as
+// a table partitioned by date and event type:
+//
+//     <Prefix>date=2024-01-02/type=page-load/13-<instance>-0.parquet
+//
+// Put it next to Honeycomb in a FanOutSink, so it can't hold up delivery:
+//
+//     parquet, err := NewParquetSink(ctx, "s3://browser-events?region=us-east-1", "user-events/")
+//     handler.Sink = NewFanOutSink(
+//         SinkOutput{Name: "honeycomb", Sink: handler.HoneycombSink()},
+//         SinkOutput{Name: "parquet", Sink: parquet},
+//     )
+//
+// The URL is a gocloud.dev/blob one (s3://, gs://, or file:// for testing),
+// with the matching driver imported. Each file's columns are the union of
+// its events' fields: numbers as doubles, booleans, and strings, with
+// anything else (nested objects, or a field that's a number in one event and
+// a string in another) as JSON text; set Flatten on the handler to get
+// flatter tables. __dataset, __timestamp and __sample_rate come from the
+// events themselves. A partition with more than MaxRows events is written
+// early, as another file in the same hour.
+type ParquetSink struct {
+    Bucket   *blob.Bucket
+    Prefix   string
+    Instance string        // In each file name, so instances don't overwrite each other; defaults to the hostname
+    MaxRows  int           // Per file; defaults to 100000
+    Interval time.Duration // Defaults to an hour
+    Logger   *slog.Logger  // Where failed writes are logged; defaults to slog.Default(). Set it before the first Send.
+
+    mu         sync.Mutex
+    partitions map[parquetPartition]*parquetBuffer
+    stop       chan struct{}
+    done       chan struct{}
+}
+
+type parquetPartition struct {
+    date      string // UTC, of the event's timestamp
+    eventType string
+}
+
+type parquetBuffer struct {
+    events []Event
+    files  int // Written so far this interval, for the file names
+}
+
+type parquetKind int
+
+const (
+    parquetNone parquetKind = iota
+    parquetDouble
+    parquetBoolean
+    parquetString
+)
+
+var parquetFiles = promauto.NewCounterVec(prometheus.CounterOpts{
+    Name: "user_events_parquet_files_total",
+    Help: "Parquet files ParquetSink has written to object storage, by outcome.",
+}, []string{"outcome"})
+
+// NewParquetSink opens the bucket at bucketURL and starts writing files every
+// Interval. Close it to write out whatever's left.
+func NewParquetSink(ctx context.Context, bucketURL, prefix string) (*ParquetSink, error) {
+    bucket, err := blob.OpenBucket(ctx, bucketURL)
+    if err != nil {
+        return nil, fmt.Errorf("opening %s: %v", bucketURL, err)
+    }
+    s := &ParquetSink{Bucket: bucket, Prefix: prefix}
+    s.Start()
+    return s, nil
+}
+
+func (s *ParquetSink) maxRows() int {
+    if s.MaxRows > 0 {
+        return s.MaxRows
+    }
+    return 100000
+}
+
+func (s *ParquetSink) interval() time.Duration {
+    if s.Interval > 0 {
+        return s.Interval
+    }
+    return time.Hour
+}
+
+func (s *ParquetSink) instance() string {
+    if s.Instance != "" {
+        return s.Instance
+    }
+    if host, err := os.Hostname(); err == nil {
+        return host
+    }
+    return "unknown"
+}
+
+// Start starts the background writes, for a ParquetSink built by hand.
+// NewParquetSink calls it.
+func (s *ParquetSink) Start() {
+    s.stop = make(chan struct{})
+    s.done = make(chan struct{})
+    go func() {
+        defer close(s.done)
+        for {
+            // On the boundary, so each file holds one clock hour's events
+            now := time.Now()
+            select {
+            case <-s.stop:
+                return
+            case <-time.After(now.Truncate(s.interval()).Add(s.interval()).Sub(now)):
+                s.flush(context.Background(), now.Truncate(s.interval()))
+            }
+        }
+    }()
+}
+
+func (s *ParquetSink) Send(ctx context.Context, ev Event) error {
+    // Other sinks share the field map, so we keep a copy of our own
+    fields := make(map[string]interface{}, len(ev.Fields()))
+    for name, value := range ev.Fields() {
+        fields[name] = value
+    }
+    ev.fields = fields
+
+    key := parquetPartition{date: ev.Timestamp.UTC().Format(usageDayLayout), eventType: ev.Type}
+    s.mu.Lock()
+    if s.partitions == nil {
+        s.partitions = make(map[parquetPartition]*parquetBuffer)
+    }
+    buf := s.partitions[key]
+    if buf == nil {
+        buf = &parquetBuffer{}
+        s.partitions[key] = buf
+    }
+    buf.events = append(buf.events, ev)
+    var full []Event
+    if len(buf.events) >= s.maxRows() {
+        full, buf.events = buf.events, nil
+        buf.files++
+    }
+    files := buf.files
+    s.mu.Unlock()
+
+    if full != nil {
+        return s.write(ctx, key, time.Now().Truncate(s.interval()), files-1, full)
+    }
+    return nil
+}
+
+func (s *ParquetSink) logger() *slog.Logger {
+    if s.Logger != nil {
+        return s.Logger
+    }
+    return slog.Default()
+}
+
+// Writes every partition's buffered events, as files for the interval
+// starting at hour
+func (s *ParquetSink) flush(ctx context.Context, hour time.Time) {
+    s.mu.Lock()
+    partitions := s.partitions
+    s.partitions = nil
+    s.mu.Unlock()
+
+    for key, buf := range partitions {
+        if len(buf.events) == 0 {
+            continue
+        }
+        if err := s.write(ctx, key, hour, buf.files, buf.events); err != nil {
+            // They've already gone to Honeycomb; holding on to them for
+            // another hour would only risk running out of memory
+            s.logger().Error("couldn't write parquet file, so dropped its events", "date", key.date, "type", key.eventType, "events", len(buf.events), "error", err)
+        }
+    }
+}
+
+func (s *ParquetSink) write(ctx context.Context, key parquetPartition, hour time.Time, seq int, events []Event) error {
+    path := fmt.Sprintf("%sdate=%s/type=%s/%s-%s-%d.parquet", s.Prefix, key.date, url.PathEscape(key.eventType), hour.UTC().Format("15"), s.instance(), seq)
+    data, err := encodeParquet(events)
+    if err == nil {
+        err = s.Bucket.WriteAll(ctx, path, data, &blob.WriterOptions{ContentType: "application/vnd.apache.parquet"})
+    }
+    if err != nil {
+        parquetFiles.WithLabelValues("error").Inc()
+        return fmt.Errorf("writing %s: %v", path, err)
+    }
+    parquetFiles.WithLabelValues("written").Inc()
+    return nil
+}
+
+// Close writes out everything still buffered, and closes the bucket.
+func (s *ParquetSink) Close() error {
+    if s.stop != nil {
+        close(s.stop)
+        <-s.done
+    }
+    s.flush(context.Background(), time.Now().Truncate(s.interval()))
+    return s.Bucket.Close()
+}
+
+func encodeParquet(events []Event) ([]byte, error) {
+    kinds := map[string]parquetKind{}
+    for _, ev := range events {
+        for name, value := range ev.Fields() {
+            kind := parquetKindOf(value)
+            if kind == parquetNone {
+                continue
+            }
+            if prev, ok := kinds[name]; ok && prev != kind {
+                kind = parquetString
+            }
+            kinds[name] = kind
+        }
+    }
+
+    group := parquet.Group{
+        "__dataset":     parquet.String(),
+        "__timestamp":   parquet.Timestamp(parquet.Millisecond),
+        "__sample_rate": parquet.Int(64),
+    }
+    for name, kind := range kinds {
+        if strings.HasPrefix(name, "__") {
+            continue // Ours
+        }
+        switch kind {
+        case parquetDouble:
+            group[name] = parquet.Optional(parquet.Leaf(parquet.DoubleType))
+        case parquetBoolean:
+            group[name] = parquet.Optional(parquet.Leaf(parquet.BooleanType))
+        default:
+            group[name] = parquet.Optional(parquet.String())
+        }
+    }
+    schema := parquet.NewSchema("event", group)
+    columns := schema.Columns()
+
+    rows := make([]parquet.Row, len(events))
+    for i, ev := range events {
+        row := make(parquet.Row, len(columns))
+        for col, path := range columns {
+            name := path[0]
+            switch name {
+            case "__dataset":
+                row[col] = parquet.ValueOf(ev.Dataset).Level(0, 0, col)
+            case "__timestamp":
+                row[col] = parquet.ValueOf(ev.Timestamp.UnixMilli()).Level(0, 0, col)
+            case "__sample_rate":
+                row[col] = parquet.ValueOf(int64(ev.SampleRate)).Level(0, 0, col)
+            default:
+                value, ok := ev.Fields()[name]
+                if !ok || value == nil {
+                    row[col] = parquet.ValueOf(nil).Level(0, 0, col)
+                    continue
+                }
+                row[col] = parquet.ValueOf(parquetValue(value, kinds[name])).Level(0, 1, col)
+            }
+        }
+        rows[i] = row
+    }
+
+    var buf bytes.Buffer
+    w := parquet.NewWriter(&buf, schema)
+    if _, err := w.WriteRows(rows); err != nil {
+        return nil, err
+    }
+    if err := w.Close(); err != nil {
+        return nil, err
+    }
+    return buf.Bytes(), nil
+}
+
+func parquetKindOf(value interface{}) parquetKind {
+    switch value.(type) {
+    case nil:
+        return parquetNone
+    case bool:
+        return parquetBoolean
+    case string:
+        return parquetString
+    }
+    if _, ok := numberValue(value); ok {
+        return parquetDouble
+    }
+    return parquetString
+}
+
+func parquetValue(value interface{}, kind parquetKind) interface{} {
+    switch kind {
+    case parquetDouble:
+        n, _ := numberValue(value)
+        return n
+    case parquetBoolean:
+        return value
+    }
+    if s, ok := value.(string); ok {
+        return s
+    }
+    return jsonString(value)
+}
+
+func numberValue(value interface{}) (float64, bool) {
+    switch v := value.(type) {
+    case float64:
+        return v, true
+    case float32:
+        return float64(v), true
+    case int:
+        return float64(v), true
+    case int64:
+        return float64(v), true
+    case uint:
+        return float64(v), true
+    case uint64:
+        return float64(v), true
+    }
+    return 0, false
+}
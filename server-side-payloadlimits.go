@@ -0,0 +1,247 @@
+// Whatever the browser (or anyone pretending to be one) posts ends up
+// decoded into a map and copied onto an event. PayloadLimits bounds what
+// that map can look like before anything else reads it: how deeply it nests,
+// how many fields it has, how long its strings and field names are, and what
+// its numbers can be. An event over any limit is turned away as invalid,
+// rather than trimmed, since it's far more likely to be garbage (or an
+// attack) than a real page's event.
+//
+//     handler.Limits = &PayloadLimits{UnknownFields: UnknownFlag}
+//
+// UnknownFields decides what happens to fields that aren't in an event type's
+// schema (see SchemaRegistry). Types without a schema have no unknown fields.
+// The limits apply the same way whichever encoding the event arrived in.
+// MaxDepth is enforced as the body's decoded, so a deeply nested payload is
+// turned away before it's built; the rest are checked once it has been.
+type PayloadLimits struct {
+    MaxDepth        int     // Levels of nested objects/arrays; defaults to 8
+    MaxFields       int     // Top-level fields in the event; defaults to 500
+    MaxValues       int     // Values anywhere in the event, nested ones and array items included; defaults to 20000 (resource-timing sends a lot)
+    MaxStringLength int     // Bytes, for each string value; defaults to 64KB
+    MaxNameLength   int     // Bytes, for each field name; defaults to 256
+    MaxAbsNumber    float64 // Defaults to 1e15, past which float64 can't hold integers exactly
+
+    UnknownFields UnknownFieldPolicy
+}
+
+type UnknownFieldPolicy int
+
+const (
+    UnknownAllow  UnknownFieldPolicy = iota // Send them like any other field
+    UnknownDrop                             // Remove them
+    UnknownFlag                             // Send them, listing their names in unknown_fields
+    UnknownReject                           // Turn the event away
+)
+
+// Fields every event can have whether or not its schema mentions them
+var schemaExemptFields = map[string]bool{"type": true, "sent_at": true, "timestamp": true, "event_id": true}
+
+// Used when the handler has no Limits of its own
+var defaultPayloadLimits = &PayloadLimits{}
+
+func (h *UserEventsHandler) limits() *PayloadLimits {
+    if h.Limits != nil {
+        return h.Limits
+    }
+    return defaultPayloadLimits
+}
+
+func (l *PayloadLimits) maxDepth() int {
+    if l.MaxDepth > 0 {
+        return l.MaxDepth
+    }
+    return 8
+}
+
+func (l *PayloadLimits) maxFields() int {
+    if l.MaxFields > 0 {
+        return l.MaxFields
+    }
+    return 500
+}
+
+func (l *PayloadLimits) maxValues() int {
+    if l.MaxValues > 0 {
+        return l.MaxValues
+    }
+    return 20000
+}
+
+func (l *PayloadLimits) maxStringLength() int {
+    if l.MaxStringLength > 0 {
+        return l.MaxStringLength
+    }
+    return 64 << 10
+}
+
+func (l *PayloadLimits) maxNameLength() int {
+    if l.MaxNameLength > 0 {
+        return l.MaxNameLength
+    }
+    return 256
+}
+
+func (l *PayloadLimits) maxAbsNumber() float64 {
+    if l.MaxAbsNumber > 0 {
+        return l.MaxAbsNumber
+    }
+    return 1e15
+}
+
+// Checks metadata against the limits, and applies the unknown-field policy
+// given the event type's schema (if any). Returns a *ValidationError for
+// anything it won't let through.
+func (l *PayloadLimits) apply(eventType string, metadata map[string]interface{}, schema EventSchema) error {
+    if len(metadata) > l.maxFields() {
+        return &ValidationError{EventType: eventType, Problems: []string{fmt.Sprintf("has %d fields, more than the %d allowed", len(metadata), l.maxFields())}}
+    }
+    w := limitWalker{limits: l}
+    w.walkObject(metadata, 1)
+    if w.values > l.maxValues() {
+        w.problem(fmt.Sprintf("has more than the %d values allowed", l.maxValues()))
+    }
+    if len(w.problems) > 0 {
+        return &ValidationError{EventType: eventType, Problems: w.problems}
+    }
+
+    if schema == nil || l.UnknownFields == UnknownAllow {
+        return nil
+    }
+    var unknown []string
+    for name := range metadata {
+        if _, known := schema[name]; !known && !schemaExemptFields[name] {
+            unknown = append(unknown, name)
+        }
+    }
+    if len(unknown) == 0 {
+        return nil
+    }
+    sort.Strings(unknown)
+    switch l.UnknownFields {
+    case UnknownDrop:
+        for _, name := range unknown {
+            delete(metadata, name)
+        }
+    case UnknownFlag:
+        metadata["unknown_fields"] = strings.Join(unknown, ",")
+    case UnknownReject:
+        return &ValidationError{EventType: eventType, Problems: []string{"unknown fields: " + strings.Join(unknown, ", ")}}
+    }
+    return nil
+}
+
+// Whether buf's JSON has objects or arrays nested more than max deep, going
+// by its brackets alone, so it's cheap to ask before decoding it. Brackets in
+// strings don't count.
+func jsonDepthExceeds(buf []byte, max int) bool {
+    depth, inString, escaped := 0, false, false
+    for _, c := range buf {
+        switch {
+        case escaped:
+            escaped = false
+        case inString:
+            switch c {
+            case '\\':
+                escaped = true
+            case '"':
+                inString = false
+            }
+        case c == '"':
+            inString = true
+        case c == '{' || c == '[':
+            depth++
+            if depth > max {
+                return true
+            }
+        case c == '}' || c == ']':
+            depth--
+        }
+    }
+    return false
+}
+
+// Walks a decoded payload once, collecting problems. We stop descending past
+// MaxDepth, and stop collecting after a few problems, so a hostile payload
+// can't make the walk (or the error message) expensive.
+type limitWalker struct {
+    limits   *PayloadLimits
+    values   int
+    problems []string
+}
+
+const maxLimitProblems = 5
+
+func (w *limitWalker) problem(problem string) {
+    if len(w.problems) < maxLimitProblems {
+        w.problems = append(w.problems, problem)
+    }
+}
+
+func (w *limitWalker) walkObject(object map[string]interface{}, depth int) {
+    for name, value := range object {
+        w.values++
+        if w.values > w.limits.maxValues() {
+            return
+        }
+        if len(name) > w.limits.maxNameLength() {
+            w.problem(fmt.Sprintf("has a field name longer than %d bytes", w.limits.maxNameLength()))
+        }
+        w.walkValue(name, value, depth)
+    }
+}
+
+func (w *limitWalker) walkValue(name string, value interface{}, depth int) {
+    if len(w.problems) >= maxLimitProblems || w.values > w.limits.maxValues() {
+        return
+    }
+    switch v := value.(type) {
+    case string:
+        if len(v) > w.limits.maxStringLength() {
+            w.problem(fmt.Sprintf("%s is longer than %d bytes", truncateName(name), w.limits.maxStringLength()))
+        }
+    case float64:
+        w.checkNumber(name, v)
+    case float32:
+        w.checkNumber(name, float64(v))
+    case int64:
+        w.checkNumber(name, float64(v))
+    case uint64:
+        w.checkNumber(name, float64(v))
+    case int:
+        w.checkNumber(name, float64(v))
+    case map[string]interface{}:
+        if depth >= w.limits.maxDepth() {
+            w.problem(fmt.Sprintf("%s nests deeper than %d levels", truncateName(name), w.limits.maxDepth()))
+            return
+        }
+        w.walkObject(v, depth+1)
+    case []interface{}:
+        if depth >= w.limits.maxDepth() {
+            w.problem(fmt.Sprintf("%s nests deeper than %d levels", truncateName(name), w.limits.maxDepth()))
+            return
+        }
+        w.values += len(v)
+        for _, item := range v {
+            w.walkValue(name, item, depth+1)
+        }
+    }
+}
+
+func (w *limitWalker) checkNumber(name string, n float64) {
+    switch {
+    case math.IsNaN(n) || math.IsInf(n, 0):
+        // JSON can't carry these, but msgpack and protobuf can
+        w.problem(fmt.Sprintf("%s isn't a finite number", truncateName(name)))
+    case math.Abs(n) > w.limits.maxAbsNumber():
+        w.problem(fmt.Sprintf("%s is out of range (max ±%g)", truncateName(name), w.limits.maxAbsNumber()))
+    }
+}
+
+// Field names go in error messages, which go back to the browser and into
+// logs, so keep them short
+func truncateName(name string) string {
+    if len(name) > 64 {
+        return name[:64] + "..."
+    }
+    return name
+}
@@ -0,0 +1,44 @@
+// Not every event is worth the same: losing an error hurts, losing one
+// heartbeat out of thousands doesn't. Priorities ranks event types so that
+// when we're under pressure the least important go first:
+//
+//     handler.Priorities = map[string]Priority{"error": PriorityHigh, "heartbeat": PriorityLow}
+//
+// As the Queue fills, low-priority events are shed once it's half full, and
+// normal ones once it's 90% full, leaving the rest of the room for high
+// priority events. While the AdmissionController is backing off, low-priority
+// events are sampled harder than normal ones, and high-priority ones aren't
+// sampled any harder at all. While the LoadShedder is shedding, high-priority
+// events are all that's sure to be kept.
+type Priority int
+
+const (
+    PriorityLow    Priority = -1
+    PriorityNormal Priority = 0 // Types without an entry in Priorities
+    PriorityHigh   Priority = 1
+)
+
+func (p Priority) String() string {
+    switch {
+    case p < PriorityNormal:
+        return "low"
+    case p > PriorityNormal:
+        return "high"
+    }
+    return "normal"
+}
+
+func (h *UserEventsHandler) priority(eventType string) Priority {
+    return h.Priorities[eventType]
+}
+
+// How full the Queue can be before we start shedding events of priority p
+func (p Priority) queueLimit() float64 {
+    switch {
+    case p < PriorityNormal:
+        return 0.5
+    case p > PriorityNormal:
+        return 1
+    }
+    return 0.9
+}
@@ -0,0 +1,81 @@
+// Processors are per-event-type hooks that run on the finished event (after
+// enrichment, right before it's sent), for logic that only makes sense for
+// one kind of event:
+//
+//     handler.On("page-unload", func(ev *Event) error {
+//         if ms, ok := ev.Fields()["time_on_page_ms"].(float64); ok {
+//             ev.AddField("is_bounce", ms < 10000)
+//         }
+//         return nil
+//     })
+//
+// "*" registers a processor for every event type. Processors run in the order
+// they were registered, "*" ones last. Register them all before the handler
+// starts serving.
+type Processor func(ev *Event) error
+
+// A processor can return ErrDropEvent to stop the event from being sent. Any
+// other error is logged, and the event is sent anyway.
+var ErrDropEvent = errors.New("drop event")
+
+func (h *UserEventsHandler) On(eventType string, processor Processor) {
+    if h.processors == nil {
+        h.processors = make(map[string][]Processor)
+    }
+    h.processors[eventType] = append(h.processors[eventType], processor)
+}
+
+// Returns false if a processor asked for the event to be dropped
+func (h *UserEventsHandler) runProcessors(ev *Event) bool {
+    for _, processors := range [][]Processor{h.processors[ev.Type], h.processors["*"]} {
+        for _, processor := range processors {
+            err := processor(ev)
+            if err == ErrDropEvent {
+                return false
+            }
+            if err != nil {
+                h.logger().Warn("processor failed", "type", ev.Type, "error", err)
+            }
+        }
+    }
+    return true
+}
+
+// OnReceive registers a processor that runs in ingest, before sampling, so it
+// sees every event of the type we keep, rather than only the ones that are
+// sent: for trackers that need all of them, like a click's follow-up activity
+// or a tab's visibility. The event it gets is the browser's fields as they
+// arrived (after FieldGuard and the session and visitor fields, but before
+// anything's enriched or scrubbed), so fields kept from it for an event of
+// our own need h.scrub before that's sent. Fields it adds are sent with the
+// event, and ErrDropEvent drops it. Events without full consent aren't given
+// to these, just as they aren't tracked by Sessions or Visitors.
+func (h *UserEventsHandler) OnReceive(eventType string, processor Processor) {
+    if h.receivers == nil {
+        h.receivers = make(map[string][]Processor)
+    }
+    h.receivers[eventType] = append(h.receivers[eventType], processor)
+}
+
+// Returns false if a receive processor asked for the event to be dropped
+func (h *UserEventsHandler) runReceivers(eventType string, metadata map[string]interface{}, r *http.Request, user *UserInfo) bool {
+    if len(h.receivers[eventType]) == 0 && len(h.receivers["*"]) == 0 {
+        return true
+    }
+    ev := h.newEvent(eventType, metadata, r)
+    ev.fields = metadata // So what they add is sent too
+    ev.user = user
+    correctClockSkew(ev, metadata, time.Now())
+    for _, processors := range [][]Processor{h.receivers[eventType], h.receivers["*"]} {
+        for _, processor := range processors {
+            err := processor(ev)
+            if err == ErrDropEvent {
+                return false
+            }
+            if err != nil {
+                h.logger().Warn("receive processor failed", "type", eventType, "error", err)
+            }
+        }
+    }
+    return true
+}
@@ -0,0 +1,170 @@
+// Some teams already batch events in the browser in Honeycomb's own format,
+// and just want them in Honeycomb with who sent them attached, as fast as
+// possible. ProxyHandler is a thin proxy to Honeycomb's batch API for them: it
+// works out the user, adds their fields to each event (and, with Enrich, runs
+// the handler's enrichers too), and forwards the batch to /1/batch/<dataset>
+// over a pooled connection, without going through libhoney or the rest of
+// the handler's pipeline (no sampling, dedup, or retries). What it never
+// skips: the handler's RateLimiter, once per request (a 429 if it's over),
+// its consent policy, which drops or anonymizes events just as it would
+// for the handler, pseudonyms, the Scrubber and the Encryptor, and the
+// AdminAPI's kill switch and disabled types, which drop items from the batch.
+//
+//     proxy := &ProxyHandler{Handler: handler, APIKey: os.Getenv("HONEYCOMB_WRITEKEY")}
+//     mux.Handle("/proxy/1/batch/", http.StripPrefix("/proxy", proxy))
+//
+// The browser POSTs exactly what it would to Honeycomb:
+// `[{"data": {...}, "time": "...", "samplerate": 1}, ...]`, and gets back
+// Honeycomb's response, with its per-event statuses.
+type ProxyHandler struct {
+    Handler *UserEventsHandler
+    APIKey  string
+    APIHost string // Defaults to https://api.honeycomb.io
+
+    // Datasets the browser may send to. Defaults to the ones the handler's
+    // Datasets route to, so nobody can write anywhere else with our key.
+    Datasets []string
+
+    RequireUser bool // Turn away requests with no user, rather than forward them anonymously
+    Enrich      bool // Run the handler's Enrichers on each event, not just add user fields
+
+    HTTPClient *http.Client // Defaults to a shared client that keeps connections to Honeycomb open
+}
+
+var proxyHTTPClient = &http.Client{
+    Timeout: 30 * time.Second,
+    Transport: &http.Transport{
+        Proxy:               http.ProxyFromEnvironment,
+        MaxIdleConns:        200,
+        MaxIdleConnsPerHost: 200, // We only ever talk to one host
+        IdleConnTimeout:     90 * time.Second,
+        ForceAttemptHTTP2:   true,
+    },
+}
+
+// One item of a Honeycomb batch. We only need to touch data, so the rest is
+// passed through untouched.
+type proxyBatchItem struct {
+    Data       map[string]interface{} `json:"data"`
+    Time       json.RawMessage        `json:"time,omitempty"`
+    SampleRate json.RawMessage        `json:"samplerate,omitempty"`
+}
+
+func (p *ProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    h := p.Handler
+    if r.Method != http.MethodPost {
+        w.Header().Set("Allow", http.MethodPost)
+        http.Error(w, "batches must be POSTed", http.StatusMethodNotAllowed)
+        return
+    }
+    dataset, err := url.PathUnescape(strings.TrimPrefix(r.URL.Path, "/1/batch/"))
+    if err != nil || dataset == "" || strings.Contains(dataset, "/") {
+        http.Error(w, "expected /1/batch/<dataset>", http.StatusNotFound)
+        return
+    }
+    if !p.allowed(dataset) {
+        http.Error(w, fmt.Sprintf("dataset %q isn't allowed", dataset), http.StatusForbidden)
+        return
+    }
+
+    user := h.currentUser(r)
+    if user == nil && p.RequireUser {
+        http.Error(w, "unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    if h.rateLimited(r, user) {
+        w.Header().Set("Retry-After", "1")
+        http.Error(w, "rate limited", http.StatusTooManyRequests)
+        return
+    }
+
+    var batch []proxyBatchItem
+    if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, h.maxBodyBytes())).Decode(&batch); err != nil {
+        http.Error(w, fmt.Sprintf("invalid batch: %v", err), bodyErrorStatus(err))
+        return
+    }
+    kept := batch[:0]
+    for _, item := range batch {
+        ev := &Event{Dataset: dataset}
+        ev.Add(item.Data)
+        ev.Type, _ = item.Data["type"].(string)
+        eventsReceived.WithLabelValues(metricsTypeLabel(ev.Type)).Inc()
+        if reason := h.Admin.dropReason(ev.Type); reason != "" {
+            eventsDropped.WithLabelValues(metricsTypeLabel(ev.Type), reason).Inc()
+            continue
+        }
+
+        consent, eventUser := ConsentFull, user
+        if h.Consent != nil {
+            consent = h.Consent.Decide(r, ev.Fields())
+        }
+        switch consent {
+        case ConsentDrop:
+            eventsDropped.WithLabelValues(metricsTypeLabel(ev.Type), "consent").Inc()
+            continue
+        case ConsentAnonymize:
+            eventUser = nil
+        }
+        if p.Enrich {
+            h.enrich(r.Context(), ev, ev.Type, r, eventUser) // Which scrubs too
+        } else {
+            UserEnricher{}.Enrich(r.Context(), ev, r, eventUser)
+            h.scrub(r.Context(), ev)
+        }
+        if consent == ConsentAnonymize {
+            h.Consent.anonymize(ev.Fields())
+        }
+        item.Data = ev.Fields()
+        kept = append(kept, item)
+    }
+    batch = kept
+
+    body, err := json.Marshal(batch)
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusInternalServerError)
+        return
+    }
+    resp, err := p.forward(r.Context(), dataset, body)
+    if err != nil {
+        h.logger().Error("couldn't proxy batch to Honeycomb", "dataset", dataset, "error", err)
+        http.Error(w, "couldn't reach Honeycomb", http.StatusBadGateway)
+        return
+    }
+    defer resp.Body.Close()
+    w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
+    w.WriteHeader(resp.StatusCode)
+    io.Copy(w, resp.Body)
+}
+
+func (p *ProxyHandler) allowed(dataset string) bool {
+    allowed := p.Datasets
+    if len(allowed) == 0 {
+        allowed = p.Handler.Datasets.all()
+    }
+    for _, name := range allowed {
+        if name == dataset {
+            return true
+        }
+    }
+    return false
+}
+
+func (p *ProxyHandler) forward(ctx context.Context, dataset string, body []byte) (*http.Response, error) {
+    host := p.APIHost
+    if host == "" {
+        host = defaultAPIHost
+    }
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(host, "/")+"/1/batch/"+url.PathEscape(dataset), bytes.NewReader(body))
+    if err != nil {
+        return nil, err
+    }
+    req.Header.Set("X-Honeycomb-Team", p.APIKey)
+    req.Header.Set("Content-Type", "application/json")
+
+    client := p.HTTPClient
+    if client == nil {
+        client = proxyHTTPClient
+    }
+    return client.Do(req)
+}
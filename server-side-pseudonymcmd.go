@@ -0,0 +1,73 @@
+// The pseudonym command finds the pseudonyms a config file's Pseudonymizer
+// gives users, to search Honeycomb for their events, or, for a TokenVault,
+// who a pseudonym stands for:
+//
+//     user-events pseudonym -config user-events.yaml -field user_id 42 1337
+//     user-events pseudonym -config user-events.yaml -field user_id -reverse -reason "SUP-1234" tok_8f3a...
+//
+// Reverse lookups need a -reason, which goes to the vault with who asked
+// ($USER, or -actor), for its audit log. The vault decides who may make them:
+// -vault-token (or $PSEUDONYM_VAULT_TOKEN) can be a token allowed to
+// detokenize, where the handler's is only allowed to tokenize. HMAC
+// pseudonyms can't be reversed at all; look up the users you suspect instead.
+func pseudonymCommand(args []string) {
+    flags := flag.NewFlagSet("pseudonym", flag.ExitOnError)
+    configPath := flags.String("config", "user-events.yaml", "handler config file")
+    field := flags.String("field", "user_id", "the field the values are for")
+    reverse := flags.Bool("reverse", false, "look up who each pseudonym stands for")
+    reason := flags.String("reason", "", "why you need to know; required with -reverse")
+    actor := flags.String("actor", os.Getenv("USER"), "who's asking, for the vault's audit log")
+    vaultToken := flags.String("vault-token", os.Getenv("PSEUDONYM_VAULT_TOKEN"), "vault token to use in place of the config's")
+    flags.Parse(args)
+    if flags.NArg() == 0 {
+        fmt.Fprintln(os.Stderr, "usage: user-events pseudonym [flags] <value>...")
+        os.Exit(2)
+    }
+
+    cfg, err := LoadConfig(*configPath)
+    if err != nil {
+        log.Fatalf("pseudonym: %v", err)
+    }
+    if cfg.Pseudonyms == nil {
+        log.Fatalf("pseudonym: %s has no pseudonyms section", *configPath)
+    }
+    pseudonyms, err := cfg.Pseudonyms.Pseudonymizer()
+    if err != nil {
+        log.Fatalf("pseudonym: %v", err)
+    }
+    if vault, ok := pseudonyms.(*TokenVault); ok {
+        if *vaultToken != "" {
+            vault.Token = *vaultToken
+        }
+        vault.Headers = http.Header{"X-Lookup-Actor": {*actor}, "X-Lookup-Reason": {*reason}}
+    }
+
+    ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+    defer cancel()
+    if !*reverse {
+        for _, value := range flags.Args() {
+            pseudonym, err := pseudonyms.Pseudonym(ctx, *field, value)
+            if err != nil {
+                log.Fatalf("pseudonym: %s: %v", value, err)
+            }
+            fmt.Printf("%s\t%s\n", value, pseudonym)
+        }
+        return
+    }
+
+    resolver, ok := pseudonyms.(PseudonymResolver)
+    if !ok {
+        log.Fatalf("pseudonym: %s pseudonyms can't be reversed", cfg.Pseudonyms.Kind)
+    }
+    if strings.TrimSpace(*reason) == "" {
+        log.Fatal("pseudonym: -reason is required with -reverse")
+    }
+    for _, pseudonym := range flags.Args() {
+        log.Printf("pseudonym: looking up %s %s for %s: %s", *field, pseudonym, *actor, *reason)
+        value, err := resolver.Resolve(ctx, *field, pseudonym)
+        if err != nil {
+            log.Fatalf("pseudonym: %s: %v", pseudonym, err)
+        }
+        fmt.Printf("%s\t%s\n", pseudonym, value)
+    }
+}
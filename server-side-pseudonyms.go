@@ -0,0 +1,225 @@
+// Internally we want to see exactly who hit an error; a strict-privacy
+// deployment mustn't send a real user ID or email to Honeycomb at all. A
+// Pseudonymizer decides what goes out in their place, for every event they're
+// on, whoever added them (UserEnricher, a custom enricher, the browser
+// itself, or our own session-end and rollup events):
+//
+//     handler.Pseudonyms = &HMACPseudonymizer{Key: key}
+//
+// The implementations:
+//
+//     PassThroughPseudonymizer  sends the values as they are, e.g. for internal dogfooding
+//     HMACPseudonymizer         a keyed hash: stable, so events still group by user, but one-way
+//     TokenVault                tokens from a tokenization service, which can turn them back
+//
+// Pseudonyms replace PseudonymFields (user_id and user_email, by default)
+// before anything else is scrubbed or encrypted. If the Pseudonymizer fails,
+// the field is dropped rather than sent as it was. The pseudonym command
+// finds the pseudonym for a user, to search Honeycomb (or a timeline) by, and,
+// with a TokenVault, the user for a pseudonym.
+type Pseudonymizer interface {
+    Pseudonym(ctx context.Context, field, value string) (string, error)
+}
+
+// A PseudonymResolver can tell who a pseudonym stands for.
+type PseudonymResolver interface {
+    Resolve(ctx context.Context, field, pseudonym string) (string, error)
+}
+
+// The fields a Pseudonymizer replaces, unless the handler's PseudonymFields
+// says otherwise
+var defaultPseudonymFields = []string{"user_id", "user_email"}
+
+var pseudonymFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+    Name: "user_events_pseudonym_failures_total",
+    Help: "Fields dropped because they couldn't be pseudonymized, by field.",
+}, []string{"field"})
+
+func (h *UserEventsHandler) pseudonymFields() []string {
+    if h.PseudonymFields != nil {
+        return h.PseudonymFields
+    }
+    return defaultPseudonymFields
+}
+
+// Replaces the event's identifying fields with their pseudonyms, in place
+func (h *UserEventsHandler) pseudonymize(ctx context.Context, ev *Event) {
+    if h.Pseudonyms == nil {
+        return
+    }
+    fields := ev.Fields()
+    for _, name := range h.pseudonymFields() {
+        value, ok := fields[name]
+        if !ok {
+            continue
+        }
+        raw := idString(value)
+        if raw == "" {
+            continue
+        }
+        pseudonym, err := h.Pseudonyms.Pseudonym(ctx, name, raw)
+        if err != nil {
+            delete(fields, name)
+            pseudonymFailures.WithLabelValues(name).Inc()
+            h.logger().Warn("couldn't pseudonymize field, so dropped it", "type", ev.Type, "field", name, "error", err)
+            continue
+        }
+        fields[name] = pseudonym
+    }
+}
+
+// PassThroughPseudonymizer sends every value as it is.
+type PassThroughPseudonymizer struct{}
+
+func (PassThroughPseudonymizer) Pseudonym(ctx context.Context, field, value string) (string, error) {
+    return value, nil
+}
+
+// HMACPseudonymizer sends a keyed hash of each value, e.g.
+// "psn_3f2a9c0b1d4e5f60718293a4b5c6d7e8". The field's name is hashed in too,
+// so a user's ID and email don't share a pseudonym. Without the Key, there's
+// no going back from one; with it, the pseudonym command can work out a given
+// user's.
+type HMACPseudonymizer struct {
+    Key    []byte
+    Prefix string // Defaults to "psn_"
+}
+
+func (p *HMACPseudonymizer) Pseudonym(ctx context.Context, field, value string) (string, error) {
+    if len(p.Key) == 0 {
+        return "", errors.New("pseudonyms: HMACPseudonymizer has no key")
+    }
+    prefix := p.Prefix
+    if prefix == "" {
+        prefix = "psn_"
+    }
+    mac := hmac.New(sha256.New, p.Key)
+    mac.Write([]byte(field + "\x00" + value))
+    return prefix + hex.EncodeToString(mac.Sum(nil)[:16]), nil
+}
+
+// TokenVault gets tokens from a vault-style tokenization service, which keeps
+// the mapping (so it can be audited, and users erased from it) and can turn a
+// token back into its value for whoever it allows to:
+//
+//     POST <URL>/tokenize    {"field": "user_id", "value": "42"}      -> {"token": "..."}
+//     POST <URL>/detokenize  {"field": "user_id", "token": "..."}     -> {"value": "42"}
+//
+// Tokens are cached in memory for CacheTTL, so a busy user costs one call
+// per instance every so often, not one per event, and a user erased from the
+// vault stops being sent under their old token once it's expired. Events for
+// a user we're already asking the vault about wait for that answer rather
+// than asking again.
+type TokenVault struct {
+    URL        string
+    Token      string        // Sent as "Authorization: Bearer <token>"
+    Headers    http.Header   // Sent with every request too, e.g. a lookup's reason, for the vault's audit log
+    CacheSize  int           // Defaults to 10000
+    CacheTTL   time.Duration // Defaults to 10 minutes
+    HTTPClient *http.Client
+
+    mu       sync.Mutex
+    cache    map[string]cachedToken // "<field>\x00<value>" -> token
+    inflight singleflight.Group
+}
+
+type cachedToken struct {
+    token   string
+    expires time.Time
+}
+
+type vaultRequest struct {
+    Field string `json:"field"`
+    Value string `json:"value,omitempty"`
+    Token string `json:"token,omitempty"`
+}
+
+type vaultResponse struct {
+    Value string `json:"value"`
+    Token string `json:"token"`
+}
+
+func (v *TokenVault) cacheSize() int {
+    if v.CacheSize > 0 {
+        return v.CacheSize
+    }
+    return 10000
+}
+
+func (v *TokenVault) cacheTTL() time.Duration {
+    if v.CacheTTL > 0 {
+        return v.CacheTTL
+    }
+    return 10 * time.Minute
+}
+
+func (v *TokenVault) Pseudonym(ctx context.Context, field, value string) (string, error) {
+    key := field + "\x00" + value
+    v.mu.Lock()
+    cached, ok := v.cache[key]
+    v.mu.Unlock()
+    if ok && time.Now().Before(cached.expires) {
+        return cached.token, nil
+    }
+
+    // The first caller's ctx is the one the call runs under
+    token, err, _ := v.inflight.Do(key, func() (interface{}, error) {
+        var resp vaultResponse
+        if err := v.call(ctx, "/tokenize", vaultRequest{Field: field, Value: value}, &resp); err != nil {
+            return "", err
+        }
+        if resp.Token == "" {
+            return "", errors.New("pseudonyms: vault returned an empty token")
+        }
+        v.mu.Lock()
+        if v.cache == nil || len(v.cache) >= v.cacheSize() {
+            v.cache = make(map[string]cachedToken) // Start over, rather than track what's least used
+        }
+        v.cache[key] = cachedToken{token: resp.Token, expires: time.Now().Add(v.cacheTTL())}
+        v.mu.Unlock()
+        return resp.Token, nil
+    })
+    if err != nil {
+        return "", err
+    }
+    return token.(string), nil
+}
+
+func (v *TokenVault) Resolve(ctx context.Context, field, pseudonym string) (string, error) {
+    var resp vaultResponse
+    if err := v.call(ctx, "/detokenize", vaultRequest{Field: field, Token: pseudonym}, &resp); err != nil {
+        return "", err
+    }
+    return resp.Value, nil
+}
+
+func (v *TokenVault) call(ctx context.Context, path string, body interface{}, out interface{}) error {
+    encoded, err := json.Marshal(body)
+    if err != nil {
+        return err
+    }
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(v.URL, "/")+path, bytes.NewReader(encoded))
+    if err != nil {
+        return err
+    }
+    for name, values := range v.Headers {
+        req.Header[name] = values
+    }
+    req.Header.Set("Content-Type", "application/json")
+    if v.Token != "" {
+        req.Header.Set("Authorization", "Bearer "+v.Token)
+    }
+    client := v.HTTPClient
+    if client == nil {
+        client = http.DefaultClient
+    }
+    resp, err := client.Do(req)
+    if err != nil {
+        return fmt.Errorf("pseudonyms: %v", err)
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        return fmt.Errorf("pseudonyms: vault %s returned %s", path, resp.Status)
+    }
+    return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(out)
+}
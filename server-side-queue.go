@@ -0,0 +1,165 @@
+// On page unload the browser is waiting on us, and a slow libhoney send (or
+// GeoIP lookup, or Kafka write) used to hold its connection open the whole
+// time. EventQueue decouples the two: the handler does its quick checks, puts
+// the event on a bounded queue, and responds, while a pool of workers does the
+// enrichment and sending.
+//
+//     handler.Queue = NewEventQueue(handler, 10000, 8, QueueDropOldest)
+//
+// When the queue is full, Policy decides what gives. Before it's full, we
+// start shedding lower-priority events (see Priorities) to keep room for the
+// important ones.
+type EventQueue struct {
+    Policy QueuePolicy
+
+    name string // For metrics and health checks
+    h    *UserEventsHandler
+    jobs chan *eventJob
+    wg   sync.WaitGroup
+}
+
+type QueuePolicy int
+
+const (
+    QueueBlock      QueuePolicy = iota // Wait for room, holding the request open (until the browser gives up)
+    QueueDropOldest                    // Make room by dropping the oldest queued event
+    QueueReject                        // Turn the event away with a 503, so the browser can retry later
+)
+
+// ErrQueueFull is returned for events turned away under QueueReject.
+var ErrQueueFull = errors.New("too many events queued, try again later")
+
+// How long a worker gives the sink for each event
+const queueSendTimeout = 10 * time.Second
+
+var queueDepth = promauto.NewGaugeVec(prometheus.GaugeOpts{
+    Name: "user_events_queue_depth",
+    Help: "Events waiting for a worker, by queue (\"default\", or a bulkhead's name).",
+}, []string{"queue"})
+
+const defaultQueueName = "default"
+
+// NewEventQueue starts the workers straight away.
+func NewEventQueue(h *UserEventsHandler, size, workers int, policy QueuePolicy) *EventQueue {
+    return NewBulkhead(h, defaultQueueName, size, workers, policy)
+}
+
+// A resource-timing batch takes far longer to process than a page-load, and
+// a page full of them used to back the one Queue up for everyone. A bulkhead
+// is an EventQueue of its own, with its own workers, for the event types
+// listed against it in the handler's Bulkheads: when it fills up, its Policy
+// and priority shedding only affect those types, and everything else carries
+// on through Queue.
+//
+//     heavy := NewBulkhead(handler, "heavy", 1000, 2, QueueDropOldest)
+//     handler.Bulkheads = map[string]*EventQueue{"resource-timing": heavy, "long-task": heavy}
+func NewBulkhead(h *UserEventsHandler, name string, size, workers int, policy QueuePolicy) *EventQueue {
+    q := &EventQueue{Policy: policy, name: name, h: h, jobs: make(chan *eventJob, size)}
+    for i := 0; i < workers; i++ {
+        q.wg.Add(1)
+        go q.work()
+    }
+    return q
+}
+
+func (q *EventQueue) work() {
+    defer q.wg.Done()
+    for job := range q.jobs {
+        queueDepth.WithLabelValues(q.name).Dec()
+        ctx, cancel := context.WithTimeout(context.Background(), queueSendTimeout)
+        q.h.process(ctx, job)
+        cancel()
+    }
+}
+
+// ctx only bounds how long we'll wait for room under QueueBlock; the worker
+// gets its own deadline once the job is picked up.
+func (q *EventQueue) enqueue(ctx context.Context, job *eventJob) error {
+    if limit := job.priority.queueLimit(); limit < 1 && float64(len(q.jobs)) >= limit*float64(cap(q.jobs)) {
+        eventsDropped.WithLabelValues(metricsTypeLabel(job.eventType), "shed_"+job.priority.String()).Inc()
+        return nil
+    }
+    if q.Policy == QueueBlock {
+        select {
+        case q.jobs <- job:
+            queueDepth.WithLabelValues(q.name).Inc()
+            return nil
+        case <-ctx.Done():
+            // The browser stopped waiting, so stop holding its handler
+            // goroutine; it's the same as being turned away
+            eventsDropped.WithLabelValues(metricsTypeLabel(job.eventType), "queue_full").Inc()
+            return ErrQueueFull
+        }
+    }
+
+    for {
+        select {
+        case q.jobs <- job:
+            queueDepth.WithLabelValues(q.name).Inc()
+            return nil
+        default:
+        }
+
+        if q.Policy == QueueReject {
+            eventsDropped.WithLabelValues(metricsTypeLabel(job.eventType), "queue_full").Inc()
+            return ErrQueueFull
+        }
+
+        // QueueDropOldest: take one off the front and try again. A worker may
+        // have beaten us to it, in which case there's room now anyway.
+        select {
+        case oldest := <-q.jobs:
+            queueDepth.WithLabelValues(q.name).Dec()
+            eventsDropped.WithLabelValues(metricsTypeLabel(oldest.eventType), "queue_full").Inc()
+        default:
+        }
+    }
+}
+
+// Waits for the workers to finish everything already queued. Nothing may be
+// enqueued after close.
+func (q *EventQueue) close() {
+    close(q.jobs)
+    q.wg.Wait()
+}
+
+// The queue an event type's jobs go on, or nil to process them right away
+func (h *UserEventsHandler) queueFor(eventType string) *EventQueue {
+    if queue, ok := h.Bulkheads[eventType]; ok && queue != nil {
+        return queue
+    }
+    return h.Queue
+}
+
+// Every queue the handler has, each once, even if it's listed against
+// several event types
+func (h *UserEventsHandler) allQueues() []*EventQueue {
+    var queues []*EventQueue
+    seen := map[*EventQueue]bool{}
+    for _, queue := range append([]*EventQueue{h.Queue}, bulkheadQueues(h.Bulkheads)...) {
+        if queue != nil && !seen[queue] {
+            seen[queue] = true
+            queues = append(queues, queue)
+        }
+    }
+    return queues
+}
+
+// In event type order, so health checks list them the same way every time
+func bulkheadQueues(bulkheads map[string]*EventQueue) []*EventQueue {
+    types := make([]string, 0, len(bulkheads))
+    for eventType := range bulkheads {
+        types = append(types, eventType)
+    }
+    sort.Strings(types)
+    queues := make([]*EventQueue, len(types))
+    for i, eventType := range types {
+        queues[i] = bulkheads[eventType]
+    }
+    return queues
+}
+
+// Len is how many events are waiting for a worker.
+func (q *EventQueue) Len() int {
+    return len(q.jobs)
+}
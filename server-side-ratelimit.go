@@ -0,0 +1,129 @@
+// A single misbehaving tab stuck in a loop can send events as fast as it can,
+// and burn through our Honeycomb quota on its own. RateLimiter gives each user
+// (or IP, for logged-out traffic) a token bucket: Burst events up front, then
+// refilled at PerSecond.
+//
+// Buckets live in memory, so with several instances each one allows the full
+// rate. With a shared store, limits are shared across instances instead: the
+// handler's StateStore, unless it's the in-memory one, or Store if it's set.
+// Shared limits count events in fixed 10 second windows (Burst plus 10s worth
+// of PerSecond per window), which is a little looser than a token bucket but
+// only needs an atomic increment.
+type RateLimiter struct {
+    PerSecond float64
+    Burst     int
+    Store     StateStore
+
+    mu        sync.Mutex
+    buckets   map[string]*rateBucket
+    lastSweep time.Time
+}
+
+type rateBucket struct {
+    limiter  *rate.Limiter
+    lastSeen time.Time
+}
+
+// How long a key can go quiet before we forget its bucket. A new bucket starts
+// full, so this only needs to be longer than it takes to refill one.
+const rateBucketIdle = 10 * time.Minute
+
+var rateLimitedTotal = promauto.NewCounter(prometheus.CounterOpts{
+    Name: "rate_limited_total",
+    Help: "Events dropped because their user or IP was over its rate limit.",
+})
+
+func NewRateLimiter(perSecond float64, burst int) *RateLimiter {
+    return &RateLimiter{
+        PerSecond: perSecond,
+        Burst:     burst,
+        buckets:   make(map[string]*rateBucket),
+        lastSweep: time.Now(),
+    }
+}
+
+func (l *RateLimiter) Allow(key string) bool {
+    return l.allow(l.Store, key)
+}
+
+// Whether the request's user (or IP) is over the handler's RateLimiter
+func (h *UserEventsHandler) rateLimited(r *http.Request, user *UserInfo) bool {
+    if h.RateLimiter == nil {
+        return false
+    }
+    store := h.RateLimiter.Store
+    if store == nil {
+        if _, inMemory := h.state().(*MemoryStore); !inMemory {
+            store = h.state()
+        }
+    }
+    return !h.RateLimiter.allow(store, rateLimitKey(r, user))
+}
+
+// Counts against store if there is one, otherwise this instance's buckets
+func (l *RateLimiter) allow(store StateStore, key string) bool {
+    if store != nil {
+        return l.allowShared(store, key)
+    }
+    now := time.Now()
+
+    l.mu.Lock()
+    bucket, ok := l.buckets[key]
+    if !ok {
+        bucket = &rateBucket{limiter: rate.NewLimiter(rate.Limit(l.PerSecond), l.Burst)}
+        l.buckets[key] = bucket
+    }
+    bucket.lastSeen = now
+    l.sweep(now)
+    l.mu.Unlock()
+
+    if !bucket.limiter.AllowN(now, 1) {
+        rateLimitedTotal.Inc()
+        return false
+    }
+    return true
+}
+
+const sharedRateWindow = 10 * time.Second
+
+func (l *RateLimiter) allowShared(store StateStore, key string) bool {
+    ctx, cancel := context.WithTimeout(context.Background(), stateStoreTimeout)
+    defer cancel()
+
+    window := time.Now().Unix() / int64(sharedRateWindow.Seconds())
+    count, err := store.Incr(ctx, fmt.Sprintf("ratelimit:%s:%d", key, window), 2*sharedRateWindow)
+    if err != nil {
+        return true // Better to let events through than drop everything when the store's down
+    }
+    if float64(count) > float64(l.Burst)+l.PerSecond*sharedRateWindow.Seconds() {
+        rateLimitedTotal.Inc()
+        return false
+    }
+    return true
+}
+
+// Drops buckets for keys we haven't heard from in a while, so the map doesn't
+// grow with every visitor we've ever seen. Called with l.mu held.
+func (l *RateLimiter) sweep(now time.Time) {
+    if now.Sub(l.lastSweep) < rateBucketIdle {
+        return
+    }
+    for key, bucket := range l.buckets {
+        if now.Sub(bucket.lastSeen) > rateBucketIdle {
+            delete(l.buckets, key)
+        }
+    }
+    l.lastSweep = now
+}
+
+// Who we rate limit an event against: the logged-in user if there is one,
+// otherwise whoever's on the other end of the connection.
+func rateLimitKey(r *http.Request, user *UserInfo) string {
+    if user != nil {
+        return "user:" + user.ID
+    }
+    if ip := clientIP(r); ip != nil {
+        return "ip:" + ip.String()
+    }
+    return "unknown"
+}
@@ -0,0 +1,135 @@
+// Checking what exactly got sent for a session means querying Honeycomb and
+// waiting for ingestion to catch up. RecentEvents keeps the last Size events
+// we sent (after enrichment, scrubbing and the PresendHook, so exactly what
+// went out) in memory, and HandleDebugEvents serves them as JSON:
+//
+//     handler.Recent = &RecentEvents{Token: os.Getenv("DEBUG_TOKEN")}
+//     mux.HandleFunc("/debug/events", handler.HandleDebugEvents)
+//
+// Any query parameter other than `fields` and `limit` filters on an event
+// field, e.g. `/debug/events?session_id=abc&type=page-load`. `fields=a,b`
+// trims each event down to just those fields, and `limit` caps how many of
+// the newest events come back (default 100). Each instance only knows about
+// the events it sent itself.
+type RecentEvents struct {
+    Size  int    // How many events to keep; defaults to 1000
+    Token string // Required as "Authorization: Bearer <token>"; with no Token, every request is refused
+
+    mu     sync.Mutex
+    events []recentEvent // Ring buffer, oldest overwritten first
+    next   int
+}
+
+type recentEvent struct {
+    Type       string                 `json:"type"`
+    Dataset    string                 `json:"dataset"`
+    Timestamp  time.Time              `json:"timestamp"`
+    SampleRate uint                   `json:"sample_rate"`
+    Fields     map[string]interface{} `json:"fields"`
+}
+
+func (re *RecentEvents) record(ev *Event) {
+    fields := make(map[string]interface{}, len(ev.Fields()))
+    for name, value := range ev.Fields() {
+        fields[name] = value
+    }
+
+    re.mu.Lock()
+    defer re.mu.Unlock()
+    size := re.Size
+    if size <= 0 {
+        size = 1000
+    }
+    entry := recentEvent{Type: ev.Type, Dataset: ev.Dataset, Timestamp: ev.Timestamp, SampleRate: ev.SampleRate, Fields: fields}
+    if len(re.events) < size {
+        re.events = append(re.events, entry)
+        return
+    }
+    re.events[re.next] = entry
+    re.next = (re.next + 1) % size
+}
+
+// Newest first
+func (re *RecentEvents) snapshot() []recentEvent {
+    re.mu.Lock()
+    defer re.mu.Unlock()
+    out := make([]recentEvent, 0, len(re.events))
+    for i := len(re.events) - 1; i >= 0; i-- {
+        out = append(out, re.events[(re.next+i)%len(re.events)])
+    }
+    return out
+}
+
+func (h *UserEventsHandler) HandleDebugEvents(w http.ResponseWriter, r *http.Request) {
+    re := h.Recent
+    if re == nil {
+        http.NotFound(w, r)
+        return
+    }
+    if !bearerTokenOK(r, re.Token) {
+        http.Error(w, "unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    query := r.URL.Query()
+    limit := 100
+    if raw := query.Get("limit"); raw != "" {
+        n, err := strconv.Atoi(raw)
+        if err != nil || n <= 0 {
+            http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+            return
+        }
+        limit = n
+    }
+    var only []string
+    if raw := query.Get("fields"); raw != "" {
+        only = strings.Split(raw, ",")
+    }
+
+    matches := []recentEvent{}
+    for _, entry := range re.snapshot() {
+        if len(matches) >= limit {
+            break
+        }
+        if !entry.matches(query) {
+            continue
+        }
+        if only != nil {
+            trimmed := make(map[string]interface{}, len(only))
+            for _, name := range only {
+                if value, ok := entry.Fields[name]; ok {
+                    trimmed[name] = value
+                }
+            }
+            entry.Fields = trimmed
+        }
+        matches = append(matches, entry)
+    }
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{"events": matches})
+}
+
+func (e recentEvent) matches(query url.Values) bool {
+    for name, values := range query {
+        if name == "fields" || name == "limit" {
+            continue
+        }
+        value := idString(e.Fields[name])
+        if name == "type" {
+            value = e.Type
+        } else if name == "dataset" {
+            value = e.Dataset
+        }
+        ok := false
+        for _, want := range values {
+            if value == want {
+                ok = true
+            }
+        }
+        if !ok {
+            return false
+        }
+    }
+    return true
+}
@@ -0,0 +1,196 @@
+// Honeycomb runs separate US and EU instances, and data sent to one never
+// reaches the other, so which API host each client uses is a data residency
+// decision, not a detail. HoneycombEndpoint names where a client sends by
+// region (or by host, for an internal proxy in front of either), and
+// NewClientRouter builds and checks the whole set at startup so a typo'd host
+// fails the deploy instead of quietly sending events nowhere:
+//
+//     router, err := NewClientRouter(map[string]HoneycombEndpoint{
+//         "us":    {Region: "us", APIKey: usKey},
+//         "eu":    {Region: "eu", APIKey: euKey},
+//         "proxy": {Region: "eu", APIHost: "https://honeycomb-proxy.internal", APIKey: euKey},
+//     }, "us")
+//     router.ByDataset = map[string]string{"eu-user-events": "eu"}
+//
+// ByDataset pins a dataset to a client no matter what the browser asks for.
+// A Tenant with a Region only ever sends with its own Endpoint, which has to
+// be in that region; ValidateEndpoints checks all of this, so call it once
+// Clients and Tenants are set up.
+type HoneycombEndpoint struct {
+    Region  string `yaml:"region"`   // "us" or "eu"; where events end up, even through a proxy
+    APIHost string `yaml:"api_host"` // Defaults to the region's own API host
+    APIKey  string `yaml:"api_key"`
+}
+
+var honeycombRegionHosts = map[string]string{
+    "us": defaultAPIHost,
+    "eu": "https://api.eu1.honeycomb.io",
+}
+
+// The region the endpoint's events end up in, "us" unless it says otherwise
+func (e HoneycombEndpoint) region() string {
+    if e.Region != "" {
+        return strings.ToLower(e.Region)
+    }
+    return "us"
+}
+
+func (e HoneycombEndpoint) host() (string, error) {
+    regionHost, ok := honeycombRegionHosts[e.region()]
+    if !ok {
+        return "", fmt.Errorf("unknown Honeycomb region %q (us or eu)", e.Region)
+    }
+    if e.APIHost == "" {
+        return regionHost, nil
+    }
+    u, err := url.Parse(e.APIHost)
+    switch {
+    case err != nil:
+        return "", fmt.Errorf("API host %q: %v", e.APIHost, err)
+    case u.Scheme != "https" && u.Scheme != "http":
+        return "", fmt.Errorf("API host %q needs to start with https:// (or http://)", e.APIHost)
+    case u.Host == "":
+        return "", fmt.Errorf("API host %q has no host name", e.APIHost)
+    case strings.Trim(u.Path, "/") != "" || u.RawQuery != "":
+        // libhoney appends its own path, so one here would only get lost
+        return "", fmt.Errorf("API host %q can't have a path or query", e.APIHost)
+    }
+    // A host that's one of Honeycomb's own has to be the region's
+    for region, host := range honeycombRegionHosts {
+        if strings.EqualFold(strings.TrimSuffix(e.APIHost, "/"), host) && region != e.region() {
+            return "", fmt.Errorf("API host %q is Honeycomb's %s region, not %s", e.APIHost, region, e.region())
+        }
+    }
+    return strings.TrimSuffix(e.APIHost, "/"), nil
+}
+
+// NewClient checks the endpoint and starts a libhoney client for it.
+func (e HoneycombEndpoint) NewClient() (*libhoney.Client, error) {
+    host, err := e.host()
+    if err != nil {
+        return nil, err
+    }
+    if e.APIKey == "" {
+        return nil, errors.New("no API key")
+    }
+    return libhoney.NewClient(libhoney.ClientConfig{APIKey: e.APIKey, APIHost: host})
+}
+
+// NewClientRouter starts a client for each endpoint, with defaultName's as
+// the one events go to when nothing else picks one.
+func NewClientRouter(endpoints map[string]HoneycombEndpoint, defaultName string) (*ClientRouter, error) {
+    if _, ok := endpoints[defaultName]; !ok {
+        return nil, fmt.Errorf("default Honeycomb client %q isn't one of the endpoints", defaultName)
+    }
+    router := &ClientRouter{Clients: map[string]*libhoney.Client{}, Default: defaultName, Regions: map[string]string{}}
+    for name, endpoint := range endpoints {
+        router.Regions[name] = endpoint.region()
+        client, err := endpoint.NewClient()
+        if err != nil {
+            router.close()
+            return nil, fmt.Errorf("Honeycomb client %q: %v", name, err)
+        }
+        router.Clients[name] = client
+    }
+    return router, nil
+}
+
+func (c *ClientRouter) close() {
+    for _, client := range c.Clients {
+        client.Close()
+    }
+}
+
+func (c *ClientRouter) regionOf(name string) string {
+    if region := c.Regions[name]; region != "" {
+        return strings.ToLower(region)
+    }
+    return "us"
+}
+
+// Every region the router's clients send to
+func (c *ClientRouter) regions() []string {
+    seen := map[string]bool{}
+    var regions []string
+    add := func(name string) {
+        if region := c.regionOf(name); !seen[region] {
+            seen[region] = true
+            regions = append(regions, region)
+        }
+    }
+    for name := range c.Clients {
+        add(name)
+    }
+    for name := range c.Regions {
+        add(name)
+    }
+    if len(regions) == 0 {
+        return []string{"us"}
+    }
+    sort.Strings(regions)
+    return regions
+}
+
+// Whether ByDataset keeps dataset's events on one client, whichever the
+// browser asks for
+func (c *ClientRouter) pins(dataset string) bool {
+    name, ok := c.ByDataset[dataset]
+    if !ok {
+        return false
+    }
+    _, known := c.Regions[name]
+    return known || c.Clients[name] != nil
+}
+
+// Checks that every client name the router refers to exists
+func (c *ClientRouter) validate() error {
+    if c.Clients[c.Default] == nil {
+        return fmt.Errorf("default Honeycomb client %q doesn't exist", c.Default)
+    }
+    for eventType, name := range c.ByType {
+        if c.Clients[name] == nil {
+            return fmt.Errorf("event type %q routed to Honeycomb client %q, which doesn't exist", eventType, name)
+        }
+    }
+    for dataset, name := range c.ByDataset {
+        if c.Clients[name] == nil {
+            return fmt.Errorf("dataset %q pinned to Honeycomb client %q, which doesn't exist", dataset, name)
+        }
+    }
+    return nil
+}
+
+// ValidateEndpoints checks Clients' routes, and starts a client for each
+// tenant with an Endpoint (and no Client yet), refusing any tenant whose
+// events could leave its Region.
+func (h *UserEventsHandler) ValidateEndpoints() error {
+    h.clientsMu.Lock()
+    defer h.clientsMu.Unlock()
+    if h.Clients != nil {
+        if err := h.Clients.validate(); err != nil {
+            return err
+        }
+    }
+    if h.Tenants == nil {
+        return nil
+    }
+    for _, tenant := range h.Tenants.Tenants {
+        if tenant.Region != "" && (tenant.Endpoint == nil || tenant.Endpoint.region() != strings.ToLower(tenant.Region)) {
+            return fmt.Errorf("tenant %q has to stay in the %s region, so needs an Endpoint there", tenant.Name, tenant.Region)
+        }
+        if tenant.Endpoint == nil || tenant.fromEndpoint {
+            continue
+        }
+        if tenant.Client != nil {
+            // We can't tell where a client someone else started sends to
+            return fmt.Errorf("tenant %q has both an Endpoint and a Client", tenant.Name)
+        }
+        client, err := tenant.Endpoint.NewClient()
+        if err != nil {
+            return fmt.Errorf("tenant %q: %v", tenant.Name, err)
+        }
+        tenant.Client = client
+        tenant.fromEndpoint = true
+    }
+    return nil
+}
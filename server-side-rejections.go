@@ -0,0 +1,167 @@
+// The browser SDK has to decide what to do with events we turn away: retry
+// them shortly, hold on to them and send them later, or give up on them. It
+// used to have to guess from the status code and a human-readable message.
+// Every rejection now comes with a JSON body carrying a stable code and what
+// we suggest the SDK does about it:
+//
+//     {"error": {"code": "queue_full", "message": "...", "action": "retry"},
+//      "results": [{"index": 0, "status": "accepted"},
+//                  {"index": 1, "status": "rejected", "code": "invalid_event", "message": "...", "action": "drop"}]}
+//
+// results (for batches) has one entry per event, in request order. A batch
+// where nothing was rejected but some events were dropped (rate limited, no
+// consent, and so on) gets a 200 with just the results; a batch where every
+// event was accepted still gets an empty 204, or 202 if some were shed.
+type ErrorCode string
+
+const (
+    CodeInvalidBody     ErrorCode = "invalid_body"
+    CodePayloadTooLarge ErrorCode = "payload_too_large"
+    CodeTooManyEvents   ErrorCode = "too_many_events"
+    CodeMissingType     ErrorCode = "missing_type"
+    CodeInvalidEvent    ErrorCode = "invalid_event"
+    CodeUnknownTenant   ErrorCode = "unknown_tenant"
+    CodeUnauthenticated ErrorCode = "unauthenticated"
+    CodeQuotaExceeded   ErrorCode = "quota_exceeded"
+    CodeQueueFull       ErrorCode = "queue_full"
+    CodeRateLimited     ErrorCode = "rate_limited"
+    CodeNoConsent       ErrorCode = "no_consent"
+    CodeInvalidNonce    ErrorCode = "invalid_nonce"
+    CodeCanceled        ErrorCode = "canceled"
+    CodeDropped         ErrorCode = "dropped" // Anything else we chose not to keep
+    CodeInternal        ErrorCode = "internal"
+)
+
+// What the SDK should do with a rejected or dropped event
+const (
+    ActionRetry   = "retry"   // Send it again shortly (after Retry-After, if there is one)
+    ActionRequeue = "requeue" // Keep it, and send it again once the tenant's quota or rate allows
+    ActionDrop    = "drop"    // Sending it again won't help
+)
+
+// EventResult is what became of one event in a batch.
+type EventResult struct {
+    Index   int       `json:"index"`
+    Status  string    `json:"status"` // "accepted", "dropped", or "rejected"
+    Code    ErrorCode `json:"code,omitempty"`
+    Message string    `json:"message,omitempty"`
+    Action  string    `json:"action,omitempty"`
+
+    shed bool // Accepted, but shed for load (see LoadShedder)
+}
+
+type rejectionError struct {
+    Code    ErrorCode `json:"code"`
+    Message string    `json:"message"`
+    Action  string    `json:"action"`
+}
+
+type rejectionBody struct {
+    Error   *rejectionError `json:"error,omitempty"`
+    Results []EventResult   `json:"results,omitempty"`
+}
+
+// Rejects the whole request, before we got as far as looking at its events
+func writeRejection(w http.ResponseWriter, status int, code ErrorCode, message string) {
+    writeRejectionBody(w, status, rejectionBody{Error: &rejectionError{Code: code, Message: message, Action: actionFor(code)}})
+}
+
+func writeRejectionBody(w http.ResponseWriter, status int, body rejectionBody) {
+    w.Header().Set("Content-Type", "application/json")
+    w.Header().Set("X-Content-Type-Options", "nosniff")
+    w.WriteHeader(status)
+    json.NewEncoder(w).Encode(body)
+}
+
+// The code for an error sendToHoneycombAPI (or reading the body) gave us
+func errorCodeFor(err error) ErrorCode {
+    var invalid *ValidationError
+    var tooLarge *http.MaxBytesError
+    switch {
+    case errors.Is(err, ErrQueueFull):
+        return CodeQueueFull
+    case errors.Is(err, ErrQuotaExceeded):
+        return CodeQuotaExceeded
+    case errors.Is(err, ErrUnknownTenant):
+        return CodeUnknownTenant
+    case errors.Is(err, ErrInvalidNonce):
+        return CodeInvalidNonce
+    case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+        return CodeCanceled
+    case errors.As(err, &invalid):
+        return CodeInvalidEvent
+    case errors.As(err, &tooLarge):
+        return CodePayloadTooLarge
+    default:
+        return CodeInternal
+    }
+}
+
+// The code for a silent drop, from its eventsDropped reason. Bot and
+// processor drops aren't spelled out, so a scraper can't tell how we
+// spotted it.
+func dropCode(reason string) ErrorCode {
+    switch reason {
+    case "rate_limited":
+        return CodeRateLimited
+    case "consent":
+        return CodeNoConsent
+    case "closed", "canceled", "deadline":
+        return CodeCanceled
+    default:
+        return CodeDropped
+    }
+}
+
+func actionFor(code ErrorCode) string {
+    switch code {
+    case CodeQueueFull, CodeCanceled, CodeInternal:
+        return ActionRetry
+    case CodeQuotaExceeded, CodeRateLimited:
+        return ActionRequeue
+    default:
+        return ActionDrop
+    }
+}
+
+// Results for a batch, each event accepted until sendBatchToHoneycombAPI
+// says otherwise
+func newEventResults(n int) []EventResult {
+    results := make([]EventResult, n)
+    for i := range results {
+        results[i] = EventResult{Index: i, Status: "accepted"}
+    }
+    return results
+}
+
+func (res *EventResult) reject(err error) {
+    res.Status = "rejected"
+    res.Code = errorCodeFor(err)
+    res.Message = err.Error()
+    res.Action = actionFor(res.Code)
+}
+
+func (res *EventResult) drop(code ErrorCode, message string) {
+    res.Status = "dropped"
+    res.Code = code
+    res.Message = message
+    res.Action = actionFor(code)
+}
+
+func anyShed(results []EventResult) bool {
+    for _, res := range results {
+        if res.shed {
+            return true
+        }
+    }
+    return false
+}
+
+func allAccepted(results []EventResult) bool {
+    for _, res := range results {
+        if res.Status != "accepted" {
+            return false
+        }
+    }
+    return true
+}
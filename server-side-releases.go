@@ -0,0 +1,165 @@
+// Comparing "before and after the deploy" in Honeycomb only works if every
+// event reliably says which build it came from. The browser sends `release`
+// and `build_sha` from meta tags on the page, but old cached pages and pages
+// rendered by other apps don't always have them, so ReleaseEnricher also keeps
+// a registry of releases and the content-hashed assets each one shipped. Any
+// event that names one of those assets (script_src, or error_source for errors)
+// can be pinned to its release even when the page didn't say.
+//
+// Every event then gets:
+//
+//   - app_version, the release's version
+//   - build_sha
+//   - deploy_environment, e.g. "production" or "staging"
+//   - release_deployed_at, if the release was registered
+//
+// Register releases at deploy time, either from the build's asset manifest or
+// by POSTing them to HandleRegister:
+//
+//     releases := &ReleaseEnricher{Environment: "production"}
+//     releases.LoadManifest(Release{Version: "2024.06.1", BuildSHA: sha}, "build/asset-manifest.json")
+//     handler.Enrichers = append(handler.Enrichers, releases)
+type ReleaseEnricher struct {
+    Environment string // deploy_environment for releases that don't say
+
+    mu        sync.RWMutex
+    byVersion map[string]*Release
+    bySHA     map[string]*Release
+    byAsset   map[string]*Release
+}
+
+type Release struct {
+    Version     string    `json:"version"`
+    BuildSHA    string    `json:"build_sha,omitempty"`
+    Environment string    `json:"environment,omitempty"`
+    DeployedAt  time.Time `json:"deployed_at,omitempty"`
+
+    // File names of the content-hashed bundles this release shipped, e.g.
+    // "main.3f2a1b9c.js"
+    Assets []string `json:"assets,omitempty"`
+}
+
+func (e *ReleaseEnricher) Register(release Release) {
+    if release.DeployedAt.IsZero() {
+        release.DeployedAt = time.Now()
+    }
+    e.mu.Lock()
+    defer e.mu.Unlock()
+    if e.byVersion == nil {
+        e.byVersion = map[string]*Release{}
+        e.bySHA = map[string]*Release{}
+        e.byAsset = map[string]*Release{}
+    }
+    rel := &release
+    if rel.Version != "" {
+        e.byVersion[rel.Version] = rel
+    }
+    if rel.BuildSHA != "" {
+        e.bySHA[rel.BuildSHA] = rel
+    }
+    for _, asset := range rel.Assets {
+        e.byAsset[path.Base(asset)] = rel
+    }
+}
+
+// LoadManifest registers a release with the assets listed in a webpack-style
+// asset manifest: a JSON object of logical names to hashed paths, optionally
+// nested under "files" (as create-react-app writes it).
+func (e *ReleaseEnricher) LoadManifest(release Release, manifestPath string) error {
+    raw, err := ioutil.ReadFile(manifestPath)
+    if err != nil {
+        return err
+    }
+    var manifest struct {
+        Files map[string]string `json:"files"`
+    }
+    if err := json.Unmarshal(raw, &manifest); err != nil || len(manifest.Files) == 0 {
+        if err := json.Unmarshal(raw, &manifest.Files); err != nil {
+            return fmt.Errorf("invalid asset manifest %s: %v", manifestPath, err)
+        }
+    }
+    for _, asset := range manifest.Files {
+        release.Assets = append(release.Assets, asset)
+    }
+    e.Register(release)
+    return nil
+}
+
+// HandleRegister registers a Release POSTed as JSON. It does no auth of its
+// own, so don't mount it anywhere public.
+func (e *ReleaseEnricher) HandleRegister(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodPost {
+        w.Header().Set("Allow", http.MethodPost)
+        http.Error(w, "releases must be POSTed", http.StatusMethodNotAllowed)
+        return
+    }
+    var release Release
+    if err := json.NewDecoder(r.Body).Decode(&release); err != nil {
+        http.Error(w, fmt.Sprintf("invalid release: %v", err), http.StatusBadRequest)
+        return
+    }
+    if release.Version == "" && release.BuildSHA == "" {
+        http.Error(w, "release needs a version or build_sha", http.StatusBadRequest)
+        return
+    }
+    e.Register(release)
+    w.WriteHeader(http.StatusCreated)
+}
+
+func (e *ReleaseEnricher) Enrich(ctx context.Context, ev *Event, r *http.Request, user *UserInfo) error {
+    fields := ev.Fields()
+    version, _ := fields["release"].(string)
+    sha, _ := fields["build_sha"].(string)
+
+    if rel := e.lookup(version, sha, fields); rel != nil {
+        if version == "" {
+            version = rel.Version
+        }
+        if sha == "" {
+            sha = rel.BuildSHA
+        }
+        if rel.Environment != "" {
+            ev.AddField("deploy_environment", rel.Environment)
+        }
+        ev.AddField("release_deployed_at", rel.DeployedAt)
+    }
+
+    if version != "" {
+        ev.AddField("app_version", version)
+    }
+    if sha != "" {
+        ev.AddField("build_sha", sha)
+    }
+    if _, ok := fields["deploy_environment"]; !ok && e.Environment != "" {
+        ev.AddField("deploy_environment", e.Environment)
+    }
+    return nil
+}
+
+// Whether version has been registered
+func (e *ReleaseEnricher) known(version string) bool {
+    e.mu.RLock()
+    defer e.mu.RUnlock()
+    return e.byVersion[version] != nil
+}
+
+func (e *ReleaseEnricher) lookup(version, sha string, fields map[string]interface{}) *Release {
+    e.mu.RLock()
+    defer e.mu.RUnlock()
+    if rel := e.byVersion[version]; rel != nil && version != "" {
+        return rel
+    }
+    if rel := e.bySHA[sha]; rel != nil && sha != "" {
+        return rel
+    }
+    for _, field := range []string{"script_src", "error_source"} {
+        if src, ok := fields[field].(string); ok && src != "" {
+            if u, err := url.Parse(src); err == nil {
+                if rel := e.byAsset[path.Base(u.Path)]; rel != nil {
+                    return rel
+                }
+            }
+        }
+    }
+    return nil
+}
@@ -0,0 +1,131 @@
+// Replay re-sends events from a dead letter spool directory (see DiskSpool), a
+// SQLiteSpool database (a .db or .sqlite file), or a JSON-lines file (see
+// JSONLinesSink), keeping their original timestamps,
+// datasets, and sample rates. It's for recovering from outages bad enough that
+// retrying wasn't going to help, like the time we shipped the wrong API key
+// for a few hours.
+type ReplayOptions struct {
+    PerSecond float64   // Max events to send per second; 0 means as fast as we can
+    DryRun    bool      // Read and report on everything, but don't send
+    Remove    bool      // Delete spooled events once they've been sent
+    Log       io.Writer // Where to report each event; nil for no report
+}
+
+type ReplayStats struct {
+    Read    int
+    Sent    int
+    Skipped int // Couldn't be parsed
+}
+
+func (h *UserEventsHandler) Replay(ctx context.Context, source string, opts ReplayOptions) (ReplayStats, error) {
+    var stats ReplayStats
+    limiter := rate.NewLimiter(rate.Inf, 1)
+    if opts.PerSecond > 0 {
+        limiter = rate.NewLimiter(rate.Limit(opts.PerSecond), 1)
+    }
+
+    send := func(ev *Event, remove func() error) error {
+        stats.Read++
+        if opts.Log != nil {
+            fmt.Fprintf(opts.Log, "%s\t%s\t%s\n", ev.Timestamp.Format(time.RFC3339), ev.Dataset, ev.Type)
+        }
+        if opts.DryRun {
+            return nil
+        }
+        if err := limiter.Wait(ctx); err != nil {
+            return err
+        }
+        h.send(ctx, ev)
+        stats.Sent++
+        if opts.Remove && remove != nil {
+            return remove()
+        }
+        return nil
+    }
+
+    info, err := os.Stat(source)
+    if err != nil {
+        return stats, err
+    }
+    switch {
+    case info.IsDir():
+        return stats, replaySpoolDir(source, send, &stats)
+    case strings.HasSuffix(source, ".db") || strings.HasSuffix(source, ".sqlite"):
+        return stats, replaySQLite(source, send, &stats)
+    }
+    return stats, replayJSONLines(source, send, &stats)
+}
+
+func replaySpoolDir(dir string, send func(*Event, func() error) error, stats *ReplayStats) error {
+    names, err := filepath.Glob(filepath.Join(dir, "[0-9]*.json"))
+    if err != nil {
+        return err
+    }
+    sort.Strings(names)
+    for _, name := range names {
+        buf, err := ioutil.ReadFile(name)
+        if err != nil {
+            return err
+        }
+        var spooled SpooledEvent
+        if err := json.Unmarshal(buf, &spooled); err != nil {
+            stats.Skipped++
+            continue
+        }
+        name := name
+        if err := send(spooledToEvent(&spooled), func() error { return os.Remove(name) }); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func replaySQLite(path string, send func(*Event, func() error) error, stats *ReplayStats) error {
+    spool, err := OpenSQLiteSpool(path)
+    if err != nil {
+        return err
+    }
+    defer spool.Close()
+    skipped, err := spool.each(func(spooled *SpooledEvent, remove func() error) error {
+        return send(spooledToEvent(spooled), remove)
+    })
+    stats.Skipped += skipped
+    return err
+}
+
+func replayJSONLines(file string, send func(*Event, func() error) error, stats *ReplayStats) error {
+    f, err := os.Open(file)
+    if err != nil {
+        return err
+    }
+    defer f.Close()
+
+    scanner := bufio.NewScanner(f)
+    scanner.Buffer(make([]byte, 64*1024), defaultMaxBodyBytes)
+    for scanner.Scan() {
+        var line jsonLine
+        if err := json.Unmarshal(scanner.Bytes(), &line); err != nil || line.Data == nil {
+            stats.Skipped++
+            continue
+        }
+        ev := &Event{Dataset: line.Dataset, Timestamp: line.Time, SampleRate: line.SampleRate, Client: defaultClientName}
+        ev.Add(line.Data)
+        ev.Type, _ = line.Data["type"].(string)
+        if err := send(ev, nil); err != nil {
+            return err
+        }
+    }
+    return scanner.Err()
+}
+
+func spooledToEvent(spooled *SpooledEvent) *Event {
+    ev := &Event{
+        Dataset:    spooled.Dataset,
+        Timestamp:  spooled.Timestamp,
+        SampleRate: spooled.SampleRate,
+        Client:     spooled.Client,
+    }
+    ev.Add(spooled.Fields)
+    ev.Type, _ = spooled.Fields["type"].(string)
+    return ev
+}
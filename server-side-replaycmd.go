@@ -0,0 +1,49 @@
+// The replay command re-sends spooled or exported browser events to Honeycomb:
+//
+//     user-events replay -writekey $HONEYCOMB_WRITEKEY -rate 500 /var/spool/user-events
+//     user-events replay -remove /var/spool/user-events.db
+//     user-events replay -dry-run exported-events.jsonl
+//
+// See UserEventsHandler.Replay for what it reads.
+func replayCommand(args []string) {
+    flags := flag.NewFlagSet("replay", flag.ExitOnError)
+    writeKey := flags.String("writekey", os.Getenv("HONEYCOMB_WRITEKEY"), "Honeycomb API key to send with")
+    apiHost := flags.String("api-host", "https://api.honeycomb.io", "Honeycomb API host")
+    perSecond := flags.Float64("rate", 200, "max events to send per second (0 for no limit)")
+    dryRun := flags.Bool("dry-run", false, "list the events that would be sent without sending them")
+    remove := flags.Bool("remove", false, "delete spooled events once they've been sent")
+    flags.Parse(args)
+    if flags.NArg() != 1 {
+        fmt.Fprintln(os.Stderr, "usage: user-events replay [flags] <spool dir, .db file, or .jsonl file>")
+        os.Exit(2)
+    }
+    if *writeKey == "" && !*dryRun {
+        log.Fatal("replay: -writekey (or $HONEYCOMB_WRITEKEY) is required unless -dry-run")
+    }
+
+    client, err := libhoney.NewClient(libhoney.ClientConfig{APIKey: *writeKey, APIHost: *apiHost})
+    if err != nil {
+        log.Fatalf("replay: %v", err)
+    }
+    handler := NewUserEventsHandler(client)
+
+    ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt)
+    defer cancel()
+
+    stats, err := handler.Replay(ctx, flags.Arg(0), ReplayOptions{
+        PerSecond: *perSecond,
+        DryRun:    *dryRun,
+        Remove:    *remove,
+        Log:       os.Stdout,
+    })
+    closeCtx, closeCancel := context.WithTimeout(context.Background(), 30*time.Second)
+    defer closeCancel()
+    if closeErr := handler.Close(closeCtx); closeErr != nil {
+        log.Printf("replay: %v", closeErr)
+    }
+
+    log.Printf("replay: read %d events, sent %d, skipped %d unreadable", stats.Read, stats.Sent, stats.Skipped)
+    if err != nil {
+        log.Fatalf("replay: %v", err)
+    }
+}
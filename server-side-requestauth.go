@@ -0,0 +1,129 @@
+// Anyone can POST events to our endpoints, and if they can get a logged-in
+// user to load a page that does it, those events get attributed to that user.
+// RequestAuth closes that off in two layers:
+//
+//   - The request's Origin (or failing that, its Referer) must be one of ours.
+//
+//   - Optionally, the body must be signed: the browser SDK computes an
+//     HMAC-SHA256 over the raw body with a per-session key, and sends it as
+//     "X-Event-Signature: sha256=<hex>".
+//
+//     handler.RequestAuth = &RequestAuth{
+//         AllowedOrigins:   []string{"https://app.example.com"},
+//         RequireSignature: true,
+//         SessionKey:       func(r *http.Request) ([]byte, error) { return DeriveSessionKey(secret, sessionID(r)), nil },
+//     }
+//     mux.Handle("/events/batch", handler.Authenticate(...))
+type RequestAuth struct {
+    AllowedOrigins []string // Exact origins, or "https://*.example.com"
+
+    RequireSignature bool
+    // The signing key for the request's session; the page gets the same key
+    // when it's rendered
+    SessionKey func(r *http.Request) ([]byte, error)
+    // Short-lived keys the page fetches from HandleSigningKey instead. Takes
+    // precedence over SessionKey. With RequireSignature and neither of them,
+    // every request is turned away.
+    SigningKeys *SigningKeys
+}
+
+const signatureHeader = "X-Event-Signature"
+
+var authRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+    Name: "user_events_auth_rejected_total",
+    Help: "Requests turned away by RequestAuth, by reason.",
+}, []string{"reason"})
+
+func (h *UserEventsHandler) Authenticate(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        auth := h.RequestAuth
+        if auth == nil || r.Method == http.MethodOptions {
+            next.ServeHTTP(w, r)
+            return
+        }
+
+        if !originAllowed(auth.AllowedOrigins, requestOrigin(r)) {
+            authRejected.WithLabelValues("origin").Inc()
+            http.Error(w, "origin not allowed", http.StatusForbidden)
+            return
+        }
+
+        if auth.RequireSignature {
+            if reason, err := auth.verifySignature(w, r, h.maxBodyBytes()); err != nil {
+                authRejected.WithLabelValues(reason).Inc()
+                if reason == "read_error" {
+                    writeRejection(w, bodyErrorStatus(err), bodyErrorCode(err), err.Error())
+                    return
+                }
+                http.Error(w, err.Error(), http.StatusUnauthorized)
+                return
+            }
+        }
+        next.ServeHTTP(w, r)
+    })
+}
+
+// The origin the request came from. sendBeacon and fetch both send Origin on
+// POSTs these days, but older browsers only give us a Referer.
+func requestOrigin(r *http.Request) string {
+    if origin := r.Header.Get("Origin"); origin != "" && origin != "null" {
+        return origin
+    }
+    if referer, err := url.Parse(r.Header.Get("Referer")); err == nil && referer.Host != "" {
+        return referer.Scheme + "://" + referer.Host
+    }
+    return ""
+}
+
+// Reads (and puts back) the body to check its signature, reading no more
+// than max bytes of it. Returns a short reason for metrics along with any
+// error.
+func (a *RequestAuth) verifySignature(w http.ResponseWriter, r *http.Request, max int64) (string, error) {
+    header := r.Header.Get(signatureHeader)
+    if !strings.HasPrefix(header, "sha256=") {
+        return "missing_signature", fmt.Errorf("missing %s header", signatureHeader)
+    }
+    signature, err := hex.DecodeString(strings.TrimPrefix(header, "sha256="))
+    if err != nil {
+        return "bad_signature", fmt.Errorf("malformed %s header", signatureHeader)
+    }
+
+    var key []byte
+    if a.SigningKeys != nil {
+        if key, err = a.SigningKeys.keyFor(r, time.Now()); err != nil {
+            return "bad_key_id", err
+        }
+    } else if a.SessionKey == nil {
+        return "no_session_key", errors.New("no signing keys configured")
+    } else if key, err = a.SessionKey(r); err != nil || len(key) == 0 {
+        return "no_session_key", errors.New("no signing key for this session")
+    }
+
+    body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, max))
+    if err != nil {
+        return "read_error", fmt.Errorf("reading body: %w", err)
+    }
+    r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+    mac := hmac.New(sha256.New, key)
+    mac.Write(body)
+    if !hmac.Equal(mac.Sum(nil), signature) {
+        return "bad_signature", errors.New("signature doesn't match payload")
+    }
+    return "", nil
+}
+
+// DeriveSessionKey gives each session its own signing key without us having
+// to store any: the server can always re-derive it from the session ID.
+func DeriveSessionKey(secret []byte, sessionID string) []byte {
+    mac := hmac.New(sha256.New, secret)
+    mac.Write([]byte("event-signing:" + sessionID))
+    return mac.Sum(nil)
+}
+
+// For our own debugging and support endpoints, which want a shared secret
+// rather than anything browser-facing. An empty token lets nobody in.
+func bearerTokenOK(r *http.Request, token string) bool {
+    got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+    return token != "" && subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+}
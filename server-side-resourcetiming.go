@@ -0,0 +1,217 @@
+// page-load only carries a resource count and the sizes of a couple of tracked
+// assets, which isn't enough to tell which CDN (or which third-party script)
+// is slowing pages down. The browser can also post its whole ResourceTiming
+// buffer as a `resource-timing` event, with the entries in a `resources`
+// array. ResourceTimings explodes that array into child events in the same
+// trace as the page-load, either one `resource` event per entry, or (the
+// default, since a page can easily load a few hundred assets) one
+// `resource-summary` event per domain and initiator type.
+//
+//     timings := &ResourceTimings{PerResource: true}
+//     timings.Register(handler)
+//
+// The resource-timing event itself is still sent, with the raw array swapped
+// for `resource_count` and `resource_transfer_size_b` totals. Children copy
+// its fields (user, session, url_route and so on), dataset, client and sample
+// rate, so they're sampled and routed as a unit.
+type ResourceTimings struct {
+    PerResource  bool // One child per resource rather than per domain/type
+    MaxResources int  // Children per page in PerResource mode; defaults to 150
+
+    h *UserEventsHandler
+}
+
+func (t *ResourceTimings) Register(h *UserEventsHandler) {
+    t.h = h
+    h.On("resource-timing", t.explode)
+}
+
+// What we read out of each PerformanceResourceTiming entry. The browser sends
+// them as-is (times relative to time_origin), so these are its field names.
+type resourceEntry struct {
+    url            string
+    domain         string
+    initiatorType  string
+    protocol       string
+    renderBlocking string
+    startTime      float64
+    duration       float64
+    ttfb           float64
+    transferSize   float64
+    encodedSize    float64
+    decodedSize    float64
+}
+
+func (t *ResourceTimings) explode(ev *Event) error {
+    fields := ev.Fields()
+    raw, _ := fields["resources"].([]interface{})
+    delete(fields, "resources")
+
+    entries := make([]resourceEntry, 0, len(raw))
+    var transferred float64
+    for _, item := range raw {
+        if entry, ok := parseResourceEntry(item); ok {
+            entries = append(entries, entry)
+            transferred += entry.transferSize
+        }
+    }
+    fields["resource_count"] = len(entries)
+    fields["resource_transfer_size_b"] = transferred
+    if len(entries) == 0 {
+        return nil
+    }
+
+    // Entry times are relative to when the page started loading. Without a
+    // time origin we just stamp children with the parent's time.
+    origin, hasOrigin := parseClientTime(fields["time_origin"])
+    if skew, ok := fields["clock_skew_ms"].(int64); ok && hasOrigin {
+        origin = origin.Add(time.Duration(skew) * time.Millisecond)
+    }
+    startOf := func(offsetMs float64) time.Time {
+        if !hasOrigin {
+            return ev.Timestamp
+        }
+        return origin.Add(time.Duration(offsetMs * float64(time.Millisecond)))
+    }
+
+    if t.PerResource {
+        if len(entries) > t.maxResources() {
+            // Keep the slowest, since those are the ones worth looking at
+            sort.Slice(entries, func(i, j int) bool { return entries[i].duration > entries[j].duration })
+            entries = entries[:t.maxResources()]
+            fields["resource_children_truncated"] = true
+        }
+        for _, entry := range entries {
+            child := t.child(ev, "resource", startOf(entry.startTime))
+            child.AddField("resource_url", entry.url)
+            child.AddField("resource_domain", entry.domain)
+            child.AddField("resource_initiator_type", entry.initiatorType)
+            child.AddField("duration_ms", entry.duration)
+            child.AddField("resource_ttfb_ms", entry.ttfb)
+            child.AddField("resource_transfer_size_b", entry.transferSize)
+            child.AddField("resource_encoded_size_b", entry.encodedSize)
+            child.AddField("resource_decoded_size_b", entry.decodedSize)
+            child.AddField("resource_cache_hit", entry.cacheHit())
+            if entry.protocol != "" {
+                child.AddField("resource_protocol", entry.protocol)
+            }
+            if entry.renderBlocking != "" {
+                child.AddField("resource_render_blocking", entry.renderBlocking == "blocking")
+            }
+            t.h.send(context.Background(), child)
+        }
+        return nil
+    }
+
+    type summaryKey struct{ domain, initiatorType string }
+    groups := make(map[summaryKey][]resourceEntry)
+    for _, entry := range entries {
+        key := summaryKey{entry.domain, entry.initiatorType}
+        groups[key] = append(groups[key], entry)
+    }
+    for key, group := range groups {
+        first := group[0].startTime
+        durations := make([]float64, len(group))
+        var transfer, decoded float64
+        var cacheHits int
+        for i, entry := range group {
+            durations[i] = entry.duration
+            transfer += entry.transferSize
+            decoded += entry.decodedSize
+            if entry.cacheHit() {
+                cacheHits++
+            }
+            if entry.startTime < first {
+                first = entry.startTime
+            }
+        }
+        sort.Float64s(durations)
+
+        child := t.child(ev, "resource-summary", startOf(first))
+        child.AddField("resource_domain", key.domain)
+        child.AddField("resource_initiator_type", key.initiatorType)
+        child.AddField("resource_count", len(group))
+        child.AddField("resource_duration_ms_p50", percentile(durations, 0.50))
+        child.AddField("resource_duration_ms_p95", percentile(durations, 0.95))
+        child.AddField("resource_duration_ms_max", durations[len(durations)-1])
+        child.AddField("resource_transfer_size_b", transfer)
+        child.AddField("resource_decoded_size_b", decoded)
+        child.AddField("resource_cache_hit_ratio", float64(cacheHits)/float64(len(group)))
+        t.h.send(context.Background(), child)
+    }
+    return nil
+}
+
+// A child span of the resource-timing event, so it shows up under the page
+// view in the trace waterfall
+func (t *ResourceTimings) child(parent *Event, eventType string, start time.Time) *Event {
+    child := &Event{
+        Type:       eventType,
+        Dataset:    parent.Dataset,
+        Timestamp:  start,
+        SampleRate: parent.SampleRate,
+        Client:     parent.Client,
+    }
+    for name, value := range parent.Fields() {
+        switch name {
+        case "trace.span_id", "trace.parent_id", "event_id", "resource_count", "resource_transfer_size_b", "resource_children_truncated":
+            continue
+        }
+        child.AddField(name, value)
+    }
+    child.AddField("type", eventType)
+    if spanID, ok := parent.Fields()["trace.span_id"].(string); ok {
+        child.AddField("trace.parent_id", spanID)
+        child.AddField("trace.span_id", newSpanID())
+    }
+    return child
+}
+
+func (t *ResourceTimings) maxResources() int {
+    if t.MaxResources > 0 {
+        return t.MaxResources
+    }
+    return 150
+}
+
+func parseResourceEntry(item interface{}) (resourceEntry, bool) {
+    m, ok := item.(map[string]interface{})
+    if !ok {
+        return resourceEntry{}, false
+    }
+    name, _ := m["name"].(string)
+    u, err := url.Parse(name)
+    if err != nil || name == "" {
+        return resourceEntry{}, false
+    }
+    number := func(key string) float64 {
+        n, _ := m[key].(float64)
+        return n
+    }
+    entry := resourceEntry{
+        url:          stripQuery(name), // Asset URLs can carry signed tokens
+        domain:       u.Hostname(),
+        startTime:    number("startTime"),
+        duration:     number("duration"),
+        transferSize: number("transferSize"),
+        encodedSize:  number("encodedBodySize"),
+        decodedSize:  number("decodedBodySize"),
+    }
+    entry.initiatorType, _ = m["initiatorType"].(string)
+    entry.protocol, _ = m["nextHopProtocol"].(string)
+    entry.renderBlocking, _ = m["renderBlockingStatus"].(string)
+    if start, end := number("requestStart"), number("responseStart"); start > 0 && end >= start {
+        entry.ttfb = end - start
+    }
+    if entry.domain == "" {
+        entry.domain = "(same-origin)"
+    }
+    return entry, true
+}
+
+// Served from the browser's cache: nothing came over the wire, but there was
+// a body. (Cross-origin resources without Timing-Allow-Origin report zero for
+// both, so they never count as hits.)
+func (e resourceEntry) cacheHit() bool {
+    return e.transferSize == 0 && e.decodedSize > 0
+}
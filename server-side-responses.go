@@ -0,0 +1,99 @@
+// libhoney reports how every send went on each client's responses channel.
+// WatchResponses is the one place that reads them (a channel can only have one
+// reader), and hands each response to anything that cares: our metrics, the
+// circuit breaker, the dead letter queue, admission control, delivery timing,
+// and OnResponse.
+// Run it for as long as the handler is sending events.
+func (h *UserEventsHandler) WatchResponses(ctx context.Context) {
+    var wg sync.WaitGroup
+    for name, client := range h.allClients() {
+        wg.Add(1)
+        go func(name string, responses chan transmission.Response) {
+            defer wg.Done()
+            h.watchClient(ctx, name, responses)
+        }(name, client.TxResponses())
+    }
+    wg.Wait()
+}
+
+// Reads one client's responses until ctx is done or the client is closed
+func (h *UserEventsHandler) watchClient(ctx context.Context, name string, responses chan transmission.Response) {
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case resp, ok := <-responses:
+            if !ok {
+                return
+            }
+            h.handleResponse(name, resp)
+        }
+    }
+}
+
+func (h *UserEventsHandler) handleResponse(client string, resp transmission.Response) {
+    observeResponse(resp)
+    recordSendOutcome(resp)
+    outcome := classifyResponse(resp)
+    sendOutcomes.WithLabelValues(client, outcome.String()).Inc()
+    if h.OnResponse != nil {
+        h.OnResponse(client, outcome, resp)
+    }
+    if h.Breaker != nil {
+        h.Breaker.record(h.logger(), client, resp)
+    }
+    if h.DeadLetters != nil {
+        h.DeadLetters.handleResponse(h, resp)
+    }
+    if h.Admission != nil {
+        h.Admission.record(resp)
+    }
+    if h.Delivery != nil {
+        h.Delivery.handleResponse(h, resp)
+    }
+}
+
+// SendOutcome is what became of one event we sent, going by libhoney's
+// response for it
+type SendOutcome int
+
+const (
+    SendAccepted     SendOutcome = iota // Honeycomb took it
+    SendRateLimited                     // 429: we're over our Honeycomb quota or throughput limit
+    SendRejected                        // Any other 4xx: Honeycomb didn't like the event (or our API key)
+    SendServerError                     // 5xx
+    SendNetworkError                    // We never got an HTTP response at all
+)
+
+func (o SendOutcome) String() string {
+    switch o {
+    case SendAccepted:
+        return "accepted"
+    case SendRateLimited:
+        return "rate_limited"
+    case SendRejected:
+        return "rejected"
+    case SendServerError:
+        return "server_error"
+    }
+    return "network_error"
+}
+
+var sendOutcomes = promauto.NewCounterVec(prometheus.CounterOpts{
+    Name: "user_events_send_outcomes_total",
+    Help: "What became of events sent to Honeycomb, by client and outcome.",
+}, []string{"client", "outcome"})
+
+func classifyResponse(resp transmission.Response) SendOutcome {
+    switch {
+    case resp.Err != nil:
+        return SendNetworkError
+    case resp.StatusCode == http.StatusTooManyRequests:
+        return SendRateLimited
+    case resp.StatusCode >= 500:
+        return SendServerError
+    case resp.StatusCode >= 400:
+        return SendRejected
+    }
+    return SendAccepted
+}
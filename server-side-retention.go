@@ -0,0 +1,117 @@
+// Not every field can be kept as long as every other. Compliance wants raw
+// URLs (with whatever ended up in their query strings) gone after 30 days, and
+// the performance team wants a year of Web Vitals; a dataset only has one
+// retention period. RetentionPolicy tags fields with a retention class, and
+// splits each event up by class just before it's sent:
+//
+//     retention:
+//       fields: {page_url: ephemeral, "query.*": ephemeral, lcp: long-term, cls: long-term}
+//       long_term_dataset: user-events-archive
+//       ephemeral_dataset: user-events-30d
+//
+// What each class means:
+//
+//     ephemeral  stripped from the event, and sent to EphemeralDataset if there is one
+//     standard   sent with the event, as usual (any field that isn't tagged)
+//     long-term  sent with the event, and to LongTermDataset too
+//
+// So set the datasets' retention in Honeycomb to match. Ephemeral fields
+// are only stripped once everything derived from them is done: the
+// enrichers (derived fields, URL normalization, GeoIP) and processors have
+// run, and the event's been flattened, so page_path and url_route survive
+// page_url. That's as it's sent, so it covers the events we make ourselves
+// (heartbeat rollups, session summaries, and the like) too. Field names
+// are exact, or path.Match globs. The copies going to the other datasets
+// keep the event's type and timestamp, and its event, session, and trace
+// IDs, so they can be joined back up.
+type RetentionPolicy struct {
+    Fields           map[string]RetentionClass `yaml:"fields"`
+    LongTermDataset  string                    `yaml:"long_term_dataset"`
+    EphemeralDataset string                    `yaml:"ephemeral_dataset"`
+}
+
+type RetentionClass string
+
+const (
+    RetentionEphemeral RetentionClass = "ephemeral"
+    RetentionStandard  RetentionClass = "standard"
+    RetentionLongTerm  RetentionClass = "long-term"
+)
+
+// Copied to the other datasets' events, unless the policy says they're
+// ephemeral themselves
+var retentionJoinFields = []string{"event_id", "session_id", "trace.trace_id", "trace.span_id"}
+
+func (p *RetentionPolicy) validate() error {
+    for name, class := range p.Fields {
+        switch class {
+        case RetentionEphemeral, RetentionStandard, RetentionLongTerm:
+        default:
+            return fmt.Errorf("retention: field %s has unknown class %q (want ephemeral, standard, or long-term)", name, class)
+        }
+        if _, err := path.Match(name, ""); err != nil {
+            return fmt.Errorf("retention: field %s: %v", name, err)
+        }
+    }
+    return nil
+}
+
+func (p *RetentionPolicy) classOf(field string) RetentionClass {
+    if class, ok := p.Fields[field]; ok {
+        return class
+    }
+    for pattern, class := range p.Fields {
+        if matched, _ := path.Match(pattern, field); matched {
+            return class
+        }
+    }
+    return RetentionStandard
+}
+
+// Strips ev's ephemeral fields, returning the events to send to the other
+// datasets alongside it, if any
+func (p *RetentionPolicy) apply(ev *Event, tenant *Tenant) []*Event {
+    var ephemeral, longTerm *Event
+    split := func(dataset string) *Event {
+        if tenant != nil {
+            dataset = tenant.DatasetPrefix + dataset
+        }
+        return &Event{Type: ev.Type, Dataset: dataset, Timestamp: ev.Timestamp, SampleRate: ev.SampleRate, Client: ev.Client, tenant: ev.tenant, fields: map[string]interface{}{"type": ev.Type}}
+    }
+    fields := ev.Fields()
+    for name, value := range fields {
+        switch p.classOf(name) {
+        case RetentionEphemeral:
+            delete(fields, name)
+            if p.EphemeralDataset == "" {
+                continue
+            }
+            if ephemeral == nil {
+                ephemeral = split(p.EphemeralDataset)
+            }
+            ephemeral.fields[name] = value
+        case RetentionLongTerm:
+            if p.LongTermDataset == "" {
+                continue
+            }
+            if longTerm == nil {
+                longTerm = split(p.LongTermDataset)
+            }
+            longTerm.fields[name] = value
+        }
+    }
+
+    var events []*Event
+    for _, split := range []*Event{ephemeral, longTerm} {
+        if split == nil {
+            continue
+        }
+        for _, name := range retentionJoinFields {
+            if value, ok := fields[name]; ok {
+                split.fields[name] = value
+            }
+        }
+        events = append(events, split)
+    }
+    return events
+}
@@ -0,0 +1,82 @@
+// libhoney's responses tell us Honeycomb rate limited a batch, but not how
+// long it asked us to wait: the response headers are gone by then.
+// RetryAfterTransport sits under libhoney's HTTP client to catch them, and
+// remembers each dataset's Retry-After so the DeadLetterQueue can honor it.
+//
+//     retryAfter := &RetryAfterTransport{}
+//     client, _ := libhoney.NewClient(libhoney.ClientConfig{
+//         APIKey:       apiKey,
+//         Transmission: &transmission.Honeycomb{MaxBatchSize: 50, BatchTimeout: time.Second, Transport: retryAfter},
+//     })
+//     handler.DeadLetters = &DeadLetterQueue{RetryAfter: retryAfter}
+type RetryAfterTransport struct {
+    Next http.RoundTripper // Defaults to http.DefaultTransport
+
+    mu    sync.Mutex
+    until map[string]time.Time // Dataset -> when we can send again
+}
+
+// Honeycomb shouldn't ask for more than this, but a bad header shouldn't
+// park events for a week either
+const maxRetryAfter = 10 * time.Minute
+
+func (t *RetryAfterTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+    next := t.Next
+    if next == nil {
+        next = http.DefaultTransport
+    }
+    resp, err := next.RoundTrip(req)
+    if err != nil {
+        return resp, err
+    }
+    if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+        if wait, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+            t.mu.Lock()
+            if t.until == nil {
+                t.until = make(map[string]time.Time)
+            }
+            t.until[batchDataset(req.URL)] = time.Now().Add(wait)
+            t.mu.Unlock()
+        }
+    }
+    return resp, nil
+}
+
+// Until is when Honeycomb last said we could send to dataset again; the zero
+// time if it never asked us to wait.
+func (t *RetryAfterTransport) Until(dataset string) time.Time {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    return t.until[dataset]
+}
+
+// libhoney posts to /1/batch/<dataset>
+func batchDataset(u *url.URL) string {
+    dataset, err := url.PathUnescape(path.Base(u.EscapedPath()))
+    if err != nil {
+        return path.Base(u.Path)
+    }
+    return dataset
+}
+
+// Retry-After is either a number of seconds or an HTTP date
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+    if value == "" {
+        return 0, false
+    }
+    var wait time.Duration
+    if seconds, err := strconv.Atoi(value); err == nil {
+        wait = time.Duration(seconds) * time.Second
+    } else if at, err := http.ParseTime(value); err == nil {
+        wait = at.Sub(now)
+    } else {
+        return 0, false
+    }
+    if wait <= 0 {
+        return 0, false
+    }
+    if wait > maxRetryAfter {
+        wait = maxRetryAfter
+    }
+    return wait, true
+}
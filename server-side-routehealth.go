@@ -0,0 +1,196 @@
+// When a route is having a bad time (error rate or p95 way up on what's
+// normal for it), triage queries want to look at just the events from while
+// it was. RouteHealth asks Honeycomb's Query Data API every Interval how each
+// url_route is doing over the last Window compared with the last Baseline,
+// caches the answer, and tags events for degraded routes with
+// `route_currently_degraded` (and `route_degraded_reason`). Events for other
+// routes get route_currently_degraded=false, so it's filterable either way.
+//
+//     health := &RouteHealth{APIKey: os.Getenv("HONEYCOMB_QUERY_KEY"), Dataset: "user-events", ErrorDataset: "browser-errors"}
+//     go health.Run(ctx, handler)
+//     handler.Enrichers = append(handler.Enrichers, health) // After the URLNormalizer
+//
+// The Query Data API needs a key with query permissions, and is rate limited,
+// so keep Interval at a few minutes. Until the first refresh finishes (or if
+// they start failing), nothing is tagged.
+type RouteHealth struct {
+    APIKey       string
+    APIHost      string // Defaults to https://api.honeycomb.io
+    Dataset      string // Where the page-loads are
+    ErrorDataset string // Where the errors are; no error rates without it
+
+    LatencyColumn string        // Defaults to "duration_ms"
+    Window        time.Duration // Defaults to 15 minutes
+    Baseline      time.Duration // Defaults to 24 hours
+    Interval      time.Duration // Defaults to 5 minutes
+
+    // A route is degraded once its p95 or error rate is this many times its
+    // baseline. Defaults to 2.
+    Factor float64
+    // ...and its error rate is at least this, so one error on a quiet route
+    // doesn't count. Defaults to 0.01.
+    MinErrorRate float64
+
+    HTTPClient *http.Client // Defaults to one with a 30 second timeout
+
+    degraded atomic.Value // map[string]string, route -> reason
+}
+
+// One row of query results, broken down by url_route
+type routeStats struct {
+    count float64
+    p95   float64
+}
+
+func (rh *RouteHealth) Enrich(ctx context.Context, ev *Event, r *http.Request, user *UserInfo) error {
+    degraded, ok := rh.degraded.Load().(map[string]string)
+    if !ok {
+        return nil
+    }
+    route, _ := ev.Fields()["url_route"].(string)
+    if route == "" {
+        return nil
+    }
+    reason, isDegraded := degraded[route]
+    ev.AddField("route_currently_degraded", isDegraded)
+    if isDegraded {
+        ev.AddField("route_degraded_reason", reason)
+    }
+    return nil
+}
+
+// Run refreshes the degraded routes every Interval until ctx is done.
+func (rh *RouteHealth) Run(ctx context.Context, h *UserEventsHandler) {
+    interval := rh.Interval
+    if interval <= 0 {
+        interval = 5 * time.Minute
+    }
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+    for {
+        if err := rh.refresh(ctx); err != nil && ctx.Err() == nil {
+            h.logger().Warn("couldn't refresh route health", "error", err)
+        }
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+        }
+    }
+}
+
+func (rh *RouteHealth) refresh(ctx context.Context) error {
+    window, baseline := rh.Window, rh.Baseline
+    if window <= 0 {
+        window = 15 * time.Minute
+    }
+    if baseline <= 0 {
+        baseline = 24 * time.Hour
+    }
+    column := rh.LatencyColumn
+    if column == "" {
+        column = "duration_ms"
+    }
+    factor, minErrorRate := rh.Factor, rh.MinErrorRate
+    if factor <= 0 {
+        factor = 2
+    }
+    if minErrorRate <= 0 {
+        minErrorRate = 0.01
+    }
+
+    current, err := rh.routeStats(ctx, rh.Dataset, window, column)
+    if err != nil {
+        return err
+    }
+    normal, err := rh.routeStats(ctx, rh.Dataset, baseline, column)
+    if err != nil {
+        return err
+    }
+    var currentErrors, normalErrors map[string]routeStats
+    if rh.ErrorDataset != "" {
+        if currentErrors, err = rh.routeStats(ctx, rh.ErrorDataset, window, ""); err != nil {
+            return err
+        }
+        if normalErrors, err = rh.routeStats(ctx, rh.ErrorDataset, baseline, ""); err != nil {
+            return err
+        }
+    }
+
+    degraded := make(map[string]string)
+    for route, now := range current {
+        before, ok := normal[route]
+        if !ok || now.count == 0 || before.count == 0 {
+            continue // A brand new route has nothing to compare with
+        }
+        if before.p95 > 0 && now.p95 >= factor*before.p95 {
+            degraded[route] = "p95"
+        }
+        errorRate := currentErrors[route].count / now.count
+        normalRate := normalErrors[route].count / before.count
+        if errorRate >= minErrorRate && errorRate >= factor*normalRate {
+            degraded[route] = "error_rate"
+        }
+    }
+    rh.degraded.Store(degraded)
+    return nil
+}
+
+// Runs a COUNT (and P95 of column, if there is one) by url_route over the
+// last timeRange, and waits for the results
+func (rh *RouteHealth) routeStats(ctx context.Context, dataset string, timeRange time.Duration, column string) (map[string]routeStats, error) {
+    calculations := []map[string]string{{"op": "COUNT"}}
+    if column != "" {
+        calculations = append(calculations, map[string]string{"op": "P95", "column": column})
+    }
+    var query struct {
+        ID string `json:"id"`
+    }
+    err := rh.call(ctx, http.MethodPost, "/1/queries/"+url.PathEscape(dataset), map[string]interface{}{
+        "breakdowns":   []string{"url_route"},
+        "calculations": calculations,
+        "time_range":   int(timeRange.Seconds()),
+    }, &query)
+    if err != nil {
+        return nil, err
+    }
+
+    var result struct {
+        ID       string `json:"id"`
+        Complete bool   `json:"complete"`
+        Data     struct {
+            Results []struct {
+                Data map[string]interface{} `json:"data"`
+            } `json:"results"`
+        } `json:"data"`
+    }
+    if err := rh.call(ctx, http.MethodPost, "/1/query_results/"+url.PathEscape(dataset), map[string]interface{}{"query_id": query.ID}, &result); err != nil {
+        return nil, err
+    }
+    for attempt := 0; !result.Complete; attempt++ {
+        if attempt >= 30 {
+            return nil, fmt.Errorf("query on %s didn't finish", dataset)
+        }
+        select {
+        case <-ctx.Done():
+            return nil, ctx.Err()
+        case <-time.After(time.Second):
+        }
+        if err := rh.call(ctx, http.MethodGet, "/1/query_results/"+url.PathEscape(dataset)+"/"+url.PathEscape(result.ID), nil, &result); err != nil {
+            return nil, err
+        }
+    }
+
+    stats := make(map[string]routeStats, len(result.Data.Results))
+    for _, row := range result.Data.Results {
+        route, _ := row.Data["url_route"].(string)
+        count, _ := row.Data["COUNT"].(float64)
+        p95, _ := row.Data["P95("+column+")"].(float64)
+        stats[route] = routeStats{count: count, p95: p95}
+    }
+    return stats, nil
+}
+
+func (rh *RouteHealth) call(ctx context.Context, method, path string, body, out interface{}) error {
+    return honeycombAPI(ctx, rh.HTTPClient, rh.APIHost, rh.APIKey, method, path, body, out)
+}
@@ -0,0 +1,50 @@
+// Where events land if nobody has configured anything else
+const defaultDataset = "user-events"
+
+// Some event types want their own dataset even when nobody's configured one,
+// e.g. errors have different retention and boards from perf stats
+var builtinDatasets = map[string]string{
+    errorEventType: "browser-errors",
+}
+
+// DatasetRoutes decides which Honeycomb dataset each type of event is sent to,
+// so page-loads, errors, and custom business events can each have their own
+// retention and boards.
+type DatasetRoutes struct {
+    Default string            // Dataset for any other event type (errors still go to "browser-errors")
+    ByType  map[string]string // Event type (e.g. "page-load") -> dataset name
+}
+
+func (d DatasetRoutes) datasetFor(eventType string) string {
+    if dataset, ok := d.ByType[eventType]; ok && dataset != "" {
+        return dataset
+    }
+    if dataset, ok := builtinDatasets[eventType]; ok {
+        return dataset
+    }
+    if d.Default != "" {
+        return d.Default
+    }
+    return defaultDataset
+}
+
+// Every dataset these routes can send to, without duplicates
+func (d DatasetRoutes) all() []string {
+    seen := map[string]bool{}
+    var all []string
+    add := func(name string) {
+        if name != "" && !seen[name] {
+            seen[name] = true
+            all = append(all, name)
+        }
+    }
+    add(d.datasetFor(""))
+    for _, name := range d.ByType {
+        add(name)
+    }
+    for _, name := range builtinDatasets {
+        add(name)
+    }
+    sort.Strings(all)
+    return all
+}
@@ -0,0 +1,92 @@
+// High-traffic pages send a page-load for every single view, which blows
+// through our event quota without telling us anything new. A Sampler picks a
+// sample rate per event: a rate of N means we keep roughly 1 in N events, and
+// Honeycomb multiplies the ones we do keep back up by N so counts stay correct.
+type Sampler interface {
+    SampleRate(eventType string, metadata map[string]interface{}) uint
+}
+
+// StaticSampler keeps 1 in every N events, regardless of what's in them.
+type StaticSampler uint
+
+func (s StaticSampler) SampleRate(eventType string, metadata map[string]interface{}) uint {
+    if s < 1 {
+        return 1
+    }
+    return uint(s)
+}
+
+// SamplersByType lets each event type have its own sampler, e.g. keep every
+// error but dynamically sample page-loads. Types without an entry use Default,
+// or aren't sampled at all if Default is nil.
+type SamplersByType struct {
+    Default Sampler
+    ByType  map[string]Sampler
+}
+
+func (s SamplersByType) SampleRate(eventType string, metadata map[string]interface{}) uint {
+    if sampler, ok := s.ByType[eventType]; ok {
+        return sampler.SampleRate(eventType, metadata)
+    }
+    if s.Default != nil {
+        return s.Default.SampleRate(eventType, metadata)
+    }
+    return 1
+}
+
+// DynamicSampler hands a key built from the event type and a few fields (e.g.
+// "url_path" and "status") to one of dynsampler-go's samplers, which then keeps
+// rare keys at a low sample rate and heavily samples the really common ones.
+// The Sampler must already have been started.
+type DynamicSampler struct {
+    Fields  []string
+    Sampler dynsampler.Sampler
+}
+
+func NewDynamicSampler(goalSampleRate int, fields ...string) (*DynamicSampler, error) {
+    sampler := &dynsampler.AvgSampleRate{
+        ClearFrequencySec: 30,
+        GoalSampleRate:    goalSampleRate,
+    }
+    if err := sampler.Start(); err != nil {
+        return nil, err
+    }
+    return &DynamicSampler{Fields: fields, Sampler: sampler}, nil
+}
+
+func (s *DynamicSampler) SampleRate(eventType string, metadata map[string]interface{}) uint {
+    rate := s.Sampler.GetSampleRate(sampleKey(eventType, s.Fields, metadata))
+    if rate < 1 {
+        return 1
+    }
+    return uint(rate)
+}
+
+// e.g. "page-load|/checkout|200"
+func sampleKey(eventType string, fields []string, metadata map[string]interface{}) string {
+    key := make([]string, 0, len(fields)+1)
+    key = append(key, eventType)
+    for _, field := range fields {
+        key = append(key, fmt.Sprint(metadata[field]))
+    }
+    return strings.Join(key, "|")
+}
+
+// Decides whether to keep this event, returning the rate it was sampled at so
+// we can record it on the event.
+func (h *UserEventsHandler) sample(eventType string, metadata map[string]interface{}) (keep bool, rate uint) {
+    rate = 1
+    if override, ok := h.Admin.sampleRate(eventType); ok {
+        rate = override
+    } else if h.Sampler != nil {
+        rate = h.Sampler.SampleRate(eventType, metadata)
+    }
+    if rate < 1 {
+        rate = 1
+    }
+    rate *= h.Admission.multiplierFor(eventType, h.priority(eventType))
+    if rate <= 1 {
+        return true, 1
+    }
+    return rand.Intn(int(rate)) == 0, rate
+}
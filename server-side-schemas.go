@@ -0,0 +1,123 @@
+// Broken client builds send broken events: a missing field here, a number
+// sent as a string there. A SchemaRegistry describes what each event type
+// should look like, so we can turn those away before they pollute a dataset.
+// Event types without a registered schema aren't checked, other than the
+// ones we have built-in schemas for (see interactivitySchemas).
+type SchemaRegistry struct {
+    Schemas map[string]EventSchema // Event type -> schema
+
+    // If set, events that fail validation are still sent here (with the
+    // problems attached as "validation_error") so we can debug which client
+    // versions are sending them. A tenant's go to its own prefixed copy.
+    MalformedDataset string
+}
+
+// EventSchema maps field names to the rules for that field. Fields not in the
+// schema are allowed through unchecked.
+type EventSchema map[string]FieldSchema
+
+type FieldType int
+
+const (
+    AnyType FieldType = iota
+    StringType
+    NumberType
+    BoolType
+)
+
+type FieldSchema struct {
+    Type      FieldType
+    Required  bool
+    MaxLength int // For strings; 0 means no limit
+}
+
+// ValidationError lists everything wrong with an event, not just the first
+// problem, since fixing a client one field at a time is no fun.
+type ValidationError struct {
+    EventType string
+    Problems  []string
+}
+
+func (e *ValidationError) Error() string {
+    return fmt.Sprintf("invalid %q event: %s", e.EventType, strings.Join(e.Problems, "; "))
+}
+
+func (s *SchemaRegistry) Validate(eventType string, metadata map[string]interface{}) error {
+    schema, ok := s.schemaFor(eventType)
+    if !ok {
+        return nil
+    }
+
+    var problems []string
+    for name, field := range schema {
+        value, present := metadata[name]
+        if !present || value == nil {
+            if field.Required {
+                problems = append(problems, fmt.Sprintf("%s is required", name))
+            }
+            continue
+        }
+        if problem := field.check(value); problem != "" {
+            problems = append(problems, fmt.Sprintf("%s %s", name, problem))
+        }
+    }
+    if len(problems) == 0 {
+        return nil
+    }
+    sort.Strings(problems) // Map order is random; keep error messages stable
+    return &ValidationError{EventType: eventType, Problems: problems}
+}
+
+// Registered schemas take precedence over the built-in ones. s may be nil.
+func (s *SchemaRegistry) schemaFor(eventType string) (EventSchema, bool) {
+    if s != nil {
+        if schema, ok := s.Schemas[eventType]; ok {
+            return schema, true
+        }
+    }
+    schema, ok := interactivitySchemas[eventType]
+    return schema, ok
+}
+
+func (f FieldSchema) check(value interface{}) string {
+    switch f.Type {
+    case StringType:
+        str, ok := value.(string)
+        if !ok {
+            return fmt.Sprintf("must be a string, got %T", value)
+        }
+        if f.MaxLength > 0 && len(str) > f.MaxLength {
+            return fmt.Sprintf("must be at most %d characters, got %d", f.MaxLength, len(str))
+        }
+    case NumberType:
+        if _, ok := value.(float64); !ok {
+            return fmt.Sprintf("must be a number, got %T", value)
+        }
+    case BoolType:
+        if _, ok := value.(bool); !ok {
+            return fmt.Sprintf("must be a boolean, got %T", value)
+        }
+    }
+    return ""
+}
+
+// Sends an event that failed validation to the malformed events dataset, with
+// the same server-side fields as a regular event so we can tell which browsers
+// and users are affected.
+func (h *UserEventsHandler) sendMalformed(ctx context.Context, eventType string, metadata map[string]interface{}, validationErr error, r *http.Request, user *UserInfo) {
+    if h.Schemas == nil || h.Schemas.MalformedDataset == "" {
+        return
+    }
+    ev := h.newEvent(eventType, metadata, r)
+    ev.Dataset = h.Schemas.MalformedDataset
+    if ev.tenant != nil {
+        ev.Dataset = ev.tenant.DatasetPrefix + ev.Dataset
+    }
+    ev.Add(metadata)
+    if ev.tenant != nil {
+        ev.AddField("tenant", ev.tenant.Name) // Whatever the browser said
+    }
+    ev.AddField("validation_error", validationErr.Error())
+    h.enrich(ctx, ev, eventType, r, user)
+    h.send(ctx, ev)
+}
@@ -0,0 +1,221 @@
+// Ad blockers and strict third-party script policies block the Honeycomb
+// browser SDK when it loads from a CDN, and then there's no telemetry from
+// those users at all, and no error to tell us. ScriptProxy serves the SDK
+// (and our wrapper) from our own origin instead, checking each script against
+// its Subresource Integrity hash before it'll serve it:
+//
+//     scripts := &ScriptProxy{Scripts: map[string]ProxiedScript{
+//         "sdk.js": {
+//             URL:       "https://unpkg.com/@honeycombio/opentelemetry-web@0.9.0/dist/index.js",
+//             Integrity: "sha384-...",
+//         },
+//         "wrapper.js": {Path: "static/user-events.js"},
+//     }, Logger: handler.Logger}
+//     if err := scripts.Load(ctx); err != nil {
+//         log.Fatal(err)
+//     }
+//     mux.Handle("/assets/", http.StripPrefix("/assets/", scripts))
+//
+// A script from a URL has to have an Integrity, which pins it to exactly
+// those bytes: a CDN serving anything else (a new release behind a moving
+// tag, or a compromised package) is refused rather than served. A local
+// script's hash is worked out when it's loaded. Scripts are fetched once and
+// kept in memory, and served with a long Cache-Control and an ETag; Tag gives
+// a <script> element with the matching integrity attribute, so the browser
+// checks them too.
+type ScriptProxy struct {
+    Scripts    map[string]ProxiedScript // By the name they're served as
+    MaxAge     time.Duration            // How long browsers may cache them; defaults to a day
+    HTTPClient *http.Client
+    Logger     *slog.Logger // Defaults to slog.Default(), so give it the handler's
+
+    mu     sync.RWMutex
+    loaded map[string]*loadedScript
+}
+
+type ProxiedScript struct {
+    URL       string `yaml:"url"`
+    Path      string `yaml:"path"`      // A local file, in place of URL
+    Integrity string `yaml:"integrity"` // e.g. "sha384-<base64>"; required with URL
+}
+
+type loadedScript struct {
+    body      []byte
+    integrity string
+    loadedAt  time.Time
+}
+
+var scriptLoads = promauto.NewCounterVec(prometheus.CounterOpts{
+    Name: "user_events_script_loads_total",
+    Help: "Attempts to load a proxied browser script, by script and outcome.",
+}, []string{"script", "outcome"})
+
+var sriHashes = map[string]func() hash.Hash{
+    "sha256": sha256.New,
+    "sha384": sha512.New384,
+    "sha512": sha512.New,
+}
+
+func (p *ScriptProxy) maxAge() time.Duration {
+    if p.MaxAge > 0 {
+        return p.MaxAge
+    }
+    return 24 * time.Hour
+}
+
+// Load fetches and checks every script, failing if any of them can't be
+// served. Call it at startup; scripts that aren't loaded are tried again
+// when they're first asked for.
+func (p *ScriptProxy) Load(ctx context.Context) error {
+    for name := range p.Scripts {
+        if _, err := p.script(ctx, name); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func (p *ScriptProxy) script(ctx context.Context, name string) (*loadedScript, error) {
+    p.mu.RLock()
+    loaded := p.loaded[name]
+    p.mu.RUnlock()
+    if loaded != nil {
+        return loaded, nil
+    }
+
+    spec, ok := p.Scripts[name]
+    if !ok {
+        return nil, nil
+    }
+    loaded, err := p.load(ctx, spec)
+    if err != nil {
+        scriptLoads.WithLabelValues(name, "error").Inc()
+        return nil, fmt.Errorf("script %s: %v", name, err)
+    }
+    scriptLoads.WithLabelValues(name, "loaded").Inc()
+    p.mu.Lock()
+    if p.loaded == nil {
+        p.loaded = make(map[string]*loadedScript)
+    }
+    p.loaded[name] = loaded
+    p.mu.Unlock()
+    return loaded, nil
+}
+
+func (p *ScriptProxy) load(ctx context.Context, spec ProxiedScript) (*loadedScript, error) {
+    var body []byte
+    switch {
+    case spec.Path != "":
+        raw, err := ioutil.ReadFile(spec.Path)
+        if err != nil {
+            return nil, err
+        }
+        body = raw
+    case spec.URL == "":
+        return nil, errors.New("needs a URL or a Path")
+    case spec.Integrity == "":
+        return nil, fmt.Errorf("%s has no integrity hash to check it against", spec.URL)
+    default:
+        raw, err := p.fetch(ctx, spec.URL)
+        if err != nil {
+            return nil, err
+        }
+        body = raw
+    }
+
+    integrity := spec.Integrity
+    if integrity == "" {
+        integrity = sriHash("sha384", body)
+    } else if err := checkIntegrity(integrity, body); err != nil {
+        return nil, err
+    }
+    return &loadedScript{body: body, integrity: integrity, loadedAt: time.Now()}, nil
+}
+
+func (p *ScriptProxy) fetch(ctx context.Context, scriptURL string) ([]byte, error) {
+    req, err := http.NewRequestWithContext(ctx, http.MethodGet, scriptURL, nil)
+    if err != nil {
+        return nil, err
+    }
+    client := p.HTTPClient
+    if client == nil {
+        client = http.DefaultClient
+    }
+    resp, err := client.Do(req)
+    if err != nil {
+        return nil, err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        return nil, fmt.Errorf("%s returned %s", scriptURL, resp.Status)
+    }
+    return ioutil.ReadAll(io.LimitReader(resp.Body, 10<<20))
+}
+
+func sriHash(algorithm string, body []byte) string {
+    h := sriHashes[algorithm]()
+    h.Write(body)
+    return algorithm + "-" + base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// Checks body against an integrity attribute's value, which (like the
+// browser's) can list several hashes, any of which may match
+func checkIntegrity(integrity string, body []byte) error {
+    for _, want := range strings.Fields(integrity) {
+        algorithm, _, ok := strings.Cut(want, "-")
+        if _, known := sriHashes[algorithm]; !ok || !known {
+            return fmt.Errorf("unsupported integrity hash %q", want)
+        }
+        if subtle.ConstantTimeCompare([]byte(sriHash(algorithm, body)), []byte(want)) == 1 {
+            return nil
+        }
+    }
+    return errors.New("doesn't match its integrity hash; has it changed upstream?")
+}
+
+// Tag returns a <script> element for the named script, served from prefix
+// (where ScriptProxy is mounted), with its integrity attribute.
+func (p *ScriptProxy) Tag(ctx context.Context, prefix, name string) (template.HTML, error) {
+    loaded, err := p.script(ctx, name)
+    if err != nil {
+        return "", err
+    }
+    if loaded == nil {
+        return "", fmt.Errorf("no script called %s", name)
+    }
+    return template.HTML(fmt.Sprintf(`<script src="%s" integrity="%s" crossorigin="anonymous"></script>`,
+        template.HTMLEscapeString(strings.TrimSuffix(prefix, "/")+"/"+name), template.HTMLEscapeString(loaded.integrity))), nil
+}
+
+func (p *ScriptProxy) logger() *slog.Logger {
+    if p.Logger != nil {
+        return p.Logger
+    }
+    return slog.Default()
+}
+
+func (p *ScriptProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+    if r.Method != http.MethodGet && r.Method != http.MethodHead {
+        w.Header().Set("Allow", "GET, HEAD")
+        http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+        return
+    }
+    name := strings.TrimPrefix(r.URL.Path, "/")
+    loaded, err := p.script(r.Context(), name)
+    if err != nil {
+        p.logger().Error("couldn't load proxied script", "name", name, "error", err)
+        http.Error(w, "script unavailable", http.StatusBadGateway)
+        return
+    }
+    if loaded == nil {
+        http.NotFound(w, r)
+        return
+    }
+    w.Header().Set("Content-Type", "text/javascript; charset=utf-8")
+    w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(p.maxAge().Seconds())))
+    w.Header().Set("ETag", strconv.Quote(loaded.integrity))
+    w.Header().Set("X-Content-Type-Options", "nosniff")
+    // So pages on other origins can load it with an integrity attribute
+    w.Header().Set("Access-Control-Allow-Origin", "*")
+    http.ServeContent(w, r, name, loaded.loadedAt, bytes.NewReader(loaded.body))
+}
@@ -0,0 +1,74 @@
+// We put things like user_email straight onto events, and the browser can send
+// us just about anything. A Scrubber runs over every field on the finished
+// event (browser metadata and server-added fields alike) right before it's
+// sent, and applies the first rule whose pattern matches each field name.
+type ScrubAction int
+
+const (
+    ScrubAllow      ScrubAction = iota // Leave the field alone, e.g. to exempt it from a broader rule below
+    ScrubDrop                          // Remove the field entirely
+    ScrubHash                          // Replace the value with a salted hash, so it's still groupable
+    ScrubStripQuery                    // Treat the value as a URL and drop its query string & fragment
+)
+
+type ScrubRule struct {
+    Field  string // Exact field name, or a path.Match glob like "*_token"
+    Action ScrubAction
+}
+
+type Scrubber struct {
+    Rules []ScrubRule
+
+    // Secret used to hash values for ScrubHash, so hashed emails can't be
+    // reversed by hashing a list of known addresses
+    HashSalt []byte
+}
+
+func (s *Scrubber) Scrub(fields map[string]interface{}) {
+    for name, value := range fields {
+        rule, ok := s.ruleFor(name)
+        if !ok {
+            continue
+        }
+        switch rule.Action {
+        case ScrubDrop:
+            delete(fields, name)
+        case ScrubHash:
+            fields[name] = s.hash(fmt.Sprint(value))
+        case ScrubStripQuery:
+            if str, ok := value.(string); ok {
+                fields[name] = stripQuery(str)
+            }
+        }
+    }
+}
+
+func (s *Scrubber) ruleFor(name string) (ScrubRule, bool) {
+    for _, rule := range s.Rules {
+        if rule.Field == name {
+            return rule, true
+        }
+        if matched, _ := path.Match(rule.Field, name); matched {
+            return rule, true
+        }
+    }
+    return ScrubRule{}, false
+}
+
+func (s *Scrubber) hash(value string) string {
+    mac := hmac.New(sha256.New, s.HashSalt)
+    mac.Write([]byte(value))
+    return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Anything that doesn't parse as a URL gets dropped rather than forwarded as-is,
+// since we can't tell what's in it
+func stripQuery(raw string) string {
+    u, err := url.Parse(raw)
+    if err != nil {
+        return ""
+    }
+    u.RawQuery = ""
+    u.Fragment = ""
+    return u.String()
+}
@@ -0,0 +1,202 @@
+// Rotating a Honeycomb write key used to mean updating an env var and
+// restarting every instance. KeyRotator instead fetches the key from a secrets
+// manager and re-checks it every Interval; when it changes, we start a new
+// libhoney client with the new key, swap it in for new events, and close the
+// old one in the background once the sends already using it are done, which
+// flushes whatever it still had queued (with the old key, so keep both keys
+// valid for a few minutes when rotating).
+//
+//     rotator := &KeyRotator{
+//         Source: &AWSSecret{Client: secretsmanager.NewFromConfig(awsCfg), SecretID: "honeycomb/write-key"},
+//         Config: libhoney.ClientConfig{APIHost: "https://api.honeycomb.io"},
+//     }
+//     if err := rotator.Init(ctx, handler); err != nil { ... }
+//     go rotator.Run(ctx, handler)
+//
+// Call Init before starting WatchResponses, so it sees the client Init sets
+// up. After that, Run watches each new client's responses itself.
+type KeyRotator struct {
+    Source   SecretSource
+    Client   string                // Which client's key this is; defaults to the handler's own ("default")
+    Config   libhoney.ClientConfig // Everything but the APIKey, which comes from Source
+    Interval time.Duration         // How often to re-check; defaults to 5 minutes
+
+    // OnRotate, if set, is called after each successful rotation
+    OnRotate func(client string)
+
+    mu      sync.Mutex
+    current string // The key the client is using now
+}
+
+// SecretSource fetches the current value of a secret.
+type SecretSource interface {
+    FetchSecret(ctx context.Context) (string, error)
+}
+
+var keyRotations = promauto.NewCounterVec(prometheus.CounterOpts{
+    Name: "user_events_key_rotations_total",
+    Help: "Honeycomb client key rotations, and failed attempts to check for one.",
+}, []string{"client", "result"})
+
+func (k *KeyRotator) clientName() string {
+    if k.Client != "" {
+        return k.Client
+    }
+    return defaultClientName
+}
+
+// Init fetches the key and sets up the client with it, so the handler can
+// start without a key in its environment at all.
+func (k *KeyRotator) Init(ctx context.Context, h *UserEventsHandler) error {
+    _, err := k.rotate(ctx, h)
+    return err
+}
+
+// Run re-checks the key every Interval until ctx is done.
+func (k *KeyRotator) Run(ctx context.Context, h *UserEventsHandler) {
+    interval := k.Interval
+    if interval <= 0 {
+        interval = 5 * time.Minute
+    }
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case <-ticker.C:
+        }
+
+        client, err := k.rotate(ctx, h)
+        if err != nil {
+            keyRotations.WithLabelValues(k.clientName(), "error").Inc()
+            h.logger().Error("couldn't check for a rotated Honeycomb key", "client", k.clientName(), "error", err)
+            continue
+        }
+        if client != nil {
+            go h.watchClient(ctx, k.clientName(), client.TxResponses())
+        }
+    }
+}
+
+// Swaps in a client with the latest key if it's changed, returning the new
+// client (or nil if the key hasn't changed)
+func (k *KeyRotator) rotate(ctx context.Context, h *UserEventsHandler) (*libhoney.Client, error) {
+    fetchCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+    defer cancel()
+    key, err := k.Source.FetchSecret(fetchCtx)
+    if err != nil {
+        return nil, err
+    }
+    key = strings.TrimSpace(key)
+    if key == "" {
+        return nil, errors.New("secret is empty")
+    }
+
+    k.mu.Lock()
+    defer k.mu.Unlock()
+    if key == k.current {
+        return nil, nil
+    }
+
+    config := k.Config
+    config.APIKey = key
+    client, err := libhoney.NewClient(config)
+    if err != nil {
+        return nil, err
+    }
+    old, err := h.replaceClient(k.clientName(), client)
+    if err != nil {
+        client.Close()
+        return nil, err
+    }
+    k.current = key
+    if old != nil {
+        go h.retireClient(k.clientName(), old)
+    }
+
+    keyRotations.WithLabelValues(k.clientName(), "rotated").Inc()
+    h.logger().Info("rotated Honeycomb key", "client", k.clientName())
+    if k.OnRotate != nil {
+        k.OnRotate(k.clientName())
+    }
+    return client, nil
+}
+
+// FileSecret reads the secret from a file, e.g. a Kubernetes Secret mounted
+// as a volume (which the kubelet updates in place when the Secret changes).
+type FileSecret struct {
+    Path string
+}
+
+func (s *FileSecret) FetchSecret(ctx context.Context) (string, error) {
+    raw, err := ioutil.ReadFile(s.Path)
+    return string(raw), err
+}
+
+// AWSSecret reads the secret from AWS Secrets Manager. If JSONKey is set, the
+// secret is a JSON object and the key is in that field of it.
+type AWSSecret struct {
+    Client   *secretsmanager.Client
+    SecretID string
+    JSONKey  string
+}
+
+func (s *AWSSecret) FetchSecret(ctx context.Context) (string, error) {
+    out, err := s.Client.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{SecretId: aws.String(s.SecretID)})
+    if err != nil {
+        return "", err
+    }
+    value := aws.ToString(out.SecretString)
+    if s.JSONKey == "" {
+        return value, nil
+    }
+    var fields map[string]string
+    if err := json.Unmarshal([]byte(value), &fields); err != nil {
+        return "", fmt.Errorf("secret %s isn't a JSON object: %v", s.SecretID, err)
+    }
+    return fields[s.JSONKey], nil
+}
+
+// VaultSecret reads one field of a KV v2 secret from Vault.
+type VaultSecret struct {
+    Client *vault.Client
+    Mount  string // Defaults to "secret"
+    Path   string
+    Field  string // Defaults to "api_key"
+}
+
+func (s *VaultSecret) FetchSecret(ctx context.Context) (string, error) {
+    mount, field := s.Mount, s.Field
+    if mount == "" {
+        mount = "secret"
+    }
+    if field == "" {
+        field = "api_key"
+    }
+    secret, err := s.Client.KVv2(mount).Get(ctx, s.Path)
+    if err != nil {
+        return "", err
+    }
+    value, ok := secret.Data[field].(string)
+    if !ok {
+        return "", fmt.Errorf("vault secret %s has no %q field", s.Path, field)
+    }
+    return value, nil
+}
+
+// GCPSecret reads a version of a secret from Google Cloud Secret Manager.
+// Name is the full resource name, e.g.
+// "projects/my-project/secrets/honeycomb-key/versions/latest".
+type GCPSecret struct {
+    Client *secretmanager.Client
+    Name   string
+}
+
+func (s *GCPSecret) FetchSecret(ctx context.Context) (string, error) {
+    resp, err := s.Client.AccessSecretVersion(ctx, &secretmanagerpb.AccessSecretVersionRequest{Name: s.Name})
+    if err != nil {
+        return "", err
+    }
+    return string(resp.Payload.Data), nil
+}
@@ -0,0 +1,119 @@
+// When forwarding slows down, the metrics say events are taking longer but not
+// which stage they're taking it in: decoding a big batch, a slow enricher, or
+// a sink pushing back. SelfTracing traces the handler's own pipeline, one trace
+// per ingest request, to an ops dataset of its own:
+//
+//     handler.SelfTrace = &SelfTracing{Dataset: "user-events-ops", SampleRate: 100}
+//     mux.Handle("/events/batch", handler.TracePipeline(http.HandlerFunc(handler.HandleBatch)))
+//
+// Each trace has a span for the request, with decode, and an ingest span per
+// event (with the limits and validate checks in it, and the reason if it was
+// dropped). Events that get that far have a process span too, with enrich and
+// send in it; with a Queue it starts when a worker picks the event up, so the
+// gap before it is the time spent queued. This is separate from TraceIngest,
+// which puts the browser's events into the browser's trace: these traces are
+// about us, and stay out of the browser events' datasets. Spans go straight
+// to Honeycomb, not through the handler's Sink (so not to Parquet or Kafka
+// outputs beside it), and aren't counted in Usage or kept by Timeline, Tail
+// or Recent. Every traced request makes half a dozen spans per event, so
+// only a sample of requests is traced unless SampleRate says otherwise.
+type SelfTracing struct {
+    Dataset    string `yaml:"dataset"`     // Defaults to "user-events-ops"
+    Client     string `yaml:"client"`      // The ClientRouter client to send spans with, if not Default
+    SampleRate uint   `yaml:"sample_rate"` // Trace 1 in this many requests; defaults to 100 (1 traces every one)
+}
+
+// One span of a pipeline trace. Every method is a no-op on nil, the span of
+// a request that isn't being traced, so callers needn't check.
+type pipelineSpan struct {
+    h          *UserEventsHandler
+    sampleRate uint
+    traceID    string
+    id         string
+    parentID   string
+    name       string
+    start      time.Time
+    fields     map[string]interface{}
+}
+
+type pipelineSpanKey struct{}
+
+const pipelineSpanType = "pipeline-span"
+
+func (t *SelfTracing) dataset() string {
+    if t.Dataset != "" {
+        return t.Dataset
+    }
+    return "user-events-ops"
+}
+
+func (t *SelfTracing) sampleRate() uint {
+    if t.SampleRate > 0 {
+        return t.SampleRate
+    }
+    return 100
+}
+
+// TracePipeline starts a trace for each request next handles, for
+// SelfTrace's sample of them.
+func (h *UserEventsHandler) TracePipeline(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        t := h.SelfTrace
+        if t == nil || rand.Intn(int(t.sampleRate())) != 0 {
+            next.ServeHTTP(w, r)
+            return
+        }
+        root := &pipelineSpan{h: h, sampleRate: t.sampleRate(), traceID: newTraceID(), id: newSpanID(), name: "request", start: time.Now()}
+        rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+        next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), pipelineSpanKey{}, root)))
+        root.add("http.route", r.URL.Path)
+        root.add("http.status_code", rec.status)
+        root.end()
+    })
+}
+
+// The span of the request ctx belongs to, if it's being traced
+func spanFrom(ctx context.Context) *pipelineSpan {
+    span, _ := ctx.Value(pipelineSpanKey{}).(*pipelineSpan)
+    return span
+}
+
+func (s *pipelineSpan) child(name string) *pipelineSpan {
+    if s == nil {
+        return nil
+    }
+    return &pipelineSpan{h: s.h, sampleRate: s.sampleRate, traceID: s.traceID, id: newSpanID(), parentID: s.id, name: name, start: time.Now()}
+}
+
+func (s *pipelineSpan) add(name string, value interface{}) {
+    if s == nil {
+        return
+    }
+    if s.fields == nil {
+        s.fields = make(map[string]interface{})
+    }
+    s.fields[name] = value
+}
+
+func (s *pipelineSpan) end() {
+    if s == nil || s.h.SelfTrace == nil {
+        return
+    }
+    ev := s.h.newEvent(pipelineSpanType, nil, nil)
+    ev.Dataset = s.h.SelfTrace.dataset()
+    if s.h.SelfTrace.Client != "" {
+        ev.Client = s.h.SelfTrace.Client
+    }
+    ev.Timestamp = s.start
+    ev.SampleRate = s.sampleRate
+    ev.Add(s.fields)
+    ev.AddField("name", s.name)
+    ev.AddField("service_name", "user-events")
+    ev.AddField("trace.trace_id", s.traceID)
+    ev.AddField("trace.span_id", s.id)
+    if s.parentID != "" {
+        ev.AddField("trace.parent_id", s.parentID)
+    }
+    ev.AddField("duration_ms", float64(time.Since(s.start))/float64(time.Millisecond))
+    s.h.sendDiagnostic(context.Background(), ev)
+}
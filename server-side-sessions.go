@@ -0,0 +1,241 @@
+// Stitching page-loads together into sessions is impossible in Honeycomb
+// queries unless every event says which session it belongs to. SessionTracker
+// issues a session ID cookie, stamps every event with `session_id` and
+// `session_sequence_number`, and once a session has been idle for 30 minutes
+// sends a synthetic `session-end` event summarizing it.
+//
+//     handler.Sessions = NewSessionTracker()
+//     mux.Handle("/events/batch", handler.Sessions.Middleware(...))
+//     go handler.Sessions.Run(ctx, handler)
+//
+// Session state lives in the handler's StateStore, so with a shared store a
+// session's events can hit any instance and still number up correctly. Each
+// instance watches the sessions it has seen for going idle, and whichever
+// notices first sends the session-end. Sessions nobody has ended (without
+// Run, say) are forgotten once the store has forgotten them too, and an
+// instance watches at most MaxSessions: past that, new sessions are still
+// numbered, but this instance won't end them.
+type SessionTracker struct {
+    CookieName  string        // Defaults to "hny_session"
+    IdleTimeout time.Duration // Defaults to 30 minutes
+    MaxSessions int           // Defaults to 100000
+
+    mu        sync.Mutex
+    local     map[string]*localSession // Sessions this instance has seen
+    lastSweep time.Time
+}
+
+type localSession struct {
+    userID   string
+    lastSeen time.Time
+    types    map[string]bool // So we know which per-type counts to read at the end
+    store    StateStore
+}
+
+type sessionIDKey struct{}
+
+// Sessions longer than this are vanishingly rare, and their session-end will
+// just be missing a start time
+const maxSessionLength = 24 * time.Hour
+
+// The event types a session keeps counts of; the browser picks the types, so
+// there has to be a limit
+const maxSessionTypes = 64
+
+func NewSessionTracker() *SessionTracker {
+    return &SessionTracker{local: make(map[string]*localSession)}
+}
+
+func (s *SessionTracker) cookieName() string {
+    if s.CookieName != "" {
+        return s.CookieName
+    }
+    return "hny_session"
+}
+
+func (s *SessionTracker) idleTimeout() time.Duration {
+    if s.IdleTimeout > 0 {
+        return s.IdleTimeout
+    }
+    return 30 * time.Minute
+}
+
+func (s *SessionTracker) maxSessions() int {
+    if s.MaxSessions > 0 {
+        return s.MaxSessions
+    }
+    return 100000
+}
+
+// Forgets sessions idle for longer than the store keeps them, at most once
+// a minute. s.mu must be held.
+func (s *SessionTracker) sweepLocked(now time.Time) {
+    if now.Sub(s.lastSweep) < time.Minute {
+        return
+    }
+    s.lastSweep = now
+    for id, sess := range s.local {
+        if now.Sub(sess.lastSeen) > s.idleTimeout()*2 {
+            delete(s.local, id)
+        }
+    }
+}
+
+// Middleware makes sure every request has a session cookie, and pushes its
+// expiry out another IdleTimeout each time, so the session slides along as
+// long as the user stays active.
+func (s *SessionTracker) Middleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        var id string
+        if cookie, err := r.Cookie(s.cookieName()); err == nil && cookie.Value != "" {
+            id = cookie.Value
+        } else {
+            id = randomHex(16)
+        }
+
+        http.SetCookie(w, &http.Cookie{
+            Name:     s.cookieName(),
+            Value:    id,
+            Path:     "/",
+            MaxAge:   int(s.idleTimeout().Seconds()),
+            HttpOnly: true,
+            Secure:   r.TLS != nil,
+            SameSite: http.SameSiteLaxMode,
+        })
+        next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), sessionIDKey{}, id)))
+    })
+}
+
+// Touch records another event in the request's session, and adds session_id
+// and session_sequence_number to its metadata. Requests that didn't come
+// through Middleware are left alone unless they already carry the cookie.
+func (s *SessionTracker) Touch(h *UserEventsHandler, r *http.Request, eventType string, metadata map[string]interface{}, user *UserInfo) {
+    id, _ := r.Context().Value(sessionIDKey{}).(string)
+    if id == "" {
+        cookie, err := r.Cookie(s.cookieName())
+        if err != nil || cookie.Value == "" {
+            return
+        }
+        id = cookie.Value
+    }
+
+    store := h.state()
+    ctx, cancel := context.WithTimeout(r.Context(), stateStoreTimeout)
+    defer cancel()
+    now := time.Now()
+    key := "session:" + id
+
+    // If the store's unavailable we'd still rather send the event, just
+    // without a sequence number
+    sequence, err := store.Incr(ctx, key+":seq", s.idleTimeout()*2)
+    if err != nil {
+        h.logger().Warn("couldn't update session", "session_id", id, "error", err)
+    }
+    store.SetIfAbsent(ctx, key+":started", encodeTime(now), maxSessionLength)
+    store.Set(ctx, key+":last", encodeTime(now), s.idleTimeout()*2)
+    store.Incr(ctx, key+":count:"+eventType, s.idleTimeout()*2)
+
+    s.mu.Lock()
+    s.sweepLocked(now)
+    sess, ok := s.local[id]
+    if !ok && len(s.local) < s.maxSessions() {
+        sess = &localSession{types: make(map[string]bool), store: store}
+        s.local[id] = sess
+    }
+    if sess != nil {
+        if user != nil && !user.Anonymous {
+            sess.userID = user.ID
+        }
+        sess.lastSeen = now
+        if len(sess.types) < maxSessionTypes {
+            sess.types[eventType] = true
+        }
+    }
+    s.mu.Unlock()
+
+    metadata["session_id"] = id
+    if sequence > 0 {
+        metadata["session_sequence_number"] = sequence
+    }
+}
+
+// Run ends idle sessions until ctx is done.
+func (s *SessionTracker) Run(ctx context.Context, h *UserEventsHandler) {
+    ticker := time.NewTicker(time.Minute)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-ctx.Done():
+            return
+        case now := <-ticker.C:
+            for id, sess := range s.idleLocally(now) {
+                s.end(ctx, h, id, sess, now)
+            }
+        }
+    }
+}
+
+func (s *SessionTracker) idleLocally(now time.Time) map[string]*localSession {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    idle := make(map[string]*localSession)
+    for id, sess := range s.local {
+        if now.Sub(sess.lastSeen) > s.idleTimeout() {
+            idle[id] = sess
+            delete(s.local, id)
+        }
+    }
+    return idle
+}
+
+// A session that's gone quiet here may still be active on another instance,
+// so check the shared last-seen time before ending it, and make sure only one
+// instance sends the session-end.
+func (s *SessionTracker) end(ctx context.Context, h *UserEventsHandler, id string, sess *localSession, now time.Time) {
+    ctx, cancel := context.WithTimeout(ctx, stateStoreTimeout)
+    defer cancel()
+    key := "session:" + id
+    store := sess.store
+
+    if raw, ok, _ := store.Get(ctx, key+":last"); ok {
+        if lastSeen, ok := decodeTime(raw); ok && now.Sub(lastSeen) <= s.idleTimeout() {
+            return // Still going elsewhere; whoever saw it last will end it
+        } else if ok {
+            sess.lastSeen = lastSeen
+        }
+    }
+    if first, err := store.SetIfAbsent(ctx, key+":ended", []byte("1"), s.idleTimeout()); err != nil || !first {
+        return
+    }
+
+    ev := h.newEvent("session-end", nil, nil)
+    ev.Timestamp = sess.lastSeen
+    ev.AddField("session_id", id)
+    if sess.userID != "" {
+        ev.AddField("user_id", sess.userID)
+    }
+    if raw, ok, _ := store.Get(ctx, key+":started"); ok {
+        if started, ok := decodeTime(raw); ok {
+            ev.AddField("session_started_at", started)
+            ev.AddField("session_duration_ms", sess.lastSeen.Sub(started).Nanoseconds()/int64(time.Millisecond))
+        }
+    }
+    if raw, ok, _ := store.Get(ctx, key+":seq"); ok {
+        if count, err := strconv.Atoi(string(raw)); err == nil {
+            ev.AddField("session_event_count", count)
+        }
+    }
+    keys := []string{key + ":seq", key + ":started", key + ":last"}
+    for eventType := range sess.types {
+        if raw, ok, _ := store.Get(ctx, key+":count:"+eventType); ok {
+            if count, err := strconv.Atoi(string(raw)); err == nil {
+                ev.AddField("session_"+eventType+"_count", count)
+            }
+        }
+        keys = append(keys, key+":count:"+eventType)
+    }
+    store.Delete(ctx, keys...)
+
+    h.scrub(ctx, ev)
+    h.send(ctx, ev)
+}
@@ -0,0 +1,67 @@
+// libhoney buffers events and sends them in the background, so without an
+// explicit flush a deploy restart silently drops whatever's still queued. Close
+// is meant to run right after the HTTP server has stopped taking requests:
+//
+//     if err := srv.Shutdown(ctx); err != nil { ... }
+//     if err := userEvents.Close(ctx); err != nil { ... }
+//
+// It waits for any sends already in flight or queued, then flushes libhoney's
+// queue, and gives up when ctx is done. Events that arrive after Close are
+// dropped.
+func (h *UserEventsHandler) Close(ctx context.Context) error {
+    h.closeMu.Lock()
+    h.closed = true
+    h.closeMu.Unlock()
+
+    done := make(chan struct{})
+    go func() {
+        h.inflight.Wait()
+        if h.Coalesce != nil {
+            h.Coalesce.flush(h, time.Time{}) // Onto the queues, before they close
+        }
+        for _, queue := range h.allQueues() {
+            queue.close() // Lets the workers finish what's already queued
+        }
+
+        // Anything sent from here on (a late span or summary) is dropped
+        h.sinkMu.Lock()
+        h.sinksClosed = true
+        h.sinkMu.Unlock()
+
+        // Sinks first, since some (like FanOutSink) drain their queues into
+        // libhoney as they close
+        closeSink(h, h.Sink)
+        for _, client := range h.allClients() {
+            client.Close() // Flushes everything queued, then stops the transmission
+        }
+        if h.DryRun != nil {
+            h.logger().Info("dry run report", "report", h.DryRun.Report())
+        } else if h.Admin != nil {
+            if report := h.Admin.dryRun.Report(); len(report) > 0 {
+                h.logger().Info("dry run report", "report", report)
+            }
+        }
+        close(done)
+    }()
+
+    select {
+    case <-done:
+        return nil
+    case <-ctx.Done():
+        return fmt.Errorf("user events: gave up waiting for pending sends: %v", ctx.Err())
+    }
+}
+
+var errSinksClosed = errors.New("user events: sinks are closed")
+
+// Registers a send as in flight so Close waits for it. Returns false once the
+// handler is closing, in which case the caller should drop the event.
+func (h *UserEventsHandler) beginSend() bool {
+    h.closeMu.RLock()
+    defer h.closeMu.RUnlock()
+    if h.closed {
+        return false
+    }
+    h.inflight.Add(1)
+    return true
+}
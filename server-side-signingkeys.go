@@ -0,0 +1,137 @@
+// RequestAuth's signatures are only as good as the key behind them, and a
+// key baked into the page when it's rendered lives as long as the tab does.
+// SigningKeys hands out short-lived keys instead: an authenticated page
+// fetches its session's current key (as a JWK) from HandleSigningKey, signs
+// each post with it, and fetches a fresh one before it expires.
+//
+//     keys := &SigningKeys{Secret: signingSecret, SessionID: app.SessionID}
+//     handler.RequestAuth = &RequestAuth{AllowedOrigins: origins, RequireSignature: true, SigningKeys: keys}
+//     mux.HandleFunc("/events/signing-key", handler.HandleSigningKey)
+//
+// The browser sends the key's ID as "X-Event-Key-Id: <kid>" next to
+// X-Event-Signature. Keys are derived from Secret, the session, and which
+// Lifetime-long period they're for, so every instance can verify any key
+// without sharing state, and nothing outside the session's own pages can
+// come up with one. After a rotation, the previous period's key is still
+// accepted for Grace, so posts signed just before the switch (or from a tab
+// that was asleep) aren't turned away.
+type SigningKeys struct {
+    Secret []byte
+
+    // The session the request belongs to; an error (or "") means the
+    // request isn't authenticated and gets no key
+    SessionID func(r *http.Request) (string, error)
+
+    Lifetime time.Duration // How long each key is current; defaults to 15 minutes
+    Grace    time.Duration // How long the previous key is still accepted; defaults to 2 minutes
+}
+
+const keyIDHeader = "X-Event-Key-Id"
+
+// What HandleSigningKey returns: an RFC 7517 symmetric key, plus when it
+// stops being current
+type signingJWK struct {
+    KeyType   string `json:"kty"`
+    Algorithm string `json:"alg"`
+    Use       string `json:"use"`
+    KeyID     string `json:"kid"`
+    Key       string `json:"k"`
+    Expires   int64  `json:"exp"` // Unix seconds; fetch a new key before then
+}
+
+var signingKeysIssued = promauto.NewCounter(prometheus.CounterOpts{
+    Name: "user_events_signing_keys_issued_total",
+    Help: "Signing keys handed out by HandleSigningKey.",
+})
+
+func (k *SigningKeys) lifetime() time.Duration {
+    if k.Lifetime > 0 {
+        return k.Lifetime
+    }
+    return 15 * time.Minute
+}
+
+func (k *SigningKeys) grace() time.Duration {
+    if k.Grace > 0 {
+        return k.Grace
+    }
+    return 2 * time.Minute
+}
+
+// The Lifetime-long period t falls in. In nanoseconds, so a Lifetime under a
+// second still works; for whole seconds, the periods are the same as ever.
+func (k *SigningKeys) period(t time.Time) int64 {
+    return t.UnixNano() / int64(k.lifetime())
+}
+
+func (k *SigningKeys) derive(sessionID string, period int64) []byte {
+    mac := hmac.New(sha256.New, k.Secret)
+    mac.Write([]byte("event-signing:" + sessionID + ":" + strconv.FormatInt(period, 10)))
+    return mac.Sum(nil)
+}
+
+func keyID(period int64) string {
+    return "p" + strconv.FormatInt(period, 10)
+}
+
+// The key the request says it signed with, if it's for the request's session
+// and still acceptable
+func (k *SigningKeys) keyFor(r *http.Request, now time.Time) ([]byte, error) {
+    sessionID, err := k.SessionID(r)
+    if err != nil || sessionID == "" {
+        return nil, errors.New("no session to sign for")
+    }
+    kid := r.Header.Get(keyIDHeader)
+    period, err := strconv.ParseInt(strings.TrimPrefix(kid, "p"), 10, 64)
+    if err != nil || !strings.HasPrefix(kid, "p") {
+        return nil, fmt.Errorf("missing or malformed %s header", keyIDHeader)
+    }
+
+    current := k.period(now)
+    switch {
+    case period == current:
+    case period == current-1 && now.Before(k.periodStart(current).Add(k.grace())):
+    default:
+        return nil, errors.New("signing key has expired")
+    }
+    return k.derive(sessionID, period), nil
+}
+
+func (k *SigningKeys) periodStart(period int64) time.Time {
+    return time.Unix(0, period*int64(k.lifetime()))
+}
+
+// HandleSigningKey gives an authenticated page its session's current signing
+// key.
+func (h *UserEventsHandler) HandleSigningKey(w http.ResponseWriter, r *http.Request) {
+    if h.RequestAuth == nil || h.RequestAuth.SigningKeys == nil {
+        http.NotFound(w, r)
+        return
+    }
+    keys := h.RequestAuth.SigningKeys
+    // Same-origin GETs often come without an Origin, but a cross-origin one
+    // always has it
+    if origin := r.Header.Get("Origin"); origin != "" && !originAllowed(h.RequestAuth.AllowedOrigins, origin) {
+        http.Error(w, "origin not allowed", http.StatusForbidden)
+        return
+    }
+    sessionID, err := keys.SessionID(r)
+    if err != nil || sessionID == "" {
+        writeRejection(w, http.StatusUnauthorized, CodeUnauthenticated, "no session to issue a signing key for")
+        return
+    }
+
+    now := time.Now()
+    period := keys.period(now)
+    signingKeysIssued.Inc()
+    w.Header().Set("Content-Type", "application/jwk+json")
+    w.Header().Set("Cache-Control", "no-store") // Per session, and a secret
+    json.NewEncoder(w).Encode(signingJWK{
+        KeyType:   "oct",
+        Algorithm: "HS256",
+        Use:       "sig",
+        KeyID:     keyID(period),
+        Key:       base64.RawURLEncoding.EncodeToString(keys.derive(sessionID, period)),
+        Expires:   keys.periodStart(period + 1).Unix(),
+    })
+}
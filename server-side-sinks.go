@@ -0,0 +1,267 @@
+// A Sink is wherever finished events go. The handler sends to Honeycomb by
+// default, but making that pluggable lets us tee browser events into our data
+// warehouse pipeline too, and run the handler locally without an API key:
+//
+//     handler.Sink = &JSONLinesSink{W: os.Stdout}
+type Sink interface {
+    Send(ctx context.Context, ev Event) error
+}
+
+func (h *UserEventsHandler) sink() Sink {
+    if h.Sink != nil {
+        return h.Sink
+    }
+    return h.HoneycombSink()
+}
+
+// Replaces the handler's Sink, then closes the old one, which nothing's
+// sending to by the time we have sinkMu. After Close, the new one is closed
+// instead.
+func (h *UserEventsHandler) swapSink(sink Sink) {
+    h.sinkMu.Lock()
+    old := h.Sink
+    if h.sinksClosed {
+        old = sink
+    } else {
+        h.Sink = sink
+    }
+    h.sinkMu.Unlock()
+    closeSink(h, old)
+}
+
+func closeSink(h *UserEventsHandler, sink Sink) {
+    if closer, ok := sink.(io.Closer); ok {
+        if err := closer.Close(); err != nil {
+            h.logger().Error("couldn't close sink", "error", err)
+        }
+    }
+}
+
+// HoneycombSink sends events with the handler's libhoney clients, which is
+// what happens when no other Sink is configured. It's there to be combined
+// with other sinks.
+func (h *UserEventsHandler) HoneycombSink() Sink {
+    return honeycombSink{h}
+}
+
+type honeycombSink struct {
+    h *UserEventsHandler
+}
+
+func (s honeycombSink) Send(ctx context.Context, ev Event) error {
+    client, done := s.h.useClient(ev.Client)
+    defer done()
+    if client == nil {
+        return errors.New("no libhoney client configured")
+    }
+    if s.h.Breaker != nil && !s.h.Breaker.Allow(ev.Client) {
+        return s.h.shortCircuit(ev)
+    }
+    lev := client.NewEvent()
+    lev.Dataset = ev.Dataset
+    lev.Timestamp = ev.Timestamp
+    lev.SampleRate = ev.SampleRate
+    for name, value := range ev.Fields() {
+        lev.AddField(name, value) // Add would reflect over the map to do the same thing, more slowly
+    }
+    if s.h.DeadLetters != nil {
+        s.h.DeadLetters.track(lev, ev.Client)
+    }
+    attachProbe(lev, s.h.Delivery.probe(ev))
+
+    // We've already made the sampling decision, so libhoney shouldn't sample
+    // the event again. libhoney queues it and sends it in the background.
+    return lev.SendPresampled()
+}
+
+// JSONLinesSink writes each event as one line of JSON, e.g. to stdout for
+// local development, or to a file for something else to pick up.
+type JSONLinesSink struct {
+    W io.Writer
+
+    mu sync.Mutex
+}
+
+// The shape each line is written in, which matches what Honeycomb's batch API
+// takes, so a file of these can be replayed straight in
+type jsonLine struct {
+    Dataset    string                 `json:"dataset"`
+    Time       time.Time              `json:"time"`
+    SampleRate uint                   `json:"samplerate"`
+    Data       map[string]interface{} `json:"data"`
+}
+
+func (s *JSONLinesSink) Send(ctx context.Context, ev Event) error {
+    buf, err := json.Marshal(jsonLine{
+        Dataset:    ev.Dataset,
+        Time:       ev.Timestamp,
+        SampleRate: ev.SampleRate,
+        Data:       ev.Fields(),
+    })
+    if err != nil {
+        return err
+    }
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    _, err = s.W.Write(append(buf, '\n'))
+    return err
+}
+
+// KafkaSink publishes each event as a JSON message to a Kafka topic, keyed by
+// user (when there is one) so each user's events stay in order on one
+// partition. Set Writer.Async if you'd rather not wait on the brokers.
+type KafkaSink struct {
+    Writer *kafka.Writer
+}
+
+func NewKafkaSink(brokers []string, topic string) *KafkaSink {
+    return &KafkaSink{Writer: &kafka.Writer{
+        Addr:         kafka.TCP(brokers...),
+        Topic:        topic,
+        Balancer:     &kafka.Hash{},
+        BatchTimeout: 50 * time.Millisecond,
+    }}
+}
+
+func (s *KafkaSink) Send(ctx context.Context, ev Event) error {
+    buf, err := json.Marshal(jsonLine{
+        Dataset:    ev.Dataset,
+        Time:       ev.Timestamp,
+        SampleRate: ev.SampleRate,
+        Data:       ev.Fields(),
+    })
+    if err != nil {
+        return err
+    }
+    return s.Writer.WriteMessages(ctx, kafka.Message{
+        Key:   []byte(fmt.Sprint(ev.Fields()["user_id"])),
+        Value: buf,
+    })
+}
+
+func (s *KafkaSink) Close() error {
+    return s.Writer.Close()
+}
+
+// FanOutSink sends every event to several sinks (say, Honeycomb and Kafka) at
+// once. Each sink gets its own queue and worker, so a Kafka outage can't hold
+// up Honeycomb delivery or vice versa: if a sink falls behind and its queue
+// fills up, events are dropped for that sink only. Sends never block the
+// request.
+//
+//     handler.Sink = NewFanOutSink(
+//         SinkOutput{Name: "honeycomb", Sink: handler.HoneycombSink()},
+//         SinkOutput{Name: "kafka", Sink: NewKafkaSink(brokers, "browser-events"), SampleRate: 10},
+//     )
+//
+// All sinks share the event's field map, so they mustn't modify it.
+type FanOutSink struct {
+    Logger *slog.Logger // Where sink failures are logged; defaults to slog.Default(). Set it before the first Send.
+
+    outputs []*fanOutput
+    wg      sync.WaitGroup
+
+    mu     sync.RWMutex // Held by Send, so Close can't close a queue under it
+    closed bool
+}
+
+type SinkOutput struct {
+    Name       string // For logs and metrics
+    Sink       Sink
+    SampleRate uint // Send 1 in SampleRate events to this sink (on top of any sampling already done)
+    QueueSize  int  // Defaults to 1000
+}
+
+type fanOutput struct {
+    SinkOutput
+    queue chan Event
+}
+
+var sinkEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+    Name: "user_events_sink_events_total",
+    Help: "Events handled by each fan-out sink, by outcome (sent, error, sampled, or queue_full).",
+}, []string{"sink", "outcome"})
+
+func (f *FanOutSink) logger() *slog.Logger {
+    if f.Logger != nil {
+        return f.Logger
+    }
+    return slog.Default()
+}
+
+func NewFanOutSink(outputs ...SinkOutput) *FanOutSink {
+    f := &FanOutSink{}
+    for _, output := range outputs {
+        size := output.QueueSize
+        if size <= 0 {
+            size = 1000
+        }
+        o := &fanOutput{SinkOutput: output, queue: make(chan Event, size)}
+        f.outputs = append(f.outputs, o)
+
+        f.wg.Add(1)
+        go func() {
+            defer f.wg.Done()
+            for ev := range o.queue {
+                if err := o.Sink.Send(context.Background(), ev); err != nil {
+                    sinkEvents.WithLabelValues(o.Name, "error").Inc()
+                    f.logger().Error("sink failed", "sink", o.Name, "type", ev.Type, "error", err)
+                    continue
+                }
+                sinkEvents.WithLabelValues(o.Name, "sent").Inc()
+            }
+        }()
+    }
+    return f
+}
+
+func (f *FanOutSink) Send(ctx context.Context, ev Event) error {
+    f.mu.RLock()
+    defer f.mu.RUnlock()
+    if f.closed {
+        return errors.New("fan-out sink is closed")
+    }
+    for _, o := range f.outputs {
+        out := ev
+        if o.SampleRate > 1 {
+            if rand.Intn(int(o.SampleRate)) != 0 {
+                sinkEvents.WithLabelValues(o.Name, "sampled").Inc()
+                continue
+            }
+            out.SampleRate *= o.SampleRate
+        }
+
+        select {
+        case o.queue <- out:
+        default:
+            sinkEvents.WithLabelValues(o.Name, "queue_full").Inc()
+        }
+    }
+    return nil
+}
+
+// Close waits for every sink to drain its queue, then closes any sinks that
+// need closing. Events sent after Close are turned away with an error.
+func (f *FanOutSink) Close() error {
+    f.mu.Lock()
+    if f.closed {
+        f.mu.Unlock()
+        return nil
+    }
+    f.closed = true
+    for _, o := range f.outputs {
+        close(o.queue)
+    }
+    f.mu.Unlock()
+    f.wg.Wait()
+
+    var firstErr error
+    for _, o := range f.outputs {
+        if closer, ok := o.Sink.(io.Closer); ok {
+            if err := closer.Close(); err != nil && firstErr == nil {
+                firstErr = fmt.Errorf("closing sink %s: %v", o.Name, err)
+            }
+        }
+    }
+    return firstErr
+}
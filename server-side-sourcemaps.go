@@ -0,0 +1,161 @@
+// Stack frames from our minified bundles ("a.b (main.3f9a2c.js:1:48213)") are
+// unreadable in Honeycomb. SourceMapStore finds the source map for each frame's
+// file, for the release the error came from, and maps the frame back to the
+// original file, line, and function name.
+//
+// Source maps are looked up as "<release>/<bundle file name>.map", either in
+// Dir on local disk, or under BaseURL (e.g. the artifact bucket our deploys
+// upload them to). Parsed maps are cached, since the same few bundles account
+// for nearly every error; so are files with no map, or whose map we couldn't
+// fetch, for MissTTL. The release comes from the browser, so one that isn't
+// a plain version string (letters, digits, ".", "_" and "-") isn't looked
+// up at all.
+type SourceMapStore struct {
+    Dir     string
+    BaseURL string
+    Client  *http.Client  // For BaseURL; defaults to one with a short timeout
+    MissTTL time.Duration // Defaults to 5 minutes
+    // Parsed maps to keep; defaults to 100, and they can be large
+    CacheSize int
+
+    cacheOnce sync.Once
+    cache     *lru.Cache
+}
+
+// A cached map, or a miss (a nil consumer) until expires
+type sourceMapEntry struct {
+    consumer *sourcemap.Consumer
+    expires  time.Time
+}
+
+var validRelease = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+var sourceMapClient = &http.Client{Timeout: 2 * time.Second}
+
+func (s *SourceMapStore) missTTL() time.Duration {
+    if s.MissTTL > 0 {
+        return s.MissTTL
+    }
+    return 5 * time.Minute
+}
+
+func (s *SourceMapStore) client() *http.Client {
+    if s.Client != nil {
+        return s.Client
+    }
+    return sourceMapClient
+}
+
+// Made on first use unless NewSourceMapStore already made it, so a plain
+// &SourceMapStore{Dir: dir} works too
+func (s *SourceMapStore) maps() *lru.Cache {
+    s.cacheOnce.Do(func() {
+        if s.cache != nil {
+            return
+        }
+        size := s.CacheSize
+        if size <= 0 {
+            size = 100
+        }
+        s.cache, _ = lru.New(size) // Only fails for a size below 1
+    })
+    return s.cache
+}
+
+func NewSourceMapStore(dir, baseURL string, cacheSize int) (*SourceMapStore, error) {
+    cache, err := lru.New(cacheSize)
+    if err != nil {
+        return nil, err
+    }
+    return &SourceMapStore{
+        Dir:       dir,
+        BaseURL:   baseURL,
+        Client:    &http.Client{Timeout: 2 * time.Second},
+        CacheSize: cacheSize,
+        cache:     cache,
+    }, nil
+}
+
+// Resolve maps each frame it can back to the original source. Frames without a
+// source map (third party scripts, inline handlers) come back unchanged, and
+// ok is false if none of them could be resolved.
+func (s *SourceMapStore) Resolve(release string, frames []StackFrame) (resolved []StackFrame, ok bool) {
+    resolved = make([]StackFrame, len(frames))
+    for i, frame := range frames {
+        resolved[i] = frame
+        consumer, err := s.mapFor(release, frame.File)
+        if err != nil || consumer == nil {
+            continue
+        }
+        // Browsers report 1-based columns; source maps use 0-based ones
+        source, name, line, col, found := consumer.Source(frame.Line, frame.Column-1)
+        if !found {
+            continue
+        }
+        resolved[i] = StackFrame{Function: name, File: source, Line: line, Column: col + 1}
+        if resolved[i].Function == "" {
+            resolved[i].Function = frame.Function
+        }
+        ok = true
+    }
+    return resolved, ok
+}
+
+// Returns nil (and no error) if there's no map for this file. That's cached
+// too, as is failing to get one, so we don't go looking again for every error
+// from the same script.
+func (s *SourceMapStore) mapFor(release, file string) (*sourcemap.Consumer, error) {
+    u, err := url.Parse(file)
+    if err != nil || u.Path == "" || !validRelease.MatchString(release) || release == "." || release == ".." {
+        return nil, err
+    }
+    name := path.Base(u.Path)
+    if name == "." || name == ".." || name == "/" {
+        return nil, nil
+    }
+    key := release + "/" + name + ".map"
+    cache := s.maps()
+    if cached, ok := cache.Get(key); ok {
+        entry := cached.(sourceMapEntry)
+        if entry.consumer != nil || time.Now().Before(entry.expires) {
+            return entry.consumer, nil
+        }
+    }
+
+    buf, err := s.load(key)
+    var consumer *sourcemap.Consumer
+    if err == nil && buf != nil {
+        consumer, err = sourcemap.Parse(file, buf)
+    }
+    if err != nil {
+        cache.Add(key, sourceMapEntry{expires: time.Now().Add(s.missTTL())})
+        return nil, err
+    }
+    cache.Add(key, sourceMapEntry{consumer: consumer, expires: time.Now().Add(s.missTTL())})
+    return consumer, nil
+}
+
+func (s *SourceMapStore) load(key string) ([]byte, error) {
+    if s.Dir != "" {
+        buf, err := ioutil.ReadFile(filepath.Join(s.Dir, filepath.FromSlash(key)))
+        if err == nil || !os.IsNotExist(err) {
+            return buf, err
+        }
+    }
+    if s.BaseURL == "" {
+        return nil, nil
+    }
+
+    resp, err := s.client().Get(strings.TrimRight(s.BaseURL, "/") + "/" + key)
+    if err != nil {
+        return nil, err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode == http.StatusNotFound {
+        return nil, nil
+    }
+    if resp.StatusCode != http.StatusOK {
+        return nil, fmt.Errorf("fetching source map %s: HTTP %d", key, resp.StatusCode)
+    }
+    return ioutil.ReadAll(io.LimitReader(resp.Body, 50<<20))
+}
@@ -0,0 +1,203 @@
+// SQLiteSpool keeps failed events in an embedded SQLite database rather than
+// a file each. Puts and takes are transactions, so a crash can't leave half an
+// event behind, and the spool is bounded: past MaxEvents the oldest events are
+// evicted, as is anything spooled more than MaxAge ago.
+//
+//     spool, err := OpenSQLiteSpool("/var/spool/user-events.db")
+//     dlq := &DeadLetterQueue{Spool: spool}
+//
+// The database runs in WAL mode, so the replay command can read it while the
+// handler is still writing to it.
+type SQLiteSpool struct {
+    MaxEvents int           // Defaults to 100000
+    MaxAge    time.Duration // Defaults to 7 days
+
+    db *sql.DB
+    spoolLog
+}
+
+const sqliteSpoolSchema = `
+CREATE TABLE IF NOT EXISTS spooled_events (
+    id           INTEGER PRIMARY KEY AUTOINCREMENT,
+    spooled_at   INTEGER NOT NULL,
+    next_attempt INTEGER NOT NULL,
+    event        BLOB NOT NULL
+);
+CREATE INDEX IF NOT EXISTS spooled_events_next_attempt ON spooled_events (next_attempt);
+`
+
+func OpenSQLiteSpool(path string) (*SQLiteSpool, error) {
+    db, err := sql.Open("sqlite", path)
+    if err != nil {
+        return nil, err
+    }
+    // SQLite only allows one writer at a time anyway; going through one
+    // connection saves us from SQLITE_BUSY
+    db.SetMaxOpenConns(1)
+    for _, stmt := range []string{"PRAGMA journal_mode=WAL", "PRAGMA synchronous=NORMAL", sqliteSpoolSchema} {
+        if _, err := db.Exec(stmt); err != nil {
+            db.Close()
+            return nil, fmt.Errorf("setting up spool %s: %v", path, err)
+        }
+    }
+    return &SQLiteSpool{db: db}, nil
+}
+
+func (s *SQLiteSpool) maxEvents() int {
+    if s.MaxEvents > 0 {
+        return s.MaxEvents
+    }
+    return 100000
+}
+
+func (s *SQLiteSpool) maxAge() time.Duration {
+    if s.MaxAge > 0 {
+        return s.MaxAge
+    }
+    return 7 * 24 * time.Hour
+}
+
+func (s *SQLiteSpool) Put(ev *SpooledEvent) error {
+    buf, err := json.Marshal(ev)
+    if err != nil {
+        return err
+    }
+    now := time.Now()
+    tx, err := s.db.Begin()
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+
+    if _, err := tx.Exec(`INSERT INTO spooled_events (spooled_at, next_attempt, event) VALUES (?, ?, ?)`,
+        now.UnixNano(), ev.NextAttempt.UnixNano(), buf); err != nil {
+        return err
+    }
+    evicted, err := s.evict(tx, now)
+    if err != nil {
+        return err
+    }
+    if err := tx.Commit(); err != nil {
+        return err
+    }
+    if evicted > 0 {
+        s.logger().Warn("sqlite spool full, evicted oldest failed events", "evicted", evicted)
+        eventsDropped.WithLabelValues("other", "spool_evicted").Add(float64(evicted))
+    }
+    return nil
+}
+
+// Drops events past MaxAge, then the oldest beyond MaxEvents
+func (s *SQLiteSpool) evict(tx *sql.Tx, now time.Time) (int64, error) {
+    aged, err := tx.Exec(`DELETE FROM spooled_events WHERE spooled_at < ?`, now.Add(-s.maxAge()).UnixNano())
+    if err != nil {
+        return 0, err
+    }
+    over, err := tx.Exec(`DELETE FROM spooled_events WHERE id IN (
+        SELECT id FROM spooled_events ORDER BY id DESC LIMIT -1 OFFSET ?)`, s.maxEvents())
+    if err != nil {
+        return 0, err
+    }
+    agedCount, _ := aged.RowsAffected()
+    overCount, _ := over.RowsAffected()
+    return agedCount + overCount, nil
+}
+
+func (s *SQLiteSpool) Len() (int, error) {
+    var n int
+    err := s.db.QueryRow(`SELECT COUNT(*) FROM spooled_events`).Scan(&n)
+    return n, err
+}
+
+func (s *SQLiteSpool) TakeDue(now time.Time, max int) ([]*SpooledEvent, error) {
+    tx, err := s.db.Begin()
+    if err != nil {
+        return nil, err
+    }
+    defer tx.Rollback()
+
+    rows, err := tx.Query(`SELECT id, event FROM spooled_events WHERE next_attempt <= ? ORDER BY next_attempt LIMIT ?`,
+        now.UnixNano(), max)
+    if err != nil {
+        return nil, err
+    }
+    var due []*SpooledEvent
+    var ids []interface{}
+    for rows.Next() {
+        var id int64
+        var buf []byte
+        if err := rows.Scan(&id, &buf); err != nil {
+            rows.Close()
+            return nil, err
+        }
+        ids = append(ids, id)
+        var ev SpooledEvent
+        if err := json.Unmarshal(buf, &ev); err != nil {
+            s.logger().Warn("dropping corrupt spooled event", "id", id, "error", err)
+            continue
+        }
+        due = append(due, &ev)
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil {
+        return nil, err
+    }
+    if len(ids) == 0 {
+        return nil, nil
+    }
+
+    placeholders := strings.TrimSuffix(strings.Repeat("?,", len(ids)), ",")
+    if _, err := tx.Exec(`DELETE FROM spooled_events WHERE id IN (`+placeholders+`)`, ids...); err != nil {
+        return nil, err
+    }
+    return due, tx.Commit()
+}
+
+// Calls fn with every spooled event in the order they were spooled, for
+// Replay. fn gets a function to delete the event once it's been sent.
+func (s *SQLiteSpool) each(fn func(ev *SpooledEvent, remove func() error) error) (skipped int, err error) {
+    rows, err := s.db.Query(`SELECT id, event FROM spooled_events ORDER BY id`)
+    if err != nil {
+        return 0, err
+    }
+    type row struct {
+        id  int64
+        buf []byte
+    }
+    // Read everything up front: with one connection, we can't delete rows
+    // while this query still holds it
+    var all []row
+    for rows.Next() {
+        var r row
+        if err := rows.Scan(&r.id, &r.buf); err != nil {
+            rows.Close()
+            return 0, err
+        }
+        all = append(all, r)
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil {
+        return 0, err
+    }
+
+    for _, r := range all {
+        var ev SpooledEvent
+        if err := json.Unmarshal(r.buf, &ev); err != nil {
+            skipped++
+            continue
+        }
+        id := r.id
+        remove := func() error {
+            _, err := s.db.Exec(`DELETE FROM spooled_events WHERE id = ?`, id)
+            return err
+        }
+        if err := fn(&ev, remove); err != nil {
+            return skipped, err
+        }
+    }
+    return skipped, nil
+}
+
+func (s *SQLiteSpool) Close() error {
+    return s.db.Close()
+}
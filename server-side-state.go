@@ -0,0 +1,293 @@
+// Sessions, rate limits, and page-view pairing all need to remember things
+// between requests. With one instance that can live in memory, but behind a
+// load balancer consecutive requests from the same browser hit different
+// instances, so the state has to be shared. StateStore is the small key/value
+// API those features need; MemoryStore is the single-instance default, and
+// RedisStore shares state across instances:
+//
+//     store := NewRedisStore(redis.NewClient(&redis.Options{Addr: "redis:6379"}), "user-events:")
+//     handler.State = store
+type StateStore interface {
+    Get(ctx context.Context, key string) (value []byte, ok bool, err error)
+    Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+
+    // SetIfAbsent sets key only if it isn't already set, and reports whether
+    // it did. Used when exactly one instance should do something.
+    SetIfAbsent(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error)
+
+    // Take gets and deletes key in one step.
+    Take(ctx context.Context, key string) (value []byte, ok bool, err error)
+
+    Delete(ctx context.Context, keys ...string) error
+
+    // Incr adds one to the integer at key (starting from 0), resets its TTL,
+    // and returns the new value.
+    Incr(ctx context.Context, key string, ttl time.Duration) (int64, error)
+
+    // IncrBy is Incr, adding n rather than one.
+    IncrBy(ctx context.Context, key string, n int64, ttl time.Duration) (int64, error)
+
+    // CompareAndSwap sets key to next only if it's still old (nil for not
+    // set at all), and reports whether it did.
+    CompareAndSwap(ctx context.Context, key string, old, next []byte, ttl time.Duration) (bool, error)
+}
+
+// How long we give the store before carrying on without it
+const stateStoreTimeout = 100 * time.Millisecond
+
+// How many times updateState tries before giving up on a busy key
+const maxStateUpdateAttempts = 5
+
+// Read-modify-writes the value at key: change gets what's there (ok is false
+// if nothing is) and returns what to replace it with, or nil to leave it.
+// If another instance changes it in between, change is run again on theirs,
+// so neither update is lost.
+func updateState(ctx context.Context, store StateStore, key string, ttl time.Duration, change func(current []byte, ok bool) []byte) error {
+    for attempt := 0; attempt < maxStateUpdateAttempts; attempt++ {
+        current, ok, err := store.Get(ctx, key)
+        if err != nil {
+            return err
+        }
+        if ok && current == nil {
+            current = []byte{} // Set, if to nothing
+        }
+        next := change(current, ok)
+        if next == nil {
+            return nil
+        }
+        swapped, err := store.CompareAndSwap(ctx, key, current, next, ttl)
+        if err != nil || swapped {
+            return err
+        }
+    }
+    return fmt.Errorf("gave up updating %s: it kept changing under us", key)
+}
+
+// The handler's store, or a private in-memory one if it doesn't have one
+func (h *UserEventsHandler) state() StateStore {
+    h.stateOnce.Do(func() {
+        if h.State == nil {
+            h.State = NewMemoryStore()
+        }
+    })
+    return h.State
+}
+
+// MemoryStore keeps state in this process only.
+type MemoryStore struct {
+    mu        sync.Mutex
+    items     map[string]memoryItem
+    lastSweep time.Time
+}
+
+type memoryItem struct {
+    value   []byte
+    expires time.Time // Zero for never
+}
+
+func NewMemoryStore() *MemoryStore {
+    return &MemoryStore{items: make(map[string]memoryItem), lastSweep: time.Now()}
+}
+
+func (m *MemoryStore) Get(ctx context.Context, key string) ([]byte, bool, error) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    item, ok := m.live(key, time.Now())
+    return item.value, ok, nil
+}
+
+func (m *MemoryStore) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    m.set(key, value, ttl, time.Now())
+    return nil
+}
+
+func (m *MemoryStore) SetIfAbsent(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    now := time.Now()
+    if _, ok := m.live(key, now); ok {
+        return false, nil
+    }
+    m.set(key, value, ttl, now)
+    return true, nil
+}
+
+func (m *MemoryStore) CompareAndSwap(ctx context.Context, key string, old, next []byte, ttl time.Duration) (bool, error) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    now := time.Now()
+    item, ok := m.live(key, now)
+    if ok != (old != nil) || (ok && !bytes.Equal(item.value, old)) {
+        return false, nil
+    }
+    m.set(key, next, ttl, now)
+    return true, nil
+}
+
+func (m *MemoryStore) Take(ctx context.Context, key string) ([]byte, bool, error) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    item, ok := m.live(key, time.Now())
+    delete(m.items, key)
+    return item.value, ok, nil
+}
+
+func (m *MemoryStore) Delete(ctx context.Context, keys ...string) error {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    for _, key := range keys {
+        delete(m.items, key)
+    }
+    return nil
+}
+
+func (m *MemoryStore) Incr(ctx context.Context, key string, ttl time.Duration) (int64, error) {
+    return m.IncrBy(ctx, key, 1, ttl)
+}
+
+func (m *MemoryStore) IncrBy(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    now := time.Now()
+    var n int64
+    if item, ok := m.live(key, now); ok {
+        var err error
+        if n, err = strconv.ParseInt(string(item.value), 10, 64); err != nil {
+            return 0, fmt.Errorf("%s isn't an integer: %v", key, err)
+        }
+    }
+    n += delta
+    m.set(key, []byte(strconv.FormatInt(n, 10)), ttl, now)
+    return n, nil
+}
+
+// Called with m.mu held. Expired items are treated as missing.
+func (m *MemoryStore) live(key string, now time.Time) (memoryItem, bool) {
+    item, ok := m.items[key]
+    if !ok || (!item.expires.IsZero() && now.After(item.expires)) {
+        return memoryItem{}, false
+    }
+    return item, true
+}
+
+// Called with m.mu held. Every so often this also clears out expired items,
+// so keys nobody reads again don't hang around forever.
+func (m *MemoryStore) set(key string, value []byte, ttl time.Duration, now time.Time) {
+    item := memoryItem{value: value}
+    if ttl > 0 {
+        item.expires = now.Add(ttl)
+    }
+    m.items[key] = item
+
+    if now.Sub(m.lastSweep) > time.Minute {
+        for k, item := range m.items {
+            if !item.expires.IsZero() && now.After(item.expires) {
+                delete(m.items, k)
+            }
+        }
+        m.lastSweep = now
+    }
+}
+
+// RedisStore shares state across every instance pointed at the same Redis.
+// Prefix is prepended to every key, so several deployments can share one
+// Redis without stepping on each other.
+type RedisStore struct {
+    Client *redis.Client
+    Prefix string
+}
+
+func NewRedisStore(client *redis.Client, prefix string) *RedisStore {
+    return &RedisStore{Client: client, Prefix: prefix}
+}
+
+func (s *RedisStore) Get(ctx context.Context, key string) ([]byte, bool, error) {
+    value, err := s.Client.Get(ctx, s.Prefix+key).Bytes()
+    if err == redis.Nil {
+        return nil, false, nil
+    }
+    return value, err == nil, err
+}
+
+func (s *RedisStore) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+    return s.Client.Set(ctx, s.Prefix+key, value, ttl).Err()
+}
+
+func (s *RedisStore) SetIfAbsent(ctx context.Context, key string, value []byte, ttl time.Duration) (bool, error) {
+    return s.Client.SetNX(ctx, s.Prefix+key, value, ttl).Result()
+}
+
+// KEYS[1] is the key; ARGV is whether it's expected to be set ("1" or "0"),
+// the value expected, the new value, and its TTL in milliseconds (0 for none)
+var compareAndSwapScript = redis.NewScript(`
+local current = redis.call("GET", KEYS[1])
+if ARGV[1] == "1" then
+    if current ~= ARGV[2] then return 0 end
+elseif current then
+    return 0
+end
+if tonumber(ARGV[4]) > 0 then
+    redis.call("SET", KEYS[1], ARGV[3], "PX", ARGV[4])
+else
+    redis.call("SET", KEYS[1], ARGV[3])
+end
+return 1
+`)
+
+func (s *RedisStore) CompareAndSwap(ctx context.Context, key string, old, next []byte, ttl time.Duration) (bool, error) {
+    expected := "0"
+    if old != nil {
+        expected = "1"
+    }
+    swapped, err := compareAndSwapScript.Run(ctx, s.Client, []string{s.Prefix + key}, expected, old, next, ttl.Milliseconds()).Int()
+    return swapped == 1, err
+}
+
+func (s *RedisStore) Take(ctx context.Context, key string) ([]byte, bool, error) {
+    value, err := s.Client.GetDel(ctx, s.Prefix+key).Bytes()
+    if err == redis.Nil {
+        return nil, false, nil
+    }
+    return value, err == nil, err
+}
+
+func (s *RedisStore) Delete(ctx context.Context, keys ...string) error {
+    prefixed := make([]string, len(keys))
+    for i, key := range keys {
+        prefixed[i] = s.Prefix + key
+    }
+    return s.Client.Del(ctx, prefixed...).Err()
+}
+
+func (s *RedisStore) Incr(ctx context.Context, key string, ttl time.Duration) (int64, error) {
+    return s.IncrBy(ctx, key, 1, ttl)
+}
+
+func (s *RedisStore) IncrBy(ctx context.Context, key string, n int64, ttl time.Duration) (int64, error) {
+    pipe := s.Client.TxPipeline()
+    incr := pipe.IncrBy(ctx, s.Prefix+key, n)
+    pipe.Expire(ctx, s.Prefix+key, ttl)
+    if _, err := pipe.Exec(ctx); err != nil {
+        return 0, err
+    }
+    return incr.Val(), nil
+}
+
+// Ping is for readiness checks.
+func (s *RedisStore) Ping(ctx context.Context) error {
+    return s.Client.Ping(ctx).Err()
+}
+
+func encodeTime(t time.Time) []byte {
+    return []byte(strconv.FormatInt(t.UnixNano(), 10))
+}
+
+func decodeTime(value []byte) (time.Time, bool) {
+    nanos, err := strconv.ParseInt(string(value), 10, 64)
+    if err != nil {
+        return time.Time{}, false
+    }
+    return time.Unix(0, nanos), true
+}
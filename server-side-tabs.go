@@ -0,0 +1,200 @@
+// One session can have the app open in five tabs, and four of them sit in
+// the background sending heartbeats and polling, and counting as engaged
+// time-on-page all the while. TabTracker tells the tabs of a session apart
+// by the tab_id the browser keeps in sessionStorage, and adds to every event
+// that has one:
+//
+//     concurrent_tabs    tabs of the session that have sent anything in the last TabTimeout
+//     is_background_tab  whether the event's tab was hidden when it sent it
+//
+// Register it after the PageViewPairer, if there is one:
+//
+//     tabs := &TabTracker{}
+//     tabs.Register(handler)
+//
+// is_background_tab comes from the event's visibility_state
+// (document.visibilityState) if it has one; otherwise a tab is in the
+// background if another of the session's tabs has been visible since it
+// was. For time-on-page, the browser sends a VisibilityType event whenever a
+// tab is hidden or shown, and page-unload gets foreground_time_ms, the part
+// of time_on_page_ms the page was actually visible for; engaged is decided
+// from that instead. Tabs are tracked in the handler's StateStore, by the
+// session_id a SessionTracker (or the browser) gives each event, as events
+// arrive, before sampling, so a sampled-out visibility change still counts.
+// Each update is a compare-and-swap, retried if another instance got in
+// first, so two tabs' events landing at once can't undo each other.
+type TabTracker struct {
+    VisibilityType string        // Defaults to "visibility-change"
+    TabTimeout     time.Duration // A tab that's sent nothing for this long is taken to be closed; defaults to 5 minutes
+    EngagedAfter   time.Duration // Foreground time to count as engaged; defaults to 10 seconds, like PageViewPairer's
+
+    store StateStore
+}
+
+// A session's tab, as we remember it, in unix milliseconds
+type tabState struct {
+    Seen    int64 `json:"s"`
+    Visible int64 `json:"v,omitempty"` // When it was last visible
+}
+
+// How long a page view has spent hidden
+type pageVisibility struct {
+    HiddenSince int64 `json:"since,omitempty"` // Unix milliseconds, while it's hidden
+    HiddenMS    int64 `json:"ms"`
+}
+
+// Past this many, a session's tabs are more likely a bot than a person
+const maxSessionTabs = 50
+
+func (t *TabTracker) visibilityType() string {
+    if t.VisibilityType != "" {
+        return t.VisibilityType
+    }
+    return "visibility-change"
+}
+
+func (t *TabTracker) tabTimeout() time.Duration {
+    if t.TabTimeout > 0 {
+        return t.TabTimeout
+    }
+    return 5 * time.Minute
+}
+
+func (t *TabTracker) engagedAfter() time.Duration {
+    if t.EngagedAfter > 0 {
+        return t.EngagedAfter
+    }
+    return 10 * time.Second
+}
+
+func (t *TabTracker) Register(h *UserEventsHandler) {
+    t.store = h.state()
+    h.OnReceive(t.visibilityType(), t.visibilityChange)
+    h.OnReceive("page-load", t.visibilityChange) // A tab opened in the background starts out hidden
+    h.OnReceive("*", t.tab)
+    h.On("page-unload", t.pageUnload) // Only matters for the unloads we send
+}
+
+// "visible", "hidden", or "" if the browser didn't say
+func visibilityState(fields map[string]interface{}) string {
+    state, _ := fields["visibility_state"].(string)
+    return state
+}
+
+func (t *TabTracker) tab(ev *Event) error {
+    fields := ev.Fields()
+    tabID := idString(fields["tab_id"])
+    session := idString(fields["session_id"])
+    if tabID == "" || session == "" {
+        return nil
+    }
+    ctx, cancel := context.WithTimeout(context.Background(), stateStoreTimeout)
+    defer cancel()
+    now := ev.Timestamp.UnixMilli()
+    state := visibilityState(fields)
+
+    var concurrent int
+    var background, tracked bool
+    err := updateState(ctx, t.store, "tabs:"+session, t.tabTimeout()*2, func(raw []byte, ok bool) []byte {
+        tabs := map[string]tabState{}
+        if ok {
+            json.Unmarshal(raw, &tabs)
+        }
+        for id, tab := range tabs {
+            if now-tab.Seen > t.tabTimeout().Milliseconds() {
+                delete(tabs, id)
+            }
+        }
+        tab, known := tabs[tabID]
+        if tracked = known || len(tabs) < maxSessionTabs; !tracked {
+            return nil
+        }
+        if now > tab.Seen {
+            tab.Seen = now
+        }
+        if state == "visible" && now > tab.Visible {
+            tab.Visible = now
+        }
+        tabs[tabID] = tab
+
+        background = state == "hidden"
+        if state == "" {
+            for id, other := range tabs {
+                if id != tabID && other.Visible > tab.Visible {
+                    background = true
+                }
+            }
+        }
+        concurrent = len(tabs)
+        encoded, _ := json.Marshal(tabs)
+        return encoded
+    })
+    if err != nil || !tracked {
+        return err
+    }
+    ev.AddField("concurrent_tabs", concurrent)
+    ev.AddField("is_background_tab", background)
+    return nil
+}
+
+func (t *TabTracker) visibilityChange(ev *Event) error {
+    id := pageViewID(ev.Fields())
+    state := visibilityState(ev.Fields())
+    if id == "" || state == "" {
+        return nil
+    }
+    ctx, cancel := context.WithTimeout(context.Background(), stateStoreTimeout)
+    defer cancel()
+    now := ev.Timestamp.UnixMilli()
+    return updateState(ctx, t.store, "tab-visibility:"+id, 12*time.Hour, func(raw []byte, ok bool) []byte {
+        var vis pageVisibility
+        if ok {
+            json.Unmarshal(raw, &vis)
+        }
+        switch {
+        case state == "hidden" && vis.HiddenSince == 0:
+            vis.HiddenSince = now
+        case state == "visible" && vis.HiddenSince != 0:
+            if now > vis.HiddenSince {
+                vis.HiddenMS += now - vis.HiddenSince
+            }
+            vis.HiddenSince = 0
+        default:
+            return nil // Nothing's changed
+        }
+        encoded, _ := json.Marshal(vis)
+        return encoded
+    })
+}
+
+func (t *TabTracker) pageUnload(ev *Event) error {
+    id := pageViewID(ev.Fields())
+    if id == "" {
+        return nil
+    }
+    ctx, cancel := context.WithTimeout(context.Background(), stateStoreTimeout)
+    defer cancel()
+    raw, ok, err := t.store.Take(ctx, "tab-visibility:"+id)
+    if err != nil {
+        return err
+    }
+    var vis pageVisibility
+    if ok {
+        json.Unmarshal(raw, &vis)
+    }
+    if vis.HiddenSince != 0 && ev.Timestamp.UnixMilli() > vis.HiddenSince {
+        vis.HiddenMS += ev.Timestamp.UnixMilli() - vis.HiddenSince // Hidden right up to the end
+    }
+
+    timeOnPage, ok := numberValue(ev.Fields()["time_on_page_ms"])
+    if !ok {
+        return nil // Nothing to take the hidden time out of
+    }
+    foreground := int64(timeOnPage) - vis.HiddenMS
+    if foreground < 0 {
+        foreground = 0
+    }
+    ev.AddField("foreground_time_ms", foreground)
+    ev.AddField("engaged", time.Duration(foreground)*time.Millisecond >= t.engagedAfter())
+    return nil
+}
@@ -0,0 +1,232 @@
+// During a client rollout we want to watch events from the new release as
+// they go out, not a minute later in Honeycomb. LiveTail streams every event
+// we send (as sent, after enrichment and scrubbing) to operators connected to
+// HandleTail's WebSocket, filtered by query parameters:
+//
+//     handler.Tail = &LiveTail{Token: os.Getenv("DEBUG_TOKEN")}
+//     mux.HandleFunc("/tail", handler.HandleTail)
+//
+//     websocat -H "Authorization: Bearer $DEBUG_TOKEN" \
+//         "wss://events.example.com/tail?type=page-load&field=sdk_version:2.4.0&sample=10"
+//
+// type and user_id match those fields, and each field=<name>:<value> has to
+// match too. sample=N sends 1 in N of the matching events. Each message is an
+// event as JSON, like HandleDebugEvents', or {"dropped": N} every few seconds
+// if events were dropped because the connection couldn't keep up. Sending
+// never waits for a tail: each connection gets a small buffer and PerSecond
+// events a second, and anything past that is dropped for that connection
+// only. Each instance only tails the events it sent itself.
+type LiveTail struct {
+    Token          string  // Required as "Authorization: Bearer <token>"; with no Token, every request is refused
+    MaxConnections int     // Defaults to 10
+    PerSecond      float64 // Per connection; defaults to 50
+
+    mu    sync.RWMutex
+    tails map[*tailConn]bool
+    count int32 // len(tails), so send can skip the lock when nobody's watching
+}
+
+type tailConn struct {
+    filter  tailFilter
+    events  chan recentEvent
+    limiter *rate.Limiter
+    seen    uint64 // Matching events, for sampling
+    dropped int64
+}
+
+type tailFilter struct {
+    eventType string
+    userID    string
+    fields    map[string]string
+    sample    uint64
+}
+
+const (
+    tailBufferSize    = 100
+    tailDroppedReport = 5 * time.Second
+)
+
+var tailConnections = promauto.NewGauge(prometheus.GaugeOpts{
+    Name: "user_events_tail_connections",
+    Help: "Operators connected to the live tail.",
+})
+
+func (t *LiveTail) maxConnections() int {
+    if t.MaxConnections > 0 {
+        return t.MaxConnections
+    }
+    return 10
+}
+
+func (t *LiveTail) perSecond() float64 {
+    if t.PerSecond > 0 {
+        return t.PerSecond
+    }
+    return 50
+}
+
+func parseTailFilter(query url.Values) (tailFilter, error) {
+    f := tailFilter{eventType: query.Get("type"), userID: query.Get("user_id"), fields: map[string]string{}, sample: 1}
+    for _, raw := range query["field"] {
+        name, value, ok := strings.Cut(raw, ":")
+        if !ok || name == "" {
+            return f, fmt.Errorf("field=%q should be <name>:<value>", raw)
+        }
+        f.fields[name] = value
+    }
+    if raw := query.Get("sample"); raw != "" {
+        n, err := strconv.ParseUint(raw, 10, 32)
+        if err != nil || n == 0 {
+            return f, errors.New("sample must be a positive integer")
+        }
+        f.sample = n
+    }
+    return f, nil
+}
+
+func (f tailFilter) matches(ev *Event) bool {
+    if f.eventType != "" && ev.Type != f.eventType {
+        return false
+    }
+    fields := ev.Fields()
+    if f.userID != "" && idString(fields["user_id"]) != f.userID {
+        return false
+    }
+    for name, want := range f.fields {
+        if idString(fields[name]) != want {
+            return false
+        }
+    }
+    return true
+}
+
+// Hands a sent event to every tail that wants it, without ever waiting
+func (t *LiveTail) publish(ev *Event) {
+    if atomic.LoadInt32(&t.count) == 0 {
+        return
+    }
+    t.mu.RLock()
+    defer t.mu.RUnlock()
+    var entry *recentEvent
+    for tail := range t.tails {
+        if !tail.filter.matches(ev) {
+            continue
+        }
+        if atomic.AddUint64(&tail.seen, 1)%tail.filter.sample != 0 {
+            continue
+        }
+        if !tail.limiter.Allow() {
+            atomic.AddInt64(&tail.dropped, 1)
+            continue
+        }
+        if entry == nil {
+            // Copied once, however many tails get it, since the event's
+            // fields may be recycled once sending is done
+            fields := make(map[string]interface{}, len(ev.Fields()))
+            for name, value := range ev.Fields() {
+                fields[name] = value
+            }
+            entry = &recentEvent{Type: ev.Type, Dataset: ev.Dataset, Timestamp: ev.Timestamp, SampleRate: ev.SampleRate, Fields: fields}
+        }
+        select {
+        case tail.events <- *entry:
+        default:
+            atomic.AddInt64(&tail.dropped, 1)
+        }
+    }
+}
+
+func (t *LiveTail) add(tail *tailConn) bool {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    if len(t.tails) >= t.maxConnections() {
+        return false
+    }
+    if t.tails == nil {
+        t.tails = make(map[*tailConn]bool)
+    }
+    t.tails[tail] = true
+    atomic.StoreInt32(&t.count, int32(len(t.tails)))
+    return true
+}
+
+func (t *LiveTail) remove(tail *tailConn) {
+    t.mu.Lock()
+    defer t.mu.Unlock()
+    delete(t.tails, tail)
+    atomic.StoreInt32(&t.count, int32(len(t.tails)))
+}
+
+func (h *UserEventsHandler) HandleTail(w http.ResponseWriter, r *http.Request) {
+    t := h.Tail
+    if t == nil {
+        http.NotFound(w, r)
+        return
+    }
+    if !bearerTokenOK(r, t.Token) {
+        http.Error(w, "unauthorized", http.StatusUnauthorized)
+        return
+    }
+    filter, err := parseTailFilter(r.URL.Query())
+    if err != nil {
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    }
+    tail := &tailConn{
+        filter:  filter,
+        events:  make(chan recentEvent, tailBufferSize),
+        limiter: rate.NewLimiter(rate.Limit(t.perSecond()), int(t.perSecond())+1),
+    }
+    if !t.add(tail) {
+        http.Error(w, "too many tails connected", http.StatusServiceUnavailable)
+        return
+    }
+    defer t.remove(tail)
+
+    // Browsers can't send the Authorization header on a WebSocket, so any
+    // origin is fine: the token already keeps out pages riding on someone's
+    // cookies
+    upgrader := websocket.Upgrader{CheckOrigin: func(r *http.Request) bool { return true }}
+    conn, err := upgrader.Upgrade(w, r, nil)
+    if err != nil {
+        return // The upgrader has already written an error response
+    }
+    defer conn.Close()
+    tailConnections.Inc()
+    defer tailConnections.Dec()
+
+    // We don't expect anything from the operator, but reading is how we
+    // notice they've gone
+    closed := make(chan struct{})
+    go func() {
+        defer close(closed)
+        for {
+            if _, _, err := conn.NextReader(); err != nil {
+                return
+            }
+        }
+    }()
+
+    ticker := time.NewTicker(tailDroppedReport)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-closed:
+            return
+        case <-r.Context().Done():
+            return
+        case entry := <-tail.events:
+            conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+            if err := conn.WriteJSON(entry); err != nil {
+                return
+            }
+        case <-ticker.C:
+            if dropped := atomic.SwapInt64(&tail.dropped, 0); dropped > 0 {
+                conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+                if err := conn.WriteJSON(map[string]int64{"dropped": dropped}); err != nil {
+                    return
+                }
+            }
+        }
+    }
+}
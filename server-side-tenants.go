@@ -0,0 +1,156 @@
+// One ingest service can front several product teams, each with its own
+// Honeycomb team (API key), datasets, and event budget. We work out which
+// tenant a request belongs to from its ingest token, which the tenant's pages
+// send in the X-Ingest-Token header (or ?token= for beacons, which can't set
+// headers), or failing that from the hostname events were posted to.
+//
+//     handler.Tenants = &TenantRegistry{Tenants: []*Tenant{{
+//         Name:            "checkout",
+//         Tokens:          []string{"ck_live_..."},
+//         Hosts:           []string{"events.checkout.example.com"},
+//         DatasetPrefix:   "checkout-",
+//         EventsPerMinute: 20000,
+//         Client:          checkoutClient, // Built with checkout's API key
+//     }}}
+type TenantRegistry struct {
+    Tenants []*Tenant
+
+    // Header carries the ingest token. Defaults to "X-Ingest-Token".
+    Header string
+    // RequireTenant turns away requests we can't match to a tenant, rather
+    // than sending them with the handler's own client and datasets.
+    RequireTenant bool
+
+    once    sync.Once
+    byToken map[string]*Tenant
+    byHost  map[string]*Tenant
+}
+
+type Tenant struct {
+    Name          string
+    Tokens        []string
+    Hosts         []string
+    DatasetPrefix string // Prepended to every dataset name, e.g. "checkout-user-events"
+
+    // EventsPerMinute is the tenant's quota, counted across every instance
+    // via the handler's State. 0 means unlimited.
+    EventsPerMinute int64
+
+    // Client sends the tenant's events. nil uses the handler's usual clients.
+    Client *libhoney.Client
+
+    // Fields limits which fields the tenant's browsers may set. nil lets
+    // them set any.
+    Fields *FieldPolicy
+
+    // Endpoint, instead of Client, has ValidateEndpoints start the tenant's
+    // client. With a Region, it has to be in that region.
+    Endpoint     *HoneycombEndpoint
+    Region       string
+    fromEndpoint bool
+}
+
+var (
+    ErrUnknownTenant = errors.New("unknown ingest token or host")
+    ErrQuotaExceeded = errors.New("tenant is over its event quota")
+)
+
+const defaultTenantHeader = "X-Ingest-Token"
+
+var tenantEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+    Name: "user_events_tenant_events_total",
+    Help: "Events received per tenant, by whether they were within quota.",
+}, []string{"tenant", "outcome"})
+
+func (t *TenantRegistry) index() {
+    t.byToken = map[string]*Tenant{}
+    t.byHost = map[string]*Tenant{}
+    for _, tenant := range t.Tenants {
+        for _, token := range tenant.Tokens {
+            t.byToken[token] = tenant
+        }
+        for _, host := range tenant.Hosts {
+            t.byHost[strings.ToLower(host)] = tenant
+        }
+    }
+}
+
+// Finds the request's tenant. Returns nil (and no error) if there are no
+// tenants configured, or if there's no match and we don't require one. A token
+// that doesn't match anyone is always an error, since it's most likely a typo
+// that would otherwise quietly send a team's events to someone else's
+// datasets.
+func (t *TenantRegistry) resolve(r *http.Request) (*Tenant, error) {
+    if t == nil || r == nil {
+        return nil, nil
+    }
+    t.once.Do(t.index)
+
+    header := t.Header
+    if header == "" {
+        header = defaultTenantHeader
+    }
+    token := r.Header.Get(header)
+    if token == "" {
+        token = r.URL.Query().Get("token")
+    }
+    if token != "" {
+        if tenant := t.byToken[token]; tenant != nil {
+            return tenant, nil
+        }
+        return nil, ErrUnknownTenant
+    }
+
+    host := r.Host
+    if h, _, err := net.SplitHostPort(host); err == nil {
+        host = h
+    }
+    if tenant := t.byHost[strings.ToLower(host)]; tenant != nil {
+        return tenant, nil
+    }
+    if t.RequireTenant {
+        return nil, ErrUnknownTenant
+    }
+    return nil, nil
+}
+
+// Counts the event against the tenant's quota for the current minute. Like
+// the shared rate limiter, if the store is down we'd rather let events through
+// than drop everyone's.
+func (t *Tenant) allow(store StateStore) bool {
+    if t.EventsPerMinute <= 0 {
+        tenantEvents.WithLabelValues(t.Name, "allowed").Inc()
+        return true
+    }
+    ctx, cancel := context.WithTimeout(context.Background(), stateStoreTimeout)
+    defer cancel()
+
+    minute := time.Now().Unix() / 60
+    count, err := store.Incr(ctx, fmt.Sprintf("quota:%s:%d", t.Name, minute), 2*time.Minute)
+    if err == nil && count > t.EventsPerMinute {
+        tenantEvents.WithLabelValues(t.Name, "over_quota").Inc()
+        return false
+    }
+    tenantEvents.WithLabelValues(t.Name, "allowed").Inc()
+    return true
+}
+
+// Tenant clients are registered alongside the ClientRouter's under this
+// prefix, so spooled events find their way back to the right team
+const tenantClientPrefix = "tenant:"
+
+func (t *Tenant) clientName() string {
+    return tenantClientPrefix + t.Name
+}
+
+func (t *TenantRegistry) clientNamed(name string) *libhoney.Client {
+    if t == nil || !strings.HasPrefix(name, tenantClientPrefix) {
+        return nil
+    }
+    for _, tenant := range t.Tenants {
+        if tenant.clientName() == name {
+            return tenant.Client
+        }
+    }
+    return nil
+}
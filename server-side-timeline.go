@@ -0,0 +1,244 @@
+// Support engineers asking "what did this user actually do?" shouldn't need
+// Honeycomb access (or to learn its query builder). UserTimeline keeps each
+// user's recent events, as sent to Honeycomb, in a short-retention store, and
+// HandleTimeline returns them in order:
+//
+//     handler.Timeline = &UserTimeline{
+//         Store: &RedisTimelineStore{Client: redisClient, Prefix: "user-events:"},
+//         Token: os.Getenv("SUPPORT_TOKEN"),
+//     }
+//     mux.HandleFunc("/support/timeline", handler.HandleTimeline)
+//
+//     GET /support/timeline?user_id=123&since=2024-01-02T15:04:05Z&limit=200
+//
+// Events keep going to Honeycomb exactly as before; this is a copy. Only
+// events from a signed-in user are kept, under the ID they authenticated
+// with (or its pseudonym, with the handler's Pseudonyms), never a user_id
+// the browser sent, so nobody can write into someone else's timeline. The
+// events have already been scrubbed.
+type UserTimeline struct {
+    Store      TimelineStore // Defaults to in-memory, which only sees this instance's events
+    Retention  time.Duration // Defaults to 24 hours
+    MaxPerUser int           // Keeps only the newest this many per user; defaults to 1000
+    Token      string        // Required as "Authorization: Bearer <token>"
+
+    storeOnce sync.Once
+}
+
+// TimelineStore holds each user's events in time order.
+type TimelineStore interface {
+    // Append adds an entry to the user's timeline, trimming it to the newest
+    // max entries within retention.
+    Append(ctx context.Context, userID string, entry TimelineEntry, retention time.Duration, max int) error
+    // Range returns up to limit entries since the given time, oldest first.
+    Range(ctx context.Context, userID string, since time.Time, limit int) ([]TimelineEntry, error)
+}
+
+type TimelineEntry struct {
+    Type      string                 `json:"type"`
+    Dataset   string                 `json:"dataset"`
+    Timestamp time.Time              `json:"timestamp"`
+    Fields    map[string]interface{} `json:"fields"`
+}
+
+func (t *UserTimeline) store() TimelineStore {
+    t.storeOnce.Do(func() {
+        if t.Store == nil {
+            t.Store = &MemoryTimelineStore{}
+        }
+    })
+    return t.Store
+}
+
+func (t *UserTimeline) retention() time.Duration {
+    if t.Retention > 0 {
+        return t.Retention
+    }
+    return 24 * time.Hour
+}
+
+func (t *UserTimeline) maxPerUser() int {
+    if t.MaxPerUser > 0 {
+        return t.MaxPerUser
+    }
+    return 1000
+}
+
+func (t *UserTimeline) record(h *UserEventsHandler, ev *Event) {
+    if ev.user == nil || ev.user.ID == "" {
+        return
+    }
+    ctx, cancel := context.WithTimeout(context.Background(), stateStoreTimeout)
+    defer cancel()
+    userID := ev.user.ID
+    if h.Pseudonyms != nil {
+        // The events' user_id is the pseudonym, so support look them up by it
+        pseudonym, err := h.Pseudonyms.Pseudonym(ctx, "user_id", userID)
+        if err != nil {
+            h.logger().Warn("couldn't pseudonymize user for timeline", "type", ev.Type, "error", err)
+            return
+        }
+        userID = pseudonym
+    }
+    entry := TimelineEntry{Type: ev.Type, Dataset: ev.Dataset, Timestamp: ev.Timestamp, Fields: ev.Fields()}
+    if err := t.store().Append(ctx, userID, entry, t.retention(), t.maxPerUser()); err != nil {
+        h.logger().Warn("couldn't add event to user timeline", "type", ev.Type, "error", err)
+    }
+}
+
+func (h *UserEventsHandler) HandleTimeline(w http.ResponseWriter, r *http.Request) {
+    t := h.Timeline
+    if t == nil {
+        http.NotFound(w, r)
+        return
+    }
+    if !bearerTokenOK(r, t.Token) {
+        http.Error(w, "unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    query := r.URL.Query()
+    userID := query.Get("user_id")
+    if userID == "" {
+        http.Error(w, "user_id is required", http.StatusBadRequest)
+        return
+    }
+    since := time.Now().Add(-t.retention())
+    if raw := query.Get("since"); raw != "" {
+        parsed, err := time.Parse(time.RFC3339, raw)
+        if err != nil {
+            http.Error(w, "since must be an RFC 3339 time", http.StatusBadRequest)
+            return
+        }
+        since = parsed
+    }
+    limit := 200
+    if raw := query.Get("limit"); raw != "" {
+        n, err := strconv.Atoi(raw)
+        if err != nil || n <= 0 {
+            http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+            return
+        }
+        limit = n
+    }
+
+    entries, err := t.store().Range(r.Context(), userID, since, limit)
+    if err != nil {
+        h.logger().Error("couldn't read user timeline", "error", err)
+        http.Error(w, "couldn't read timeline", http.StatusInternalServerError)
+        return
+    }
+    if entries == nil {
+        entries = []TimelineEntry{}
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{"user_id": userID, "events": entries})
+}
+
+// MemoryTimelineStore keeps timelines in this process, for a single instance
+// or local development. Past MaxUsers, the users least recently added to are
+// forgotten.
+type MemoryTimelineStore struct {
+    MaxUsers int // Defaults to 10000
+
+    mu    sync.Mutex
+    users *lru.Cache // User ID -> []TimelineEntry
+}
+
+// Only with mu held
+func (m *MemoryTimelineStore) timelines() *lru.Cache {
+    if m.users == nil {
+        size := m.MaxUsers
+        if size <= 0 {
+            size = 10000
+        }
+        m.users, _ = lru.New(size)
+    }
+    return m.users
+}
+
+// Only with mu held
+func (m *MemoryTimelineStore) timeline(userID string) []TimelineEntry {
+    if cached, ok := m.timelines().Peek(userID); ok {
+        return cached.([]TimelineEntry)
+    }
+    return nil
+}
+
+func (m *MemoryTimelineStore) Append(ctx context.Context, userID string, entry TimelineEntry, retention time.Duration, max int) error {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    entries := append(m.timeline(userID), entry)
+    sort.SliceStable(entries, func(i, j int) bool { return entries[i].Timestamp.Before(entries[j].Timestamp) })
+
+    cutoff := time.Now().Add(-retention)
+    start := sort.Search(len(entries), func(i int) bool { return !entries[i].Timestamp.Before(cutoff) })
+    if len(entries)-start > max {
+        start = len(entries) - max
+    }
+    m.timelines().Add(userID, append([]TimelineEntry(nil), entries[start:]...))
+    return nil
+}
+
+func (m *MemoryTimelineStore) Range(ctx context.Context, userID string, since time.Time, limit int) ([]TimelineEntry, error) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    var out []TimelineEntry
+    for _, entry := range m.timeline(userID) {
+        if entry.Timestamp.Before(since) {
+            continue
+        }
+        if len(out) >= limit {
+            break
+        }
+        out = append(out, entry)
+    }
+    return out, nil
+}
+
+// RedisTimelineStore keeps each user's timeline in a Redis sorted set scored
+// by event time, so every instance appends to (and reads) the same timeline.
+type RedisTimelineStore struct {
+    Client *redis.Client
+    Prefix string
+}
+
+func (s *RedisTimelineStore) key(userID string) string {
+    return s.Prefix + "timeline:" + userID
+}
+
+func (s *RedisTimelineStore) Append(ctx context.Context, userID string, entry TimelineEntry, retention time.Duration, max int) error {
+    buf, err := json.Marshal(entry)
+    if err != nil {
+        return err
+    }
+    key := s.key(userID)
+    cutoff := time.Now().Add(-retention)
+    pipe := s.Client.TxPipeline()
+    pipe.ZAdd(ctx, key, redis.Z{Score: float64(entry.Timestamp.UnixNano()), Member: buf})
+    pipe.ZRemRangeByScore(ctx, key, "-inf", "("+strconv.FormatInt(cutoff.UnixNano(), 10))
+    pipe.ZRemRangeByRank(ctx, key, 0, int64(-max-1))
+    pipe.Expire(ctx, key, retention)
+    _, err = pipe.Exec(ctx)
+    return err
+}
+
+func (s *RedisTimelineStore) Range(ctx context.Context, userID string, since time.Time, limit int) ([]TimelineEntry, error) {
+    members, err := s.Client.ZRangeByScore(ctx, s.key(userID), &redis.ZRangeBy{
+        Min:   strconv.FormatInt(since.UnixNano(), 10),
+        Max:   "+inf",
+        Count: int64(limit),
+    }).Result()
+    if err != nil {
+        return nil, err
+    }
+    entries := make([]TimelineEntry, 0, len(members))
+    for _, member := range members {
+        var entry TimelineEntry
+        if err := json.Unmarshal([]byte(member), &entry); err != nil {
+            continue // Written by some incompatible version; skip it
+        }
+        entries = append(entries, entry)
+    }
+    return entries, nil
+}
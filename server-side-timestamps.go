@@ -0,0 +1,42 @@
+// Browser clocks are often minutes (sometimes hours) off, which makes any
+// latency math in Honeycomb garbage. Each event tells us when the browser
+// thinks it sent it (`sent_at`), so comparing that to when we received it gives
+// us the client's clock skew, give or take network latency. We then shift the
+// event's own `timestamp` (if it has one) by the same amount, and record the
+// skew itself as `clock_skew_ms` so badly-off clients are easy to find.
+//
+// Events without a sent_at (like spans from the OTel SDK) keep their own
+// timestamp as-is, since we've nothing to correct it against.
+func correctClockSkew(ev *Event, metadata map[string]interface{}, receivedAt time.Time) {
+    sentAt, ok := parseClientTime(metadata["sent_at"])
+    if !ok {
+        if clientTimestamp, ok := parseClientTime(metadata["timestamp"]); ok {
+            ev.Timestamp = clientTimestamp
+        }
+        return
+    }
+    skew := receivedAt.Sub(sentAt)
+    ev.AddField("clock_skew_ms", skew.Nanoseconds()/int64(time.Millisecond))
+
+    if clientTimestamp, ok := parseClientTime(metadata["timestamp"]); ok {
+        ev.Timestamp = clientTimestamp.Add(skew)
+    } else {
+        ev.Timestamp = receivedAt
+    }
+}
+
+// The browser sends times either as ms since the epoch (Date.now()), or as
+// ISO 8601 strings (new Date().toISOString()).
+func parseClientTime(value interface{}) (time.Time, bool) {
+    switch v := value.(type) {
+    case float64:
+        if v <= 0 {
+            return time.Time{}, false
+        }
+        return time.Unix(0, int64(v)*int64(time.Millisecond)), true
+    case string:
+        t, err := time.Parse(time.RFC3339Nano, v)
+        return t, err == nil
+    }
+    return time.Time{}, false
+}
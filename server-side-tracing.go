@@ -0,0 +1,122 @@
+// Browser events are much more useful when they join up with the traces from
+// our backend services. The browser SDK sends a W3C `traceparent` header (or
+// a `trace_id` field, for beacons, which can't set headers), and we use it to
+// put each event into that trace.
+//
+// TraceIngest also records the ingest request itself as a span, as a child of
+// the browser's span, with the browser events as children of that. Wrap the
+// event endpoints with it:
+//
+//     mux.Handle("/events/beacon", handler.TraceIngest(http.HandlerFunc(handler.HandleBeacon)))
+type traceContext struct {
+    TraceID  string
+    ParentID string // The browser's span, if it told us about one
+    SpanID   string // Our span for the ingest request
+}
+
+type traceContextKey struct{}
+
+func (h *UserEventsHandler) TraceIngest(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        tc := traceContext{SpanID: newSpanID()}
+        if traceID, parentID, ok := parseTraceparent(r.Header.Get("traceparent")); ok {
+            tc.TraceID, tc.ParentID = traceID, parentID
+        } else {
+            tc.TraceID = newTraceID()
+        }
+
+        start := time.Now()
+        rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+        next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), traceContextKey{}, tc)))
+
+        span := h.newEvent("ingest-request", nil, r)
+        span.Timestamp = start
+        span.AddField("name", r.URL.Path)
+        span.AddField("service_name", "user-events")
+        span.AddField("trace.trace_id", tc.TraceID)
+        span.AddField("trace.span_id", tc.SpanID)
+        if tc.ParentID != "" {
+            span.AddField("trace.parent_id", tc.ParentID)
+        }
+        span.AddField("http.method", r.Method)
+        span.AddField("http.status_code", rec.status)
+        span.AddField("duration_ms", float64(time.Since(start))/float64(time.Millisecond))
+        h.send(context.Background(), span) // The request's own context is done by now
+    })
+}
+
+// TraceEnricher puts each event into the trace of the request that delivered
+// it. If the request didn't come through TraceIngest, we fall back on any
+// trace_id (and span_id, for the parent) the browser put in the event itself.
+// An event that's already in a trace (the browser, or a span, set its
+// trace.trace_id) is left in it, so browser-to-server links survive.
+type TraceEnricher struct{}
+
+func (TraceEnricher) Enrich(ctx context.Context, ev *Event, r *http.Request, user *UserInfo) error {
+    if id, _ := ev.Fields()["trace.trace_id"].(string); id != "" {
+        if span, _ := ev.Fields()["trace.span_id"].(string); span == "" {
+            ev.AddField("trace.span_id", newSpanID())
+        }
+        return nil
+    }
+    if tc, ok := r.Context().Value(traceContextKey{}).(traceContext); ok {
+        ev.AddField("trace.trace_id", tc.TraceID)
+        ev.AddField("trace.parent_id", tc.SpanID)
+        ev.AddField("trace.span_id", newSpanID())
+        return nil
+    }
+
+    fields := ev.Fields()
+    traceID, ok := fields["trace_id"].(string)
+    if !ok || traceID == "" {
+        return nil
+    }
+    ev.AddField("trace.trace_id", traceID)
+    if parentID, ok := fields["span_id"].(string); ok && parentID != "" {
+        ev.AddField("trace.parent_id", parentID)
+    }
+    ev.AddField("trace.span_id", newSpanID())
+    return nil
+}
+
+// traceparent looks like "00-<32 hex trace ID>-<16 hex parent ID>-<2 hex flags>"
+func parseTraceparent(header string) (traceID, parentID string, ok bool) {
+    parts := strings.Split(strings.TrimSpace(header), "-")
+    if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+        return "", "", false
+    }
+    traceID, parentID = strings.ToLower(parts[1]), strings.ToLower(parts[2])
+    if !isHexID(traceID, 32) || !isHexID(parentID, 16) {
+        return "", "", false
+    }
+    return traceID, parentID, true
+}
+
+// All-zero IDs are explicitly invalid in the spec
+func isHexID(id string, length int) bool {
+    if len(id) != length || strings.Trim(id, "0") == "" {
+        return false
+    }
+    _, err := hex.DecodeString(id)
+    return err == nil
+}
+
+func newTraceID() string { return randomHex(16) }
+func newSpanID() string  { return randomHex(8) }
+
+func randomHex(n int) string {
+    buf := make([]byte, n)
+    crand.Read(buf)
+    return hex.EncodeToString(buf)
+}
+
+// Remembers the status code so we can put it on the ingest span
+type statusRecorder struct {
+    http.ResponseWriter
+    status int
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+    s.status = code
+    s.ResponseWriter.WriteHeader(code)
+}
@@ -0,0 +1,115 @@
+// Marketing wants to break page views down by where visitors came from.
+// TrafficSourceEnricher works that out from the page's UTM parameters if it
+// has them, and otherwise from its referrer, adding:
+//
+//   - traffic_source, e.g. "google", "newsletter", or "direct"
+//   - traffic_medium: the page's utm_medium, or our own classification of
+//     the referrer as "search", "social", "referral", "internal", or "direct"
+//   - utm_campaign, when the page has one
+//   - referrer_domain
+//
+// The page URL comes from the event's url field, or the Referer header of
+// the request that sent it (which is the page, not where the page came from).
+// The page's own referrer is the event's referrer field, from
+// document.referrer. Add this before URLNormalizer, which strips the query
+// string the UTM parameters are in.
+type TrafficSourceEnricher struct {
+    // Domains (and their subdomains) to classify referrers by. Search and
+    // Social have sensible defaults; Internal should be our own domains.
+    Search   []string `yaml:"search"`
+    Social   []string `yaml:"social"`
+    Internal []string `yaml:"internal"`
+}
+
+var (
+    defaultSearchDomains = []string{"google.com", "bing.com", "duckduckgo.com", "yahoo.com", "baidu.com", "yandex.ru", "ecosia.org"}
+    defaultSocialDomains = []string{"facebook.com", "t.co", "twitter.com", "x.com", "linkedin.com", "reddit.com", "instagram.com", "youtube.com", "news.ycombinator.com"}
+)
+
+func (t *TrafficSourceEnricher) Enrich(ctx context.Context, ev *Event, r *http.Request, user *UserInfo) error {
+    fields := ev.Fields()
+    pageURL, _ := fields["url"].(string)
+    if pageURL == "" {
+        pageURL = r.Referer()
+    }
+    if page, err := url.Parse(pageURL); err == nil {
+        query := page.Query()
+        if source := query.Get("utm_source"); source != "" {
+            ev.AddField("traffic_source", source)
+            medium := query.Get("utm_medium")
+            if medium == "" {
+                medium = "campaign"
+            }
+            ev.AddField("traffic_medium", medium)
+        }
+        if campaign := query.Get("utm_campaign"); campaign != "" {
+            ev.AddField("utm_campaign", campaign)
+        }
+    }
+
+    referrer, _ := fields["referrer"].(string)
+    domain := ""
+    if u, err := url.Parse(referrer); err == nil && u.Host != "" {
+        domain = strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+        ev.AddField("referrer_domain", domain)
+    }
+    if _, ok := fields["traffic_source"]; ok {
+        return nil // The UTM parameters win
+    }
+
+    medium := t.classify(domain)
+    source := domain
+    switch medium {
+    case "direct":
+        source = "direct"
+    case "search", "social":
+        source = siteName(domain)
+    }
+    ev.AddField("traffic_source", source)
+    ev.AddField("traffic_medium", medium)
+    return nil
+}
+
+func (t *TrafficSourceEnricher) classify(domain string) string {
+    if domain == "" {
+        return "direct"
+    }
+    search, social := t.Search, t.Social
+    if search == nil {
+        search = defaultSearchDomains
+    }
+    if social == nil {
+        social = defaultSocialDomains
+    }
+    switch {
+    case domainIn(domain, t.Internal):
+        return "internal"
+    case domainIn(domain, search) || strings.HasPrefix(domain, "google."):
+        return "search" // Google has a domain for every country
+    case domainIn(domain, social):
+        return "social"
+    }
+    return "referral"
+}
+
+func domainIn(domain string, domains []string) bool {
+    for _, d := range domains {
+        if domain == d || strings.HasSuffix(domain, "."+d) {
+            return true
+        }
+    }
+    return false
+}
+
+// "www.google.co.uk" -> "google", "m.facebook.com" -> "facebook", "t.co" -> "t"
+func siteName(domain string) string {
+    labels := strings.Split(domain, ".")
+    for _, label := range labels {
+        switch label {
+        case "www", "m", "mobile", "l", "lm", "old", "news":
+            continue
+        }
+        return label
+    }
+    return domain
+}
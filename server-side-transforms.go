@@ -0,0 +1,225 @@
+// Field names drift between browser SDK versions (pageLoadTime one release,
+// page_load_ms the next), and old versions stay out in the wild for months.
+// Transforms are a compatibility shim, defined in the config file and applied
+// to each event type's fields as they arrive, before the payload limits,
+// flattening, validation or anything else reads them:
+//
+//     transforms:
+//       "*":
+//         - {rename: userAgent, to: user_agent}
+//       page-load:
+//         - {rename: pageLoadTime, to: page_load_ms}
+//         - {cast: page_load_ms, to: number}
+//         - {move: timing.ttfb, to: ttfb_ms}
+//         - {flatten: navigation}               # navigation.type, navigation.redirect_count, ...
+//         - {delete: debugBlob}
+//
+// "*" applies to every type, before the type's own. rename works on
+// top-level field names as-is (they can contain dots, like trace.span_id),
+// while move's names are dot paths into nested objects. Transforms that
+// don't apply (a field that isn't there, a string that isn't a number) are
+// skipped, leaving the field for validation to catch. Config.Reload swaps in
+// new transforms without a restart.
+type Transform struct {
+    Rename  string `yaml:"rename"`
+    Move    string `yaml:"move"`
+    Cast    string `yaml:"cast"`
+    Flatten string `yaml:"flatten"` // A field, or "*" for every nested object
+    Delete  string `yaml:"delete"`
+
+    To        string `yaml:"to"`        // New name for rename/move; number, integer, string, or bool for cast
+    Separator string `yaml:"separator"` // Between flattened names; defaults to "."
+}
+
+// Transforms holds the transforms for each event type, and lets Reload
+// replace them while events are flowing.
+type Transforms struct {
+    mu     sync.RWMutex
+    byType map[string][]Transform
+}
+
+var castTypes = map[string]bool{"number": true, "integer": true, "string": true, "bool": true}
+
+func NewTransforms(byType map[string][]Transform) (*Transforms, error) {
+    t := &Transforms{}
+    if err := t.Set(byType); err != nil {
+        return nil, err
+    }
+    return t, nil
+}
+
+// Set replaces every transform, unless one of them is invalid.
+func (t *Transforms) Set(byType map[string][]Transform) error {
+    for eventType, transforms := range byType {
+        for i, transform := range transforms {
+            if err := transform.validate(); err != nil {
+                return fmt.Errorf("transforms.%s[%d]: %v", eventType, i, err)
+            }
+        }
+    }
+    t.mu.Lock()
+    t.byType = byType
+    t.mu.Unlock()
+    return nil
+}
+
+func (tr Transform) validate() error {
+    ops := 0
+    for _, field := range []string{tr.Rename, tr.Move, tr.Cast, tr.Flatten, tr.Delete} {
+        if field != "" {
+            ops++
+        }
+    }
+    switch {
+    case ops != 1:
+        return errors.New("needs exactly one of rename, move, cast, flatten, or delete")
+    case (tr.Rename != "" || tr.Move != "") && tr.To == "":
+        return errors.New("rename and move need a to")
+    case tr.Cast != "" && !castTypes[tr.To]:
+        return fmt.Errorf("can't cast to %q (number, integer, string, or bool)", tr.To)
+    }
+    return nil
+}
+
+// Applies eventType's transforms to metadata in place. t may be nil.
+func (t *Transforms) apply(eventType string, metadata map[string]interface{}) {
+    if t == nil {
+        return
+    }
+    t.mu.RLock()
+    all, own := t.byType["*"], t.byType[eventType]
+    t.mu.RUnlock()
+    for _, transforms := range [][]Transform{all, own} {
+        for _, tr := range transforms {
+            tr.apply(metadata)
+        }
+    }
+}
+
+func (tr Transform) apply(metadata map[string]interface{}) {
+    switch {
+    case tr.Rename != "":
+        if value, ok := metadata[tr.Rename]; ok {
+            delete(metadata, tr.Rename)
+            metadata[tr.To] = value
+        }
+    case tr.Move != "":
+        if value, ok := takePath(metadata, strings.Split(tr.Move, ".")); ok {
+            setPath(metadata, strings.Split(tr.To, "."), value)
+        }
+    case tr.Cast != "":
+        if value, ok := metadata[tr.Cast]; ok {
+            if cast, ok := castValue(value, tr.To); ok {
+                metadata[tr.Cast] = cast
+            }
+        }
+    case tr.Flatten != "":
+        separator := tr.Separator
+        if separator == "" {
+            separator = "."
+        }
+        for name, value := range metadata {
+            if nested, ok := value.(map[string]interface{}); ok && (tr.Flatten == "*" || tr.Flatten == name) {
+                delete(metadata, name)
+                flattenInto(metadata, name, nested, separator)
+            }
+        }
+    case tr.Delete != "":
+        delete(metadata, tr.Delete)
+    }
+}
+
+// Removes and returns the value at path, e.g. ["timing", "ttfb"]
+func takePath(object map[string]interface{}, path []string) (interface{}, bool) {
+    for _, key := range path[:len(path)-1] {
+        next, ok := object[key].(map[string]interface{})
+        if !ok {
+            return nil, false
+        }
+        object = next
+    }
+    value, ok := object[path[len(path)-1]]
+    delete(object, path[len(path)-1])
+    return value, ok
+}
+
+// Sets the value at path, creating objects along the way (and replacing any
+// non-object in the way)
+func setPath(object map[string]interface{}, path []string, value interface{}) {
+    for _, key := range path[:len(path)-1] {
+        next, ok := object[key].(map[string]interface{})
+        if !ok {
+            next = map[string]interface{}{}
+            object[key] = next
+        }
+        object = next
+    }
+    object[path[len(path)-1]] = value
+}
+
+// Existing top-level fields win over flattened ones, so flattening can't
+// clobber something the browser sent on its own
+func flattenInto(metadata map[string]interface{}, prefix string, nested map[string]interface{}, separator string) {
+    for name, value := range nested {
+        key := prefix + separator + name
+        if inner, ok := value.(map[string]interface{}); ok {
+            flattenInto(metadata, key, inner, separator)
+            continue
+        }
+        if _, exists := metadata[key]; !exists {
+            metadata[key] = value
+        }
+    }
+}
+
+func castValue(value interface{}, to string) (interface{}, bool) {
+    switch to {
+    case "number", "integer":
+        var n float64
+        switch v := value.(type) {
+        case float64:
+            n = v
+        case string:
+            parsed, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+            if err != nil {
+                return nil, false
+            }
+            n = parsed
+        case bool:
+            if v {
+                n = 1
+            }
+        default:
+            return nil, false
+        }
+        if math.IsNaN(n) || math.IsInf(n, 0) {
+            return nil, false
+        }
+        if to == "integer" {
+            n = math.Trunc(n)
+        }
+        return n, true // Still a float64, like every other number from JSON
+    case "string":
+        switch v := value.(type) {
+        case string:
+            return v, true
+        case float64:
+            return strconv.FormatFloat(v, 'f', -1, 64), true
+        case bool:
+            return strconv.FormatBool(v), true
+        }
+        return nil, false
+    case "bool":
+        switch v := value.(type) {
+        case bool:
+            return v, true
+        case string:
+            parsed, err := strconv.ParseBool(strings.TrimSpace(v))
+            return parsed, err == nil
+        case float64:
+            return v != 0, true
+        }
+        return nil, false
+    }
+    return nil, false
+}
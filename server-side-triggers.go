@@ -0,0 +1,391 @@
+// Every team that set up this handler then had to click together the same
+// Honeycomb triggers by hand. TriggerSync creates them from config instead,
+// and keeps them in sync on every startup: triggers are matched by name,
+// updated if they've changed, and ones we created that have since been taken
+// out of the config are deleted. Triggers made by hand in the UI are left
+// alone.
+//
+//     triggers:
+//       - name: Slow LCP
+//         calculation: P75(lcp)
+//         filters: ["type = page-load"]
+//         threshold: "> 4000"
+//         window: 10m
+//         recipients: [{type: slack, target: "#frontend-alerts"}]
+//
+// A trigger without a Dataset is created on every dataset the handler sends
+// to. DefaultTriggers are a reasonable starting set for browser events.
+type TriggerSpec struct {
+    Name        string   `yaml:"name"`
+    Dataset     string   `yaml:"dataset"`
+    Calculation string   `yaml:"calculation"` // e.g. "COUNT" or "P75(lcp)"
+    Filters     []string `yaml:"filters"`     // "<column> <op> <value>", e.g. "type = page-load"
+    Threshold   string   `yaml:"threshold"`   // "<op> <value>", e.g. "> 4000"
+
+    Window     time.Duration      `yaml:"window"`    // The query's time range; defaults to 10 minutes
+    Frequency  time.Duration      `yaml:"frequency"` // How often it runs; defaults to Window
+    Recipients []TriggerRecipient `yaml:"recipients"`
+}
+
+type TriggerRecipient struct {
+    Type   string `json:"type" yaml:"type"` // e.g. "email", "slack", "pagerduty", "webhook"
+    Target string `json:"target" yaml:"target"`
+}
+
+// DefaultTriggers alert on the Web Vitals thresholds for "poor" and on a
+// burst of errors.
+var DefaultTriggers = []TriggerSpec{
+    {Name: "Slow LCP (p75 over 4s)", Calculation: "P75(lcp)", Filters: []string{"type = page-load"}, Threshold: "> 4000"},
+    {Name: "Slow interactions (p75 INP over 500ms)", Calculation: "P75(duration_ms)", Filters: []string{"type = interaction"}, Threshold: "> 500"},
+    {Name: "Error burst", Dataset: builtinDatasets[errorEventType], Calculation: "COUNT", Threshold: "> 100"},
+}
+
+// Marks triggers as ours, so we know which ones we're allowed to change
+const managedTriggerNote = "Managed by the user events handler's config; changes made here will be overwritten."
+
+type TriggerSync struct {
+    APIKey     string // Needs the "manage triggers" permission
+    APIHost    string // Defaults to https://api.honeycomb.io
+    HTTPClient *http.Client
+    Logger     *slog.Logger // Defaults to slog.Default(); SyncTriggers gives it the handler's
+}
+
+// The shape of a trigger in Honeycomb's Triggers API
+type honeycombTrigger struct {
+    ID          string                 `json:"id,omitempty"`
+    Name        string                 `json:"name"`
+    Description string                 `json:"description"`
+    Query       map[string]interface{} `json:"query"`
+    Threshold   map[string]interface{} `json:"threshold"`
+    Frequency   int                    `json:"frequency"`
+    Recipients  []TriggerRecipient     `json:"recipients,omitempty"`
+}
+
+// Sync makes each dataset's managed triggers match specs. datasets are where
+// specs without a Dataset go.
+func (s *TriggerSync) Sync(ctx context.Context, specs []TriggerSpec, datasets []string) error {
+    wanted := make(map[string]map[string]honeycombTrigger) // Dataset -> name -> trigger
+    for _, spec := range specs {
+        trigger, err := spec.trigger()
+        if err != nil {
+            return fmt.Errorf("trigger %q: %v", spec.Name, err)
+        }
+        targets := datasets
+        if spec.Dataset != "" {
+            targets = []string{spec.Dataset}
+        }
+        for _, dataset := range targets {
+            if wanted[dataset] == nil {
+                wanted[dataset] = make(map[string]honeycombTrigger)
+            }
+            wanted[dataset][spec.Name] = trigger
+        }
+    }
+    for _, dataset := range datasets {
+        if wanted[dataset] == nil {
+            wanted[dataset] = map[string]honeycombTrigger{} // So leftovers still get cleaned up
+        }
+    }
+
+    for dataset, triggers := range wanted {
+        if err := s.syncDataset(ctx, dataset, triggers); err != nil {
+            return fmt.Errorf("syncing triggers on %s: %v", dataset, err)
+        }
+    }
+    return nil
+}
+
+func (s *TriggerSync) syncDataset(ctx context.Context, dataset string, wanted map[string]honeycombTrigger) error {
+    base := "/1/triggers/" + url.PathEscape(dataset)
+    var existing []honeycombTrigger
+    if err := s.call(ctx, http.MethodGet, base, nil, &existing); err != nil {
+        return err
+    }
+    byName := make(map[string]honeycombTrigger, len(existing))
+    for _, trigger := range existing {
+        byName[trigger.Name] = trigger
+    }
+
+    for name, trigger := range wanted {
+        current, ok := byName[name]
+        switch {
+        case !ok:
+            if err := s.call(ctx, http.MethodPost, base, trigger, nil); err != nil {
+                return err
+            }
+        case current.Description != managedTriggerNote:
+            s.logger().Warn("not touching a trigger someone made by hand with the same name", "dataset", dataset, "trigger", name)
+        default:
+            if err := s.call(ctx, http.MethodPut, base+"/"+url.PathEscape(current.ID), trigger, nil); err != nil {
+                return err
+            }
+        }
+    }
+    for _, trigger := range existing {
+        if _, ok := wanted[trigger.Name]; !ok && trigger.Description == managedTriggerNote {
+            if err := s.call(ctx, http.MethodDelete, base+"/"+url.PathEscape(trigger.ID), nil, nil); err != nil {
+                return err
+            }
+        }
+    }
+    return nil
+}
+
+func (s *TriggerSync) logger() *slog.Logger {
+    if s.Logger != nil {
+        return s.Logger
+    }
+    return slog.Default()
+}
+
+func (s *TriggerSync) call(ctx context.Context, method, path string, body, out interface{}) error {
+    return honeycombAPI(ctx, s.HTTPClient, s.APIHost, s.APIKey, method, path, body, out)
+}
+
+func (spec TriggerSpec) trigger() (honeycombTrigger, error) {
+    calculation := map[string]interface{}{"op": spec.Calculation}
+    if op, column, ok := strings.Cut(strings.TrimSuffix(spec.Calculation, ")"), "("); ok {
+        calculation = map[string]interface{}{"op": strings.ToUpper(op), "column": column}
+    }
+
+    var filters []map[string]interface{}
+    for _, raw := range spec.Filters {
+        parts := strings.SplitN(strings.TrimSpace(raw), " ", 3)
+        if len(parts) < 2 {
+            return honeycombTrigger{}, fmt.Errorf("filter %q should be \"<column> <op> <value>\"", raw)
+        }
+        filter := map[string]interface{}{"column": parts[0], "op": parts[1]}
+        if len(parts) == 3 {
+            filter["value"] = triggerValue(parts[2])
+        }
+        filters = append(filters, filter)
+    }
+
+    op, value, ok := strings.Cut(strings.TrimSpace(spec.Threshold), " ")
+    threshold, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+    if !ok || err != nil {
+        return honeycombTrigger{}, fmt.Errorf("threshold %q should be \"<op> <number>\"", spec.Threshold)
+    }
+
+    window := spec.Window
+    if window <= 0 {
+        window = 10 * time.Minute
+    }
+    frequency := spec.Frequency
+    if frequency <= 0 {
+        frequency = window
+    }
+    query := map[string]interface{}{
+        "calculations": []interface{}{calculation},
+        "time_range":   int(window.Seconds()),
+    }
+    if len(filters) > 0 {
+        query["filters"] = filters
+    }
+    return honeycombTrigger{
+        Name:        spec.Name,
+        Description: managedTriggerNote,
+        Query:       query,
+        Threshold:   map[string]interface{}{"op": op, "value": threshold},
+        Frequency:   int(frequency.Seconds()),
+        Recipients:  spec.Recipients,
+    }, nil
+}
+
+// Filter values are numbers if they look like one
+func triggerValue(raw string) interface{} {
+    if n, err := strconv.ParseFloat(raw, 64); err == nil {
+        return n
+    }
+    return raw
+}
+
+// Triggers fire on a threshold; an SLO's burn alerts fire when its error
+// budget is going faster than it should, which is what should page someone.
+// BurnAlertSpecs are synced alongside the triggers, onto SLOs that already
+// exist (SLOs need a derived column, which is better made in the UI):
+//
+//     burn_alerts:
+//       - slo: Page loads under 3s
+//         exhaustion: 4h
+//         recipients: [{type: pagerduty, target: frontend}]
+//       - slo: Page loads under 3s
+//         budget_rate: {window: 1h, decrease_percent: 2}
+//
+// Give each alert Exhaustion (fire when the budget will run out within that
+// long) or BudgetRate (fire when it drops by more than DecreasePercent within
+// Window). A spec without a Dataset goes on every dataset the handler sends
+// to that has an SLO by that name. Like triggers, the burn alerts we create
+// are kept in line with the config, and ones made by hand are left alone.
+type BurnAlertSpec struct {
+    SLO        string             `yaml:"slo"` // The SLO's name
+    Dataset    string             `yaml:"dataset"`
+    Exhaustion time.Duration      `yaml:"exhaustion"`
+    BudgetRate *BudgetRate        `yaml:"budget_rate"`
+    Recipients []TriggerRecipient `yaml:"recipients"`
+}
+
+type BudgetRate struct {
+    Window          time.Duration `yaml:"window"`
+    DecreasePercent float64       `yaml:"decrease_percent"`
+}
+
+// The shapes of an SLO and a burn alert in Honeycomb's API
+type honeycombSLO struct {
+    ID   string `json:"id"`
+    Name string `json:"name"`
+}
+
+type honeycombBurnAlert struct {
+    ID                        string             `json:"id,omitempty"`
+    Description               string             `json:"description"`
+    AlertType                 string             `json:"alert_type"` // "exhaustion_time" or "budget_rate"
+    ExhaustionMinutes         int                `json:"exhaustion_minutes,omitempty"`
+    BudgetRateWindowMinutes   int                `json:"budget_rate_window_minutes,omitempty"`
+    BudgetRateDecreasePercent float64            `json:"budget_rate_decrease_percent,omitempty"`
+    SLO                       honeycombSLORef    `json:"slo"`
+    Recipients                []TriggerRecipient `json:"recipients,omitempty"`
+}
+
+type honeycombSLORef struct {
+    ID string `json:"id"`
+}
+
+// A burn alert has no name, so we match ours up by what they alert on
+func (a honeycombBurnAlert) key() string {
+    return fmt.Sprintf("%s/%s/%d/%d/%g", a.SLO.ID, a.AlertType, a.ExhaustionMinutes, a.BudgetRateWindowMinutes, a.BudgetRateDecreasePercent)
+}
+
+func (spec BurnAlertSpec) burnAlert(sloID string) (honeycombBurnAlert, error) {
+    alert := honeycombBurnAlert{Description: managedTriggerNote, SLO: honeycombSLORef{ID: sloID}, Recipients: spec.Recipients}
+    switch {
+    case spec.Exhaustion > 0 && spec.BudgetRate != nil:
+        return alert, errors.New("give exhaustion or budget_rate, not both")
+    case spec.Exhaustion > 0:
+        if spec.Exhaustion < time.Minute {
+            return alert, errors.New("exhaustion must be at least a minute")
+        }
+        alert.AlertType = "exhaustion_time"
+        alert.ExhaustionMinutes = int(spec.Exhaustion / time.Minute)
+    case spec.BudgetRate != nil:
+        if spec.BudgetRate.Window < time.Minute || spec.BudgetRate.DecreasePercent <= 0 || spec.BudgetRate.DecreasePercent > 100 {
+            return alert, errors.New("budget_rate needs a window of at least a minute, and a decrease_percent over 0 and up to 100")
+        }
+        alert.AlertType = "budget_rate"
+        alert.BudgetRateWindowMinutes = int(spec.BudgetRate.Window / time.Minute)
+        alert.BudgetRateDecreasePercent = spec.BudgetRate.DecreasePercent
+    default:
+        return alert, errors.New("needs exhaustion or budget_rate")
+    }
+    return alert, nil
+}
+
+// SyncBurnAlerts makes the managed burn alerts on each dataset's SLOs match
+// specs. datasets are where specs without a Dataset go.
+func (s *TriggerSync) SyncBurnAlerts(ctx context.Context, specs []BurnAlertSpec, datasets []string) error {
+    slos := make(map[string]map[string]string) // Dataset -> SLO name -> ID
+    sloIDs := func(dataset string) (map[string]string, error) {
+        if byName, ok := slos[dataset]; ok {
+            return byName, nil
+        }
+        var existing []honeycombSLO
+        err := s.call(ctx, http.MethodGet, "/1/slos/"+url.PathEscape(dataset), nil, &existing)
+        if len(specs) == 0 && (isAPIStatus(err, http.StatusUnauthorized) || isAPIStatus(err, http.StatusForbidden)) {
+            err = nil // A key that can't see SLOs can't have made any burn alerts of ours to clean up
+        }
+        if err != nil {
+            return nil, fmt.Errorf("listing SLOs on %s: %v", dataset, err)
+        }
+        byName := make(map[string]string, len(existing))
+        for _, slo := range existing {
+            byName[slo.Name] = slo.ID
+        }
+        slos[dataset] = byName
+        return byName, nil
+    }
+
+    wanted := make(map[string]map[string][]honeycombBurnAlert) // Dataset -> SLO ID -> alerts
+    for _, spec := range specs {
+        targets := datasets
+        if spec.Dataset != "" {
+            targets = []string{spec.Dataset}
+        }
+        found := false
+        for _, dataset := range targets {
+            byName, err := sloIDs(dataset)
+            if err != nil {
+                return err
+            }
+            id, ok := byName[spec.SLO]
+            if !ok {
+                continue
+            }
+            found = true
+            alert, err := spec.burnAlert(id)
+            if err != nil {
+                return fmt.Errorf("burn alert on SLO %q: %v", spec.SLO, err)
+            }
+            if wanted[dataset] == nil {
+                wanted[dataset] = make(map[string][]honeycombBurnAlert)
+            }
+            wanted[dataset][id] = append(wanted[dataset][id], alert)
+        }
+        if !found {
+            return fmt.Errorf("burn alert on SLO %q: no dataset has an SLO by that name", spec.SLO)
+        }
+    }
+
+    // Every SLO we know of, so leftovers on SLOs no spec mentions any more
+    // still get cleaned up
+    for _, dataset := range datasets {
+        if _, err := sloIDs(dataset); err != nil {
+            return err
+        }
+    }
+    for dataset, byName := range slos {
+        for _, id := range byName {
+            if err := s.syncBurnAlerts(ctx, dataset, id, wanted[dataset][id]); err != nil {
+                return fmt.Errorf("syncing burn alerts on %s: %v", dataset, err)
+            }
+        }
+    }
+    return nil
+}
+
+func (s *TriggerSync) syncBurnAlerts(ctx context.Context, dataset, sloID string, wanted []honeycombBurnAlert) error {
+    base := "/1/burn_alerts/" + url.PathEscape(dataset)
+    var existing []honeycombBurnAlert
+    if err := s.call(ctx, http.MethodGet, base+"?slo_id="+url.QueryEscape(sloID), nil, &existing); err != nil {
+        return err
+    }
+    ours := make(map[string]honeycombBurnAlert)
+    for _, alert := range existing {
+        if alert.Description == managedTriggerNote {
+            alert.SLO.ID = sloID // Not every response includes it
+            ours[alert.key()] = alert
+        }
+    }
+
+    kept := make(map[string]bool)
+    for _, alert := range wanted {
+        current, ok := ours[alert.key()]
+        if !ok {
+            if err := s.call(ctx, http.MethodPost, base, alert, nil); err != nil {
+                return err
+            }
+            continue
+        }
+        kept[alert.key()] = true
+        if err := s.call(ctx, http.MethodPut, base+"/"+url.PathEscape(current.ID), alert, nil); err != nil {
+            return err
+        }
+    }
+    for key, alert := range ours {
+        if !kept[key] {
+            if err := s.call(ctx, http.MethodDelete, base+"/"+url.PathEscape(alert.ID), nil, nil); err != nil {
+                return err
+            }
+        }
+    }
+    return nil
+}
@@ -0,0 +1,84 @@
+// Raw URLs are useless for grouping in Honeycomb: every user ID, slug, and
+// tracking parameter makes a new value. URLNormalizer cleans up each URL field
+// (dropping the query string and fragment, and lowercasing the host) and adds
+// `url_route`, the route template the path matched, e.g. "/users/123/edit"
+// becomes "/users/:id/edit".
+//
+// Routes are matched in order, segment by segment: ":name" matches any one
+// segment, and a trailing "*" matches whatever's left. When no route matches,
+// we still collapse the segments that are obviously IDs (numbers, UUIDs, and
+// long hex strings), so the route stays groupable.
+//
+//     handler.Enrichers = append(handler.Enrichers, &URLNormalizer{
+//         Routes: []string{"/:team/datasets/:dataset/*", "/users/:id/edit"},
+//     })
+type URLNormalizer struct {
+    Routes []string
+    Fields []string // URL fields to normalize; defaults to "url". url_route is taken from the first.
+}
+
+var (
+    uuidSegment = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+    hexSegment  = regexp.MustCompile(`^[0-9a-fA-F]{16,}$`)
+    numSegment  = regexp.MustCompile(`^[0-9]+$`)
+)
+
+func (n *URLNormalizer) Enrich(ctx context.Context, ev *Event, r *http.Request, user *UserInfo) error {
+    fields := n.Fields
+    if len(fields) == 0 {
+        fields = []string{"url"}
+    }
+    for i, field := range fields {
+        raw, ok := ev.Fields()[field].(string)
+        if !ok || raw == "" {
+            continue
+        }
+        u, err := url.Parse(raw)
+        if err != nil {
+            continue
+        }
+        u.RawQuery, u.ForceQuery, u.Fragment = "", false, ""
+        u.Host = strings.ToLower(u.Host)
+        ev.AddField(field, u.String())
+        if i == 0 {
+            ev.AddField("url_route", n.route(u.Path))
+        }
+    }
+    return nil
+}
+
+func (n *URLNormalizer) route(urlPath string) string {
+    segments := strings.Split(strings.Trim(urlPath, "/"), "/")
+    for _, route := range n.Routes {
+        if routeMatches(strings.Split(strings.Trim(route, "/"), "/"), segments) {
+            return route
+        }
+    }
+
+    for i, segment := range segments {
+        switch {
+        case numSegment.MatchString(segment):
+            segments[i] = ":id"
+        case uuidSegment.MatchString(segment):
+            segments[i] = ":uuid"
+        case hexSegment.MatchString(segment):
+            segments[i] = ":hash"
+        }
+    }
+    return "/" + strings.Join(segments, "/")
+}
+
+func routeMatches(pattern, segments []string) bool {
+    for i, want := range pattern {
+        if want == "*" && i == len(pattern)-1 {
+            return true
+        }
+        if i >= len(segments) {
+            return false
+        }
+        if !strings.HasPrefix(want, ":") && want != segments[i] {
+            return false
+        }
+    }
+    return len(pattern) == len(segments)
+}
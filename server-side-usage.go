@@ -0,0 +1,402 @@
+// Finance wants to know which team's browser events are using up our
+// Honeycomb quota. UsageAccounting counts the events (and roughly how many
+// bytes) we actually forward, per tenant, event type and UTC day, and
+// HandleUsage reports them:
+//
+//     handler.Usage = &UsageAccounting{
+//         Store:   &RedisUsageStore{Client: redisClient, Prefix: "user-events:"},
+//         Token:   os.Getenv("USAGE_TOKEN"),
+//         Dataset: "ingest-usage",
+//     }
+//     go handler.Usage.Run(ctx, handler)
+//     mux.HandleFunc("/usage", handler.HandleUsage)
+//
+//     GET /usage?from=2024-01-01&to=2024-01-31&tenant=checkout
+//
+// Counts are kept in memory and added to the Store every Interval, so a busy
+// instance makes one store write per tenant/type every few seconds rather
+// than one per event. Once a day has ended (and every instance has had a
+// chance to flush it), one instance sends a `usage-summary` event per
+// tenant/type for that day to Dataset, so the numbers can be graphed in
+// Honeycomb too. The tenant is the one the request authenticated as; events
+// without one are counted under "default". Event types are capped as they
+// are for our metrics, so past a few hundred, new ones count as "other".
+type UsageAccounting struct {
+    Store     UsageStore    // Defaults to in-memory, which only counts this instance's events
+    Token     string        // Required as "Authorization: Bearer <token>"
+    Dataset   string        // Where daily usage-summary events go; "" sends none
+    Interval  time.Duration // How often counts are added to Store; defaults to 10 seconds
+    Retention time.Duration // How long the store keeps each day; defaults to 400 days
+
+    storeOnce  sync.Once
+    mu         sync.Mutex
+    pending    map[UsageKey]UsageCount
+    summarized string // The last day we sent (or checked for) summaries
+}
+
+// UsageKey is what usage is counted by.
+type UsageKey struct {
+    Day       string `json:"date"` // UTC, as 2006-01-02
+    Tenant    string `json:"tenant"`
+    EventType string `json:"type"`
+}
+
+type UsageCount struct {
+    Events int64 `json:"events"`
+    Bytes  int64 `json:"bytes"` // Roughly the JSON size of the events' fields
+}
+
+// UsageStore holds the running totals for each day.
+type UsageStore interface {
+    // Add adds counts to the day's running totals.
+    Add(ctx context.Context, counts map[UsageKey]UsageCount, retention time.Duration) error
+    // Day returns the totals for a day, by tenant and event type.
+    Day(ctx context.Context, day string) (map[UsageKey]UsageCount, error)
+}
+
+const (
+    usageDayLayout       = "2006-01-02"
+    usageSummaryType     = "usage-summary"
+    defaultUsageTenant   = "default"
+    maxUsageReportDays   = 366
+    usageSummaryClaimTTL = 72 * time.Hour
+)
+
+func (u *UsageAccounting) store() UsageStore {
+    u.storeOnce.Do(func() {
+        if u.Store == nil {
+            u.Store = &MemoryUsageStore{}
+        }
+    })
+    return u.Store
+}
+
+func (u *UsageAccounting) interval() time.Duration {
+    if u.Interval > 0 {
+        return u.Interval
+    }
+    return 10 * time.Second
+}
+
+func (u *UsageAccounting) retention() time.Duration {
+    if u.Retention > 0 {
+        return u.Retention
+    }
+    return 400 * 24 * time.Hour
+}
+
+// Counts an event we've just handed to the sink
+func (u *UsageAccounting) record(ev *Event) {
+    if ev.Type == usageSummaryType {
+        return // Our own reporting isn't anyone's usage
+    }
+    // The tenant the request authenticated as, not the field, which the
+    // browser could have sent itself
+    tenant := defaultUsageTenant
+    if ev.tenant != nil {
+        tenant = ev.tenant.Name
+    }
+    key := UsageKey{Day: ev.Timestamp.UTC().Format(usageDayLayout), Tenant: tenant, EventType: metricsTypeLabel(ev.Type)}
+    size := approxJSONSize(ev.Fields())
+
+    u.mu.Lock()
+    defer u.mu.Unlock()
+    if u.pending == nil {
+        u.pending = make(map[UsageKey]UsageCount)
+    }
+    count := u.pending[key]
+    count.Events++
+    count.Bytes += size
+    u.pending[key] = count
+}
+
+// Flushes counts to the store every Interval, and sends the daily summaries,
+// until ctx is done.
+func (u *UsageAccounting) Run(ctx context.Context, h *UserEventsHandler) {
+    ticker := time.NewTicker(u.interval())
+    defer ticker.Stop()
+    for {
+        select {
+        case <-ctx.Done():
+            // Our own ctx is done, but the last counts still need to land
+            flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+            u.flush(flushCtx, h)
+            cancel()
+            return
+        case now := <-ticker.C:
+            u.flush(ctx, h)
+            u.summarize(ctx, h, now)
+        }
+    }
+}
+
+func (u *UsageAccounting) flush(ctx context.Context, h *UserEventsHandler) {
+    u.mu.Lock()
+    counts := u.pending
+    u.pending = nil
+    u.mu.Unlock()
+    if len(counts) == 0 {
+        return
+    }
+    if err := u.store().Add(ctx, counts, u.retention()); err != nil {
+        // Put them back for next time, rather than under-report
+        h.logger().Warn("couldn't save usage counts", "error", err)
+        u.mu.Lock()
+        if u.pending == nil {
+            u.pending = make(map[UsageKey]UsageCount)
+        }
+        for key, count := range counts {
+            total := u.pending[key]
+            total.Events += count.Events
+            total.Bytes += count.Bytes
+            u.pending[key] = total
+        }
+        u.mu.Unlock()
+    }
+}
+
+// Sends yesterday's usage-summary events, once every instance has had two
+// intervals into today to flush yesterday's counts. Only the instance that
+// claims the day in the handler's State sends them.
+func (u *UsageAccounting) summarize(ctx context.Context, h *UserEventsHandler, now time.Time) {
+    if u.Dataset == "" {
+        return
+    }
+    day := now.UTC().Add(-2*u.interval()).AddDate(0, 0, -1).Format(usageDayLayout)
+    if day == u.summarized {
+        return
+    }
+    u.summarized = day
+
+    claimCtx, cancel := context.WithTimeout(ctx, stateStoreTimeout)
+    claimed, err := h.state().SetIfAbsent(claimCtx, "usage-summary:"+day, []byte("1"), usageSummaryClaimTTL)
+    cancel()
+    if err != nil || !claimed {
+        return
+    }
+    counts, err := u.store().Day(ctx, day)
+    if err != nil {
+        h.logger().Warn("couldn't read usage for daily summary", "date", day, "error", err)
+        return
+    }
+    start, _ := time.Parse(usageDayLayout, day)
+    for key, count := range counts {
+        ev := h.newEvent(usageSummaryType, nil, nil)
+        ev.Dataset = u.Dataset
+        ev.Timestamp = start
+        ev.AddField("usage_date", key.Day)
+        ev.AddField("tenant", key.Tenant)
+        ev.AddField("usage_event_type", key.EventType)
+        ev.AddField("events", count.Events)
+        ev.AddField("bytes", count.Bytes)
+        h.send(ctx, ev)
+    }
+}
+
+type usageRow struct {
+    UsageKey
+    UsageCount
+}
+
+func (h *UserEventsHandler) HandleUsage(w http.ResponseWriter, r *http.Request) {
+    u := h.Usage
+    if u == nil {
+        http.NotFound(w, r)
+        return
+    }
+    if !bearerTokenOK(r, u.Token) {
+        http.Error(w, "unauthorized", http.StatusUnauthorized)
+        return
+    }
+
+    query := r.URL.Query()
+    today := time.Now().UTC().Truncate(24 * time.Hour)
+    from, to := today.AddDate(0, 0, -29), today // The last 30 days by default
+    for name, dest := range map[string]*time.Time{"from": &from, "to": &to} {
+        if raw := query.Get(name); raw != "" {
+            parsed, err := time.Parse(usageDayLayout, raw)
+            if err != nil {
+                http.Error(w, name+" must be a date, e.g. 2024-01-31", http.StatusBadRequest)
+                return
+            }
+            *dest = parsed
+        }
+    }
+    if to.Before(from) || to.Sub(from) > maxUsageReportDays*24*time.Hour {
+        http.Error(w, fmt.Sprintf("from must be before to, and at most %d days apart", maxUsageReportDays), http.StatusBadRequest)
+        return
+    }
+    tenant := query.Get("tenant")
+
+    rows := []usageRow{}
+    totals := map[string]UsageCount{}
+    for day := from; !day.After(to); day = day.AddDate(0, 0, 1) {
+        counts, err := u.store().Day(r.Context(), day.Format(usageDayLayout))
+        if err != nil {
+            h.logger().Error("couldn't read usage", "error", err)
+            http.Error(w, "couldn't read usage", http.StatusInternalServerError)
+            return
+        }
+        for key, count := range counts {
+            if tenant != "" && key.Tenant != tenant {
+                continue
+            }
+            rows = append(rows, usageRow{key, count})
+            total := totals[key.Tenant]
+            total.Events += count.Events
+            total.Bytes += count.Bytes
+            totals[key.Tenant] = total
+        }
+    }
+    sort.Slice(rows, func(i, j int) bool {
+        if rows[i].Day != rows[j].Day {
+            return rows[i].Day < rows[j].Day
+        }
+        if rows[i].Tenant != rows[j].Tenant {
+            return rows[i].Tenant < rows[j].Tenant
+        }
+        return rows[i].EventType < rows[j].EventType
+    })
+
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+        "from":   from.Format(usageDayLayout),
+        "to":     to.Format(usageDayLayout),
+        "usage":  rows,
+        "totals": totals,
+    })
+}
+
+// A cheap estimate of how big fields would be as JSON, without encoding them.
+// Good enough for sharing out a bill; not byte-for-byte what libhoney sends.
+func approxJSONSize(fields map[string]interface{}) int64 {
+    size := int64(2) // {}
+    for name, value := range fields {
+        size += int64(len(name)) + 4 // Quotes, colon, comma
+        size += approxValueSize(value)
+    }
+    return size
+}
+
+func approxValueSize(value interface{}) int64 {
+    switch v := value.(type) {
+    case nil:
+        return 4
+    case string:
+        return int64(len(v)) + 2
+    case bool:
+        return 5
+    case map[string]interface{}:
+        return approxJSONSize(v)
+    case []interface{}:
+        size := int64(2)
+        for _, item := range v {
+            size += approxValueSize(item) + 1
+        }
+        return size
+    default:
+        return 8 // Numbers, mostly
+    }
+}
+
+// MemoryUsageStore keeps usage in this process, for a single instance or
+// local development. It forgets everything on restart.
+type MemoryUsageStore struct {
+    mu   sync.Mutex
+    days map[string]map[UsageKey]UsageCount
+}
+
+func (m *MemoryUsageStore) Add(ctx context.Context, counts map[UsageKey]UsageCount, retention time.Duration) error {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    if m.days == nil {
+        m.days = make(map[string]map[UsageKey]UsageCount)
+    }
+    for key, count := range counts {
+        day := m.days[key.Day]
+        if day == nil {
+            day = make(map[UsageKey]UsageCount)
+            m.days[key.Day] = day
+        }
+        total := day[key]
+        total.Events += count.Events
+        total.Bytes += count.Bytes
+        day[key] = total
+    }
+    cutoff := time.Now().UTC().Add(-retention).Format(usageDayLayout)
+    for day := range m.days {
+        if day < cutoff {
+            delete(m.days, day)
+        }
+    }
+    return nil
+}
+
+func (m *MemoryUsageStore) Day(ctx context.Context, day string) (map[UsageKey]UsageCount, error) {
+    m.mu.Lock()
+    defer m.mu.Unlock()
+    out := make(map[UsageKey]UsageCount, len(m.days[day]))
+    for key, count := range m.days[day] {
+        out[key] = count
+    }
+    return out, nil
+}
+
+// RedisUsageStore keeps each day's usage in a Redis hash, with a
+// "<tenant>|<type>|events" and "<tenant>|<type>|bytes" field per tenant and
+// event type, so every instance adds to the same totals.
+type RedisUsageStore struct {
+    Client *redis.Client
+    Prefix string
+}
+
+func (s *RedisUsageStore) key(day string) string {
+    return s.Prefix + "usage:" + day
+}
+
+func (s *RedisUsageStore) Add(ctx context.Context, counts map[UsageKey]UsageCount, retention time.Duration) error {
+    pipe := s.Client.TxPipeline()
+    days := map[string]bool{}
+    for key, count := range counts {
+        field := key.Tenant + "|" + key.EventType + "|"
+        pipe.HIncrBy(ctx, s.key(key.Day), field+"events", count.Events)
+        pipe.HIncrBy(ctx, s.key(key.Day), field+"bytes", count.Bytes)
+        days[key.Day] = true
+    }
+    for day := range days {
+        pipe.Expire(ctx, s.key(day), retention)
+    }
+    _, err := pipe.Exec(ctx)
+    return err
+}
+
+func (s *RedisUsageStore) Day(ctx context.Context, day string) (map[UsageKey]UsageCount, error) {
+    fields, err := s.Client.HGetAll(ctx, s.key(day)).Result()
+    if err != nil {
+        return nil, err
+    }
+    out := make(map[UsageKey]UsageCount)
+    for field, raw := range fields {
+        // Tenant names come from our config and have no "|" in them, but
+        // event types come from the browser and might, so split from both
+        // ends
+        first, last := strings.Index(field, "|"), strings.LastIndex(field, "|")
+        if first < 0 || first == last {
+            continue
+        }
+        n, err := strconv.ParseInt(raw, 10, 64)
+        if err != nil {
+            continue
+        }
+        key := UsageKey{Day: day, Tenant: field[:first], EventType: field[first+1 : last]}
+        count := out[key]
+        switch field[last+1:] {
+        case "events":
+            count.Events = n
+        case "bytes":
+            count.Bytes = n
+        }
+        out[key] = count
+    }
+    return out, nil
+}
@@ -0,0 +1,148 @@
+// When the session store has a hiccup, every user lookup fails, and with a
+// Required AuthStack every event is turned away until it's back: exactly when
+// we'd most like to see what users are going through. With a UserFallback, a
+// lookup that fails because the store couldn't answer (ErrUserLookupUnavailable)
+// doesn't stop the event. It goes on with an Unresolved user, keyed by a hash
+// of the session cookie, and we keep retrying the lookup in the background
+// for up to Timeout before sending it:
+//
+//     handler.UserFallback = &UserFallback{Cookie: "_app_session", Timeout: 5 * time.Second}
+//
+// If the store comes back in time, the event goes out with its user's fields
+// as usual, and user_resolution=backfilled (or no_user, if it turns out
+// nobody was logged in). If it doesn't, it goes out with
+// user_resolution=failed and session_cookie_hash, so the events of one
+// session can still be told apart (and joined up with their user later).
+// Retries only start once an event's been sampled, and at most MaxPending
+// events wait on them at a time; past that they're sent unresolved straight
+// away, rather than pile up while the store's down.
+type UserFallback struct {
+    Cookie     string        // The session cookie to hash; defaults to "session"
+    Timeout    time.Duration // How long to keep retrying; defaults to 5 seconds
+    MaxPending int           // Defaults to 1000
+
+    pending int64
+}
+
+var userBackfills = promauto.NewCounterVec(prometheus.CounterOpts{
+    Name: "user_events_user_backfills_total",
+    Help: "Events sent with an unresolved user, by what became of the retried lookup (backfilled, no_user, failed, or skipped).",
+}, []string{"outcome"})
+
+func (f *UserFallback) cookie() string {
+    if f.Cookie != "" {
+        return f.Cookie
+    }
+    return "session"
+}
+
+func (f *UserFallback) timeout() time.Duration {
+    if f.Timeout > 0 {
+        return f.Timeout
+    }
+    return 5 * time.Second
+}
+
+func (f *UserFallback) maxPending() int64 {
+    if f.MaxPending > 0 {
+        return int64(f.MaxPending)
+    }
+    return 1000
+}
+
+// The stand-in for a user we couldn't look up, or nil if there's no session
+// cookie to tell them by (or no fallback)
+func (f *UserFallback) unresolved(r *http.Request) *UserInfo {
+    if f == nil {
+        return nil
+    }
+    cookie, err := r.Cookie(f.cookie())
+    if err != nil || cookie.Value == "" {
+        return nil
+    }
+    sum := sha256.Sum256([]byte(cookie.Value))
+    return &UserInfo{ID: hex.EncodeToString(sum[:8]), Anonymous: true, Unresolved: true}
+}
+
+// Retries job's user lookup in the background, and delivers it once that's
+// done. Returns false if there are too many waiting already, in which case
+// the caller should deliver it now.
+func (f *UserFallback) backfill(h *UserEventsHandler, job *eventJob) bool {
+    if f == nil {
+        return false
+    }
+    if atomic.AddInt64(&f.pending, 1) > f.maxPending() {
+        atomic.AddInt64(&f.pending, -1)
+        userBackfills.WithLabelValues("skipped").Inc()
+        return false
+    }
+    // Coalesce's last flush runs after Close has stopped waiting, and its
+    // queues are about to close, so by then it's too late to retry
+    if !h.beginSend() {
+        atomic.AddInt64(&f.pending, -1)
+        userBackfills.WithLabelValues("skipped").Inc()
+        return false
+    }
+    go func() {
+        defer h.inflight.Done()
+        defer atomic.AddInt64(&f.pending, -1)
+
+        // The request's own context is likely done by now, but a resolver
+        // may still want its values
+        ctx, cancel := context.WithTimeout(context.WithoutCancel(job.r.Context()), f.timeout())
+        defer cancel()
+        user, ok := f.retry(ctx, h, job.r.WithContext(ctx))
+        switch {
+        case !ok:
+            userBackfills.WithLabelValues("failed").Inc()
+        case user == nil:
+            job.user = nil
+            job.metadata["user_resolution"] = "no_user"
+            userBackfills.WithLabelValues("no_user").Inc()
+        default:
+            job.user = user
+            job.metadata["user_resolution"] = "backfilled"
+            userBackfills.WithLabelValues("backfilled").Inc()
+        }
+        deliverCtx, deliverCancel := context.WithTimeout(context.Background(), queueSendTimeout)
+        defer deliverCancel()
+        if err := h.deliver(deliverCtx, job); err != nil {
+            h.logger().Warn("couldn't deliver event after retrying its user", "type", job.eventType, "error", err)
+        }
+    }()
+    return true
+}
+
+// Looks the user up again, with backoff, until the store answers or ctx is
+// done. ok is whether it answered; user is nil if it says nobody's logged in.
+func (f *UserFallback) retry(ctx context.Context, h *UserEventsHandler, r *http.Request) (user *UserInfo, ok bool) {
+    _, identified := identifiedUser(r)
+    wait := 250 * time.Millisecond
+    for {
+        select {
+        case <-ctx.Done():
+            return nil, false
+        case <-time.After(wait):
+        }
+        if wait < 2*time.Second {
+            wait *= 2
+        }
+
+        var err error
+        if identified && h.Auth != nil {
+            user, _, err = h.Auth.Authenticate(r)
+        } else if h.Users != nil {
+            var resolved UserInfo
+            if resolved, err = h.Users.Resolve(r); err == nil && resolved.ID != "" {
+                user = &resolved
+            }
+        }
+        switch {
+        case errors.Is(err, ErrUserLookupUnavailable):
+            continue
+        case err != nil:
+            return nil, true // It answered, just not with anyone
+        }
+        return user, true
+    }
+}
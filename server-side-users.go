@@ -0,0 +1,207 @@
+// The handler only needs to know a few things about who sent an event, and
+// shouldn't care how the app found out. A UserResolver works it out from the
+// request, however the app does auth:
+//
+//     handler.Users = ChainResolver{
+//         &JWTResolver{Secret: jwtSecret},     // API clients and mobile apps
+//         SessionResolver(app.CurrentUser),    // Our own logged-in pages
+//         AnonymousResolver{},                 // Everyone else
+//     }
+type UserResolver interface {
+    // Resolve returns ErrNoUser if the request doesn't identify anyone, or
+    // another error if it tried to (e.g. an expired token).
+    Resolve(r *http.Request) (UserInfo, error)
+}
+
+// UserInfo is who sent a request.
+type UserInfo struct {
+    ID    string
+    Email string
+
+    // Anonymous users are visitors we can recognize between visits (by ID)
+    // but don't know the identity of
+    Anonymous bool
+
+    // Anything else worth putting on their events (e.g. "plan", "team_id").
+    // UserEnricher adds each as "user_<name>".
+    Attributes map[string]interface{}
+
+    // Unresolved stands in for a user we couldn't look up because the store
+    // was down (see UserFallback). ID is a hash of their session cookie, and
+    // they count as Anonymous until the lookup's retried.
+    Unresolved bool
+}
+
+var ErrNoUser = errors.New("request doesn't identify a user")
+
+// Resolvers wrap their errors with ErrUserLookupUnavailable when whatever
+// they ask couldn't answer, rather than saying the request's credentials are
+// bad, so UserFallback knows to try again.
+var ErrUserLookupUnavailable = errors.New("user lookup unavailable")
+
+// Whether err is the store or the network failing, rather than the request's
+// credentials being bad
+func lookupUnavailable(err error) bool {
+    var netErr net.Error
+    var temporary interface{ Temporary() bool }
+    switch {
+    case errors.Is(err, ErrUserLookupUnavailable),
+        errors.Is(err, context.DeadlineExceeded),
+        errors.Is(err, syscall.ECONNREFUSED),
+        errors.Is(err, syscall.ECONNRESET):
+        return true
+    case errors.As(err, &netErr):
+        return true
+    case errors.As(err, &temporary):
+        return temporary.Temporary()
+    }
+    return false
+}
+
+// Who sent the request, or nil if we can't tell. A resolver failing is never
+// a reason to drop an event, just to send it without user fields.
+func (h *UserEventsHandler) currentUser(r *http.Request) *UserInfo {
+    if user, ok := identifiedUser(r); ok {
+        return user
+    }
+    if h.Users == nil {
+        return nil
+    }
+    user, err := h.Users.Resolve(r)
+    if err != nil {
+        if !errors.Is(err, ErrNoUser) {
+            h.logger().Info("couldn't resolve user", "path", r.URL.Path, "error", err)
+        }
+        if errors.Is(err, ErrUserLookupUnavailable) {
+            return h.UserFallback.unresolved(r)
+        }
+        return nil
+    }
+    if user.ID == "" {
+        return nil
+    }
+    return &user
+}
+
+// ChainResolver tries each resolver in turn, and returns the first user any
+// of them finds.
+type ChainResolver []UserResolver
+
+func (c ChainResolver) Resolve(r *http.Request) (UserInfo, error) {
+    err := ErrNoUser
+    for _, resolver := range c {
+        user, resolveErr := resolver.Resolve(r)
+        if resolveErr == nil {
+            return user, nil
+        }
+        if !errors.Is(resolveErr, ErrNoUser) {
+            err = resolveErr // Worth reporting if nobody else finds a user
+        }
+    }
+    return UserInfo{}, err
+}
+
+// SessionResolver adapts our app's session lookup (the logged-in user, from
+// the session cookie) to a UserResolver. The lookup returns nil for nobody
+// logged in. Its errors only count as the session store being unavailable if
+// they're timeouts or network errors (or already say so): a forged or
+// unknown session is an authentication failure like any other.
+type SessionResolver func(r *http.Request) (*types.User, error)
+
+func (f SessionResolver) Resolve(r *http.Request) (UserInfo, error) {
+    user, err := f(r)
+    if err != nil {
+        if lookupUnavailable(err) && !errors.Is(err, ErrUserLookupUnavailable) {
+            return UserInfo{}, fmt.Errorf("%w: %v", ErrUserLookupUnavailable, err)
+        }
+        return UserInfo{}, err
+    }
+    if user == nil {
+        return UserInfo{}, ErrNoUser
+    }
+    return UserInfo{ID: fmt.Sprint(user.ID), Email: user.Email}, nil
+}
+
+// JWTResolver reads the user from an `Authorization: Bearer` JWT, taking
+// their ID from the "sub" claim. Set Secret for HMAC-signed tokens, or Keyfunc
+// to look up public keys (e.g. from a JWKS endpoint).
+type JWTResolver struct {
+    Secret  []byte
+    Keyfunc jwt.Keyfunc
+
+    Issuer   string // If set, tokens must be from this issuer
+    Audience string // ...and for this audience
+
+    EmailClaim string   // Defaults to "email"
+    Claims     []string // Other claims to copy into Attributes, e.g. "org_id"
+}
+
+func (j *JWTResolver) Resolve(r *http.Request) (UserInfo, error) {
+    auth := r.Header.Get("Authorization")
+    if !strings.HasPrefix(auth, "Bearer ") {
+        return UserInfo{}, ErrNoUser
+    }
+
+    keyfunc := j.Keyfunc
+    if keyfunc == nil {
+        keyfunc = func(*jwt.Token) (interface{}, error) { return j.Secret, nil }
+    }
+    opts := []jwt.ParserOption{jwt.WithExpirationRequired()}
+    if j.Keyfunc == nil {
+        opts = append(opts, jwt.WithValidMethods([]string{"HS256", "HS384", "HS512"}))
+    }
+    if j.Issuer != "" {
+        opts = append(opts, jwt.WithIssuer(j.Issuer))
+    }
+    if j.Audience != "" {
+        opts = append(opts, jwt.WithAudience(j.Audience))
+    }
+
+    claims := jwt.MapClaims{}
+    if _, err := jwt.ParseWithClaims(strings.TrimPrefix(auth, "Bearer "), claims, keyfunc, opts...); err != nil {
+        return UserInfo{}, fmt.Errorf("invalid bearer token: %w", err)
+    }
+    subject, err := claims.GetSubject()
+    if err != nil || subject == "" {
+        return UserInfo{}, errors.New("bearer token has no subject")
+    }
+
+    user := UserInfo{ID: subject}
+    emailClaim := j.EmailClaim
+    if emailClaim == "" {
+        emailClaim = "email"
+    }
+    user.Email, _ = claims[emailClaim].(string)
+    for _, claim := range j.Claims {
+        if value, ok := claims[claim]; ok {
+            if user.Attributes == nil {
+                user.Attributes = map[string]interface{}{}
+            }
+            user.Attributes[claim] = value
+        }
+    }
+    return user, nil
+}
+
+// AnonymousResolver recognizes logged-out visitors by a first-party visitor
+// cookie, so their events can at least be tied to each other.
+type AnonymousResolver struct {
+    Cookie string // Defaults to "hny_visitor"
+}
+
+const defaultVisitorCookie = "hny_visitor"
+
+func (a AnonymousResolver) Resolve(r *http.Request) (UserInfo, error) {
+    name := a.Cookie
+    if name == "" {
+        name = defaultVisitorCookie
+    }
+    if id, ok := r.Context().Value(visitorIDKey{}).(string); ok {
+        return UserInfo{ID: id, Anonymous: true}, nil // Just minted by VisitorTracker
+    }
+    cookie, err := r.Cookie(name)
+    if err != nil || cookie.Value == "" {
+        return UserInfo{}, ErrNoUser
+    }
+    return UserInfo{ID: cookie.Value, Anonymous: true}, nil
+}
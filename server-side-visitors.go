@@ -0,0 +1,94 @@
+// Most of our traffic never logs in, and without a user_id its events can't
+// be tied to each other, let alone to who the visitor turns out to be when
+// they sign up. VisitorTracker gives every browser a long-lived first-party
+// `hny_visitor` cookie, stamps every event with its `visitor_id`, and the
+// first time a visitor shows up logged in, sends an `identity-link` event
+// joining their visitor_id to their user_id. Queries can then follow a user
+// back through everything they did before they logged in.
+//
+//     handler.Visitors = &VisitorTracker{}
+//     handler.Users = ChainResolver{SessionResolver(app.CurrentUser), AnonymousResolver{}}
+//     mux.Handle("/events/batch", handler.Visitors.Middleware(...))
+//
+// Events from browsers that haven't given full consent don't get a visitor_id.
+type VisitorTracker struct {
+    CookieName string        // Defaults to "hny_visitor"; AnonymousResolver must use the same one
+    MaxAge     time.Duration // Defaults to 395 days, about as long as browsers allow
+}
+
+type visitorIDKey struct{}
+
+// How long we remember that we've linked a visitor to a user, so we don't
+// send the same identity-link on every event
+const identityLinkMemory = 30 * 24 * time.Hour
+
+func (v *VisitorTracker) cookieName() string {
+    if v.CookieName != "" {
+        return v.CookieName
+    }
+    return defaultVisitorCookie
+}
+
+// Middleware makes sure every browser has a visitor cookie. A visitor's very
+// first request doesn't have the cookie yet, so we also pass the ID along in
+// the request context.
+func (v *VisitorTracker) Middleware(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        cookie, err := r.Cookie(v.cookieName())
+        if err == nil && cookie.Value != "" {
+            next.ServeHTTP(w, r)
+            return
+        }
+
+        maxAge := v.MaxAge
+        if maxAge <= 0 {
+            maxAge = 395 * 24 * time.Hour
+        }
+        id := randomHex(16)
+        http.SetCookie(w, &http.Cookie{
+            Name:     v.cookieName(),
+            Value:    id,
+            Path:     "/",
+            MaxAge:   int(maxAge.Seconds()),
+            HttpOnly: true,
+            Secure:   r.TLS != nil,
+            SameSite: http.SameSiteLaxMode,
+        })
+        next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), visitorIDKey{}, id)))
+    })
+}
+
+func (v *VisitorTracker) visitorID(r *http.Request) string {
+    if id, ok := r.Context().Value(visitorIDKey{}).(string); ok {
+        return id
+    }
+    if cookie, err := r.Cookie(v.cookieName()); err == nil {
+        return cookie.Value
+    }
+    return ""
+}
+
+// Touch adds visitor_id to the event's metadata, and links the visitor to
+// user if this is the first we've seen of them together.
+func (v *VisitorTracker) Touch(h *UserEventsHandler, r *http.Request, metadata map[string]interface{}, user *UserInfo) {
+    id := v.visitorID(r)
+    if id == "" {
+        return
+    }
+    metadata["visitor_id"] = id
+    if user == nil || user.Anonymous {
+        return
+    }
+
+    ctx, cancel := context.WithTimeout(r.Context(), stateStoreTimeout)
+    defer cancel()
+    first, err := h.state().SetIfAbsent(ctx, "identity-link:"+id+":"+user.ID, []byte("1"), identityLinkMemory)
+    if err != nil || !first {
+        return
+    }
+
+    ev := h.newEvent("identity-link", nil, r)
+    ev.AddField("visitor_id", id)
+    h.enrich(ctx, ev, ev.Type, r, user) // Adds the user_id (and anything else we know about them)
+    h.send(ctx, ev)
+}
@@ -0,0 +1,221 @@
+// Single-page apps can send an event for every click and route change, and
+// even batched POSTs mean a new request (and auth check) every few seconds.
+// HandleWebSocket lets the browser open one connection for the life of the
+// page and stream events over it instead. Each message is one event object,
+// or an array of them, exactly as the batch endpoint takes. We buffer them up
+// and push them through the usual pipeline every FlushEvery, and when the
+// connection closes we send a session-summary event describing it.
+//
+// The browser can't set headers on a WebSocket, so anything that'd usually
+// come in a header (like a tenant's ingest token) goes in the query string:
+//
+//     new WebSocket("wss://events.example.com/events/ws?token=...")
+type WebSocketConfig struct {
+    // Per-connection rate limit. Defaults to 20 events a second, with bursts
+    // of up to 100. This is on top of the handler's RateLimiter, and is mostly
+    // there so one connection can't hog a handler goroutine.
+    PerSecond float64
+    Burst     int
+
+    FlushEvery  time.Duration // Defaults to 1 second
+    IdleTimeout time.Duration // Close connections that go this long without a message. Defaults to 5 minutes.
+}
+
+const (
+    defaultWebSocketPerSecond = 20
+    defaultWebSocketBurst     = 100
+    defaultWebSocketFlush     = time.Second
+    defaultWebSocketIdle      = 5 * time.Minute
+)
+
+var websocketConnections = promauto.NewGauge(prometheus.GaugeOpts{
+    Name: "user_events_websocket_connections",
+    Help: "WebSocket ingest connections currently open.",
+})
+
+// A summary of one connection, sent as the session-summary event
+type wsStats struct {
+    opened      time.Time
+    messages    int
+    received    int
+    rateLimited int
+    rejected    int
+    byType      map[string]int // At most maxSessionTypes of them
+    otherTypes  int            // Events of the types past that
+}
+
+func (s *wsStats) count(eventType string) {
+    if _, ok := s.byType[eventType]; ok || len(s.byType) < maxSessionTypes {
+        s.byType[eventType]++
+        return
+    }
+    s.otherTypes++
+}
+
+func (h *UserEventsHandler) HandleWebSocket(w http.ResponseWriter, r *http.Request) {
+    user := h.currentUser(r) // Once, for the life of the connection
+    cfg := h.WebSocket
+    if cfg == nil {
+        cfg = &WebSocketConfig{}
+    }
+    upgrader := websocket.Upgrader{CheckOrigin: h.websocketOriginOK}
+    conn, err := upgrader.Upgrade(w, r, nil)
+    if err != nil {
+        return // The upgrader has already written an error response
+    }
+    defer conn.Close()
+    conn.SetReadLimit(h.maxBodyBytes()) // A message is a batch, so it gets the same cap as one
+    websocketConnections.Inc()
+    defer websocketConnections.Dec()
+
+    perSecond, burst := cfg.PerSecond, cfg.Burst
+    if perSecond <= 0 {
+        perSecond = defaultWebSocketPerSecond
+    }
+    if burst <= 0 {
+        burst = defaultWebSocketBurst
+    }
+    limiter := rate.NewLimiter(rate.Limit(perSecond), burst)
+    stats := &wsStats{opened: time.Now(), byType: map[string]int{}}
+    defer h.sendSessionSummary(r, user, stats)
+
+    // gorilla/websocket only allows one reader and one writer at a time, so
+    // reads happen here and everything else in the loop below
+    idle := cfg.IdleTimeout
+    if idle <= 0 {
+        idle = defaultWebSocketIdle
+    }
+    incoming := make(chan []map[string]interface{})
+    readErr := make(chan error, 1)
+    done := make(chan struct{})
+    defer close(done)
+    go func() {
+        for {
+            conn.SetReadDeadline(time.Now().Add(idle))
+            _, msg, err := conn.ReadMessage()
+            if err != nil {
+                readErr <- err
+                return
+            }
+            events, err := decodeEventBatch(bytes.NewReader(msg), h.limits())
+            if err != nil {
+                readErr <- err
+                return
+            }
+            select {
+            case incoming <- events:
+            case <-done:
+                return
+            }
+        }
+    }()
+
+    flushEvery := cfg.FlushEvery
+    if flushEvery <= 0 {
+        flushEvery = defaultWebSocketFlush
+    }
+    ticker := time.NewTicker(flushEvery)
+    defer ticker.Stop()
+
+    var pending []map[string]interface{}
+    flush := func() bool {
+        if len(pending) == 0 {
+            return true
+        }
+        results, errs := h.sendBatchToHoneycombAPI(r.Context(), pending, r, user)
+        pending = pending[:0]
+        stats.rejected += len(errs)
+        if len(errs) == 0 {
+            return true
+        }
+        for _, err := range errs {
+            if errors.Is(err, ErrQueueFull) || errors.Is(err, ErrQuotaExceeded) {
+                conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, err.Error()), time.Now().Add(time.Second))
+                return false
+            }
+        }
+        // Let the browser know, but carry on; the next events may be fine
+        conn.WriteJSON(map[string]interface{}{"rejected": joinErrors(errs), "results": results})
+        return true
+    }
+
+    for {
+        select {
+        case events := <-incoming:
+            stats.messages++
+            for _, metadata := range events {
+                stats.received++
+                eventType, _ := metadata["type"].(string)
+                if !limiter.Allow() {
+                    stats.rateLimited++
+                    eventsDropped.WithLabelValues(metricsTypeLabel(eventType), "rate_limited").Inc()
+                    continue
+                }
+                stats.count(eventType)
+                pending = append(pending, metadata)
+            }
+            if len(pending) >= maxBatchEvents && !flush() {
+                return
+            }
+        case <-ticker.C:
+            if !flush() {
+                return
+            }
+        case err := <-readErr:
+            flush()
+            if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+                conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseProtocolError, err.Error()), time.Now().Add(time.Second))
+            }
+            return
+        }
+    }
+}
+
+// Browsers will open a WebSocket to anywhere, so same-origin checks are on
+// us. We allow the same origins our other endpoints do.
+func (h *UserEventsHandler) websocketOriginOK(r *http.Request) bool {
+    origin := requestOrigin(r)
+    switch {
+    case h.RequestAuth != nil:
+        return originAllowed(h.RequestAuth.AllowedOrigins, origin)
+    case h.CORS != nil:
+        return h.CORS.allows(origin)
+    default:
+        u, err := url.Parse(origin)
+        return origin == "" || (err == nil && strings.EqualFold(u.Host, r.Host))
+    }
+}
+
+func (h *UserEventsHandler) sendSessionSummary(r *http.Request, user *UserInfo, stats *wsStats) {
+    // The summary carries the same user fields as the events it describes,
+    // so only if the browser's consented to that
+    if h.Consent != nil && h.Consent.Decide(r, nil) != ConsentFull {
+        user = nil
+    }
+
+    ev := h.newEvent("session-summary", nil, r)
+    ev.Timestamp = stats.opened
+    ev.AddField("connection_duration_ms", time.Since(stats.opened).Nanoseconds()/int64(time.Millisecond))
+    ev.AddField("messages_received", stats.messages)
+    ev.AddField("events_received", stats.received)
+    ev.AddField("events_rate_limited", stats.rateLimited)
+    ev.AddField("events_rejected", stats.rejected)
+    for eventType, count := range stats.byType {
+        if eventType != "" {
+            ev.AddField(eventType+"_count", count)
+        }
+    }
+    if stats.otherTypes > 0 {
+        ev.AddField("other_count", stats.otherTypes)
+    }
+    if h.Sessions != nil {
+        if cookie, err := r.Cookie(h.Sessions.cookieName()); err == nil {
+            ev.AddField("session_id", cookie.Value)
+        }
+    }
+    // The connection's request context is done by now
+    ctx, cancel := context.WithTimeout(context.Background(), queueSendTimeout)
+    defer cancel()
+    h.enrich(ctx, ev, ev.Type, r, user)
+    h.send(ctx, ev)
+}
@@ -0,0 +1,60 @@
+// Newer browser SDK versions send raw Navigation Timing timestamps and Web
+// Vitals (LCP, CLS, FID, TTFB) rather than working out deltas client-side like
+// page-load.js does. We compute the derived fields here, once, so every
+// dataset gets them without needing its own derived columns.
+//
+// Fields the browser already computed itself are left alone.
+func addPerformanceFields(ev *Event, metadata map[string]interface{}) {
+    if start, ok := timingField(metadata, "navigationStart", "navigation_start"); ok && start > 0 {
+        if end, ok := timingField(metadata, "loadEventEnd", "load_event_end"); ok && end >= start {
+            addIfMissing(ev, metadata, "page_load_time_ms", end-start)
+        }
+        if interactive, ok := timingField(metadata, "domInteractive", "dom_interactive"); ok && interactive >= start {
+            addIfMissing(ev, metadata, "dom_interactive_ms", interactive-start)
+        }
+        if responseStart, ok := timingField(metadata, "responseStart", "response_start"); ok && responseStart >= start {
+            addIfMissing(ev, metadata, "ttfb_ms", responseStart-start)
+        }
+    }
+    if ttfb, ok := timingField(metadata, "ttfb"); ok {
+        addIfMissing(ev, metadata, "ttfb_ms", ttfb)
+    }
+
+    // Thresholds from https://web.dev/vitals/
+    if lcp, ok := timingField(metadata, "lcp"); ok {
+        addIfMissing(ev, metadata, "lcp_bucket", vitalsBucket(lcp, 2500, 4000))
+    }
+    if fid, ok := timingField(metadata, "fid"); ok {
+        addIfMissing(ev, metadata, "fid_bucket", vitalsBucket(fid, 100, 300))
+    }
+    if cls, ok := timingField(metadata, "cls"); ok {
+        addIfMissing(ev, metadata, "cls_bucket", vitalsBucket(cls, 0.1, 0.25))
+    }
+}
+
+func vitalsBucket(value, good, poor float64) string {
+    switch {
+    case value <= good:
+        return "good"
+    case value <= poor:
+        return "needs-improvement"
+    default:
+        return "poor"
+    }
+}
+
+// Returns the first of the given fields that's present and numeric
+func timingField(metadata map[string]interface{}, names ...string) (float64, bool) {
+    for _, name := range names {
+        if value, ok := metadata[name].(float64); ok {
+            return value, true
+        }
+    }
+    return 0, false
+}
+
+func addIfMissing(ev *Event, metadata map[string]interface{}, name string, value interface{}) {
+    if _, ok := metadata[name]; !ok {
+        ev.AddField(name, value)
+    }
+}